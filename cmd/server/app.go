@@ -0,0 +1,450 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/minasoft/hl7-replicator/internal/alerts"
+	"github.com/minasoft/hl7-replicator/internal/config"
+	"github.com/minasoft/hl7-replicator/internal/connectors"
+	"github.com/minasoft/hl7-replicator/internal/consumers"
+	"github.com/minasoft/hl7-replicator/internal/hl7"
+	"github.com/minasoft/hl7-replicator/internal/phi"
+	"github.com/minasoft/hl7-replicator/internal/web"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// inboundRoute holds the inbound settings of one route
+type inboundRoute struct {
+	direction       string
+	name            string // used in log messages
+	port            int
+	destination     string // label recorded on every message
+	allowCIDRs      string
+	denyCIDRs       string
+	expectedSenders string
+	expectedTraffic string
+	validationMode  string
+	transforms      string
+	inputDir        string
+	remoteSource    string
+}
+
+func inboundRoutes(cfg *config.Config) []inboundRoute {
+	return []inboundRoute{
+		{
+			direction:       "order",
+			name:            "Order",
+			port:            cfg.OrderListenPort,
+			destination:     fmt.Sprintf("%s:%d", cfg.ZenPACSHost, cfg.ZenPACSPort),
+			allowCIDRs:      cfg.OrderAllowCIDRs,
+			denyCIDRs:       cfg.OrderDenyCIDRs,
+			expectedSenders: cfg.OrderExpectedSenders,
+			expectedTraffic: cfg.OrderExpectedTraffic,
+			validationMode:  cfg.OrderValidationMode,
+			transforms:      cfg.OrderTransforms,
+			inputDir:        cfg.OrderInputDir,
+			remoteSource:    cfg.OrderRemoteSource,
+		},
+		{
+			direction:       "report",
+			name:            "Report",
+			port:            cfg.ReportListenPort,
+			destination:     fmt.Sprintf("%s:%d", cfg.HospitalHISHost, cfg.HospitalHISPort),
+			allowCIDRs:      cfg.ReportAllowCIDRs,
+			denyCIDRs:       cfg.ReportDenyCIDRs,
+			expectedSenders: cfg.ReportExpectedSenders,
+			expectedTraffic: cfg.ReportExpectedTraffic,
+			validationMode:  cfg.ReportValidationMode,
+			transforms:      cfg.ReportTransforms,
+			inputDir:        cfg.ReportInputDir,
+			remoteSource:    cfg.ReportRemoteSource,
+		},
+	}
+}
+
+// inboundPlan holds the options built from a configuration for the inbound
+// paths of every route; building it starts nothing, so an invalid
+// configuration is rejected before any component changes
+type inboundPlan struct {
+	receivers map[string]hl7.ReceiverOptions
+	servers   map[string]hl7.ServerOptions
+	remotes   map[string]*connectors.RemoteConfig
+}
+
+func planInbound(cfg *config.Config, store jetstream.ObjectStore) (*inboundPlan, error) {
+	// Conformance profiles
+	var validator *hl7.Validator
+	if cfg.ValidationProfiles != "" {
+		var err error
+		validator, err = hl7.LoadValidator(cfg.ValidationProfiles)
+		if err != nil {
+			return nil, fmt.Errorf("doğrulama profilleri yüklenemedi: %w", err)
+		}
+	}
+
+	attachmentBaseURL := cfg.AttachmentBaseURL
+	if attachmentBaseURL == "" {
+		attachmentBaseURL = fmt.Sprintf("http://localhost:%d", cfg.WebPort)
+	}
+	extractor := hl7.NewAttachmentExtractor(store, attachmentBaseURL)
+
+	plan := &inboundPlan{
+		receivers: make(map[string]hl7.ReceiverOptions),
+		servers:   make(map[string]hl7.ServerOptions),
+		remotes:   make(map[string]*connectors.RemoteConfig),
+	}
+	for _, r := range inboundRoutes(cfg) {
+		policy, err := hl7.ParseAccessPolicy(r.allowCIDRs, r.denyCIDRs, r.expectedSenders)
+		if err != nil {
+			return nil, fmt.Errorf("%s erişim politikası geçersiz: %w", r.name, err)
+		}
+		expectations, err := hl7.ParseTrafficExpectations(r.expectedTraffic)
+		if err != nil {
+			return nil, fmt.Errorf("%s trafik beklentileri geçersiz: %w", r.name, err)
+		}
+		transforms, err := hl7.ParseTransforms(r.transforms, extractor)
+		if err != nil {
+			return nil, fmt.Errorf("%s dönüşümleri geçersiz: %w", r.name, err)
+		}
+		if r.remoteSource != "" {
+			remote, err := connectors.ParseRemoteURL(r.remoteSource)
+			if err != nil {
+				return nil, fmt.Errorf("%s uzak dosya girişi yapılandırması hatalı: %w", r.name, err)
+			}
+			plan.remotes[r.direction] = remote
+		}
+
+		plan.receivers[r.direction] = hl7.ReceiverOptions{
+			Destination:    r.destination,
+			AccessPolicy:   policy,
+			Validator:      validator,
+			ValidationMode: r.validationMode,
+			Transforms:     transforms,
+			Expectations:   expectations,
+		}
+		plan.servers[r.direction] = hl7.ServerOptions{
+			AccessPolicy:   policy,
+			MaxMessageSize: cfg.MLLPMaxMessageSize,
+			MaxConnections: cfg.MLLPMaxConnections,
+			MaxConnsPerIP:  cfg.MLLPMaxConnsPerIP,
+			IdleTimeout:    cfg.MLLPIdleTimeout,
+			ReadTimeout:    cfg.MLLPReadTimeout,
+		}
+	}
+	return plan, nil
+}
+
+// app holds the running components and swaps them on a configuration reload
+type app struct {
+	ctx   context.Context
+	js    jetstream.JetStream
+	store jetstream.ObjectStore
+
+	mu        sync.Mutex // serializes reloads
+	cfg       *config.Config
+	receivers map[string]*hl7.Receiver
+	servers   map[string]*hl7.MLLPServer
+	inputs    map[string]*runningInput
+	forwarder *consumers.MessageForwarder
+	alerts    *alerts.Engine
+	web       *web.Server
+}
+
+// runningInput is a started file or remote input; key holds the settings
+// it was started with
+type runningInput struct {
+	key    string
+	cancel context.CancelFunc
+}
+
+func (a *app) currentConfig() *config.Config {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.cfg
+}
+
+// traffic returns the traffic expectation states of every route
+func (a *app) traffic() []hl7.TrafficStatus {
+	var statuses []hl7.TrafficStatus
+	for _, r := range inboundRoutes(a.currentConfig()) {
+		statuses = append(statuses, a.receivers[r.direction].Traffic()...)
+	}
+	return statuses
+}
+
+// listeners returns the MLLP listeners in route order
+func (a *app) listeners() []*hl7.MLLPServer {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var servers []*hl7.MLLPServer
+	for _, r := range inboundRoutes(a.cfg) {
+		servers = append(servers, a.servers[r.direction])
+	}
+	return servers
+}
+
+// syncInputs starts the file and remote inputs of cfg and stops those that
+// were removed or changed; unchanged inputs keep running
+func (a *app) syncInputs(cfg *config.Config, plan *inboundPlan) ([]string, error) {
+	wanted := make(map[string]string)
+	for _, r := range inboundRoutes(cfg) {
+		if r.inputDir != "" {
+			wanted[r.direction+"_input_dir"] = fmt.Sprintf("%s|%s", r.inputDir, cfg.InputPollInterval)
+		}
+		if r.remoteSource != "" {
+			wanted[r.direction+"_remote_source"] = r.remoteSource
+		}
+	}
+
+	var changed []string
+	for name, in := range a.inputs {
+		if wanted[name] != in.key {
+			in.cancel()
+			delete(a.inputs, name)
+			changed = append(changed, name)
+		}
+	}
+
+	for _, r := range inboundRoutes(cfg) {
+		receiver := a.receivers[r.direction]
+
+		name := r.direction + "_input_dir"
+		if key, ok := wanted[name]; ok && a.inputs[name] == nil {
+			ctx, cancel := context.WithCancel(a.ctx)
+			if err := connectors.NewFileWatcher(r.inputDir, cfg.InputPollInterval, receiver).Start(ctx); err != nil {
+				cancel()
+				return changed, fmt.Errorf("%s dosya girişi başlatılamadı: %w", r.name, err)
+			}
+			a.inputs[name] = &runningInput{key: key, cancel: cancel}
+			changed = appendOnce(changed, name)
+		}
+
+		name = r.direction + "_remote_source"
+		if key, ok := wanted[name]; ok && a.inputs[name] == nil {
+			ctx, cancel := context.WithCancel(a.ctx)
+			connectors.NewRemotePoller(plan.remotes[r.direction], receiver).Start(ctx)
+			a.inputs[name] = &runningInput{key: key, cancel: cancel}
+			changed = appendOnce(changed, name)
+		}
+	}
+	return changed, nil
+}
+
+// reload reads the configuration again and applies it. Everything that can
+// fail (parsing, validation, building destinations, creating input
+// directories, binding new ports) is done first, so a rejected configuration leaves the running one untouched.
+func (a *app) reload(source string) ([]string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	slog.Info("Yapılandırma yeniden yükleniyor", "source", source,
+		"envFile", config.EnvFile(),
+		"configFile", config.ConfigFile())
+
+	changes, err := a.apply()
+	if err != nil {
+		slog.Error("Yapılandırma reddedildi, mevcut yapılandırma kullanılmaya devam ediyor",
+			"source", source,
+			"error", err)
+		return nil, err
+	}
+
+	slog.Info("Yapılandırma yeniden yüklendi", "source", source, "changes", changes)
+	return changes, nil
+}
+
+func (a *app) apply() ([]string, error) {
+	cfg, err := config.Reload()
+	if err != nil {
+		return nil, err
+	}
+	plan, err := planInbound(cfg, a.store)
+	if err != nil {
+		return nil, err
+	}
+
+	// Create the input directories, so starting the file inputs cannot fail
+	for _, r := range inboundRoutes(cfg) {
+		if r.inputDir == "" {
+			continue
+		}
+		if err := connectors.PrepareInputDir(r.inputDir); err != nil {
+			return nil, fmt.Errorf("%s dosya girişi hazırlanamadı: %w", r.name, err)
+		}
+	}
+
+	// Bind the listeners whose port changed
+	rebound := make(map[string]*hl7.MLLPServer)
+	closeRebound := func() {
+		for _, server := range rebound {
+			server.Shutdown(context.Background())
+		}
+	}
+	for _, r := range inboundRoutes(cfg) {
+		if a.servers[r.direction].Port() == r.port {
+			continue
+		}
+		server := hl7.NewMLLPServer(r.port, a.receivers[r.direction], plan.servers[r.direction])
+		if err := server.Listen(); err != nil {
+			closeRebound()
+			return nil, fmt.Errorf("%s dinleyicisi: %w", r.name, err)
+		}
+		rebound[r.direction] = server
+	}
+
+	alertSetup, err := alerts.Prepare(cfg.Alerts)
+	if err != nil {
+		closeRebound()
+		return nil, err
+	}
+
+	reconf, err := a.forwarder.Prepare(cfg)
+	if err != nil {
+		closeRebound()
+		return nil, err
+	}
+
+	// Nothing below fails the reload
+	changes := []string{}
+	oldRoutes := make(map[string]inboundRoute)
+	for _, r := range inboundRoutes(a.cfg) {
+		oldRoutes[r.direction] = r
+	}
+	sharedChanged := cfg.ValidationProfiles != a.cfg.ValidationProfiles ||
+		cfg.AttachmentBaseURL != a.cfg.AttachmentBaseURL ||
+		cfg.MLLPMaxMessageSize != a.cfg.MLLPMaxMessageSize ||
+		cfg.MLLPMaxConnections != a.cfg.MLLPMaxConnections ||
+		cfg.MLLPMaxConnsPerIP != a.cfg.MLLPMaxConnsPerIP ||
+		cfg.MLLPIdleTimeout != a.cfg.MLLPIdleTimeout ||
+		cfg.MLLPReadTimeout != a.cfg.MLLPReadTimeout
+
+	for _, r := range inboundRoutes(cfg) {
+		a.receivers[r.direction].SetOptions(plan.receivers[r.direction])
+
+		if server, ok := rebound[r.direction]; ok {
+			old := a.servers[r.direction]
+			server.Serve(a.ctx)
+			a.servers[r.direction] = server
+			a.web.ReplaceListener(old, server)
+			go func(old *hl7.MLLPServer) {
+				ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+				defer cancel()
+				old.Shutdown(ctx)
+			}(old)
+			changes = append(changes, r.direction+"_listener")
+			continue
+		}
+
+		a.servers[r.direction].SetOptions(plan.servers[r.direction])
+		if sharedChanged || !reflect.DeepEqual(oldRoutes[r.direction], r) {
+			changes = append(changes, r.direction+"_inbound")
+		}
+	}
+
+	reconf.Apply()
+	for _, direction := range reconf.Changed() {
+		changes = append(changes, direction+"_destination")
+	}
+	if a.alerts.Apply(alertSetup) {
+		changes = append(changes, "alerts")
+	}
+
+	inputs, err := a.syncInputs(cfg, plan)
+	changes = append(changes, inputs...)
+	if err != nil {
+		slog.Error("Giriş yeniden başlatılamadı", "error", err)
+	}
+
+	if restart := restartRequired(a.cfg, cfg); len(restart) > 0 {
+		slog.Warn("Bu ayarlar yeniden başlatmadan sonra geçerli olur", "settings", restart)
+	}
+
+	phi.SetDefault(phi.NewMasker(cfg.PHIMaskMode, cfg.PHIHashSalt))
+	config.SetupLogger(cfg.LogLevel)
+	a.web.SetConfig(cfg)
+	a.cfg = cfg
+	return changes, nil
+}
+
+// restartRequired lists the changed settings that only take effect on restart
+func restartRequired(old, cfg *config.Config) []string {
+	var settings []string
+	if old.WebPort != cfg.WebPort {
+		settings = append(settings, "WEB_PORT")
+	}
+	if old.DBPath != cfg.DBPath {
+		settings = append(settings, "DB_PATH")
+	}
+	if old.StoreEncryptionKey != cfg.StoreEncryptionKey ||
+		old.StoreEncryptionKeyFile != cfg.StoreEncryptionKeyFile ||
+		old.StoreEncryptionKeyCommand != cfg.StoreEncryptionKeyCommand ||
+		old.StoreEncryptionCipher != cfg.StoreEncryptionCipher {
+		settings = append(settings, "STORE_ENCRYPTION_*")
+	}
+	if old.ConfigWatchInterval != cfg.ConfigWatchInterval {
+		settings = append(settings, "CONFIG_WATCH_INTERVAL")
+	}
+	return settings
+}
+
+// watchConfigFiles reloads the configuration when the env file, the config
+// file or the alert rules file changes
+func (a *app) watchConfigFiles(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	// The rules file may be changed by a reload, so paths are resolved on
+	// every check
+	modified := func() map[string]time.Time {
+		paths := []string{config.EnvFile(), config.ConfigFile(), a.currentConfig().Alerts.RulesFile}
+		times := make(map[string]time.Time, len(paths))
+		for _, path := range paths {
+			if path == "" {
+				continue
+			}
+			times[path] = time.Time{}
+			if info, err := os.Stat(path); err == nil {
+				times[path] = info.ModTime()
+			}
+		}
+		return times
+	}
+
+	last := modified()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-a.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		current := modified()
+		for path, t := range current {
+			if previous, ok := last[path]; ok && !t.Equal(previous) {
+				a.reload("file")
+				break
+			}
+		}
+		last = current
+	}
+}
+
+func appendOnce(list []string, s string) []string {
+	for _, v := range list {
+		if v == s {
+			return list
+		}
+	}
+	return append(list, s)
+}
@@ -8,11 +8,15 @@ import (
 	"os/signal"
 	"sync"
 	"syscall"
+	"time"
 
+	"github.com/minasoft/hl7-replicator/internal/alerts"
 	"github.com/minasoft/hl7-replicator/internal/config"
 	"github.com/minasoft/hl7-replicator/internal/consumers"
 	"github.com/minasoft/hl7-replicator/internal/hl7"
 	"github.com/minasoft/hl7-replicator/internal/nats"
+	"github.com/minasoft/hl7-replicator/internal/phi"
+	"github.com/minasoft/hl7-replicator/internal/stats"
 	"github.com/minasoft/hl7-replicator/internal/web"
 )
 
@@ -24,6 +28,9 @@ func main() {
 		os.Exit(1)
 	}
 
+	// Configure PHI masking for logs and API responses
+	phi.SetDefault(phi.NewMasker(cfg.PHIMaskMode, cfg.PHIHashSalt))
+
 	// Create context with cancellation
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -31,14 +38,15 @@ func main() {
 	// Setup signal handling
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
 
 	// Start embedded NATS server
-	natsServer, err := nats.NewEmbeddedServer(cfg.DBPath)
+	natsServer, err := nats.NewEmbeddedServer(cfg.DBPath, storeEncryption(cfg))
 	if err != nil {
 		slog.Error("NATS sunucu başlatılamadı", "error", err)
 		os.Exit(1)
 	}
-	defer natsServer.Shutdown()
 
 	// Get JetStream context
 	js := natsServer.JetStream()
@@ -46,30 +54,115 @@ func main() {
 	// Create wait group for goroutines
 	var wg sync.WaitGroup
 
-	// Start HL7 MLLP servers
-	orderServer := hl7.NewMLLPServer(cfg.OrderListenPort, "order", js)
-	if err := orderServer.Start(ctx); err != nil {
-		slog.Error("Order sunucu başlatılamadı", "error", err)
+	// Message counters and time series, written in the background
+	statsStore, err := stats.Open(ctx, js)
+	if err != nil {
+		slog.Error("İstatistikler açılamadı", "error", err)
 		os.Exit(1)
 	}
-	defer orderServer.Stop()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		statsStore.Run(ctx)
+	}()
 
-	reportServer := hl7.NewMLLPServer(cfg.ReportListenPort, "report", js)
-	if err := reportServer.Start(ctx); err != nil {
-		slog.Error("Report sunucu başlatılamadı", "error", err)
+	// Message transforms store extracted attachments here
+	attachmentStore, err := js.ObjectStore(ctx, hl7.AttachmentBucket)
+	if err != nil {
+		slog.Error("Attachment object store açılamadı", "error", err)
 		os.Exit(1)
 	}
-	defer reportServer.Stop()
 
-	// Start message forwarder consumers
-	forwarder := consumers.NewMessageForwarder(js, cfg)
-	if err := forwarder.Start(ctx); err != nil {
+	// Access policies, validation profiles and transforms per route
+	plan, err := planInbound(cfg, attachmentStore)
+	if err != nil {
+		slog.Error("Gelen mesaj yapılandırması geçersiz", "error", err)
+		os.Exit(1)
+	}
+
+	a := &app{
+		ctx:       ctx,
+		js:        js,
+		store:     attachmentStore,
+		cfg:       cfg,
+		receivers: make(map[string]*hl7.Receiver),
+		servers:   make(map[string]*hl7.MLLPServer),
+		inputs:    make(map[string]*runningInput),
+	}
+
+	// Inbound paths shared by every input of a route, and the HL7 MLLP servers
+	for _, r := range inboundRoutes(cfg) {
+		receiver := hl7.NewReceiver(r.direction, js, statsStore, plan.receivers[r.direction])
+		server := hl7.NewMLLPServer(r.port, receiver, plan.servers[r.direction])
+		if err := server.Start(ctx); err != nil {
+			slog.Error(r.name+" sunucu başlatılamadı", "error", err)
+			os.Exit(1)
+		}
+		a.receivers[r.direction] = receiver
+		a.servers[r.direction] = server
+	}
+
+	// Start file-drop and SFTP/FTP polling inputs
+	if _, err := a.syncInputs(cfg, plan); err != nil {
+		slog.Error("Dosya girişi başlatılamadı", "error", err)
+		os.Exit(1)
+	}
+
+	// Start message forwarder consumers, including the destinations managed
+	// through the web API
+	forwarder := consumers.NewMessageForwarder(js, cfg, statsStore)
+	destinations, err := consumers.NewDestinationManager(js, forwarder)
+	if err != nil {
+		slog.Error("Hedef yönetimi başlatılamadı", "error", err)
+		os.Exit(1)
+	}
+	managed, err := destinations.List(ctx)
+	if err != nil {
+		slog.Error("Yönetilen hedefler okunamadı", "error", err)
+		os.Exit(1)
+	}
+	if err := forwarder.Start(ctx, managed); err != nil {
 		slog.Error("Message forwarder başlatılamadı", "error", err)
 		os.Exit(1)
 	}
+	a.forwarder = forwarder
+
+	// Start the alert engine
+	alertSetup, err := alerts.Prepare(cfg.Alerts)
+	if err != nil {
+		slog.Error("Alarm yapılandırması geçersiz", "error", err)
+		os.Exit(1)
+	}
+	alertEngine, err := alerts.NewEngine(js, alerts.Sources{
+		Heartbeats: forwarder.Heartbeats,
+		Backlogs:   forwarder.Backlogs,
+		Traffic:    a.traffic,
+		Stats:      statsStore,
+	}, alertSetup)
+	if err != nil {
+		slog.Error("Alarm motoru başlatılamadı", "error", err)
+		os.Exit(1)
+	}
+	a.alerts = alertEngine
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		alertEngine.Run(ctx)
+	}()
 
 	// Start web server
 	webServer := web.NewServer(js, cfg)
+	for _, r := range inboundRoutes(cfg) {
+		webServer.AddListener(a.servers[r.direction])
+		webServer.AddReceiver(a.receivers[r.direction])
+	}
+	webServer.SetPoolStats(forwarder.PoolStats)
+	webServer.SetHeartbeats(forwarder.Heartbeats)
+	webServer.SetStats(statsStore, forwarder.Backlogs)
+	webServer.SetReloader(a.reload)
+	webServer.SetDestinations(destinations)
+	webServer.SetAlerts(alertEngine)
+	a.web = webServer
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
@@ -89,17 +182,95 @@ func main() {
 	// Print startup information
 	printStartupInfo(cfg)
 
-	// Wait for shutdown signal
-	<-sigChan
-	slog.Info("Kapatma sinyali alındı, sunucu kapatılıyor...")
+	// Reload the configuration when the env or config file changes
+	go a.watchConfigFiles(cfg.ConfigWatchInterval)
 
-	// Cancel context to stop all services
+	// Wait for shutdown signal; SIGHUP reloads the configuration
+	var sig os.Signal
+	for sig == nil {
+		select {
+		case <-hupChan:
+			a.reload("signal")
+		case sig = <-sigChan:
+		}
+	}
+	shutdownTimeout := a.currentConfig().ShutdownTimeout
+	slog.Info("Kapatma sinyali alındı, sunucu kapatılıyor...", "signal", sig.String(), "timeout", shutdownTimeout)
+	start := time.Now()
+
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer shutdownCancel()
+	clean := true
+
+	// Stop accepting and finish messages being read and acknowledged
+	servers := a.listeners()
+	serverErrs := make([]error, len(servers))
+	var listeners sync.WaitGroup
+	for i, server := range servers {
+		listeners.Add(1)
+		go func(i int, server *hl7.MLLPServer) {
+			defer listeners.Done()
+			serverErrs[i] = server.Shutdown(shutdownCtx)
+		}(i, server)
+	}
+	listeners.Wait()
+	for _, err := range serverErrs {
+		if err != nil {
+			clean = false
+		}
+	}
+
+	// Cancel context to stop inputs, consumers and the web server
 	cancel()
 
+	// Let in-flight deliveries finish, then close destination pools
+	if err := forwarder.Stop(shutdownCtx); err != nil {
+		clean = false
+	}
+
 	// Wait for all goroutines to finish
 	wg.Wait()
 
-	slog.Info("HL7 Replicator kapatıldı")
+	// Write the counts of the last deliveries, even if the drain timed out
+	flushCtx, flushCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	if err := statsStore.Flush(flushCtx); err != nil {
+		slog.Error("İstatistikler kaydedilemedi", "error", err)
+		clean = false
+	}
+	flushCancel()
+
+	// NATS is shut down last so that pending ACKs and stats are flushed
+	natsServer.Shutdown()
+
+	slog.Info("HL7 Replicator kapatıldı", "clean", clean, "duration", time.Since(start).Round(time.Millisecond))
+}
+
+// storeEncryption builds the JetStream encryption options; a key command
+// takes precedence over a key file, which takes precedence over a plain key
+func storeEncryption(cfg *config.Config) nats.EncryptionOptions {
+	enc := nats.EncryptionOptions{
+		Cipher:   cfg.StoreEncryptionCipher,
+		Required: cfg.StoreEncryptionRequired,
+		Migrate:  cfg.StoreEncryptionMigrate,
+	}
+
+	switch {
+	case cfg.StoreEncryptionKeyCommand != "":
+		enc.Key = nats.CommandKey(cfg.StoreEncryptionKeyCommand)
+	case cfg.StoreEncryptionKeyFile != "":
+		enc.Key = nats.FileKey(cfg.StoreEncryptionKeyFile)
+	case cfg.StoreEncryptionKey != "":
+		enc.Key = nats.StaticKey(cfg.StoreEncryptionKey)
+	}
+
+	switch {
+	case cfg.StoreEncryptionOldKeyFile != "":
+		enc.OldKey = nats.FileKey(cfg.StoreEncryptionOldKeyFile)
+	case cfg.StoreEncryptionOldKey != "":
+		enc.OldKey = nats.StaticKey(cfg.StoreEncryptionOldKey)
+	}
+
+	return enc
 }
 
 func printStartupInfo(cfg *config.Config) {
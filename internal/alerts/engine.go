@@ -0,0 +1,756 @@
+package alerts
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/minasoft/hl7-replicator/internal/config"
+	"github.com/minasoft/hl7-replicator/internal/consumers"
+	"github.com/minasoft/hl7-replicator/internal/hl7"
+	"github.com/minasoft/hl7-replicator/internal/schedule"
+	"github.com/minasoft/hl7-replicator/internal/stats"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+var (
+	// ErrRuleNotFound is returned for an unknown rule
+	ErrRuleNotFound = errors.New("kural bulunamadı")
+	// ErrInvalidRule wraps the errors of a rejected rule
+	ErrInvalidRule = errors.New("geçersiz kural")
+	// ErrRuleReadOnly is returned when changing a rule of ALERT_RULES_FILE
+	ErrRuleReadOnly = errors.New("kural dosyada tanımlı, API ile değiştirilemez")
+	// ErrNoChannel is returned when no notification channel is configured
+	ErrNoChannel = errors.New("bildirim kanalı yapılandırılmamış")
+)
+
+// RulesBucket stores the rules saved through the web API
+const RulesBucket = "HL7_ALERT_RULES"
+
+// Alert states
+const (
+	StatePending  = "pending" // condition holds, waiting for the rule's "for"
+	StateFiring   = "firing"
+	StateResolved = "resolved" // condition cleared, resolved notifications pending
+)
+
+// Alert is a rule condition that holds (or held) for one subject
+type Alert struct {
+	Rule       string               `json:"rule"`
+	Type       string               `json:"type"`
+	Severity   string               `json:"severity"`
+	Subject    string               `json:"subject,omitempty"`
+	Summary    string               `json:"summary"`
+	State      string               `json:"state"`
+	Value      float64              `json:"value"`
+	Since      time.Time            `json:"since"`
+	FiredAt    *time.Time           `json:"fired_at,omitempty"`
+	ResolvedAt *time.Time           `json:"resolved_at,omitempty"`
+	Notified   map[string]time.Time `json:"notified,omitempty"` // last notification by channel
+	LastError  string               `json:"last_error,omitempty"`
+}
+
+// Finding is the result of evaluating a rule for one subject
+type Finding struct {
+	Subject string  `json:"subject,omitempty"`
+	Value   float64 `json:"value"`
+	Active  bool    `json:"active"`
+	Summary string  `json:"summary"`
+}
+
+// Setup is a validated alerting configuration, built before it replaces the
+// running one so that an invalid configuration is rejected as a whole
+type Setup struct {
+	cfg       config.AlertConfig
+	rules     []*Rule
+	quiet     *schedule.Schedule
+	notifiers map[string]Notifier
+}
+
+// Prepare reads the rules file and builds the notification channels
+func Prepare(cfg config.AlertConfig) (*Setup, error) {
+	s := &Setup{cfg: cfg, notifiers: NewNotifiers(cfg)}
+	if cfg.QuietHours != "" {
+		s.quiet = &schedule.Schedule{Hours: cfg.QuietHours}
+		if err := s.quiet.Parse(); err != nil {
+			return nil, fmt.Errorf("ALERT_QUIET_HOURS geçersiz: %w", err)
+		}
+	}
+	rules, err := LoadRules(cfg.RulesFile)
+	if err != nil {
+		return nil, err
+	}
+	s.rules = rules
+	return s, nil
+}
+
+// Engine evaluates the alert rules every ALERT_EVAL_INTERVAL. A firing alert
+// is notified once per channel, again after the repeat interval while it
+// keeps firing, and once more when it resolves. Notifications due within
+// quiet hours are held until the quiet hours end.
+type Engine struct {
+	js       jetstream.JetStream
+	kv       jetstream.KeyValue
+	sources  Sources
+	instance string
+	started  time.Time
+	wake     chan struct{}
+
+	mu       sync.Mutex
+	setup    *Setup
+	apiRules map[string]*Rule
+	alerts   map[string]*alert // by rule and subject
+}
+
+// alert is the state of an Alert and the rule it belongs to
+type alert struct {
+	Alert
+	rule *Rule
+}
+
+// Sources are where the rules read the state of the replicator from
+type Sources struct {
+	Heartbeats func() []consumers.HeartbeatStatus                     // destination probe results
+	Backlogs   func(ctx context.Context) ([]consumers.Backlog, error) // consumer backlog of the destinations
+	Traffic    func() []hl7.TrafficStatus                             // inbound traffic expectations
+	Stats      *stats.Store                                           // message counts
+}
+
+// NewEngine loads the rules saved through the API
+func NewEngine(js jetstream.JetStream, sources Sources, setup *Setup) (*Engine, error) {
+	ctx := context.Background()
+	kv, err := js.KeyValue(ctx, RulesBucket)
+	if err != nil {
+		return nil, fmt.Errorf("alarm kuralları KV store erişilemedi: %w", err)
+	}
+
+	e := &Engine{
+		js:       js,
+		kv:       kv,
+		sources:  sources,
+		instance: instance(),
+		started:  time.Now(),
+		wake:     make(chan struct{}, 1),
+		setup:    setup,
+		apiRules: make(map[string]*Rule),
+		alerts:   make(map[string]*alert),
+	}
+
+	keys, err := kv.Keys(ctx)
+	if err != nil && !errors.Is(err, jetstream.ErrNoKeysFound) {
+		return nil, fmt.Errorf("alarm kuralları okunamadı: %w", err)
+	}
+	for _, key := range keys {
+		entry, err := kv.Get(ctx, key)
+		if err != nil {
+			continue
+		}
+		var r Rule
+		if err := json.Unmarshal(entry.Value(), &r); err != nil {
+			slog.Error("Alarm kuralı okunamadı", "name", key, "error", err)
+			continue
+		}
+		r.Source = SourceAPI
+		if err := r.Validate(); err != nil {
+			slog.Error("Kayıtlı alarm kuralı geçersiz, atlanıyor", "name", key, "error", err)
+			continue
+		}
+		e.apiRules[r.Name] = &r
+	}
+	return e, nil
+}
+
+// Apply replaces the configuration; it reports whether anything changed
+func (e *Engine) Apply(s *Setup) bool {
+	e.mu.Lock()
+	changed := !reflect.DeepEqual(e.setup.cfg, s.cfg) || !reflect.DeepEqual(e.setup.rules, s.rules)
+	e.setup = s
+	e.mu.Unlock()
+
+	if changed {
+		e.trigger()
+	}
+	return changed
+}
+
+// trigger runs an evaluation without waiting for the next interval
+func (e *Engine) trigger() {
+	select {
+	case e.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run evaluates the rules until ctx ends
+func (e *Engine) Run(ctx context.Context) {
+	slog.Info("Alarm motoru başlatıldı",
+		"rules", len(e.Rules()),
+		"channels", e.ConfiguredChannels())
+
+	for {
+		e.evaluate(ctx)
+
+		e.mu.Lock()
+		interval := e.setup.cfg.EvalInterval
+		e.mu.Unlock()
+
+		timer := time.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		case <-e.wake:
+			timer.Stop()
+		}
+	}
+}
+
+// Rules returns the file and API rules sorted by name
+func (e *Engine) Rules() []*Rule {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.rules()
+}
+
+func (e *Engine) rules() []*Rule {
+	rules := make([]*Rule, 0, len(e.setup.rules)+len(e.apiRules))
+	rules = append(rules, e.setup.rules...)
+	for _, r := range e.apiRules {
+		if e.fileRule(r.Name) == nil {
+			rules = append(rules, r)
+		}
+	}
+	sort.Slice(rules, func(i, j int) bool { return rules[i].Name < rules[j].Name })
+	return rules
+}
+
+func (e *Engine) fileRule(name string) *Rule {
+	for _, r := range e.setup.rules {
+		if r.Name == name {
+			return r
+		}
+	}
+	return nil
+}
+
+// Rule returns a rule by name
+func (e *Engine) Rule(name string) (*Rule, error) {
+	for _, r := range e.Rules() {
+		if r.Name == name {
+			return r, nil
+		}
+	}
+	return nil, ErrRuleNotFound
+}
+
+// SaveRule creates or replaces a rule saved through the API
+func (e *Engine) SaveRule(ctx context.Context, r *Rule) error {
+	r.Source = SourceAPI
+	if err := r.Validate(); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidRule, err)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.fileRule(r.Name) != nil {
+		return ErrRuleReadOnly
+	}
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if _, err := e.kv.Put(ctx, r.Name, data); err != nil {
+		return fmt.Errorf("kural kaydedilemedi: %w", err)
+	}
+	e.apiRules[r.Name] = r
+	e.trigger()
+
+	slog.Info("Alarm kuralı kaydedildi", "name", r.Name, "type", r.Type)
+	return nil
+}
+
+// DeleteRule removes a rule saved through the API; its alerts are dropped
+// without notification
+func (e *Engine) DeleteRule(ctx context.Context, name string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.fileRule(name) != nil {
+		return ErrRuleReadOnly
+	}
+	if _, ok := e.apiRules[name]; !ok {
+		return ErrRuleNotFound
+	}
+	if err := e.kv.Delete(ctx, name); err != nil {
+		return fmt.Errorf("kural silinemedi: %w", err)
+	}
+	delete(e.apiRules, name)
+	for key, a := range e.alerts {
+		if a.Rule == name {
+			delete(e.alerts, key)
+		}
+	}
+
+	slog.Info("Alarm kuralı silindi", "name", name)
+	return nil
+}
+
+// Alerts returns the pending, firing and unnotified resolved alerts
+func (e *Engine) Alerts() []Alert {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	list := make([]Alert, 0, len(e.alerts))
+	for _, a := range e.alerts {
+		c := a.Alert
+		c.Notified = make(map[string]time.Time, len(a.Notified))
+		for ch, t := range a.Notified {
+			c.Notified[ch] = t
+		}
+		list = append(list, c)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Rule != list[j].Rule {
+			return list[i].Rule < list[j].Rule
+		}
+		return list[i].Subject < list[j].Subject
+	})
+	return list
+}
+
+// ConfiguredChannels returns the names of the configured channels
+func (e *Engine) ConfiguredChannels() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var names []string
+	for _, ch := range Channels {
+		if _, ok := e.setup.notifiers[ch]; ok {
+			names = append(names, ch)
+		}
+	}
+	return names
+}
+
+// ChannelResult is the outcome of a test notification
+type ChannelResult struct {
+	Channel string `json:"channel"`
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+}
+
+// TestChannels sends a test notification to a channel, or to every
+// configured channel when channel is empty
+func (e *Engine) TestChannels(ctx context.Context, channel string) ([]ChannelResult, error) {
+	e.mu.Lock()
+	notifiers := e.setup.notifiers
+	e.mu.Unlock()
+
+	var channels []string
+	for _, ch := range Channels {
+		if _, ok := notifiers[ch]; ok && (channel == "" || channel == ch) {
+			channels = append(channels, ch)
+		}
+	}
+	if len(channels) == 0 {
+		if channel != "" {
+			return nil, fmt.Errorf("%w: %s", ErrNoChannel, channel)
+		}
+		return nil, ErrNoChannel
+	}
+
+	n := &Notification{
+		Status:   StatusTest,
+		Rule:     "test",
+		Type:     "test",
+		Severity: SeverityInfo,
+		Summary:  "HL7 Replicator test bildirimi",
+		StartsAt: time.Now(),
+		Instance: e.instance,
+	}
+	results := make([]ChannelResult, 0, len(channels))
+	for _, ch := range channels {
+		result := ChannelResult{Channel: ch, Success: true}
+		if err := notifiers[ch].Notify(ctx, n); err != nil {
+			result.Success = false
+			result.Error = err.Error()
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// TestRule evaluates a rule, saved or not, without changing any alert
+func (e *Engine) TestRule(ctx context.Context, r *Rule) ([]Finding, error) {
+	if err := r.Validate(); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidRule, err)
+	}
+	return e.check(ctx, r, time.Now())
+}
+
+// delivery is a notification to send over one channel
+type delivery struct {
+	a        *alert
+	channel  string
+	notifier Notifier
+	n        *Notification
+	at       time.Time // evaluation the notification was due at
+}
+
+// evaluate checks every rule and sends the notifications due
+func (e *Engine) evaluate(ctx context.Context) {
+	now := time.Now()
+
+	e.mu.Lock()
+	rules := e.rules()
+	e.mu.Unlock()
+
+	results := make(map[string][]Finding, len(rules))
+	for _, r := range rules {
+		if r.Disabled {
+			continue
+		}
+		if r.Schedule != nil && !r.Schedule.Contains(now) {
+			// Outside its schedule the rule holds for nothing, so its
+			// alerts resolve instead of firing until the schedule opens
+			results[r.Name] = nil
+			continue
+		}
+		findings, err := e.check(ctx, r, now)
+		if err != nil {
+			slog.Warn("Alarm kuralı değerlendirilemedi", "rule", r.Name, "error", err)
+			continue
+		}
+		results[r.Name] = findings
+	}
+
+	e.mu.Lock()
+	for _, r := range rules {
+		findings, ok := results[r.Name]
+		if !ok {
+			continue
+		}
+		e.update(r, findings, now)
+	}
+	// Alerts of removed or disabled rules are dropped
+	for key, a := range e.alerts {
+		if r := ruleByName(rules, a.Rule); r == nil || r.Disabled {
+			delete(e.alerts, key)
+		}
+	}
+	deliveries := e.due(now)
+	e.mu.Unlock()
+
+	e.send(ctx, deliveries)
+}
+
+// send delivers the notifications and records which channels were told
+func (e *Engine) send(ctx context.Context, deliveries []delivery) {
+	for _, d := range deliveries {
+		err := d.notifier.Notify(ctx, d.n)
+
+		e.mu.Lock()
+		if err != nil {
+			d.a.LastError = fmt.Sprintf("%s: %v", d.channel, err)
+		} else {
+			d.a.LastError = ""
+			if d.n.Status == StatusResolved {
+				delete(d.a.Notified, d.channel)
+			} else {
+				d.a.Notified[d.channel] = d.at
+			}
+		}
+		e.mu.Unlock()
+
+		if err != nil {
+			slog.Error("Alarm bildirimi gönderilemedi",
+				"rule", d.a.Rule, "subject", d.a.Subject, "channel", d.channel, "error", err)
+		} else {
+			slog.Info("Alarm bildirimi gönderildi",
+				"rule", d.a.Rule, "subject", d.a.Subject, "channel", d.channel, "status", d.n.Status)
+		}
+	}
+
+	// Resolved alerts are kept until every channel has been told
+	e.mu.Lock()
+	for key, a := range e.alerts {
+		if a.State == StateResolved && len(a.Notified) == 0 {
+			delete(e.alerts, key)
+		}
+	}
+	e.mu.Unlock()
+}
+
+func ruleByName(rules []*Rule, name string) *Rule {
+	for _, r := range rules {
+		if r.Name == name {
+			return r
+		}
+	}
+	return nil
+}
+
+// update moves the alerts of a rule through their states
+func (e *Engine) update(r *Rule, findings []Finding, now time.Time) {
+	active := make(map[string]bool)
+	for _, f := range findings {
+		key := r.Name + "/" + f.Subject
+		a := e.alerts[key]
+		if !f.Active {
+			continue
+		}
+		active[key] = true
+
+		if a == nil || a.State == StateResolved {
+			a = &alert{
+				Alert: Alert{
+					Rule:     r.Name,
+					Subject:  f.Subject,
+					State:    StatePending,
+					Since:    now,
+					Notified: map[string]time.Time{},
+				},
+			}
+			if previous := e.alerts[key]; previous != nil {
+				// Channels still owed a resolved notification hear about the
+				// new firing instead
+				a.Notified = previous.Notified
+			}
+			e.alerts[key] = a
+		}
+		a.rule = r
+		a.Type = r.Type
+		a.Severity = r.Severity
+		a.Summary = f.Summary
+		a.Value = f.Value
+
+		if a.State == StatePending && now.Sub(a.Since) >= r.hold {
+			a.State = StateFiring
+			a.FiredAt = &now
+			slog.Warn("Alarm tetiklendi", "rule", r.Name, "subject", f.Subject, "summary", f.Summary)
+		}
+	}
+
+	for key, a := range e.alerts {
+		if a.Rule != r.Name || active[key] || a.State == StateResolved {
+			continue
+		}
+		if a.State == StatePending {
+			delete(e.alerts, key)
+			continue
+		}
+		a.State = StateResolved
+		a.ResolvedAt = &now
+		slog.Info("Alarm çözüldü", "rule", r.Name, "subject", a.Subject)
+	}
+}
+
+// due returns the notifications to send now
+func (e *Engine) due(now time.Time) []delivery {
+	var deliveries []delivery
+	for _, a := range e.alerts {
+		r := a.rule
+		if r == nil || a.State == StatePending {
+			continue
+		}
+		quiet := r.quiet
+		if quiet == nil {
+			quiet = e.setup.quiet
+		}
+		if quiet != nil && quiet.Contains(now) {
+			continue
+		}
+		repeat := e.setup.cfg.RepeatInterval
+		if r.repeat != nil {
+			repeat = *r.repeat
+		}
+
+		for _, ch := range Channels {
+			notifier, ok := e.setup.notifiers[ch]
+			if !ok || (len(r.Channels) > 0 && !contains(r.Channels, ch)) {
+				continue
+			}
+			last, notified := a.Notified[ch]
+			status := StatusFiring
+			switch {
+			case a.State == StateResolved && notified:
+				status = StatusResolved
+			case a.State == StateResolved:
+				continue
+			case notified && (repeat == 0 || now.Sub(last) < repeat):
+				continue
+			}
+			deliveries = append(deliveries, delivery{a: a, channel: ch, notifier: notifier, n: e.notification(a, status), at: now})
+		}
+	}
+	return deliveries
+}
+
+func (e *Engine) notification(a *alert, status string) *Notification {
+	starts := a.Since
+	if a.FiredAt != nil {
+		starts = *a.FiredAt
+	}
+	return &Notification{
+		Status:      status,
+		Rule:        a.Rule,
+		Type:        a.Type,
+		Severity:    a.Severity,
+		Subject:     a.Subject,
+		Summary:     a.Summary,
+		Description: a.rule.Description,
+		Value:       a.Value,
+		Threshold:   a.rule.Threshold,
+		StartsAt:    starts,
+		EndsAt:      a.ResolvedAt,
+		Instance:    e.instance,
+	}
+}
+
+// routeStreams maps the routes of a rule to their streams
+func routeStreams(route string) map[string]string {
+	streams := map[string]string{"order": "HL7_ORDERS", "report": "HL7_REPORTS"}
+	if route != "" {
+		return map[string]string{route: streams[route]}
+	}
+	return streams
+}
+
+// check evaluates a rule
+func (e *Engine) check(ctx context.Context, r *Rule, now time.Time) ([]Finding, error) {
+	switch r.Type {
+	case RuleDLQCount:
+		kv, err := e.js.KeyValue(ctx, "HL7_DLQ")
+		if err != nil {
+			return nil, err
+		}
+		keys, err := kv.Keys(ctx)
+		if err != nil && !errors.Is(err, jetstream.ErrNoKeysFound) {
+			return nil, err
+		}
+		count := len(keys)
+		return []Finding{{
+			Value:   float64(count),
+			Active:  count > r.Threshold,
+			Summary: fmt.Sprintf("DLQ'da %d mesaj var (eşik %d)", count, r.Threshold),
+		}}, nil
+
+	case RuleNoTraffic:
+		var findings []Finding
+		for route, name := range routeStreams(r.Route) {
+			stream, err := e.js.Stream(ctx, name)
+			if err != nil {
+				return nil, err
+			}
+			info, err := stream.Info(ctx)
+			if err != nil {
+				return nil, err
+			}
+			// Silence counts from the last message, the start of the
+			// scheduled window or the start of the service, whichever is last
+			since := info.State.LastTime
+			if e.started.After(since) {
+				since = e.started
+			}
+			if r.Schedule != nil {
+				if start, ok := r.Schedule.Start(now); ok && start.After(since) {
+					since = start
+				}
+			}
+			silence := now.Sub(since)
+			findings = append(findings, Finding{
+				Subject: route,
+				Value:   silence.Minutes(),
+				Active:  silence >= r.window,
+				Summary: fmt.Sprintf("%s yönünde %s süredir mesaj alınmadı", route, silence.Round(time.Second)),
+			})
+		}
+		return findings, nil
+
+	case RuleDestinationDown:
+		var findings []Finding
+		if e.sources.Heartbeats == nil {
+			return nil, nil
+		}
+		for _, hb := range e.sources.Heartbeats() {
+			if (r.Destination != "" && hb.Name != r.Destination) || (r.Route != "" && hb.Direction != r.Route) {
+				continue
+			}
+			findings = append(findings, Finding{
+				Subject: hb.Name,
+				Value:   float64(hb.ConsecutiveFailures),
+				Active:  hb.State == consumers.HeartbeatDown,
+				Summary: fmt.Sprintf("%s hedefine (%s) erişilemiyor: %s", hb.Name, hb.Destination, hb.LastError),
+			})
+		}
+		return findings, nil
+
+	case RuleSilentSender:
+		var findings []Finding
+		if e.sources.Traffic == nil {
+			return nil, nil
+		}
+		for _, t := range e.sources.Traffic() {
+			if (r.Sender != "" && !strings.EqualFold(t.Sender, r.Sender)) || (r.Route != "" && t.Direction != r.Route) {
+				continue
+			}
+			silence := time.Duration(t.Silence) * time.Second
+			findings = append(findings, Finding{
+				Subject: t.Name,
+				Value:   silence.Minutes(),
+				Active:  t.State == hl7.TrafficSilent,
+				Summary: fmt.Sprintf("%s göndericisinden (%s) %s süredir mesaj alınmadı (beklenen aralık %s)", t.Sender, t.Direction, silence, t.Interval),
+			})
+		}
+		return findings, nil
+
+	case RuleDeliveryFailures:
+		if e.sources.Stats == nil {
+			return nil, nil
+		}
+		var findings []Finding
+		for route := range routeStreams(r.Route) {
+			counts, err := e.sources.Stats.Sum(ctx, stats.ByRoute, route, now.Add(-r.window), now)
+			if err != nil {
+				return nil, err
+			}
+			findings = append(findings, Finding{
+				Subject: route,
+				Value:   float64(counts.Failed),
+				Active:  counts.Failed > int64(r.Threshold),
+				Summary: fmt.Sprintf("%s yönünde son %s içinde %d başarısız teslimat (eşik %d)", route, r.Window, counts.Failed, r.Threshold),
+			})
+		}
+		return findings, nil
+
+	case RuleStreamLag:
+		if e.sources.Backlogs == nil {
+			return nil, nil
+		}
+		backlogs, err := e.sources.Backlogs(ctx)
+		if err != nil {
+			return nil, err
+		}
+		var findings []Finding
+		for _, b := range backlogs {
+			if r.Route != "" && b.Direction != r.Route {
+				continue
+			}
+			pending := b.Total()
+			findings = append(findings, Finding{
+				Subject: b.Consumer,
+				Value:   float64(pending),
+				Active:  pending > uint64(r.Threshold),
+				Summary: fmt.Sprintf("%s consumer'ında %d mesaj bekliyor (eşik %d)", b.Consumer, pending, r.Threshold),
+			})
+		}
+		return findings, nil
+	}
+	return nil, fmt.Errorf("bilinmeyen kural tipi: %s", r.Type)
+}
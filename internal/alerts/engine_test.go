@@ -0,0 +1,191 @@
+package alerts
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/minasoft/hl7-replicator/internal/config"
+	"github.com/minasoft/hl7-replicator/internal/consumers"
+	"github.com/minasoft/hl7-replicator/internal/schedule"
+)
+
+// recorder is a notifier that keeps what it was sent
+type recorder struct {
+	mu     sync.Mutex
+	sent   []*Notification
+	failed error // returned once, then cleared
+}
+
+func (r *recorder) Notify(ctx context.Context, n *Notification) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.failed; err != nil {
+		r.failed = nil
+		return err
+	}
+	r.sent = append(r.sent, n)
+	return nil
+}
+
+// statuses returns the statuses sent since the previous call
+func (r *recorder) statuses() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var statuses []string
+	for _, n := range r.sent {
+		statuses = append(statuses, n.Status)
+	}
+	r.sent = nil
+	return statuses
+}
+
+func newTestEngine(t *testing.T, rules []*Rule, repeat time.Duration, notifiers map[string]Notifier) *Engine {
+	t.Helper()
+	for _, r := range rules {
+		if err := r.Validate(); err != nil {
+			t.Fatalf("%s kuralı geçersiz: %v", r.Name, err)
+		}
+	}
+	return &Engine{
+		instance: "test",
+		wake:     make(chan struct{}, 1),
+		setup: &Setup{
+			cfg:       config.AlertConfig{RepeatInterval: repeat},
+			rules:     rules,
+			notifiers: notifiers,
+		},
+		apiRules: make(map[string]*Rule),
+		alerts:   make(map[string]*alert),
+	}
+}
+
+// step evaluates findings at now and sends what is due
+func step(e *Engine, r *Rule, now time.Time, findings ...Finding) {
+	e.mu.Lock()
+	e.update(r, findings, now)
+	deliveries := e.due(now)
+	e.mu.Unlock()
+	e.send(context.Background(), deliveries)
+}
+
+func expectSent(t *testing.T, when string, r *recorder, want ...string) {
+	t.Helper()
+	if got := r.statuses(); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("%s: gönderilen %v, beklenen %v", when, got, want)
+	}
+}
+
+// window returns the "HH:MM-HH:MM" hours from a to b
+func window(a, b time.Time) string {
+	return a.Format("15:04") + "-" + b.Format("15:04")
+}
+
+func TestEngineNotificationFlow(t *testing.T) {
+	t0 := time.Now()
+	rule := &Rule{
+		Name:       "pacs_down",
+		Type:       RuleDestinationDown,
+		For:        "5m",
+		Repeat:     "1h",
+		QuietHours: window(t0.Add(150*time.Minute), t0.Add(210*time.Minute)),
+	}
+	webhook, slack := &recorder{}, &recorder{}
+	e := newTestEngine(t, []*Rule{rule}, 4*time.Hour, map[string]Notifier{
+		ChannelWebhook: webhook,
+		ChannelSlack:   slack,
+	})
+	down := Finding{Subject: "order", Value: 3, Active: true, Summary: "order hedefine erişilemiyor"}
+	up := Finding{Subject: "order", Active: false}
+
+	step(e, rule, t0, down)
+	expectSent(t, "for süresi dolmadan", webhook)
+	if a := e.Alerts(); len(a) != 1 || a[0].State != StatePending {
+		t.Fatalf("alarm bekleyen durumda değil: %+v", a)
+	}
+
+	step(e, rule, t0.Add(5*time.Minute), down)
+	expectSent(t, "tetiklendiğinde", webhook, StatusFiring)
+	expectSent(t, "tetiklendiğinde", slack, StatusFiring)
+
+	step(e, rule, t0.Add(30*time.Minute), down)
+	expectSent(t, "tekrar aralığı dolmadan", webhook)
+
+	// A failed channel is retried on the next evaluation
+	slack.failed = errors.New("HTTP 500")
+	step(e, rule, t0.Add(70*time.Minute), down)
+	expectSent(t, "tekrar aralığı dolunca", webhook, StatusFiring)
+	expectSent(t, "hata veren kanal", slack)
+	if a := e.Alerts(); a[0].LastError == "" {
+		t.Error("gönderim hatası kaydedilmedi")
+	}
+	step(e, rule, t0.Add(71*time.Minute), down)
+	expectSent(t, "yeniden denemede", slack, StatusFiring)
+	expectSent(t, "yeniden denemede", webhook)
+
+	// Resolved within quiet hours: held until they end
+	step(e, rule, t0.Add(3*time.Hour), up)
+	expectSent(t, "sessiz saatlerde", webhook)
+	if a := e.Alerts(); len(a) != 1 || a[0].State != StateResolved {
+		t.Fatalf("alarm çözüldü durumunda değil: %+v", a)
+	}
+
+	step(e, rule, t0.Add(4*time.Hour), up)
+	expectSent(t, "sessiz saatlerden sonra", webhook, StatusResolved)
+	expectSent(t, "sessiz saatlerden sonra", slack, StatusResolved)
+	if a := e.Alerts(); len(a) != 0 {
+		t.Errorf("bildirilen çözülmüş alarm kaldı: %+v", a)
+	}
+}
+
+func TestEnginePendingAlertResolvesSilently(t *testing.T) {
+	t0 := time.Now()
+	rule := &Rule{Name: "pacs_down", Type: RuleDestinationDown, For: "5m"}
+	webhook := &recorder{}
+	e := newTestEngine(t, []*Rule{rule}, time.Hour, map[string]Notifier{ChannelWebhook: webhook})
+
+	step(e, rule, t0, Finding{Subject: "order", Active: true})
+	step(e, rule, t0.Add(time.Minute), Finding{Subject: "order", Active: false})
+	expectSent(t, "tetiklenmeden düzelen alarm", webhook)
+	if a := e.Alerts(); len(a) != 0 {
+		t.Errorf("bekleyen alarm silinmedi: %+v", a)
+	}
+}
+
+func TestEngineResolvesWhenScheduleCloses(t *testing.T) {
+	now := time.Now()
+	today := []string{map[time.Weekday]string{
+		time.Sunday: "sun", time.Monday: "mon", time.Tuesday: "tue", time.Wednesday: "wed",
+		time.Thursday: "thu", time.Friday: "fri", time.Saturday: "sat",
+	}[now.Weekday()]}
+	rule := &Rule{
+		Name:     "pacs_down",
+		Type:     RuleDestinationDown,
+		Schedule: &schedule.Schedule{Days: today},
+	}
+	webhook := &recorder{}
+	e := newTestEngine(t, []*Rule{rule}, time.Hour, map[string]Notifier{ChannelWebhook: webhook})
+	e.sources.Heartbeats = func() []consumers.HeartbeatStatus {
+		return []consumers.HeartbeatStatus{{Name: "order", Direction: "order", State: consumers.HeartbeatDown}}
+	}
+
+	e.evaluate(context.Background())
+	expectSent(t, "zaman aralığında", webhook, StatusFiring)
+
+	// The destination is still down, but the schedule has closed
+	rule.Schedule.Hours = window(now.Add(-2*time.Hour), now.Add(-time.Hour))
+	if err := rule.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	e.evaluate(context.Background())
+	expectSent(t, "zaman aralığı kapandığında", webhook, StatusResolved)
+	if a := e.Alerts(); len(a) != 0 {
+		t.Errorf("zaman aralığı dışında alarm kaldı: %+v", a)
+	}
+
+	e.evaluate(context.Background())
+	expectSent(t, "zaman aralığı dışında", webhook)
+}
@@ -0,0 +1,281 @@
+package alerts
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/minasoft/hl7-replicator/internal/config"
+)
+
+// Notification channels
+const (
+	ChannelEmail   = "email"
+	ChannelWebhook = "webhook"
+	ChannelSlack   = "slack"
+	ChannelTeams   = "teams"
+)
+
+// Channels lists the notification channels
+var Channels = []string{ChannelEmail, ChannelWebhook, ChannelSlack, ChannelTeams}
+
+// Notification statuses
+const (
+	StatusFiring   = "firing"
+	StatusResolved = "resolved"
+	StatusTest     = "test"
+)
+
+// Notification is what a channel sends about an alert; the generic webhook
+// receives it as JSON
+type Notification struct {
+	Status      string     `json:"status"`
+	Rule        string     `json:"rule"`
+	Type        string     `json:"type"`
+	Severity    string     `json:"severity"`
+	Subject     string     `json:"subject,omitempty"` // route, destination or consumer the alert is about
+	Summary     string     `json:"summary"`
+	Description string     `json:"description,omitempty"`
+	Value       float64    `json:"value"`
+	Threshold   int        `json:"threshold,omitempty"`
+	StartsAt    time.Time  `json:"starts_at"`
+	EndsAt      *time.Time `json:"ends_at,omitempty"`
+	Instance    string     `json:"instance"`
+}
+
+// title is the one-line form used as e-mail subject and chat title
+func (n *Notification) title() string {
+	switch n.Status {
+	case StatusResolved:
+		return fmt.Sprintf("[ÇÖZÜLDÜ] %s", n.Summary)
+	case StatusTest:
+		return fmt.Sprintf("[TEST] %s", n.Summary)
+	default:
+		return fmt.Sprintf("[%s] %s", strings.ToUpper(n.Severity), n.Summary)
+	}
+}
+
+// text is the plain text body
+func (n *Notification) text() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Kural: %s (%s)\n", n.Rule, n.Type)
+	if n.Subject != "" {
+		fmt.Fprintf(&b, "Kaynak: %s\n", n.Subject)
+	}
+	if n.Description != "" {
+		fmt.Fprintf(&b, "Açıklama: %s\n", n.Description)
+	}
+	fmt.Fprintf(&b, "Değer: %s\n", strconv.FormatFloat(n.Value, 'f', -1, 64))
+	fmt.Fprintf(&b, "Başlangıç: %s\n", n.StartsAt.Format(time.RFC3339))
+	if n.EndsAt != nil {
+		fmt.Fprintf(&b, "Bitiş: %s\n", n.EndsAt.Format(time.RFC3339))
+	}
+	fmt.Fprintf(&b, "Sunucu: %s\n", n.Instance)
+	return b.String()
+}
+
+// Notifier sends notifications over one channel
+type Notifier interface {
+	Notify(ctx context.Context, n *Notification) error
+}
+
+// NewNotifiers builds the notifiers of the configured channels by channel name
+func NewNotifiers(cfg config.AlertConfig) map[string]Notifier {
+	client := &http.Client{Timeout: cfg.Timeout}
+	notifiers := make(map[string]Notifier)
+	if cfg.SMTP.Host != "" {
+		notifiers[ChannelEmail] = &emailNotifier{cfg: cfg.SMTP, timeout: cfg.Timeout}
+	}
+	if cfg.WebhookURL != "" {
+		notifiers[ChannelWebhook] = &webhookNotifier{client: client, url: cfg.WebhookURL, token: cfg.WebhookToken}
+	}
+	if cfg.SlackWebhookURL != "" {
+		notifiers[ChannelSlack] = &slackNotifier{client: client, url: cfg.SlackWebhookURL}
+	}
+	if cfg.TeamsWebhookURL != "" {
+		notifiers[ChannelTeams] = &teamsNotifier{client: client, url: cfg.TeamsWebhookURL}
+	}
+	return notifiers
+}
+
+// instance names the replicator in notifications
+func instance() string {
+	host, err := os.Hostname()
+	if err != nil {
+		return "hl7-replicator"
+	}
+	return host
+}
+
+// emailNotifier sends plain text e-mails over SMTP
+type emailNotifier struct {
+	cfg     config.SMTPConfig
+	timeout time.Duration
+}
+
+func (e *emailNotifier) Notify(ctx context.Context, n *Notification) error {
+	addr := net.JoinHostPort(e.cfg.Host, strconv.Itoa(e.cfg.Port))
+	deadline := time.Now().Add(e.timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+
+	dialer := &net.Dialer{Deadline: deadline}
+	var conn net.Conn
+	var err error
+	if e.cfg.TLS == "tls" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{ServerName: e.cfg.Host})
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return fmt.Errorf("SMTP bağlantısı kurulamadı: %w", err)
+	}
+	conn.SetDeadline(deadline)
+
+	c, err := smtp.NewClient(conn, e.cfg.Host)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("SMTP oturumu açılamadı: %w", err)
+	}
+	defer c.Close()
+
+	if e.cfg.TLS == "starttls" {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return fmt.Errorf("SMTP sunucusu STARTTLS desteklemiyor")
+		}
+		if err := c.StartTLS(&tls.Config{ServerName: e.cfg.Host}); err != nil {
+			return fmt.Errorf("SMTP STARTTLS hatası: %w", err)
+		}
+	}
+	if e.cfg.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", e.cfg.Username, e.cfg.Password, e.cfg.Host)); err != nil {
+			return fmt.Errorf("SMTP kimlik doğrulama hatası: %w", err)
+		}
+	}
+
+	recipients := splitList(e.cfg.To)
+	if err := c.Mail(e.cfg.From); err != nil {
+		return fmt.Errorf("SMTP MAIL FROM hatası: %w", err)
+	}
+	for _, to := range recipients {
+		if err := c.Rcpt(to); err != nil {
+			return fmt.Errorf("SMTP RCPT TO hatası (%s): %w", to, err)
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return fmt.Errorf("SMTP DATA hatası: %w", err)
+	}
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", e.cfg.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(recipients, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.BEncoding.Encode("UTF-8", n.title()))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=UTF-8\r\nContent-Transfer-Encoding: 8bit\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(n.text(), "\n", "\r\n"))
+	if _, err := w.Write(msg.Bytes()); err != nil {
+		return fmt.Errorf("SMTP gönderim hatası: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("SMTP gönderim hatası: %w", err)
+	}
+	return c.Quit()
+}
+
+// webhookNotifier posts the notification as JSON
+type webhookNotifier struct {
+	client *http.Client
+	url    string
+	token  string
+}
+
+func (w *webhookNotifier) Notify(ctx context.Context, n *Notification) error {
+	return postJSON(ctx, w.client, w.url, w.token, n)
+}
+
+// slackNotifier posts to a Slack (or Mattermost/Rocket.Chat) incoming webhook
+type slackNotifier struct {
+	client *http.Client
+	url    string
+}
+
+func (s *slackNotifier) Notify(ctx context.Context, n *Notification) error {
+	payload := map[string]string{
+		"text": fmt.Sprintf("*%s*\n%s", n.title(), n.text()),
+	}
+	return postJSON(ctx, s.client, s.url, "", payload)
+}
+
+// teamsNotifier posts a MessageCard to a Microsoft Teams incoming webhook
+type teamsNotifier struct {
+	client *http.Client
+	url    string
+}
+
+func (t *teamsNotifier) Notify(ctx context.Context, n *Notification) error {
+	color := map[string]string{
+		SeverityInfo:     "0078D7",
+		SeverityWarning:  "FFA500",
+		SeverityCritical: "D70000",
+	}[n.Severity]
+	if n.Status == StatusResolved {
+		color = "2EB886"
+	}
+	payload := map[string]string{
+		"@type":      "MessageCard",
+		"@context":   "https://schema.org/extensions",
+		"summary":    n.title(),
+		"title":      n.title(),
+		"themeColor": color,
+		"text":       strings.ReplaceAll(n.text(), "\n", "<br>"),
+	}
+	return postJSON(ctx, t.client, t.url, "", payload)
+}
+
+func postJSON(ctx context.Context, client *http.Client, url, token string, payload any) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
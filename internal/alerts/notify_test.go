@@ -0,0 +1,268 @@
+package alerts
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/minasoft/hl7-replicator/internal/config"
+)
+
+func testNotification(status string) *Notification {
+	n := &Notification{
+		Status:   status,
+		Rule:     "pacs_down",
+		Type:     RuleDestinationDown,
+		Severity: SeverityCritical,
+		Subject:  "order",
+		Summary:  "ZenPACS hedefine erişilemiyor",
+		Value:    3,
+		StartsAt: time.Date(2024, 1, 1, 8, 0, 0, 0, time.UTC),
+		Instance: "test",
+	}
+	if status == StatusResolved {
+		ends := n.StartsAt.Add(time.Hour)
+		n.EndsAt = &ends
+	}
+	return n
+}
+
+// smtpSession is what the SMTP stub received
+type smtpSession struct {
+	commands []string
+	data     string
+}
+
+// startSMTP serves one SMTP session; extensions are announced after EHLO
+func startSMTP(t *testing.T, extensions ...string) (port int, session chan smtpSession) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	session = make(chan smtpSession, 1)
+	go func() {
+		var s smtpSession
+		defer func() { session <- s }()
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		r := bufio.NewReader(conn)
+		reply := func(lines ...string) { io.WriteString(conn, strings.Join(lines, "\r\n")+"\r\n") }
+		reply("220 stub ESMTP")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimRight(line, "\r\n")
+			s.commands = append(s.commands, line)
+			verb := strings.ToUpper(strings.Fields(line + " ")[0])
+			switch verb {
+			case "EHLO":
+				lines := []string{"250-stub"}
+				for _, ext := range extensions {
+					lines = append(lines, "250-"+ext)
+				}
+				reply(append(lines, "250 8BITMIME")...)
+			case "AUTH":
+				reply("235 2.7.0 Authentication successful")
+			case "DATA":
+				reply("354 End data with <CR><LF>.<CR><LF>")
+				var data strings.Builder
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if line == ".\r\n" {
+						break
+					}
+					data.WriteString(line)
+				}
+				s.data = data.String()
+				reply("250 2.0.0 OK")
+			case "QUIT":
+				reply("221 2.0.0 Bye")
+				return
+			default:
+				reply("250 2.0.0 OK")
+			}
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr).Port, session
+}
+
+func TestEmailNotifier(t *testing.T) {
+	port, session := startSMTP(t, "AUTH PLAIN")
+	n := &emailNotifier{timeout: 5 * time.Second, cfg: config.SMTPConfig{
+		Host:     "127.0.0.1",
+		Port:     port,
+		TLS:      "none",
+		Username: "alerts",
+		Password: "secret",
+		From:     "hl7@example.org",
+		To:       "ops@example.org, pacs@example.org",
+	}}
+	if err := n.Notify(context.Background(), testNotification(StatusFiring)); err != nil {
+		t.Fatalf("Notify: %v", err)
+	}
+
+	s := <-session
+	commands := strings.Join(s.commands, "\n")
+	auth := "AUTH PLAIN " + base64.StdEncoding.EncodeToString([]byte("\x00alerts\x00secret"))
+	for _, want := range []string{auth, "MAIL FROM:<hl7@example.org>", "RCPT TO:<ops@example.org>", "RCPT TO:<pacs@example.org>", "QUIT"} {
+		if !strings.Contains(commands, want) {
+			t.Errorf("%q komutu gönderilmedi:\n%s", want, commands)
+		}
+	}
+	for _, want := range []string{
+		"To: ops@example.org, pacs@example.org\r\n",
+		"Subject: =?UTF-8?b?",
+		"Content-Type: text/plain; charset=UTF-8\r\n",
+		"Kural: pacs_down (destination_down)\r\n",
+		"Kaynak: order\r\n",
+	} {
+		if !strings.Contains(s.data, want) {
+			t.Errorf("e-postada %q yok:\n%s", want, s.data)
+		}
+	}
+}
+
+func TestEmailNotifierRequiresStartTLS(t *testing.T) {
+	port, session := startSMTP(t)
+	n := &emailNotifier{timeout: 5 * time.Second, cfg: config.SMTPConfig{
+		Host: "127.0.0.1", Port: port, TLS: "starttls", From: "hl7@example.org", To: "ops@example.org",
+	}}
+	err := n.Notify(context.Background(), testNotification(StatusFiring))
+	if err == nil || !strings.Contains(err.Error(), "STARTTLS") {
+		t.Fatalf("STARTTLS desteklemeyen sunucuya gönderildi: %v", err)
+	}
+	s := <-session
+	for _, cmd := range s.commands {
+		if strings.HasPrefix(cmd, "MAIL") {
+			t.Errorf("şifresiz bağlantıda mesaj gönderildi: %v", s.commands)
+		}
+	}
+}
+
+func TestEmailNotifierConnectionError(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	n := &emailNotifier{timeout: time.Second, cfg: config.SMTPConfig{Host: "127.0.0.1", Port: port, TLS: "none"}}
+	if err := n.Notify(context.Background(), testNotification(StatusFiring)); err == nil {
+		t.Fatal("kapalı porta bağlanılmış görünüyor")
+	}
+}
+
+// request is what the HTTP stub received
+type request struct {
+	header http.Header
+	body   map[string]any
+}
+
+func startHTTP(t *testing.T, status int) (url string, requests chan request) {
+	t.Helper()
+	requests = make(chan request, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("gövde JSON değil: %v", err)
+		}
+		requests <- request{header: r.Header.Clone(), body: body}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL, requests
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	url, requests := startHTTP(t, http.StatusAccepted)
+	n := NewNotifiers(config.AlertConfig{Timeout: 5 * time.Second, WebhookURL: url, WebhookToken: "token"})[ChannelWebhook]
+	if err := n.Notify(context.Background(), testNotification(StatusResolved)); err != nil {
+		t.Fatalf("Notify: %v", err)
+	}
+
+	req := <-requests
+	if v := req.header.Get("Authorization"); v != "Bearer token" {
+		t.Errorf("Authorization %q", v)
+	}
+	if v := req.header.Get("Content-Type"); v != "application/json" {
+		t.Errorf("Content-Type %q", v)
+	}
+	for key, want := range map[string]any{
+		"status":  StatusResolved,
+		"rule":    "pacs_down",
+		"subject": "order",
+		"value":   float64(3),
+		"ends_at": "2024-01-01T09:00:00Z",
+	} {
+		if got := req.body[key]; got != want {
+			t.Errorf("%s = %v, beklenen %v", key, got, want)
+		}
+	}
+}
+
+func TestSlackNotifier(t *testing.T) {
+	url, requests := startHTTP(t, http.StatusOK)
+	n := NewNotifiers(config.AlertConfig{Timeout: 5 * time.Second, SlackWebhookURL: url})[ChannelSlack]
+	if err := n.Notify(context.Background(), testNotification(StatusFiring)); err != nil {
+		t.Fatalf("Notify: %v", err)
+	}
+
+	req := <-requests
+	if v := req.header.Get("Authorization"); v != "" {
+		t.Errorf("Slack isteğinde Authorization var: %q", v)
+	}
+	text, _ := req.body["text"].(string)
+	if !strings.HasPrefix(text, "*[CRITICAL] ZenPACS hedefine erişilemiyor*\n") || !strings.Contains(text, "Kural: pacs_down") {
+		t.Errorf("Slack metni hatalı: %q", text)
+	}
+}
+
+func TestTeamsNotifier(t *testing.T) {
+	url, requests := startHTTP(t, http.StatusOK)
+	n := NewNotifiers(config.AlertConfig{Timeout: 5 * time.Second, TeamsWebhookURL: url})[ChannelTeams]
+
+	for status, color := range map[string]string{StatusFiring: "D70000", StatusResolved: "2EB886"} {
+		if err := n.Notify(context.Background(), testNotification(status)); err != nil {
+			t.Fatalf("Notify: %v", err)
+		}
+		req := <-requests
+		if req.body["@type"] != "MessageCard" || req.body["themeColor"] != color {
+			t.Errorf("%s kartı hatalı: %v", status, req.body)
+		}
+		if text, _ := req.body["text"].(string); !strings.Contains(text, "<br>") || strings.Contains(text, "\n") {
+			t.Errorf("%s kartında satırlar <br> değil: %q", status, text)
+		}
+	}
+}
+
+func TestPostJSONRejectsErrorStatus(t *testing.T) {
+	url, requests := startHTTP(t, http.StatusInternalServerError)
+	err := postJSON(context.Background(), http.DefaultClient, url, "", map[string]string{"text": "x"})
+	<-requests
+	if err == nil || err.Error() != "HTTP "+strconv.Itoa(http.StatusInternalServerError) {
+		t.Fatalf("HTTP 500 hata döndürmedi: %v", err)
+	}
+}
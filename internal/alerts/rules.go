@@ -0,0 +1,197 @@
+package alerts
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/minasoft/hl7-replicator/internal/schedule"
+	"gopkg.in/yaml.v3"
+)
+
+// Rule types
+const (
+	RuleDLQCount         = "dlq_count"         // DLQ holds more than Threshold messages
+	RuleNoTraffic        = "no_traffic"        // nothing received on a route for Window
+	RuleDestinationDown  = "destination_down"  // heartbeat of a destination reports it down
+	RuleDeliveryFailures = "delivery_failures" // more than Threshold failed deliveries within Window
+	RuleStreamLag        = "stream_lag"        // a consumer has more than Threshold messages waiting
+	RuleSilentSender     = "silent_sender"     // an expected sender stayed silent longer than its interval
+)
+
+// Severities
+const (
+	SeverityInfo     = "info"
+	SeverityWarning  = "warning"
+	SeverityCritical = "critical"
+)
+
+// Rule sources
+const (
+	SourceFile = "file"
+	SourceAPI  = "api"
+)
+
+var ruleName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+
+// Rule is an alert rule, read from ALERT_RULES_FILE or saved through the
+// web API. Durations are strings such as "15m".
+type Rule struct {
+	Name        string             `json:"name" yaml:"name"`
+	Type        string             `json:"type" yaml:"type"`
+	Description string             `json:"description,omitempty" yaml:"description"`
+	Severity    string             `json:"severity,omitempty" yaml:"severity"`       // info, warning (default) or critical
+	Route       string             `json:"route,omitempty" yaml:"route"`             // order or report; empty means both
+	Destination string             `json:"destination,omitempty" yaml:"destination"` // destination_down: route or managed destination name; empty means all
+	Sender      string             `json:"sender,omitempty" yaml:"sender"`           // silent_sender: sender of a traffic expectation; empty means all
+	Threshold   int                `json:"threshold,omitempty" yaml:"threshold"`
+	Window      string             `json:"window,omitempty" yaml:"window"`           // no_traffic, delivery_failures
+	For         string             `json:"for,omitempty" yaml:"for"`                 // condition must hold this long before the alert fires
+	Schedule    *schedule.Schedule `json:"schedule,omitempty" yaml:"schedule"`       // the rule is evaluated only within the schedule
+	QuietHours  string             `json:"quiet_hours,omitempty" yaml:"quiet_hours"` // overrides ALERT_QUIET_HOURS
+	Repeat      string             `json:"repeat,omitempty" yaml:"repeat"`           // overrides ALERT_REPEAT_INTERVAL
+	Channels    []string           `json:"channels,omitempty" yaml:"channels"`       // empty means every configured channel
+	Disabled    bool               `json:"disabled,omitempty" yaml:"disabled"`
+	Source      string             `json:"source" yaml:"-"`
+
+	window time.Duration
+	hold   time.Duration
+	repeat *time.Duration
+	quiet  *schedule.Schedule
+}
+
+// Validate checks the rule and parses its durations and schedules
+func (r *Rule) Validate() error {
+	if r.Severity == "" {
+		r.Severity = SeverityWarning
+	}
+
+	var errs []error
+	fail := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	if !ruleName.MatchString(r.Name) {
+		fail("geçersiz kural adı: %q (küçük harf, rakam, - ve _)", r.Name)
+	}
+	switch r.Severity {
+	case SeverityInfo, SeverityWarning, SeverityCritical:
+	default:
+		fail("geçersiz severity: %q (info, warning veya critical)", r.Severity)
+	}
+	if r.Route != "" && r.Route != "order" && r.Route != "report" {
+		fail("geçersiz yön: %q (order veya report)", r.Route)
+	}
+
+	duration := func(name, value string, required bool) time.Duration {
+		if value == "" {
+			if required {
+				fail("%s kuralı için %s gerekli", r.Type, name)
+			}
+			return 0
+		}
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			fail("geçersiz %s: %q", name, value)
+		}
+		return d
+	}
+
+	switch r.Type {
+	case RuleDLQCount, RuleStreamLag:
+		if r.Threshold < 0 {
+			fail("threshold negatif olamaz")
+		}
+	case RuleNoTraffic:
+		r.window = duration("window", r.Window, true)
+	case RuleDeliveryFailures:
+		if r.Threshold < 0 {
+			fail("threshold negatif olamaz")
+		}
+		r.window = duration("window", r.Window, true)
+	case RuleDestinationDown, RuleSilentSender:
+	default:
+		fail("bilinmeyen kural tipi: %q", r.Type)
+	}
+
+	r.hold = duration("for", r.For, false)
+	r.repeat = nil
+	if r.Repeat != "" {
+		d, err := time.ParseDuration(r.Repeat)
+		if err != nil || d < 0 {
+			fail("geçersiz repeat: %q", r.Repeat)
+		}
+		r.repeat = &d
+	}
+	if r.Schedule != nil {
+		if err := r.Schedule.Parse(); err != nil {
+			fail("geçersiz schedule: %v", err)
+		}
+	}
+	r.quiet = nil
+	if r.QuietHours != "" {
+		quiet := &schedule.Schedule{Hours: r.QuietHours}
+		if err := quiet.Parse(); err != nil {
+			fail("geçersiz quiet_hours: %v", err)
+		}
+		r.quiet = quiet
+	}
+	for _, ch := range r.Channels {
+		if !contains(Channels, ch) {
+			fail("bilinmeyen kanal: %q (%s)", ch, strings.Join(Channels, ", "))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// rulesFile is the layout of ALERT_RULES_FILE
+type rulesFile struct {
+	Rules []*Rule `yaml:"rules"`
+}
+
+// LoadRules reads and validates the rules of a YAML file
+func LoadRules(path string) ([]*Rule, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("alarm kuralları okunamadı: %w", err)
+	}
+
+	var file rulesFile
+	dec := yaml.NewDecoder(strings.NewReader(string(data)))
+	dec.KnownFields(true)
+	if err := dec.Decode(&file); err != nil {
+		return nil, fmt.Errorf("%s geçersiz: %w", path, err)
+	}
+
+	var errs []error
+	seen := make(map[string]bool)
+	for i, r := range file.Rules {
+		r.Source = SourceFile
+		if err := r.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: kural %d (%s): %w", path, i+1, r.Name, err))
+		}
+		if seen[r.Name] {
+			errs = append(errs, fmt.Errorf("%s: %s kuralı birden fazla kez tanımlanmış", path, r.Name))
+		}
+		seen[r.Name] = true
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return file.Rules, nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
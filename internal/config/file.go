@@ -0,0 +1,105 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// readConfigFile reads a YAML config file into setting keys. Nested maps
+// are joined with "_" and upper-cased, so
+//
+//	zenpacs:
+//	  hl7_host: pacs.example.org
+//
+// sets ZENPACS_HL7_HOST. Lists become comma separated values.
+func readConfigFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("yapılandırma dosyası okunamadı: %w", err)
+	}
+
+	var root map[string]any
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, fmt.Errorf("%s geçersiz YAML: %w", path, err)
+	}
+
+	values := make(map[string]string)
+	if err := flatten(values, "", root); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return values, nil
+}
+
+func flatten(values map[string]string, prefix string, node map[string]any) error {
+	keys := make([]string, 0, len(node))
+	for key := range node {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		name := strings.ToUpper(strings.ReplaceAll(key, "-", "_"))
+		if prefix != "" {
+			name = prefix + "_" + name
+		}
+
+		switch value := node[key].(type) {
+		case map[string]any:
+			if err := flatten(values, name, value); err != nil {
+				return err
+			}
+			continue
+		case []any:
+			items := make([]string, len(value))
+			for i, item := range value {
+				s, err := scalar(name, item)
+				if err != nil {
+					return err
+				}
+				items[i] = s
+			}
+			if err := set(values, name, strings.Join(items, ",")); err != nil {
+				return err
+			}
+		default:
+			s, err := scalar(name, value)
+			if err != nil {
+				return err
+			}
+			if err := set(values, name, s); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func set(values map[string]string, name, value string) error {
+	if _, ok := values[name]; ok {
+		return fmt.Errorf("%s birden fazla kez tanımlanmış", name)
+	}
+	values[name] = value
+	return nil
+}
+
+func scalar(name string, value any) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case int:
+		return strconv.Itoa(v), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	default:
+		return "", fmt.Errorf("%s desteklenmeyen değer: %v", name, value)
+	}
+}
@@ -0,0 +1,201 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// minHashSalt is the minimum length of PHI_HASH_SALT in hash mode
+const minHashSalt = 16
+
+// Validate checks the values that no component validates on its own. All
+// problems are reported at once so a broken configuration is fixed in one go.
+func (c *Config) Validate() error {
+	var errs []error
+	fail := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	listen := []struct {
+		name string
+		port int
+	}{
+		{"ORDER_LISTEN_PORT", c.OrderListenPort},
+		{"REPORT_LISTEN_PORT", c.ReportListenPort},
+		{"WEB_PORT", c.WebPort},
+	}
+	used := make(map[int]string)
+	for _, l := range listen {
+		if l.port < 1 || l.port > 65535 {
+			fail("%s geçersiz port: %d", l.name, l.port)
+			continue
+		}
+		if other, ok := used[l.port]; ok {
+			fail("%s ve %s aynı olamaz", other, l.name)
+		}
+		used[l.port] = l.name
+	}
+
+	destinations := []struct {
+		prefix   string
+		typ      string
+		hostKey  string
+		host     string
+		portKey  string
+		port     int
+		mllp     MLLPConfig
+		pool     PoolConfig
+		hb       HeartbeatConfig
+		batch    int
+		outDir   string
+		remote   string
+		webhook  string
+		fhirBase string
+	}{
+		{"ZENPACS", c.ZenPACSDestinationType, "ZENPACS_HL7_HOST", c.ZenPACSHost, "ZENPACS_HL7_PORT", c.ZenPACSPort,
+			c.ZenPACSMLLP, c.ZenPACSPool, c.ZenPACSHeartbeat, c.ZenPACSBatchSize, c.ZenPACSOutputDir, c.ZenPACSRemoteURL,
+			c.ZenPACSWebhook.URL, c.ZenPACSFHIR.BaseURL},
+		{"HOSPITAL_HIS", c.HospitalHISDestinationType, "HOSPITAL_HIS_HOST", c.HospitalHISHost, "HOSPITAL_HIS_PORT", c.HospitalHISPort,
+			c.HospitalHISMLLP, c.HospitalHISPool, c.HospitalHISHeartbeat, c.HospitalHISBatchSize, c.HospitalHISOutputDir, c.HospitalHISRemoteURL,
+			c.HospitalHISWebhook.URL, c.HospitalHISFHIR.BaseURL},
+	}
+	for _, d := range destinations {
+		switch d.typ {
+		case "", "mllp":
+			if d.host == "" {
+				fail("%s gerekli", d.hostKey)
+			}
+			if d.port < 1 || d.port > 65535 {
+				fail("%s geçersiz port: %d", d.portKey, d.port)
+			}
+		case "file":
+			if d.outDir == "" {
+				fail("%s_OUTPUT_DIR gerekli", d.prefix)
+			}
+		case "sftp", "ftp":
+			if d.remote == "" {
+				fail("%s_REMOTE_URL gerekli", d.prefix)
+			}
+		case "webhook":
+			if d.webhook == "" {
+				fail("%s_WEBHOOK_URL gerekli", d.prefix)
+			}
+		case "fhir":
+			if d.fhirBase == "" {
+				fail("%s_FHIR_BASE_URL gerekli", d.prefix)
+			}
+		case "none":
+			// Delivered only by destinations managed through the web API
+		default:
+			fail("%s_DESTINATION_TYPE geçersiz: %s", d.prefix, d.typ)
+		}
+
+		switch d.mllp.Mode {
+		case "", "persistent", "per_message":
+		default:
+			fail("%s_MLLP_MODE geçersiz: %s", d.prefix, d.mllp.Mode)
+		}
+		switch strings.ToLower(d.mllp.SegmentTerminator) {
+		case "", "cr", "crlf":
+		default:
+			fail("%s_MLLP_SEGMENT_TERMINATOR geçersiz: %s", d.prefix, d.mllp.SegmentTerminator)
+		}
+		if d.pool.MaxConns < 0 || d.pool.MaxIdle < 0 {
+			fail("%s_POOL_* değerleri negatif olamaz", d.prefix)
+		}
+		switch d.hb.Mode {
+		case "", "off":
+		case "tcp", "hl7":
+			if d.hb.Mode == "hl7" && d.typ != "" && d.typ != "mllp" {
+				fail("%s_HEARTBEAT_MODE=hl7 yalnızca mllp hedefinde kullanılabilir", d.prefix)
+			}
+			if d.typ == "file" || d.typ == "none" {
+				fail("%s_HEARTBEAT_MODE %s hedefinde kullanılamaz", d.prefix, d.typ)
+			}
+			positive(fail, d.prefix+"_HEARTBEAT_INTERVAL", d.hb.Interval)
+			positive(fail, d.prefix+"_HEARTBEAT_TIMEOUT", d.hb.Timeout)
+			if d.hb.Failures < 1 {
+				fail("%s_HEARTBEAT_FAILURES en az 1 olmalı", d.prefix)
+			}
+		default:
+			fail("%s_HEARTBEAT_MODE geçersiz: %s", d.prefix, d.hb.Mode)
+		}
+		if d.batch < 0 {
+			fail("%s_BATCH_SIZE negatif olamaz", d.prefix)
+		}
+		if d.mllp.ConnectTimeout < 0 || d.mllp.WriteTimeout < 0 || d.mllp.AckTimeout < 0 {
+			fail("%s_MLLP_* zaman aşımları negatif olamaz", d.prefix)
+		}
+	}
+
+	choices := []struct {
+		name    string
+		value   string
+		allowed []string
+	}{
+		{"ORDER_VALIDATION_MODE", c.OrderValidationMode, []string{"", "off", "warn", "reject"}},
+		{"REPORT_VALIDATION_MODE", c.ReportValidationMode, []string{"", "off", "warn", "reject"}},
+		{"PHI_MASK_MODE", strings.ToLower(c.PHIMaskMode), []string{"", "off", "redact", "hash"}},
+		{"LOG_LEVEL", c.LogLevel, []string{"debug", "info", "warn", "error"}},
+		{"STORE_ENCRYPTION_CIPHER", c.StoreEncryptionCipher, []string{"", "chacha", "chachapoly", "aes"}},
+	}
+	for _, ch := range choices {
+		if !contains(ch.allowed, ch.value) {
+			fail("%s geçersiz: %s", ch.name, ch.value)
+		}
+	}
+
+	// Without a secret salt hashed identifiers can be brute-forced
+	if strings.EqualFold(c.PHIMaskMode, "hash") && len(c.PHIHashSalt) < minHashSalt {
+		fail("PHI_MASK_MODE=hash için en az %d karakterlik PHI_HASH_SALT gerekli", minHashSalt)
+	}
+
+	if c.MLLPMaxMessageSize < 1 {
+		fail("MLLP_MAX_MESSAGE_SIZE en az 1 olmalı")
+	}
+	if c.MLLPMaxConnections < 0 || c.MLLPMaxConnsPerIP < 0 {
+		fail("MLLP bağlantı limitleri negatif olamaz")
+	}
+	positive(fail, "MLLP_IDLE_TIMEOUT", c.MLLPIdleTimeout)
+	positive(fail, "MLLP_READ_TIMEOUT", c.MLLPReadTimeout)
+	positive(fail, "SHUTDOWN_TIMEOUT", c.ShutdownTimeout)
+	positive(fail, "INPUT_POLL_INTERVAL", c.InputPollInterval)
+	positive(fail, "ALERT_EVAL_INTERVAL", c.Alerts.EvalInterval)
+	positive(fail, "ALERT_TIMEOUT", c.Alerts.Timeout)
+	if c.Alerts.RepeatInterval < 0 {
+		fail("ALERT_REPEAT_INTERVAL negatif olamaz")
+	}
+	if smtp := c.Alerts.SMTP; smtp.Host != "" {
+		if smtp.Port < 1 || smtp.Port > 65535 {
+			fail("ALERT_SMTP_PORT geçersiz port: %d", smtp.Port)
+		}
+		if !contains([]string{"starttls", "tls", "none"}, smtp.TLS) {
+			fail("ALERT_SMTP_TLS geçersiz: %s", smtp.TLS)
+		}
+		if smtp.From == "" || smtp.To == "" {
+			fail("ALERT_SMTP_FROM ve ALERT_SMTP_TO gerekli")
+		}
+	}
+	if c.ConfigWatchInterval < 0 {
+		fail("CONFIG_WATCH_INTERVAL negatif olamaz")
+	}
+
+	return errors.Join(errs...)
+}
+
+func positive(fail func(string, ...any), name string, d time.Duration) {
+	if d <= 0 {
+		fail("%s pozitif olmalı", name)
+	}
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
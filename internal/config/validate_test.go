@@ -0,0 +1,125 @@
+package config
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// validConfig reads the defaults with both MLLP destinations set
+func validConfig(t *testing.T) *Config {
+	t.Helper()
+	t.Setenv("ENV_FILE", filepath.Join(t.TempDir(), ".env"))
+	t.Setenv("CONFIG_FILE", "")
+	t.Setenv("ZENPACS_HL7_HOST", "zenpacs.example.org")
+	t.Setenv("ZENPACS_HL7_PORT", "2575")
+	t.Setenv("HOSPITAL_HIS_HOST", "his.example.org")
+	t.Setenv("HOSPITAL_HIS_PORT", "7200")
+
+	cfg, err := Reload()
+	if err != nil {
+		t.Fatalf("varsayılan yapılandırma geçersiz: %v", err)
+	}
+	return cfg
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(c *Config)
+		want   string // part of the error, empty when valid
+	}{
+		{"defaults", func(c *Config) {}, ""},
+		{"port out of range", func(c *Config) { c.WebPort = 70000 }, "WEB_PORT geçersiz port"},
+		{"port used twice", func(c *Config) { c.ReportListenPort = c.OrderListenPort }, "ORDER_LISTEN_PORT ve REPORT_LISTEN_PORT aynı olamaz"},
+		{"missing MLLP host", func(c *Config) { c.ZenPACSHost = "" }, "ZENPACS_HL7_HOST gerekli"},
+		{"missing MLLP port", func(c *Config) { c.HospitalHISPort = 0 }, "HOSPITAL_HIS_PORT geçersiz port"},
+		{"file destination", func(c *Config) { c.ZenPACSDestinationType, c.ZenPACSHost, c.ZenPACSOutputDir = "file", "", "/out" }, ""},
+		{"file destination without directory", func(c *Config) { c.ZenPACSDestinationType = "file" }, "ZENPACS_OUTPUT_DIR gerekli"},
+		{"sftp without URL", func(c *Config) { c.HospitalHISDestinationType = "sftp" }, "HOSPITAL_HIS_REMOTE_URL gerekli"},
+		{"webhook without URL", func(c *Config) { c.ZenPACSDestinationType = "webhook" }, "ZENPACS_WEBHOOK_URL gerekli"},
+		{"fhir without base URL", func(c *Config) { c.ZenPACSDestinationType = "fhir" }, "ZENPACS_FHIR_BASE_URL gerekli"},
+		{"no destination", func(c *Config) { c.ZenPACSDestinationType, c.ZenPACSHost = "none", "" }, ""},
+		{"unknown destination type", func(c *Config) { c.ZenPACSDestinationType = "smtp" }, "ZENPACS_DESTINATION_TYPE geçersiz"},
+		{"unknown MLLP mode", func(c *Config) { c.ZenPACSMLLP.Mode = "pooled" }, "ZENPACS_MLLP_MODE geçersiz"},
+		{"segment terminator", func(c *Config) { c.ZenPACSMLLP.SegmentTerminator = "CRLF" }, ""},
+		{"unknown segment terminator", func(c *Config) { c.ZenPACSMLLP.SegmentTerminator = "lf" }, "ZENPACS_MLLP_SEGMENT_TERMINATOR geçersiz"},
+		{"negative pool size", func(c *Config) { c.HospitalHISPool.MaxConns = -1 }, "HOSPITAL_HIS_POOL_* değerleri negatif olamaz"},
+		{"negative timeout", func(c *Config) { c.ZenPACSMLLP.AckTimeout = -time.Second }, "ZENPACS_MLLP_* zaman aşımları negatif olamaz"},
+		{"negative batch size", func(c *Config) { c.ZenPACSBatchSize = -1 }, "ZENPACS_BATCH_SIZE negatif olamaz"},
+		{"heartbeat", func(c *Config) {
+			c.ZenPACSHeartbeat = HeartbeatConfig{Mode: "hl7", Interval: time.Minute, Timeout: time.Second, Failures: 3}
+		}, ""},
+		{"heartbeat without interval", func(c *Config) {
+			c.ZenPACSHeartbeat = HeartbeatConfig{Mode: "tcp", Timeout: time.Second, Failures: 3}
+		}, "ZENPACS_HEARTBEAT_INTERVAL pozitif olmalı"},
+		{"hl7 heartbeat on webhook", func(c *Config) {
+			c.ZenPACSDestinationType, c.ZenPACSWebhook.URL = "webhook", "https://example.org/hl7"
+			c.ZenPACSHeartbeat = HeartbeatConfig{Mode: "hl7", Interval: time.Minute, Timeout: time.Second, Failures: 3}
+		}, "ZENPACS_HEARTBEAT_MODE=hl7 yalnızca mllp hedefinde kullanılabilir"},
+		{"heartbeat on file destination", func(c *Config) {
+			c.ZenPACSDestinationType, c.ZenPACSOutputDir = "file", "/out"
+			c.ZenPACSHeartbeat = HeartbeatConfig{Mode: "tcp", Interval: time.Minute, Timeout: time.Second, Failures: 3}
+		}, "ZENPACS_HEARTBEAT_MODE file hedefinde kullanılamaz"},
+		{"unknown validation mode", func(c *Config) { c.OrderValidationMode = "strict" }, "ORDER_VALIDATION_MODE geçersiz"},
+		{"unknown log level", func(c *Config) { c.LogLevel = "trace" }, "LOG_LEVEL geçersiz"},
+		{"unknown cipher", func(c *Config) { c.StoreEncryptionCipher = "des" }, "STORE_ENCRYPTION_CIPHER geçersiz"},
+		{"redact mode", func(c *Config) { c.PHIMaskMode = "Redact" }, ""},
+		{"hash mode without salt", func(c *Config) { c.PHIMaskMode = "hash" }, "PHI_HASH_SALT gerekli"},
+		{"hash mode with short salt", func(c *Config) { c.PHIMaskMode, c.PHIHashSalt = "hash", "short" }, "PHI_HASH_SALT gerekli"},
+		{"hash mode with salt", func(c *Config) { c.PHIMaskMode, c.PHIHashSalt = "HASH", "0123456789abcdef" }, ""},
+		{"no message size", func(c *Config) { c.MLLPMaxMessageSize = 0 }, "MLLP_MAX_MESSAGE_SIZE en az 1 olmalı"},
+		{"negative connection limit", func(c *Config) { c.MLLPMaxConnsPerIP = -1 }, "MLLP bağlantı limitleri negatif olamaz"},
+		{"zero read timeout", func(c *Config) { c.MLLPReadTimeout = 0 }, "MLLP_READ_TIMEOUT pozitif olmalı"},
+		{"negative repeat interval", func(c *Config) { c.Alerts.RepeatInterval = -time.Minute }, "ALERT_REPEAT_INTERVAL negatif olamaz"},
+		{"SMTP", func(c *Config) {
+			c.Alerts.SMTP = SMTPConfig{Host: "smtp.example.org", Port: 587, TLS: "starttls", From: "hl7@example.org", To: "ops@example.org"}
+		}, ""},
+		{"SMTP without recipients", func(c *Config) {
+			c.Alerts.SMTP = SMTPConfig{Host: "smtp.example.org", Port: 587, TLS: "starttls", From: "hl7@example.org"}
+		}, "ALERT_SMTP_FROM ve ALERT_SMTP_TO gerekli"},
+		{"unknown SMTP TLS", func(c *Config) {
+			c.Alerts.SMTP = SMTPConfig{Host: "smtp.example.org", Port: 25, TLS: "ssl", From: "hl7@example.org", To: "ops@example.org"}
+		}, "ALERT_SMTP_TLS geçersiz"},
+		{"negative watch interval", func(c *Config) { c.ConfigWatchInterval = -time.Second }, "CONFIG_WATCH_INTERVAL negatif olamaz"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := validConfig(t)
+			tt.change(c)
+			err := c.Validate()
+			switch {
+			case tt.want == "" && err != nil:
+				t.Errorf("geçerli yapılandırma reddedildi: %v", err)
+			case tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)):
+				t.Errorf("hata %v, beklenen %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateReportsAllErrors(t *testing.T) {
+	c := validConfig(t)
+	c.ZenPACSHost = ""
+	c.LogLevel = "trace"
+	c.PHIMaskMode = "hash"
+
+	err := c.Validate()
+	if err == nil {
+		t.Fatal("geçersiz yapılandırma kabul edildi")
+	}
+	for _, want := range []string{"ZENPACS_HL7_HOST", "LOG_LEVEL", "PHI_HASH_SALT"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("%s hatası raporlanmadı: %v", want, err)
+		}
+	}
+}
+
+func TestReloadRejectsMissingDestination(t *testing.T) {
+	validConfig(t)
+	t.Setenv("ZENPACS_HL7_HOST", "")
+	if _, err := Reload(); err == nil || !strings.Contains(err.Error(), "ZENPACS_HL7_HOST gerekli") {
+		t.Errorf("ZenPACS adresi olmadan yapılandırma yüklendi: %v", err)
+	}
+}
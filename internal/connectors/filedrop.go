@@ -0,0 +1,266 @@
+package connectors
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/minasoft/hl7-replicator/internal/db"
+	"github.com/minasoft/hl7-replicator/internal/hl7"
+)
+
+const (
+	processedDir = "processed"
+	errorDir     = "error"
+)
+
+// fileExtensions lists the extensions picked up by the file watcher
+var fileExtensions = []string{".hl7", ".txt", ".msg", ".dat"}
+
+// FileWatcher polls a directory for HL7 files, publishes their messages
+// through the route's receiver and moves each file to processed/ or error/
+type FileWatcher struct {
+	dir      string
+	interval time.Duration
+	receiver *hl7.Receiver
+}
+
+func NewFileWatcher(dir string, interval time.Duration, receiver *hl7.Receiver) *FileWatcher {
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	return &FileWatcher{
+		dir:      dir,
+		interval: interval,
+		receiver: receiver,
+	}
+}
+
+// PrepareInputDir creates dir with its processed/ and error/ directories
+func PrepareInputDir(dir string) error {
+	for _, sub := range []string{"", processedDir, errorDir} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			return fmt.Errorf("dizin oluşturulamadı %s: %w", filepath.Join(dir, sub), err)
+		}
+	}
+	return nil
+}
+
+func (w *FileWatcher) Start(ctx context.Context) error {
+	if err := PrepareInputDir(w.dir); err != nil {
+		return err
+	}
+
+	slog.Info("Dosya girişi başlatıldı",
+		"dir", w.dir,
+		"direction", w.receiver.Direction(),
+		"interval", w.interval)
+
+	go func() {
+		ticker := time.NewTicker(w.interval)
+		defer ticker.Stop()
+
+		for {
+			w.scan()
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (w *FileWatcher) scan() {
+	entries, err := os.ReadDir(w.dir)
+	if err != nil {
+		slog.Error("Giriş dizini okunamadı", "dir", w.dir, "error", err)
+		return
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || !hasHL7Extension(entry.Name()) {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		// Skip files that may still be written
+		if time.Since(info.ModTime()) < 2*time.Second {
+			continue
+		}
+
+		w.processFile(filepath.Join(w.dir, entry.Name()))
+	}
+}
+
+func (w *FileWatcher) processFile(path string) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		slog.Error("Dosya okunamadı", "file", path, "error", err)
+		return
+	}
+
+	errs := ReceiveFile(w.receiver, data, path)
+	if retryable(errs) {
+		// Leave the file for the next scan; messages already enqueued are
+		// dropped as duplicates then
+		slog.Warn("Dosya kuyruğa eklenemedi, tekrar denenecek", "file", path, "error", errors.Join(errs...))
+		return
+	}
+	if len(errs) > 0 {
+		w.moveTo(path, errorDir)
+		report := errors.Join(errs...).Error() + "\n"
+		os.WriteFile(filepath.Join(w.dir, errorDir, filepath.Base(path)+".err"), []byte(report), 0644)
+		slog.Warn("Dosya hatalı mesaj içeriyor", "file", path, "errors", len(errs))
+		return
+	}
+
+	w.moveTo(path, processedDir)
+}
+
+// moveTo moves a file into a subdirectory, adding a timestamp when a file
+// with the same name was processed before
+func (w *FileWatcher) moveTo(path, sub string) {
+	target := filepath.Join(w.dir, sub, filepath.Base(path))
+	if _, err := os.Stat(target); err == nil {
+		target = fmt.Sprintf("%s.%d", target, time.Now().UnixNano())
+	}
+	if err := os.Rename(path, target); err != nil {
+		slog.Error("Dosya taşınamadı", "file", path, "target", target, "error", err)
+	}
+}
+
+// retryable reports whether a file failed only because messages could not be
+// enqueued; parse and validation errors would fail again
+func retryable(errs []error) bool {
+	for _, err := range errs {
+		var enqueueErr *hl7.EnqueueError
+		if errors.As(err, &enqueueErr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ReceiveFile publishes every message of a file (single message, several
+// consecutive messages or a FHS/BHS batch) and returns the per-message errors.
+// Messages are published with IDs derived from the name and content, so
+// receiving the same file again shortly after enqueues nothing twice.
+func ReceiveFile(receiver *hl7.Receiver, data []byte, name string) []error {
+	data = hl7.NormalizeSegments(data)
+	sum := sha256.Sum256(data)
+	fileID := fmt.Sprintf("file-%s-%x", name, sum[:8])
+
+	src := hl7.Source{Addr: name}
+	var messages [][]byte
+	if hl7.IsBatch(data) {
+		batch, err := hl7.ParseBatch(data)
+		if err != nil {
+			return []error{err}
+		}
+		messages = batch.Messages
+		src.BatchID = fmt.Sprintf("file-%d", time.Now().UnixNano())
+	} else {
+		messages = hl7.SplitMessages(data)
+	}
+
+	if len(messages) == 0 {
+		return []error{fmt.Errorf("dosyada HL7 mesajı bulunamadı")}
+	}
+
+	var errs []error
+	for i, message := range messages {
+		src.MsgID = fmt.Sprintf("%s-%d", fileID, i+1)
+		if _, err := receiver.Receive(message, src); err != nil {
+			errs = append(errs, fmt.Errorf("mesaj %d: %w", i+1, err))
+		}
+	}
+	return errs
+}
+
+func hasHL7Extension(name string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	for _, e := range fileExtensions {
+		if ext == e {
+			return true
+		}
+	}
+	return false
+}
+
+// FileWriter is a destination writing each forwarded message to a file
+type FileWriter struct {
+	dir      string
+	template string
+}
+
+// DefaultFileNameTemplate names output files after route, time and control ID
+const DefaultFileNameTemplate = "{direction}_{timestamp}_{control_id}.hl7"
+
+// NewFileWriter creates a file destination; the template may use {id},
+// {direction}, {type}, {control_id}, {patient_id}, {date} and {timestamp}
+func NewFileWriter(dir, template string) *FileWriter {
+	if template == "" {
+		template = DefaultFileNameTemplate
+	}
+	return &FileWriter{dir: dir, template: template}
+}
+
+func (w *FileWriter) String() string {
+	return "file://" + w.dir
+}
+
+// Deliver writes the message atomically: a temporary file is renamed once
+// it is complete so that readers never see partial files
+func (w *FileWriter) Deliver(ctx context.Context, msg *db.HL7Message) ([]byte, error) {
+	if err := os.MkdirAll(w.dir, 0755); err != nil {
+		return nil, fmt.Errorf("çıkış dizini oluşturulamadı: %w", err)
+	}
+
+	name := w.fileName(msg)
+	target := filepath.Join(w.dir, name)
+	tmp := filepath.Join(w.dir, "."+name+".tmp")
+
+	if err := os.WriteFile(tmp, hl7.UnwrapMLLP(msg.RawMessage), 0644); err != nil {
+		return nil, fmt.Errorf("dosya yazılamadı: %w", err)
+	}
+	if err := os.Rename(tmp, target); err != nil {
+		os.Remove(tmp)
+		return nil, fmt.Errorf("dosya taşınamadı: %w", err)
+	}
+
+	slog.Debug("Mesaj dosyaya yazıldı", "file", target, "id", msg.ID)
+	return nil, nil
+}
+
+func (w *FileWriter) Close() error {
+	return nil
+}
+
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+func (w *FileWriter) fileName(msg *db.HL7Message) string {
+	now := time.Now()
+	r := strings.NewReplacer(
+		"{id}", msg.ID,
+		"{direction}", msg.Direction,
+		"{type}", msg.MessageType,
+		"{control_id}", msg.MessageControlID,
+		"{patient_id}", msg.PatientID,
+		"{date}", now.Format("20060102"),
+		"{timestamp}", now.Format("20060102150405.000"),
+	)
+	return unsafeFileChars.ReplaceAllString(r.Replace(w.template), "_")
+}
@@ -0,0 +1,216 @@
+package connectors
+
+import (
+	"context"
+	"net"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/minasoft/hl7-replicator/internal/hl7"
+	natsrv "github.com/minasoft/hl7-replicator/internal/nats"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/pkg/sftp"
+)
+
+const (
+	testORM1 = "MSH|^~\\&|HIS|H|ZP|Z|20240101||ORM^O01|C1|P|2.5\rPID|1||123\rORC|NW|1\rOBR|1|1||CT\r"
+	testORM2 = "MSH|^~\\&|HIS|H|ZP|Z|20240101||ORM^O01|C2|P|2.5\rPID|1||456\rORC|NW|2\rOBR|1|2||MR\r"
+)
+
+// newTestReceiver starts an embedded JetStream and returns an order receiver
+func newTestReceiver(t *testing.T) (*hl7.Receiver, jetstream.JetStream) {
+	t.Helper()
+	es, err := natsrv.NewEmbeddedServer(t.TempDir(), natsrv.EncryptionOptions{})
+	if err != nil {
+		t.Fatalf("NATS başlatılamadı: %v", err)
+	}
+	t.Cleanup(es.Shutdown)
+	return hl7.NewReceiver("order", es.JetStream(), nil, hl7.ReceiverOptions{}), es.JetStream()
+}
+
+// orderCount returns the number of messages in the order stream
+func orderCount(t *testing.T, js jetstream.JetStream) uint64 {
+	t.Helper()
+	stream, err := js.Stream(context.Background(), "HL7_ORDERS")
+	if err != nil {
+		t.Fatalf("stream açılamadı: %v", err)
+	}
+	info, err := stream.Info(context.Background())
+	if err != nil {
+		t.Fatalf("stream bilgisi alınamadı: %v", err)
+	}
+	return info.State.Msgs
+}
+
+// testSFTP serves an in-memory file system; every dial opens a new session
+// over a pipe, as a real poll opens a new connection
+type testSFTP struct {
+	t        *testing.T
+	handlers sftp.Handlers
+}
+
+func newTestSFTP(t *testing.T) *testSFTP {
+	return &testSFTP{t: t, handlers: sftp.InMemHandler()}
+}
+
+func (s *testSFTP) client() *sftp.Client {
+	s.t.Helper()
+	serverConn, clientConn := net.Pipe()
+	server := sftp.NewRequestServer(serverConn, s.handlers)
+	go server.Serve()
+	s.t.Cleanup(func() { server.Close() })
+
+	client, err := sftp.NewClientPipe(clientConn, clientConn)
+	if err != nil {
+		s.t.Fatalf("SFTP oturumu açılamadı: %v", err)
+	}
+	return client
+}
+
+func (s *testSFTP) dial(*RemoteConfig) (remoteFS, error) {
+	return &sftpFS{client: s.client()}, nil
+}
+
+func (s *testSFTP) put(name, data string, flags int) {
+	s.t.Helper()
+	client := s.client()
+	defer client.Close()
+	f, err := client.OpenFile(name, flags)
+	if err != nil {
+		s.t.Fatalf("%s açılamadı: %v", name, err)
+	}
+	if _, err := f.Write([]byte(data)); err != nil {
+		s.t.Fatalf("%s yazılamadı: %v", name, err)
+	}
+	f.Close()
+}
+
+func (s *testSFTP) exists(name string) bool {
+	client := s.client()
+	defer client.Close()
+	_, err := client.Stat(name)
+	return err == nil
+}
+
+func newTestPoller(t *testing.T, srv *testSFTP, receiver *hl7.Receiver, settle time.Duration) *RemotePoller {
+	t.Helper()
+	cfg, err := ParseRemoteURL("sftp://user@example.org/inbox?insecure=true&after=archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Settle = settle
+	p := NewRemotePoller(cfg, receiver)
+	p.dial = srv.dial
+	return p
+}
+
+func poll(t *testing.T, p *RemotePoller) {
+	t.Helper()
+	if err := p.Poll(); err != nil {
+		t.Fatalf("Poll: %v", err)
+	}
+}
+
+func TestRemotePollerImportsAndArchives(t *testing.T) {
+	receiver, js := newTestReceiver(t)
+	srv := newTestSFTP(t)
+	srv.client().Mkdir("/inbox")
+	srv.put("/inbox/a.hl7", testORM1+testORM2, os.O_WRONLY|os.O_CREATE)
+	srv.put("/inbox/notes.pdf", "not hl7", os.O_WRONLY|os.O_CREATE)
+	srv.put("/inbox/bad.hl7", "not hl7", os.O_WRONLY|os.O_CREATE)
+
+	p := newTestPoller(t, srv, receiver, 0)
+	poll(t, p)
+
+	if n := orderCount(t, js); n != 2 {
+		t.Fatalf("kuyrukta %d mesaj var, 2 bekleniyordu", n)
+	}
+	for name, want := range map[string]bool{
+		"/inbox/a.hl7":         false,
+		"/inbox/archive/a.hl7": true,
+		"/inbox/bad.hl7":       false,
+		"/inbox/error/bad.hl7": true,
+		"/inbox/notes.pdf":     true,
+	} {
+		if got := srv.exists(name); got != want {
+			t.Errorf("%s mevcut = %v, beklenen %v", name, got, want)
+		}
+	}
+}
+
+func TestRemotePollerWaitsForUploads(t *testing.T) {
+	receiver, js := newTestReceiver(t)
+	srv := newTestSFTP(t)
+	srv.client().Mkdir("/inbox")
+	srv.put("/inbox/a.hl7", testORM1, os.O_WRONLY|os.O_CREATE)
+
+	// SFTP reports modification times in whole seconds
+	settle := 2 * time.Second
+	p := newTestPoller(t, srv, receiver, settle)
+
+	// Modified within the settle window
+	poll(t, p)
+	if n := orderCount(t, js); n != 0 {
+		t.Fatalf("yeni değişen dosya içe alındı (%d mesaj)", n)
+	}
+
+	// Still growing although its modification time is old enough; the
+	// in-memory server keeps the creation time on writes
+	time.Sleep(settle)
+	srv.put("/inbox/a.hl7", testORM1+testORM2, os.O_WRONLY)
+	poll(t, p)
+	if n := orderCount(t, js); n != 0 {
+		t.Fatalf("büyüyen dosya içe alındı (%d mesaj)", n)
+	}
+
+	// Unchanged since the previous poll
+	poll(t, p)
+	if n := orderCount(t, js); n != 2 {
+		t.Fatalf("kuyrukta %d mesaj var, 2 bekleniyordu", n)
+	}
+	if !srv.exists("/inbox/archive/a.hl7") {
+		t.Error("dosya arşive taşınmadı")
+	}
+}
+
+func TestRemotePollerRetriesWhenEnqueueFails(t *testing.T) {
+	receiver, js := newTestReceiver(t)
+	srv := newTestSFTP(t)
+	srv.client().Mkdir("/inbox")
+	srv.put("/inbox/a.hl7", testORM1, os.O_WRONLY|os.O_CREATE)
+
+	ctx := context.Background()
+	stream, err := js.Stream(ctx, "HL7_ORDERS")
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := stream.Info(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := js.DeleteStream(ctx, "HL7_ORDERS"); err != nil {
+		t.Fatal(err)
+	}
+
+	p := newTestPoller(t, srv, receiver, 0)
+	poll(t, p)
+	if !srv.exists("/inbox/a.hl7") {
+		t.Fatal("kuyruğa eklenemeyen dosya yerinden taşındı")
+	}
+	if srv.exists(path.Join("/inbox", errorDir, "a.hl7")) {
+		t.Fatal("kuyruğa eklenemeyen dosya error dizinine taşındı")
+	}
+
+	if _, err := js.CreateStream(ctx, info.Config); err != nil {
+		t.Fatal(err)
+	}
+	poll(t, p)
+	if n := orderCount(t, js); n != 1 {
+		t.Fatalf("kuyrukta %d mesaj var, 1 bekleniyordu", n)
+	}
+	if !srv.exists("/inbox/archive/a.hl7") {
+		t.Error("dosya arşive taşınmadı")
+	}
+}
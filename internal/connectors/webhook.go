@@ -0,0 +1,213 @@
+package connectors
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/minasoft/hl7-replicator/internal/db"
+	"github.com/minasoft/hl7-replicator/internal/hl7"
+)
+
+// Webhook payload formats
+const (
+	WebhookFormatRaw  = "raw"
+	WebhookFormatJSON = "json"
+)
+
+// Webhook authentication types
+const (
+	WebhookAuthNone   = "none"
+	WebhookAuthBearer = "bearer"
+	WebhookAuthBasic  = "basic"
+	WebhookAuthHMAC   = "hmac"
+)
+
+// maxWebhookResponse limits the response body recorded as ACK
+const maxWebhookResponse = 1 << 20
+
+// WebhookOptions configures an HTTP webhook destination
+type WebhookOptions struct {
+	URL        string
+	Format     string            // WebhookFormatRaw or WebhookFormatJSON
+	Headers    map[string]string // extra request headers
+	Auth       string            // none, bearer, basic or hmac
+	Token      string            // bearer token
+	Username   string            // basic auth
+	Password   string
+	HMACSecret string // key of the X-HL7-Signature header
+	Timeout    time.Duration
+}
+
+// webhookPayload is the body sent in JSON format
+type webhookPayload struct {
+	ID               string    `json:"id"`
+	Direction        string    `json:"direction"`
+	MessageType      string    `json:"message_type"`
+	MessageControlID string    `json:"message_control_id"`
+	PatientID        string    `json:"patient_id"`
+	Timestamp        time.Time `json:"timestamp"`
+	Message          string    `json:"message"`
+}
+
+// Webhook is a destination POSTing each message to an HTTP endpoint. Any 2xx
+// status is a successful delivery; the response body is recorded as ACK.
+type Webhook struct {
+	opts   WebhookOptions
+	client *http.Client
+}
+
+func NewWebhook(opts WebhookOptions) (*Webhook, error) {
+	if opts.URL == "" {
+		return nil, fmt.Errorf("webhook hedefi için URL gerekli")
+	}
+	switch opts.Format {
+	case "":
+		opts.Format = WebhookFormatRaw
+	case WebhookFormatRaw, WebhookFormatJSON:
+	default:
+		return nil, fmt.Errorf("geçersiz webhook formatı: %s", opts.Format)
+	}
+	switch opts.Auth {
+	case "", WebhookAuthNone:
+		opts.Auth = WebhookAuthNone
+	case WebhookAuthBearer:
+		if opts.Token == "" {
+			return nil, fmt.Errorf("bearer kimlik doğrulaması için token gerekli")
+		}
+	case WebhookAuthBasic:
+		if opts.Username == "" {
+			return nil, fmt.Errorf("basic kimlik doğrulaması için kullanıcı adı gerekli")
+		}
+	case WebhookAuthHMAC:
+		if opts.HMACSecret == "" {
+			return nil, fmt.Errorf("HMAC imzası için secret gerekli")
+		}
+	default:
+		return nil, fmt.Errorf("geçersiz webhook kimlik doğrulama tipi: %s", opts.Auth)
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 30 * time.Second
+	}
+
+	return &Webhook{
+		opts:   opts,
+		client: &http.Client{Timeout: opts.Timeout},
+	}, nil
+}
+
+// ParseHeaders parses "Name=value,Name2=value2" into a header map
+func ParseHeaders(s string) (map[string]string, error) {
+	headers := make(map[string]string)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(item, "=")
+		if !ok || strings.TrimSpace(name) == "" {
+			return nil, fmt.Errorf("geçersiz header tanımı: %s", item)
+		}
+		headers[strings.TrimSpace(name)] = strings.TrimSpace(value)
+	}
+	return headers, nil
+}
+
+func (w *Webhook) String() string {
+	return w.opts.URL
+}
+
+func (w *Webhook) Deliver(ctx context.Context, msg *db.HL7Message) ([]byte, error) {
+	body, contentType, err := w.payload(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.opts.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("webhook isteği oluşturulamadı: %w", err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	// Lets the receiver drop duplicates caused by retries
+	req.Header.Set("X-Message-ID", msg.ID)
+	for name, value := range w.opts.Headers {
+		req.Header.Set(name, value)
+	}
+	w.authenticate(req, body)
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("webhook isteği başarısız: %w", err)
+	}
+	defer resp.Body.Close()
+
+	ack, _ := io.ReadAll(io.LimitReader(resp.Body, maxWebhookResponse))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return ack, fmt.Errorf("webhook HTTP %d döndü", resp.StatusCode)
+	}
+
+	// An HL7 ACK in the response body must be positive as well
+	for _, code := range hl7.ACKCodes(ack) {
+		if code != "AA" && code != "CA" {
+			return ack, fmt.Errorf("webhook negatif ACK döndü: %s", code)
+		}
+	}
+
+	slog.Debug("Mesaj webhook'a gönderildi", "url", w.opts.URL, "id", msg.ID, "status", resp.StatusCode)
+	return ack, nil
+}
+
+func (w *Webhook) payload(msg *db.HL7Message) ([]byte, string, error) {
+	raw := hl7.UnwrapMLLP(msg.RawMessage)
+	if w.opts.Format == WebhookFormatRaw {
+		return raw, "application/hl7-v2", nil
+	}
+
+	body, err := json.Marshal(webhookPayload{
+		ID:               msg.ID,
+		Direction:        msg.Direction,
+		MessageType:      msg.MessageType,
+		MessageControlID: msg.MessageControlID,
+		PatientID:        msg.PatientID,
+		Timestamp:        msg.Timestamp,
+		Message:          string(raw),
+	})
+	if err != nil {
+		return nil, "", fmt.Errorf("webhook gövdesi oluşturulamadı: %w", err)
+	}
+	return body, "application/json", nil
+}
+
+// authenticate adds the configured credentials; the HMAC signature covers
+// "<timestamp>.<body>" so that captured requests cannot be replayed later
+func (w *Webhook) authenticate(req *http.Request, body []byte) {
+	switch w.opts.Auth {
+	case WebhookAuthBearer:
+		req.Header.Set("Authorization", "Bearer "+w.opts.Token)
+	case WebhookAuthBasic:
+		req.SetBasicAuth(w.opts.Username, w.opts.Password)
+	case WebhookAuthHMAC:
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		mac := hmac.New(sha256.New, []byte(w.opts.HMACSecret))
+		mac.Write([]byte(timestamp + "."))
+		mac.Write(body)
+		req.Header.Set("X-HL7-Timestamp", timestamp)
+		req.Header.Set("X-HL7-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+}
+
+func (w *Webhook) Close() error {
+	w.client.CloseIdleConnections()
+	return nil
+}
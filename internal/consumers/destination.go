@@ -0,0 +1,190 @@
+package consumers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/minasoft/hl7-replicator/internal/config"
+	"github.com/minasoft/hl7-replicator/internal/connectors"
+	"github.com/minasoft/hl7-replicator/internal/db"
+	"github.com/minasoft/hl7-replicator/internal/fhir"
+	"github.com/minasoft/hl7-replicator/internal/hl7"
+)
+
+// Destination delivers the messages of a route to a downstream system
+type Destination interface {
+	// Deliver sends a message and returns the response recorded as ACK, if any
+	Deliver(ctx context.Context, msg *db.HL7Message) ([]byte, error)
+	// String describes the destination in logs
+	String() string
+	Close() error
+}
+
+// PooledDestination is implemented by destinations keeping a connection pool
+type PooledDestination interface {
+	PoolStats() hl7.PoolStats
+}
+
+// BatchDestination is implemented by destinations that accept batches
+type BatchDestination interface {
+	DeliverBatch(ctx context.Context, msgs []*db.HL7Message) error
+}
+
+// Destination types
+const (
+	DestinationMLLP    = "mllp"
+	DestinationFile    = "file"
+	DestinationSFTP    = "sftp"
+	DestinationFTP     = "ftp"
+	DestinationWebhook = "webhook"
+	DestinationFHIR    = "fhir"
+	DestinationNone    = "none" // no configured destination, see ManagedDestination
+)
+
+// DestinationConfig describes how to build a destination
+type DestinationConfig struct {
+	Type         string
+	Host         string
+	Port         int
+	OutputDir    string
+	FileTemplate string
+	RemoteURL    string // sftp:// or ftp:// URL for remote file destinations
+	Webhook      config.WebhookConfig
+	FHIR         config.FHIRConfig
+	Pool         config.PoolConfig
+	MLLP         config.MLLPConfig
+	Heartbeat    config.HeartbeatConfig
+	// Identifier systems of the HL7 to FHIR conversion
+	FHIRPatientSystem string
+	FHIROrderSystem   string
+}
+
+// NewDestination creates a destination of the configured type
+func NewDestination(cfg DestinationConfig) (Destination, error) {
+	switch cfg.Type {
+	case "", DestinationMLLP:
+		return newMLLPDestination(cfg.Host, cfg.Port, cfg.Pool, cfg.MLLP)
+	case DestinationFile:
+		if cfg.OutputDir == "" {
+			return nil, fmt.Errorf("file hedefi için çıkış dizini gerekli")
+		}
+		return connectors.NewFileWriter(cfg.OutputDir, cfg.FileTemplate), nil
+	case DestinationSFTP, DestinationFTP:
+		if cfg.RemoteURL == "" {
+			return nil, fmt.Errorf("%s hedefi için uzak URL gerekli", cfg.Type)
+		}
+		remote, err := connectors.ParseRemoteURL(cfg.RemoteURL)
+		if err != nil {
+			return nil, err
+		}
+		if remote.Scheme != cfg.Type {
+			return nil, fmt.Errorf("hedef tipi %s ile URL şeması %s uyuşmuyor", cfg.Type, remote.Scheme)
+		}
+		if remote.FileTemplate == "" {
+			remote.FileTemplate = cfg.FileTemplate
+		}
+		return connectors.NewRemoteWriter(remote), nil
+	case DestinationWebhook:
+		headers, err := connectors.ParseHeaders(cfg.Webhook.Headers)
+		if err != nil {
+			return nil, err
+		}
+		return connectors.NewWebhook(connectors.WebhookOptions{
+			URL:        cfg.Webhook.URL,
+			Format:     cfg.Webhook.Format,
+			Headers:    headers,
+			Auth:       cfg.Webhook.Auth,
+			Token:      cfg.Webhook.Token,
+			Username:   cfg.Webhook.Username,
+			Password:   cfg.Webhook.Password,
+			HMACSecret: cfg.Webhook.HMACSecret,
+			Timeout:    cfg.Webhook.Timeout,
+		})
+	case DestinationFHIR:
+		converter := fhir.NewConverter(cfg.FHIRPatientSystem, cfg.FHIROrderSystem)
+		return fhir.NewDestination(cfg.FHIR.BaseURL, cfg.FHIR.Token, cfg.FHIR.Timeout, converter)
+	default:
+		return nil, fmt.Errorf("bilinmeyen hedef tipi: %s", cfg.Type)
+	}
+}
+
+// mllpDestination delivers messages over MLLP
+type mllpDestination struct {
+	client *hl7.MLLPClient
+	addr   string
+}
+
+func newMLLPDestination(host string, port int, pool config.PoolConfig, mllp config.MLLPConfig) (*mllpDestination, error) {
+	opts, err := clientOptions(pool, mllp)
+	if err != nil {
+		return nil, err
+	}
+
+	return &mllpDestination{
+		client: hl7.NewMLLPClient(host, port, opts),
+		addr:   fmt.Sprintf("%s:%d", host, port),
+	}, nil
+}
+
+// clientOptions converts the MLLP settings of a destination
+func clientOptions(pool config.PoolConfig, mllp config.MLLPConfig) (hl7.ClientOptions, error) {
+	opts := hl7.ClientOptions{
+		ConnectTimeout: mllp.ConnectTimeout,
+		WriteTimeout:   mllp.WriteTimeout,
+		AckTimeout:     mllp.AckTimeout,
+		Mode:           mllp.Mode,
+		Framing:        hl7.Framing{NoTrailingCR: !mllp.TrailingCR},
+		Pool: hl7.PoolOptions{
+			MaxConns:    pool.MaxConns,
+			MaxIdle:     pool.MaxIdle,
+			IdleTimeout: pool.IdleTimeout,
+			MaxLifetime: pool.MaxLifetime,
+		},
+	}
+
+	switch opts.Mode {
+	case "", hl7.ModePersistent, hl7.ModePerMessage:
+	default:
+		return opts, fmt.Errorf("bilinmeyen MLLP bağlantı modu: %s", opts.Mode)
+	}
+	switch strings.ToLower(mllp.SegmentTerminator) {
+	case "", "cr":
+	case "crlf":
+		opts.Framing.CRLF = true
+	default:
+		return opts, fmt.Errorf("bilinmeyen segment sonlandırıcı: %s", mllp.SegmentTerminator)
+	}
+	return opts, nil
+}
+
+// Deliver sends the message and returns the ACK, also when it is negative
+func (d *mllpDestination) Deliver(ctx context.Context, msg *db.HL7Message) ([]byte, error) {
+	result, err := d.client.Send(ctx, msg.RawMessage)
+	if result != nil {
+		return result.Message, err
+	}
+	return nil, err
+}
+
+func (d *mllpDestination) DeliverBatch(ctx context.Context, msgs []*db.HL7Message) error {
+	raw := make([][]byte, len(msgs))
+	for i, msg := range msgs {
+		raw[i] = msg.RawMessage
+	}
+	_, err := d.client.SendBatch(ctx, raw)
+	return err
+}
+
+// PoolStats returns the connection pool counters
+func (d *mllpDestination) PoolStats() hl7.PoolStats {
+	return d.client.PoolStats()
+}
+
+func (d *mllpDestination) String() string {
+	return d.addr
+}
+
+func (d *mllpDestination) Close() error {
+	return d.client.Close()
+}
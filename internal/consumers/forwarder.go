@@ -3,35 +3,51 @@ package consumers
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
+	"reflect"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/minasoft/hl7-replicator/internal/config"
 	"github.com/minasoft/hl7-replicator/internal/db"
 	"github.com/minasoft/hl7-replicator/internal/hl7"
+	"github.com/minasoft/hl7-replicator/internal/phi"
+	"github.com/minasoft/hl7-replicator/internal/stats"
 	"github.com/nats-io/nats.go/jetstream"
 )
 
 type MessageForwarder struct {
 	js        jetstream.JetStream
 	config    *config.Config
-	statsKV   jetstream.KeyValue
+	stats     *stats.Store
 	dlqKV     jetstream.KeyValue
 	historyKV jetstream.KeyValue
-	statsMu   sync.Mutex
+
+	ctx     context.Context // parent of the route consumers, set by Start
+	destMu  sync.Mutex
+	runners map[string]*routeRunner // by route name
+	managed []*ManagedDestination   // destinations added through the web API
+
+	// reconfMu is held from Prepare until Apply or Discard so configuration
+	// reloads and destination changes do not interleave
+	reconfMu sync.Mutex
+
+	// Deliveries run with deliverCtx, which Stop cancels when the drain
+	// timeout expires; no delivery starts once draining is set
+	deliverCtx       context.Context
+	cancelDeliveries context.CancelFunc
+	drainMu          sync.Mutex
+	draining         bool
+	inflight         sync.WaitGroup
 }
 
-func NewMessageForwarder(js jetstream.JetStream, cfg *config.Config) *MessageForwarder {
+func NewMessageForwarder(js jetstream.JetStream, cfg *config.Config, st *stats.Store) *MessageForwarder {
 	ctx := context.Background()
 
-	// Get stats KV store
-	statsKV, err := js.KeyValue(ctx, "HL7_STATS")
-	if err != nil {
-		slog.Error("Stats KV store erişilemedi", "error", err)
-	}
-
 	// Get DLQ KV store
 	dlqKV, err := js.KeyValue(ctx, "HL7_DLQ")
 	if err != nil {
@@ -44,53 +60,270 @@ func NewMessageForwarder(js jetstream.JetStream, cfg *config.Config) *MessageFor
 		slog.Error("History KV store erişilemedi", "error", err)
 	}
 
+	deliverCtx, cancelDeliveries := context.WithCancel(context.Background())
+
 	return &MessageForwarder{
-		js:        js,
-		config:    cfg,
-		statsKV:   statsKV,
-		dlqKV:     dlqKV,
-		historyKV: historyKV,
+		js:               js,
+		config:           cfg,
+		stats:            st,
+		dlqKV:            dlqKV,
+		historyKV:        historyKV,
+		deliverCtx:       deliverCtx,
+		cancelDeliveries: cancelDeliveries,
+	}
+}
+
+// route describes one forwarding direction: the stream it consumes and the
+// destination it delivers to
+type route struct {
+	name        string // direction of a configured route, name of a managed one
+	direction   string // "order" or "report"
+	stream      string
+	consumer    string
+	description string
+	target      DestinationConfig
+	batchSize   int  // > 1 delivers messages as BHS/BTS batches
+	merge       bool // combine same-patient ORU^R01 results into one message
+	managed     bool // destination added through the web API
+}
+
+// defaultMergeWindow is the number of messages fetched at once when merging
+// results and no batch size is configured
+const defaultMergeWindow = 20
+
+func routes(cfg *config.Config) []*route {
+	return []*route{
+		{
+			// HIS -> ZenPACS
+			name:        "order",
+			direction:   "order",
+			stream:      "HL7_ORDERS",
+			consumer:    "order-forwarder",
+			description: "HIS'ten ZenPACS'a order mesajlarını ileten consumer",
+			target: DestinationConfig{
+				Type:         cfg.ZenPACSDestinationType,
+				Host:         cfg.ZenPACSHost,
+				Port:         cfg.ZenPACSPort,
+				OutputDir:    cfg.ZenPACSOutputDir,
+				FileTemplate: cfg.OutputFileTemplate,
+				RemoteURL:    cfg.ZenPACSRemoteURL,
+				Webhook:      cfg.ZenPACSWebhook,
+				FHIR:         cfg.ZenPACSFHIR,
+				Pool:         cfg.ZenPACSPool,
+				MLLP:         cfg.ZenPACSMLLP,
+				Heartbeat:    cfg.ZenPACSHeartbeat,
+
+				FHIRPatientSystem: cfg.FHIRPatientSystem,
+				FHIROrderSystem:   cfg.FHIROrderSystem,
+			},
+			batchSize: cfg.ZenPACSBatchSize,
+			merge:     cfg.ZenPACSMergeResults,
+		},
+		{
+			// ZenPACS -> HIS
+			name:        "report",
+			direction:   "report",
+			stream:      "HL7_REPORTS",
+			consumer:    "report-forwarder",
+			description: "ZenPACS'tan HIS'e rapor mesajlarını ileten consumer",
+			target: DestinationConfig{
+				Type:         cfg.HospitalHISDestinationType,
+				Host:         cfg.HospitalHISHost,
+				Port:         cfg.HospitalHISPort,
+				OutputDir:    cfg.HospitalHISOutputDir,
+				FileTemplate: cfg.OutputFileTemplate,
+				RemoteURL:    cfg.HospitalHISRemoteURL,
+				Webhook:      cfg.HospitalHISWebhook,
+				FHIR:         cfg.HospitalHISFHIR,
+				Pool:         cfg.HospitalHISPool,
+				MLLP:         cfg.HospitalHISMLLP,
+				Heartbeat:    cfg.HospitalHISHeartbeat,
+
+				FHIRPatientSystem: cfg.FHIRPatientSystem,
+				FHIROrderSystem:   cfg.FHIROrderSystem,
+			},
+			batchSize: cfg.HospitalHISBatchSize,
+			merge:     cfg.HospitalHISMergeResults,
+		},
 	}
 }
 
-func (f *MessageForwarder) Start(ctx context.Context) error {
-	// Start order consumer (HIS -> ZenPACS)
-	if err := f.startOrderConsumer(ctx); err != nil {
-		return fmt.Errorf("order consumer başlatılamadı: %w", err)
+// desiredRoutes returns the routes to run: the managed destinations that are
+// enabled and the configured route of every direction without one
+func desiredRoutes(cfg *config.Config, managed []*ManagedDestination) []*route {
+	replaced := make(map[string]bool)
+	var managedRoutes []*route
+	for _, d := range managed {
+		if d.Enabled {
+			replaced[d.Route] = true
+			managedRoutes = append(managedRoutes, d.route(cfg))
+		}
+	}
+
+	var desired []*route
+	for _, r := range routes(cfg) {
+		if replaced[r.direction] || r.target.Type == DestinationNone {
+			continue
+		}
+		desired = append(desired, r)
 	}
+	return append(desired, managedRoutes...)
+}
+
+func (f *MessageForwarder) Start(ctx context.Context, managed []*ManagedDestination) error {
+	f.ctx = ctx
+	f.managed = managed
 
-	// Start report consumer (ZenPACS -> HIS)
-	if err := f.startReportConsumer(ctx); err != nil {
-		return fmt.Errorf("report consumer başlatılamadı: %w", err)
+	desired := desiredRoutes(f.config, managed)
+	for _, r := range desired {
+		// Configured routes keep every message received before they start;
+		// managed destinations begin with new messages
+		consumer, err := f.createConsumer(r, r.managed)
+		if err != nil {
+			return fmt.Errorf("%s consumer başlatılamadı: %w", r.name, err)
+		}
+		dest, err := NewDestination(r.target)
+		if err != nil {
+			return fmt.Errorf("%s consumer başlatılamadı: %w", r.name, err)
+		}
+		hb, err := newHeartbeat(r, dest.String())
+		if err != nil {
+			dest.Close()
+			return fmt.Errorf("%s heartbeat başlatılamadı: %w", r.name, err)
+		}
+		f.startRoute(r, consumer, dest, hb)
 	}
 
+	for _, r := range routes(f.config) {
+		if !hasDirection(desired, r.direction) {
+			slog.Warn("Bu yön için hedef yok, mesajlar kuyrukta bekleyecek", "direction", r.direction)
+		}
+		if !hasConsumer(desired, r) {
+			// Replaced by managed destinations; a consumer left behind would
+			// replay everything received meanwhile once it is used again
+			f.deleteConsumer(r)
+		}
+	}
 	return nil
 }
 
-func (f *MessageForwarder) startOrderConsumer(ctx context.Context) error {
-	consumer, err := f.js.CreateOrUpdateConsumer(ctx, "HL7_ORDERS", jetstream.ConsumerConfig{
-		Name:          "order-forwarder",
-		Description:   "HIS'ten ZenPACS'a order mesajlarını ileten consumer",
+func hasDirection(routes []*route, direction string) bool {
+	for _, r := range routes {
+		if r.direction == direction {
+			return true
+		}
+	}
+	return false
+}
+
+func hasConsumer(routes []*route, r *route) bool {
+	for _, other := range routes {
+		if other.stream == r.stream && other.consumer == r.consumer {
+			return true
+		}
+	}
+	return false
+}
+
+// createConsumer creates or updates the durable consumer of a route. A new
+// consumer starts with the messages received from now on when deliverNew is
+// set; an existing one keeps its position.
+func (f *MessageForwarder) createConsumer(r *route, deliverNew bool) (jetstream.Consumer, error) {
+	cfg := jetstream.ConsumerConfig{
+		Name:          r.consumer,
+		Description:   r.description,
 		MaxDeliver:    5,
 		AckWait:       30 * time.Second,
 		MaxAckPending: 100,
-	})
-	if err != nil {
-		return err
 	}
+	if deliverNew {
+		cfg.DeliverPolicy = jetstream.DeliverNewPolicy
+	}
+	if existing, err := f.js.Consumer(f.ctx, r.stream, r.consumer); err == nil {
+		current := existing.CachedInfo().Config
+		cfg.DeliverPolicy = current.DeliverPolicy
+		cfg.OptStartSeq = current.OptStartSeq
+		cfg.OptStartTime = current.OptStartTime
+	}
+	return f.js.CreateOrUpdateConsumer(f.ctx, r.stream, cfg)
+}
+
+// deleteConsumer removes the durable consumer of a route that no longer runs
+func (f *MessageForwarder) deleteConsumer(r *route) {
+	err := f.js.DeleteConsumer(context.Background(), r.stream, r.consumer)
+	if err == nil {
+		slog.Info("Kullanılmayan consumer silindi", "stream", r.stream, "consumer", r.consumer)
+		return
+	}
+	if !errors.Is(err, jetstream.ErrConsumerNotFound) {
+		slog.Error("Consumer silinemedi", "stream", r.stream, "consumer", r.consumer, "error", err)
+	}
+}
+
+// routeRunner runs the consumer of one route; a reload replaces the runner
+// of every changed route
+type routeRunner struct {
+	route    *route
+	consumer jetstream.Consumer
+	dest     Destination
+	hb       *heartbeat // nil when heartbeats are off
+	cancel   context.CancelFunc
+	inflight sync.WaitGroup
+	stopped  bool // guarded by drainMu
+}
 
-	// Create ZenPACS client
-	zenpacsClient := hl7.NewMLLPClient(f.config.ZenPACSHost, f.config.ZenPACSPort)
+func (f *MessageForwarder) startRoute(r *route, consumer jetstream.Consumer, dest Destination, hb *heartbeat) {
+	ctx, cancel := context.WithCancel(f.ctx)
+	run := &routeRunner{route: r, consumer: consumer, dest: dest, hb: hb, cancel: cancel}
+
+	f.destMu.Lock()
+	if f.runners == nil {
+		f.runners = make(map[string]*routeRunner)
+	}
+	f.runners[r.name] = run
+	f.destMu.Unlock()
+
+	slog.Info("Forwarder başlatıldı",
+		"name", r.name,
+		"direction", r.direction,
+		"stream", r.stream,
+		"destination", dest.String(),
+		"batchSize", r.batchSize,
+		"merge", r.merge)
+
+	if hb != nil {
+		go hb.run(ctx)
+	}
+
+	if r.merge {
+		size := r.batchSize
+		if size <= 1 {
+			size = defaultMergeWindow
+		}
+		go f.fetchLoop(ctx, consumer, size, run, func(msgs []jetstream.Msg) {
+			f.processMerged(msgs, dest, r)
+		})
+		return
+	}
+
+	if batchDest, ok := dest.(BatchDestination); ok && r.batchSize > 1 {
+		go f.fetchLoop(ctx, consumer, r.batchSize, run, func(msgs []jetstream.Msg) {
+			f.processBatch(msgs, batchDest, dest, r)
+		})
+		return
+	}
 
 	// Start consuming
 	go func() {
-		slog.Info("Order forwarder başlatıldı",
-			"stream", "HL7_ORDERS",
-			"destination", fmt.Sprintf("%s:%d", f.config.ZenPACSHost, f.config.ZenPACSPort))
-
 		cons, err := consumer.Consume(func(msg jetstream.Msg) {
+			if !f.begin(run) {
+				msg.Nak()
+				return
+			}
+			defer f.end(run)
+
 			// Process message
-			f.processOrderMessage(msg, zenpacsClient)
+			f.processMessage(msg, dest, r)
 		})
 		if err != nil {
 			slog.Error("Consumer hatası", "error", err)
@@ -101,49 +334,370 @@ func (f *MessageForwarder) startOrderConsumer(ctx context.Context) error {
 		<-ctx.Done()
 		cons.Stop()
 	}()
+}
 
-	return nil
+// PoolStats returns the connection pool counters of the pooled destinations
+// by route name: the direction of a configured route, the name of a managed
+// destination
+func (f *MessageForwarder) PoolStats() map[string]hl7.PoolStats {
+	f.destMu.Lock()
+	defer f.destMu.Unlock()
+
+	stats := make(map[string]hl7.PoolStats)
+	for name, run := range f.runners {
+		if pooled, ok := run.dest.(PooledDestination); ok {
+			stats[name] = pooled.PoolStats()
+		}
+	}
+	return stats
 }
 
-func (f *MessageForwarder) startReportConsumer(ctx context.Context) error {
-	consumer, err := f.js.CreateOrUpdateConsumer(ctx, "HL7_REPORTS", jetstream.ConsumerConfig{
-		Name:          "report-forwarder",
-		Description:   "ZenPACS'tan HIS'e rapor mesajlarını ileten consumer",
-		MaxDeliver:    5,
-		AckWait:       30 * time.Second,
-		MaxAckPending: 100,
-	})
-	if err != nil {
-		return err
+// Heartbeats returns the probe results of the routes with heartbeats
+func (f *MessageForwarder) Heartbeats() []HeartbeatStatus {
+	f.destMu.Lock()
+	defer f.destMu.Unlock()
+
+	statuses := make([]HeartbeatStatus, 0, len(f.runners))
+	for _, run := range f.runners {
+		if run.hb != nil {
+			statuses = append(statuses, run.hb.Status())
+		}
 	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
+
+// Backlog is what the consumer of a destination has not finished yet
+type Backlog struct {
+	Name        string `json:"name"` // route or managed destination
+	Direction   string `json:"direction"`
+	Consumer    string `json:"consumer"`
+	Pending     uint64 `json:"pending"`   // not yet delivered to the consumer
+	InFlight    int    `json:"in_flight"` // delivered, waiting for the ack
+	Redelivered int    `json:"redelivered"`
+}
 
-	// Create HIS client
-	hisClient := hl7.NewMLLPClient(f.config.HospitalHISHost, f.config.HospitalHISPort)
+// Total is the number of messages waiting for delivery
+func (b Backlog) Total() uint64 {
+	return b.Pending + uint64(b.InFlight)
+}
 
-	// Start consuming
-	go func() {
-		slog.Info("Report forwarder başlatıldı",
-			"stream", "HL7_REPORTS",
-			"destination", fmt.Sprintf("%s:%d", f.config.HospitalHISHost, f.config.HospitalHISPort))
+// Backlogs reads the consumer state of every destination, sorted by name
+func (f *MessageForwarder) Backlogs(ctx context.Context) ([]Backlog, error) {
+	f.destMu.Lock()
+	runners := make([]*routeRunner, 0, len(f.runners))
+	for _, run := range f.runners {
+		runners = append(runners, run)
+	}
+	f.destMu.Unlock()
 
-		cons, err := consumer.Consume(func(msg jetstream.Msg) {
-			// Process message
-			f.processReportMessage(msg, hisClient)
+	backlogs := make([]Backlog, 0, len(runners))
+	for _, run := range runners {
+		info, err := run.consumer.Info(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("%s consumer bilgisi okunamadı: %w", run.route.consumer, err)
+		}
+		backlogs = append(backlogs, Backlog{
+			Name:        run.route.name,
+			Direction:   run.route.direction,
+			Consumer:    info.Name,
+			Pending:     info.NumPending,
+			InFlight:    info.NumAckPending,
+			Redelivered: info.NumRedelivered,
 		})
+	}
+	sort.Slice(backlogs, func(i, j int) bool { return backlogs[i].Name < backlogs[j].Name })
+	return backlogs, nil
+}
+
+// currentConfig returns the configuration the routes were built from
+func (f *MessageForwarder) currentConfig() *config.Config {
+	f.destMu.Lock()
+	defer f.destMu.Unlock()
+	return f.config
+}
+
+// fetchLoop fetches up to size pending messages at a time and hands them to
+// process together (batch delivery, result merging)
+func (f *MessageForwarder) fetchLoop(ctx context.Context, consumer jetstream.Consumer, size int, run *routeRunner, process func([]jetstream.Msg)) {
+	for ctx.Err() == nil {
+		batch, err := consumer.Fetch(size, jetstream.FetchMaxWait(2*time.Second))
 		if err != nil {
-			slog.Error("Consumer hatası", "error", err)
+			slog.Error("Batch fetch hatası", "error", err, "direction", run.route.direction)
+			time.Sleep(time.Second)
+			continue
+		}
+
+		var msgs []jetstream.Msg
+		for msg := range batch.Messages() {
+			msgs = append(msgs, msg)
+		}
+		if len(msgs) == 0 {
+			continue
+		}
+		if !f.begin(run) {
+			// Fetched while stopping; redelivered to the next consumer
+			for _, msg := range msgs {
+				msg.Nak()
+			}
 			return
 		}
+		process(msgs)
+		f.end(run)
+	}
+}
 
-		// Wait for context cancellation
-		<-ctx.Done()
-		cons.Stop()
+// begin registers an in-flight delivery of a route; it returns false once
+// the forwarder is draining or the route has been replaced
+func (f *MessageForwarder) begin(run *routeRunner) bool {
+	f.drainMu.Lock()
+	defer f.drainMu.Unlock()
+
+	if f.draining || run.stopped {
+		return false
+	}
+	f.inflight.Add(1)
+	run.inflight.Add(1)
+	return true
+}
+
+func (f *MessageForwarder) end(run *routeRunner) {
+	run.inflight.Done()
+	f.inflight.Done()
+}
+
+// Reconfiguration holds what a new configuration or a change of the managed
+// destinations changes in the forwarder: the routes whose settings differ,
+// with their destinations already built, and the routes to remove. It holds
+// the reconfiguration lock until Apply or Discard is called.
+type Reconfiguration struct {
+	f         *MessageForwarder
+	cfg       *config.Config
+	managed   []*ManagedDestination
+	routes    []*route
+	consumers []jetstream.Consumer
+	dests     []Destination
+	hbs       []*heartbeat
+	removed   []string
+}
+
+// Prepare builds the destinations of the routes that differ under cfg.
+// Nothing changes until Apply is called; Discard releases the destinations
+// when the configuration is rejected.
+func (f *MessageForwarder) Prepare(cfg *config.Config) (*Reconfiguration, error) {
+	f.reconfMu.Lock()
+	rc, err := f.prepare(cfg, f.managed)
+	if err != nil {
+		f.reconfMu.Unlock()
+		return nil, err
+	}
+	return rc, nil
+}
+
+// PrepareDestinations is Prepare for a new set of managed destinations
+func (f *MessageForwarder) PrepareDestinations(managed []*ManagedDestination) (*Reconfiguration, error) {
+	f.reconfMu.Lock()
+	rc, err := f.prepare(f.currentConfig(), managed)
+	if err != nil {
+		f.reconfMu.Unlock()
+		return nil, err
+	}
+	return rc, nil
+}
+
+func (f *MessageForwarder) prepare(cfg *config.Config, managed []*ManagedDestination) (*Reconfiguration, error) {
+	rc := &Reconfiguration{f: f, cfg: cfg, managed: managed}
+
+	f.destMu.Lock()
+	current := make(map[string]*route, len(f.runners))
+	for name, run := range f.runners {
+		current[name] = run.route
+	}
+	f.destMu.Unlock()
+
+	desired := desiredRoutes(cfg, managed)
+	for _, r := range desired {
+		if reflect.DeepEqual(current[r.name], r) {
+			continue
+		}
+		consumer, err := f.createConsumer(r, true)
+		if err != nil {
+			rc.close()
+			return nil, fmt.Errorf("%s consumer oluşturulamadı: %w", r.name, err)
+		}
+		dest, err := NewDestination(r.target)
+		if err != nil {
+			rc.close()
+			return nil, fmt.Errorf("%s hedefi geçersiz: %w", r.name, err)
+		}
+		hb, err := newHeartbeat(r, dest.String())
+		if err != nil {
+			dest.Close()
+			rc.close()
+			return nil, fmt.Errorf("%s heartbeat ayarları geçersiz: %w", r.name, err)
+		}
+		rc.routes = append(rc.routes, r)
+		rc.consumers = append(rc.consumers, consumer)
+		rc.dests = append(rc.dests, dest)
+		rc.hbs = append(rc.hbs, hb)
+	}
+	for name := range current {
+		if !hasName(desired, name) {
+			rc.removed = append(rc.removed, name)
+		}
+	}
+	sort.Strings(rc.removed)
+	return rc, nil
+}
+
+func hasName(routes []*route, name string) bool {
+	for _, r := range routes {
+		if r.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Changed returns the names of the routes the reconfiguration starts,
+// replaces or removes
+func (rc *Reconfiguration) Changed() []string {
+	names := make([]string, 0, len(rc.routes)+len(rc.removed))
+	for _, r := range rc.routes {
+		names = append(names, r.name)
+	}
+	return append(names, rc.removed...)
+}
+
+// Apply replaces the runners of the changed routes and stops the removed
+// ones. A previous runner stops taking messages at once; its destination and
+// connection pool are closed after its in-flight deliveries have finished.
+func (rc *Reconfiguration) Apply() {
+	f := rc.f
+	defer f.reconfMu.Unlock()
+
+	f.destMu.Lock()
+	f.config = rc.cfg
+	f.managed = rc.managed
+	f.destMu.Unlock()
+
+	for i, r := range rc.routes {
+		f.stopRunner(r.name, r)
+		f.startRoute(r, rc.consumers[i], rc.dests[i], rc.hbs[i])
+	}
+	for _, name := range rc.removed {
+		f.stopRunner(name, nil)
+	}
+}
+
+// stopRunner stops the runner of a route replaced by next, or removed when
+// next is nil. The durable consumer is deleted once it is no longer used.
+func (f *MessageForwarder) stopRunner(name string, next *route) {
+	f.destMu.Lock()
+	old := f.runners[name]
+	if next == nil {
+		delete(f.runners, name)
+	}
+	f.destMu.Unlock()
+	if old == nil {
+		return
+	}
+
+	f.drainMu.Lock()
+	old.stopped = true
+	f.drainMu.Unlock()
+	old.cancel()
+
+	unused := next == nil || next.stream != old.route.stream || next.consumer != old.route.consumer
+
+	go func() {
+		old.inflight.Wait()
+		if err := old.dest.Close(); err != nil {
+			slog.Error("Eski hedef kapatılamadı", "name", name, "error", err)
+		}
+		slog.Info("Eski hedef kapatıldı", "name", name, "destination", old.dest.String())
+
+		if unused && !f.consumerInUse(old.route) {
+			f.deleteConsumer(old.route)
+		}
 	}()
+}
 
-	return nil
+// consumerInUse reports whether a running route uses the consumer of r
+func (f *MessageForwarder) consumerInUse(r *route) bool {
+	f.destMu.Lock()
+	defer f.destMu.Unlock()
+	for _, run := range f.runners {
+		if run.route.stream == r.stream && run.route.consumer == r.consumer {
+			return true
+		}
+	}
+	return false
+}
+
+// Discard closes the destinations built for a rejected configuration
+func (rc *Reconfiguration) Discard() {
+	rc.close()
+	rc.f.reconfMu.Unlock()
+}
+
+func (rc *Reconfiguration) close() {
+	for _, dest := range rc.dests {
+		dest.Close()
+	}
+	for _, hb := range rc.hbs {
+		hb.close()
+	}
+	rc.dests = nil
+	rc.hbs = nil
+	rc.routes = nil
+}
+
+// Stop drains the forwarder: no new delivery starts, in-flight deliveries
+// may finish until ctx ends and are then cancelled and NAKed for redelivery.
+// The destinations and their connection pools are closed afterwards. The
+// consumers themselves stop with the context passed to Start.
+func (f *MessageForwarder) Stop(ctx context.Context) error {
+	f.drainMu.Lock()
+	f.draining = true
+	f.drainMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		f.inflight.Wait()
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+		slog.Info("Devam eden teslimatlar tamamlandı")
+	case <-ctx.Done():
+		slog.Warn("Kapatma süresi aşıldı, devam eden teslimatlar iptal ediliyor")
+		f.cancelDeliveries()
+		// Cancelled deliveries return promptly; destinations ignoring the
+		// context are not waited for indefinitely
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			slog.Error("Bazı teslimatlar iptal edilemedi")
+		}
+		err = ctx.Err()
+	}
+	f.cancelDeliveries()
+
+	f.destMu.Lock()
+	defer f.destMu.Unlock()
+	for name, run := range f.runners {
+		if cerr := run.dest.Close(); cerr != nil {
+			slog.Error("Hedef kapatılamadı", "name", name, "error", cerr)
+		}
+	}
+	slog.Info("Forwarder durduruldu", "destinations", len(f.runners))
+	return err
 }
 
-func (f *MessageForwarder) processOrderMessage(msg jetstream.Msg, client *hl7.MLLPClient) {
+func (f *MessageForwarder) processMessage(msg jetstream.Msg, dest Destination, r *route) {
 	// Parse message
 	var hl7Msg db.HL7Message
 	if err := json.Unmarshal(msg.Data(), &hl7Msg); err != nil {
@@ -155,98 +709,140 @@ func (f *MessageForwarder) processOrderMessage(msg jetstream.Msg, client *hl7.ML
 	// Get message metadata to check redelivery count
 	meta, _ := msg.Metadata()
 
-	slog.Info("Order mesajı işleniyor",
+	slog.Info("Mesaj işleniyor",
 		"id", hl7Msg.ID,
+		"direction", r.direction,
 		"messageType", hl7Msg.MessageType,
-		"patientID", hl7Msg.PatientID,
-		"deliveryAttempt", meta.NumDelivered)
+		"patientID", phi.Mask(hl7Msg.PatientID),
+		"deliveryAttempt", deliveryAttempt(meta))
 
-	// Forward message
-	err := client.SendMessage(hl7Msg.RawMessage)
-	if err != nil {
-		hl7Msg.Status = "failed"
-		hl7Msg.LastError = err.Error()
-		if meta != nil {
-			hl7Msg.RetryCount = int(meta.NumDelivered)
+	// Forward message; the response is kept as ACK even when delivery failed
+	ack, err := dest.Deliver(f.deliverCtx, &hl7Msg)
+	if len(ack) > 0 {
+		hl7Msg.AckMessage = string(ack)
+	}
+	f.complete(msg, meta, &hl7Msg, err, dest, r)
+}
+
+func (f *MessageForwarder) processBatch(msgs []jetstream.Msg, batchDest BatchDestination, dest Destination, r *route) {
+	var pending []jetstream.Msg
+	var decoded []*db.HL7Message
+
+	for _, msg := range msgs {
+		var hl7Msg db.HL7Message
+		if err := json.Unmarshal(msg.Data(), &hl7Msg); err != nil {
+			slog.Error("Mesaj parse hatası", "error", err)
+			msg.Nak()
+			continue
 		}
+		pending = append(pending, msg)
+		decoded = append(decoded, &hl7Msg)
+	}
+	if len(pending) == 0 {
+		return
+	}
 
-		slog.Error("Order mesaj gönderme hatası",
-			"id", hl7Msg.ID,
-			"error", err,
-			"deliveryAttempt", meta.NumDelivered)
-
-		// Update statistics
-		if f.statsKV != nil {
-			// Only count as a new message on first attempt
-			if meta != nil && meta.NumDelivered == 1 {
-				f.incrementKVCounter("total_orders")
-				f.incrementKVCounter("failed_orders")
-			}
+	slog.Info("Batch işleniyor", "direction", r.direction, "messages", len(pending))
+
+	// The batch is delivered and acknowledged as a whole
+	err := batchDest.DeliverBatch(f.deliverCtx, decoded)
+	for i, msg := range pending {
+		meta, _ := msg.Metadata()
+		f.complete(msg, meta, decoded[i], err, dest, r)
+	}
+}
+
+// processMerged groups the fetched ORU^R01 messages by patient and delivers
+// every group as one message holding all OBR groups; other messages are
+// delivered on their own
+func (f *MessageForwarder) processMerged(msgs []jetstream.Msg, dest Destination, r *route) {
+	type mergeGroup struct {
+		msgs    []jetstream.Msg
+		decoded []*db.HL7Message
+	}
+	var groups []*mergeGroup
+	byPatient := map[string]*mergeGroup{}
+
+	for _, msg := range msgs {
+		var hl7Msg db.HL7Message
+		if err := json.Unmarshal(msg.Data(), &hl7Msg); err != nil {
+			slog.Error("Mesaj parse hatası", "error", err)
+			msg.Nak()
+			continue
 		}
 
-		// Save to DLQ after max retries
-		if meta != nil && meta.NumDelivered >= 5 && f.dlqKV != nil {
-			hl7Msg.Direction = "order"
-			dlqKey := fmt.Sprintf("order_%s_%d", hl7Msg.ID, time.Now().Unix())
-			dlqData, _ := json.Marshal(hl7Msg)
-			f.dlqKV.Put(context.Background(), dlqKey, dlqData)
-			slog.Warn("Mesaj DLQ'ya kaydedildi", "id", hl7Msg.ID, "key", dlqKey, "attempts", meta.NumDelivered)
-			// Save to history
-			f.saveToHistory(&hl7Msg)
-			// ACK to remove from stream after saving to DLQ
-			msg.Ack()
-			return
+		key := ""
+		if strings.HasPrefix(hl7Msg.MessageType, "ORU^R01") && hl7Msg.PatientID != "" {
+			key = hl7Msg.PatientID
 		}
+		g := byPatient[key]
+		if g == nil || key == "" {
+			g = &mergeGroup{}
+			groups = append(groups, g)
+			if key != "" {
+				byPatient[key] = g
+			}
+		}
+		g.msgs = append(g.msgs, msg)
+		g.decoded = append(g.decoded, &hl7Msg)
+	}
 
-		// NACK for retry
-		msg.Nak()
-		return
+	for _, g := range groups {
+		f.deliverMerged(g.msgs, g.decoded, dest, r)
 	}
+}
 
-	// Success
-	hl7Msg.Status = "forwarded"
-	now := time.Now()
-	hl7Msg.ProcessedAt = &now
-	hl7Msg.Direction = "order"
+func (f *MessageForwarder) deliverMerged(msgs []jetstream.Msg, decoded []*db.HL7Message, dest Destination, r *route) {
+	raws := make([][]byte, len(decoded))
+	for i, m := range decoded {
+		raws[i] = hl7.UnwrapMLLP(m.RawMessage)
+	}
 
-	// Update KV statistics
-	if f.statsKV != nil {
-		f.incrementKVCounter("total_orders")
-		f.incrementKVCounter("successful_orders")
-		f.statsKV.Put(context.Background(), "last_order_time", []byte(now.Format(time.RFC3339)))
+	merged, err := hl7.MergeResults(raws)
+	if err != nil {
+		slog.Warn("Mesajlar birleştirilemedi, tek tek gönderiliyor", "error", err, "direction", r.direction)
+		for _, msg := range msgs {
+			f.processMessage(msg, dest, r)
+		}
+		return
 	}
 
-	slog.Info("Order mesajı başarıyla gönderildi",
-		"id", hl7Msg.ID,
-		"destination", fmt.Sprintf("%s:%d", f.config.ZenPACSHost, f.config.ZenPACSPort))
+	// The merged message carries the metadata of the first member
+	combined := *decoded[0]
+	combined.RawMessage = merged
 
-	// Save to history
-	f.saveToHistory(&hl7Msg)
+	if len(decoded) > 1 {
+		slog.Info("Mesajlar birleştirilerek gönderiliyor",
+			"id", combined.ID,
+			"direction", r.direction,
+			"messages", len(decoded),
+			"patientID", phi.Mask(combined.PatientID))
+	}
 
-	// ACK message
-	msg.Ack()
+	ack, err := dest.Deliver(f.deliverCtx, &combined)
+	for i, msg := range msgs {
+		if len(ack) > 0 {
+			decoded[i].AckMessage = string(ack)
+		}
+		meta, _ := msg.Metadata()
+		f.complete(msg, meta, decoded[i], err, dest, r)
+	}
 }
 
-func (f *MessageForwarder) processReportMessage(msg jetstream.Msg, client *hl7.MLLPClient) {
-	// Parse message
-	var hl7Msg db.HL7Message
-	if err := json.Unmarshal(msg.Data(), &hl7Msg); err != nil {
-		slog.Error("Mesaj parse hatası", "error", err)
+// complete records the delivery result of a message: statistics, history,
+// DLQ after the last attempt, and the JetStream ack/nak
+func (f *MessageForwarder) complete(msg jetstream.Msg, meta *jetstream.MsgMetadata, hl7Msg *db.HL7Message, err error, dest Destination, r *route) {
+	labels := stats.Labels{Route: r.direction, Destination: r.name, MessageType: hl7Msg.MessageType}
+
+	// A delivery cancelled by shutdown is not a failed attempt
+	if err != nil && f.deliverCtx.Err() != nil {
+		slog.Warn("Teslimat kapatma nedeniyle iptal edildi, mesaj yeniden gönderilecek",
+			"id", hl7Msg.ID,
+			"direction", r.direction)
 		msg.Nak()
 		return
 	}
 
-	// Get message metadata to check redelivery count
-	meta, _ := msg.Metadata()
-
-	slog.Info("Report mesajı işleniyor",
-		"id", hl7Msg.ID,
-		"messageType", hl7Msg.MessageType,
-		"patientID", hl7Msg.PatientID,
-		"deliveryAttempt", meta.NumDelivered)
-
-	// Forward message
-	err := client.SendMessage(hl7Msg.RawMessage)
 	if err != nil {
 		hl7Msg.Status = "failed"
 		hl7Msg.LastError = err.Error()
@@ -254,29 +850,28 @@ func (f *MessageForwarder) processReportMessage(msg jetstream.Msg, client *hl7.M
 			hl7Msg.RetryCount = int(meta.NumDelivered)
 		}
 
-		slog.Error("Report mesaj gönderme hatası",
+		slog.Error("Mesaj gönderme hatası",
 			"id", hl7Msg.ID,
+			"direction", r.direction,
 			"error", err,
-			"deliveryAttempt", meta.NumDelivered)
-
-		// Update statistics
-		if f.statsKV != nil {
-			// Only count as a new message on first attempt
-			if meta != nil && meta.NumDelivered == 1 {
-				f.incrementKVCounter("total_reports")
-				f.incrementKVCounter("failed_reports")
-			}
-		}
-
-		// Save to DLQ after max retries
-		if meta != nil && meta.NumDelivered >= 5 && f.dlqKV != nil {
-			hl7Msg.Direction = "report"
-			dlqKey := fmt.Sprintf("report_%s_%d", hl7Msg.ID, time.Now().Unix())
+			"deliveryAttempt", deliveryAttempt(meta))
+
+		// Every failed attempt is counted; the message is counted once more
+		// when it is moved to the DLQ
+		f.stats.Record(stats.Failed, labels)
+
+		// Save to DLQ after max retries or when a retry cannot succeed
+		var permanent *hl7.PermanentError
+		if f.dlqKV != nil && (errors.As(err, &permanent) || meta != nil && meta.NumDelivered >= 5) {
+			hl7Msg.Direction = r.direction
+			hl7Msg.DestinationAddr = dest.String()
+			dlqKey := fmt.Sprintf("%s_%s_%d", r.direction, hl7Msg.ID, time.Now().Unix())
 			dlqData, _ := json.Marshal(hl7Msg)
 			f.dlqKV.Put(context.Background(), dlqKey, dlqData)
-			slog.Warn("Mesaj DLQ'ya kaydedildi", "id", hl7Msg.ID, "key", dlqKey, "attempts", meta.NumDelivered)
+			f.stats.Record(stats.DeadLettered, labels)
+			slog.Warn("Mesaj DLQ'ya kaydedildi", "id", hl7Msg.ID, "key", dlqKey, "attempts", deliveryAttempt(meta))
 			// Save to history
-			f.saveToHistory(&hl7Msg)
+			f.saveToHistory(hl7Msg)
 			// ACK to remove from stream after saving to DLQ
 			msg.Ack()
 			return
@@ -291,26 +886,30 @@ func (f *MessageForwarder) processReportMessage(msg jetstream.Msg, client *hl7.M
 	hl7Msg.Status = "forwarded"
 	now := time.Now()
 	hl7Msg.ProcessedAt = &now
-	hl7Msg.Direction = "report"
+	hl7Msg.Direction = r.direction
+	hl7Msg.DestinationAddr = dest.String()
 
-	// Update KV statistics
-	if f.statsKV != nil {
-		f.incrementKVCounter("total_reports")
-		f.incrementKVCounter("successful_reports")
-		f.statsKV.Put(context.Background(), "last_report_time", []byte(now.Format(time.RFC3339)))
-	}
+	f.stats.RecordAt(stats.Delivered, labels, now)
 
-	slog.Info("Report mesajı başarıyla gönderildi",
+	slog.Info("Mesaj başarıyla gönderildi",
 		"id", hl7Msg.ID,
-		"destination", fmt.Sprintf("%s:%d", f.config.HospitalHISHost, f.config.HospitalHISPort))
+		"direction", r.direction,
+		"destination", dest.String())
 
 	// Save to history
-	f.saveToHistory(&hl7Msg)
+	f.saveToHistory(hl7Msg)
 
 	// ACK message
 	msg.Ack()
 }
 
+func deliveryAttempt(meta *jetstream.MsgMetadata) uint64 {
+	if meta == nil {
+		return 0
+	}
+	return meta.NumDelivered
+}
+
 func (f *MessageForwarder) saveToHistory(msg *db.HL7Message) {
 	if f.historyKV == nil {
 		return
@@ -332,31 +931,3 @@ func (f *MessageForwarder) saveToHistory(msg *db.HL7Message) {
 		slog.Error("History KV put hatası", "error", err, "key", key)
 	}
 }
-
-func (f *MessageForwarder) incrementKVCounter(key string) {
-	if f.statsKV == nil {
-		return
-	}
-
-	// Lock for thread-safe counter increment
-	f.statsMu.Lock()
-	defer f.statsMu.Unlock()
-
-	ctx := context.Background()
-	entry, err := f.statsKV.Get(ctx, key)
-	if err != nil {
-		// If key doesn't exist, start from 0
-		if err.Error() == "nats: key not found" {
-			f.statsKV.Put(ctx, key, []byte("1"))
-		}
-		return
-	}
-
-	// Parse current value
-	currentVal := 0
-	fmt.Sscanf(string(entry.Value()), "%d", &currentVal)
-
-	// Increment and store
-	newVal := fmt.Sprintf("%d", currentVal+1)
-	f.statsKV.Put(ctx, key, []byte(newVal))
-}
@@ -0,0 +1,279 @@
+package consumers
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/minasoft/hl7-replicator/internal/connectors"
+	"github.com/minasoft/hl7-replicator/internal/hl7"
+)
+
+// Heartbeat modes
+const (
+	HeartbeatOff = "off"
+	HeartbeatTCP = "tcp" // connect only
+	HeartbeatHL7 = "hl7" // send a message and wait for a positive ACK
+)
+
+// Heartbeat states
+const (
+	HeartbeatUnknown = "unknown" // no probe finished yet
+	HeartbeatUp      = "up"
+	HeartbeatDown    = "down" // the last Failures probes failed
+)
+
+// HeartbeatStatus is the result of the liveness probes of a destination
+type HeartbeatStatus struct {
+	Name                string     `json:"name"`
+	Direction           string     `json:"direction"`
+	Destination         string     `json:"destination"`
+	Mode                string     `json:"mode"`
+	State               string     `json:"state"`
+	LastProbe           *time.Time `json:"last_probe,omitempty"`
+	LastSuccess         *time.Time `json:"last_success,omitempty"`
+	DownSince           *time.Time `json:"down_since,omitempty"`
+	LastError           string     `json:"last_error,omitempty"`
+	AckCode             string     `json:"ack_code,omitempty"`
+	RTTMs               float64    `json:"rtt_ms"`     // round trip of the last successful probe
+	AvgRTTMs            float64    `json:"avg_rtt_ms"` // moving average of successful probes
+	Probes              uint64     `json:"probes"`
+	Failures            uint64     `json:"failures"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+}
+
+// heartbeat probes the destination of a route periodically. Probes use their
+// own connection, so they neither wait for nor disturb deliveries.
+type heartbeat struct {
+	r       *route
+	addr    string
+	client  *hl7.MLLPClient // hl7 mode
+	message []byte          // hl7 mode: template, MSH-7 and MSH-10 are renewed per probe
+
+	mu     sync.Mutex
+	status HeartbeatStatus
+}
+
+// newHeartbeat prepares the probes of a route; nil when they are off
+func newHeartbeat(r *route, destination string) (*heartbeat, error) {
+	cfg := r.target.Heartbeat
+	if cfg.Mode == "" || cfg.Mode == HeartbeatOff {
+		return nil, nil
+	}
+
+	hb := &heartbeat{
+		r: r,
+		status: HeartbeatStatus{
+			Name:        r.name,
+			Direction:   r.direction,
+			Destination: destination,
+			Mode:        cfg.Mode,
+			State:       HeartbeatUnknown,
+		},
+	}
+
+	switch cfg.Mode {
+	case HeartbeatTCP:
+		addr, err := probeAddress(r.target)
+		if err != nil {
+			return nil, err
+		}
+		hb.addr = addr
+	case HeartbeatHL7:
+		if r.target.Type != "" && r.target.Type != DestinationMLLP {
+			return nil, fmt.Errorf("hl7 heartbeat yalnızca mllp hedefinde kullanılabilir")
+		}
+		opts, err := clientOptions(r.target.Pool, r.target.MLLP)
+		if err != nil {
+			return nil, err
+		}
+		opts.ConnectTimeout = cfg.Timeout
+		opts.WriteTimeout = cfg.Timeout
+		opts.AckTimeout = cfg.Timeout
+		opts.Mode = hl7.ModePerMessage
+		opts.Pool.MaxConns = 1
+
+		if cfg.MessageFile != "" {
+			data, err := os.ReadFile(cfg.MessageFile)
+			if err != nil {
+				return nil, fmt.Errorf("heartbeat mesajı okunamadı: %w", err)
+			}
+			if _, err := hl7.ParseStructure(data); err != nil {
+				return nil, fmt.Errorf("heartbeat mesajı geçersiz: %w", err)
+			}
+			hb.message = data
+		}
+		hb.addr = fmt.Sprintf("%s:%d", r.target.Host, r.target.Port)
+		hb.client = hl7.NewMLLPClient(r.target.Host, r.target.Port, opts)
+	default:
+		return nil, fmt.Errorf("bilinmeyen heartbeat modu: %s", cfg.Mode)
+	}
+	return hb, nil
+}
+
+// probeAddress returns the host:port a TCP probe connects to
+func probeAddress(target DestinationConfig) (string, error) {
+	switch target.Type {
+	case "", DestinationMLLP:
+		return fmt.Sprintf("%s:%d", target.Host, target.Port), nil
+	case DestinationSFTP, DestinationFTP:
+		remote, err := connectors.ParseRemoteURL(target.RemoteURL)
+		if err != nil {
+			return "", err
+		}
+		return remote.Addr, nil
+	case DestinationWebhook:
+		return urlAddress(target.Webhook.URL)
+	case DestinationFHIR:
+		return urlAddress(target.FHIR.BaseURL)
+	default:
+		return "", fmt.Errorf("%s hedefi için heartbeat desteklenmiyor", target.Type)
+	}
+}
+
+func urlAddress(raw string) (string, error) {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return "", fmt.Errorf("geçersiz URL: %s", raw)
+	}
+	if u.Port() != "" {
+		return u.Host, nil
+	}
+	if u.Scheme == "https" {
+		return net.JoinHostPort(u.Hostname(), "443"), nil
+	}
+	return net.JoinHostPort(u.Hostname(), "80"), nil
+}
+
+// run probes until ctx ends
+func (hb *heartbeat) run(ctx context.Context) {
+	defer hb.close()
+
+	ticker := time.NewTicker(hb.r.target.Heartbeat.Interval)
+	defer ticker.Stop()
+
+	for {
+		hb.probe(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (hb *heartbeat) probe(ctx context.Context) {
+	cfg := hb.r.target.Heartbeat
+	ctx, cancel := context.WithTimeout(ctx, cfg.Timeout)
+	defer cancel()
+
+	start := time.Now()
+	var ackCode string
+	var err error
+	switch cfg.Mode {
+	case HeartbeatTCP:
+		var conn net.Conn
+		conn, err = (&net.Dialer{}).DialContext(ctx, "tcp", hb.addr)
+		if err == nil {
+			conn.Close()
+		}
+	case HeartbeatHL7:
+		var ack *hl7.AckResult
+		ack, err = hb.client.TestConnection(ctx, hb.nextMessage())
+		if ack != nil {
+			ackCode = ack.Code
+		}
+	}
+	rtt := time.Since(start)
+
+	// A probe cut short by shutdown or a reload says nothing
+	if ctx.Err() != nil && ctx.Err() != context.DeadlineExceeded {
+		return
+	}
+	hb.record(start, rtt, ackCode, err)
+}
+
+// nextMessage returns the message of an hl7 probe with a fresh timestamp and
+// control ID, so receivers do not drop it as a duplicate
+func (hb *heartbeat) nextMessage() []byte {
+	if hb.message == nil {
+		return hl7.CreateTestMessage()
+	}
+	msg, err := hl7.ParseStructure(hb.message)
+	if err != nil {
+		return hb.message
+	}
+	now := time.Now()
+	msh := msg.Segment("MSH")
+	msh.SetField(7, now.Format("20060102150405"))
+	msh.SetField(10, fmt.Sprintf("HB%d", now.UnixNano()))
+	return msg.Encode()
+}
+
+func (hb *heartbeat) record(at time.Time, rtt time.Duration, ackCode string, err error) {
+	hb.mu.Lock()
+	defer hb.mu.Unlock()
+
+	st := &hb.status
+	st.Probes++
+	st.LastProbe = &at
+	st.AckCode = ackCode
+	previous := st.State
+
+	if err != nil {
+		st.Failures++
+		st.ConsecutiveFailures++
+		st.LastError = err.Error()
+		if st.ConsecutiveFailures >= hb.r.target.Heartbeat.Failures && st.State != HeartbeatDown {
+			st.State = HeartbeatDown
+			st.DownSince = &at
+		}
+	} else {
+		ms := float64(rtt.Microseconds()) / 1000
+		st.RTTMs = ms
+		if st.AvgRTTMs == 0 {
+			st.AvgRTTMs = ms
+		} else {
+			st.AvgRTTMs = 0.8*st.AvgRTTMs + 0.2*ms
+		}
+		st.ConsecutiveFailures = 0
+		st.LastError = ""
+		st.LastSuccess = &at
+		st.DownSince = nil
+		st.State = HeartbeatUp
+	}
+
+	switch {
+	case st.State == HeartbeatDown && previous != HeartbeatDown:
+		slog.Error("Hedef erişilemiyor",
+			"name", st.Name,
+			"destination", st.Destination,
+			"failures", st.ConsecutiveFailures,
+			"error", st.LastError)
+	case st.State == HeartbeatUp && previous == HeartbeatDown:
+		slog.Info("Hedef yeniden erişilebilir", "name", st.Name, "destination", st.Destination, "rtt", rtt)
+	case err != nil && st.State != HeartbeatDown:
+		slog.Warn("Heartbeat başarısız", "name", st.Name, "destination", st.Destination, "error", err)
+	default:
+		slog.Debug("Heartbeat tamamlandı", "name", st.Name, "state", st.State, "rtt", rtt, "ackCode", ackCode, "error", err)
+	}
+}
+
+// close releases the connection of an hl7 probe
+func (hb *heartbeat) close() {
+	if hb != nil && hb.client != nil {
+		hb.client.Close()
+	}
+}
+
+// Status returns a copy of the probe results
+func (hb *heartbeat) Status() HeartbeatStatus {
+	hb.mu.Lock()
+	defer hb.mu.Unlock()
+	return hb.status
+}
@@ -5,21 +5,31 @@ import (
 )
 
 type HL7Message struct {
-	ID               string     `json:"id"`
-	Timestamp        time.Time  `json:"timestamp"`
-	Direction        string     `json:"direction"` // "order" or "report"
-	SourceAddr       string     `json:"source_addr"`
-	DestinationAddr  string     `json:"destination_addr"`
-	MessageType      string     `json:"message_type"`
-	MessageControlID string     `json:"message_control_id"`
-	PatientID        string     `json:"patient_id"`
-	PatientName      string     `json:"patient_name"`
-	RawMessage       []byte     `json:"raw_message"`
-	Status           string     `json:"status"` // "pending", "forwarded", "failed"
-	RetryCount       int        `json:"retry_count"`
-	LastError        string     `json:"last_error,omitempty"`
-	CreatedAt        time.Time  `json:"created_at"`
-	ProcessedAt      *time.Time `json:"processed_at,omitempty"`
+	ID               string    `json:"id"`
+	Timestamp        time.Time `json:"timestamp"`
+	Direction        string    `json:"direction"` // "order" or "report"
+	SourceAddr       string    `json:"source_addr"`
+	DestinationAddr  string    `json:"destination_addr"`
+	MessageType      string    `json:"message_type"`
+	MessageControlID string    `json:"message_control_id"`
+	PatientID        string    `json:"patient_id"`
+	PatientName      string    `json:"patient_name"`
+	RawMessage       []byte    `json:"raw_message"`
+	Status           string    `json:"status"` // "pending", "forwarded", "failed"
+	RetryCount       int       `json:"retry_count"`
+	LastError        string    `json:"last_error,omitempty"`
+	// AckMessage is the response of the destination (HL7 ACK or HTTP body)
+	AckMessage string `json:"ack_message,omitempty"`
+	// BatchID links messages received in the same FHS/BHS batch
+	BatchID string `json:"batch_id,omitempty"`
+	// ParentID links a message produced by a transform (e.g. OBR split) to
+	// the original message; the original lists its children in ChildIDs
+	ParentID string   `json:"parent_id,omitempty"`
+	ChildIDs []string `json:"child_ids,omitempty"`
+	// ValidationWarnings lists conformance violations found in warn mode
+	ValidationWarnings []string   `json:"validation_warnings,omitempty"`
+	CreatedAt          time.Time  `json:"created_at"`
+	ProcessedAt        *time.Time `json:"processed_at,omitempty"`
 }
 
 type StreamInfo struct {
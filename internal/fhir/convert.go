@@ -0,0 +1,700 @@
+package fhir
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/minasoft/hl7-replicator/internal/hl7"
+)
+
+// Default identifier systems used when the message carries no assigning
+// authority (PID-3.4) or universal ID (EI-3)
+const (
+	DefaultPatientSystem = "urn:hl7-replicator:patient-id"
+	DefaultOrderSystem   = "urn:hl7-replicator:order-id"
+)
+
+const (
+	identifierTypeSystem = "http://terminology.hl7.org/CodeSystem/v2-0203"
+	actCodeSystem        = "http://terminology.hl7.org/CodeSystem/v3-ActCode"
+	serviceSectionSystem = "http://terminology.hl7.org/CodeSystem/v2-0074"
+	interpretationSystem = "http://terminology.hl7.org/CodeSystem/v3-ObservationInterpretation"
+)
+
+// codeSystems maps HL7 v2 coding system names (table 0396) to FHIR URIs
+var codeSystems = map[string]string{
+	"LN":     "http://loinc.org",
+	"SCT":    "http://snomed.info/sct",
+	"SNM":    "http://snomed.info/sct",
+	"I10":    "http://hl7.org/fhir/sid/icd-10",
+	"I9C":    "http://hl7.org/fhir/sid/icd-9-cm",
+	"UCUM":   "http://unitsofmeasure.org",
+	"DCM":    "http://dicom.nema.org/resources/ontology/DCM",
+	"RADLEX": "http://radlex.org",
+}
+
+var oidPattern = regexp.MustCompile(`^[0-2](\.[0-9]+)+$`)
+
+// Converter maps HL7 v2 messages to FHIR R4 resources
+type Converter struct {
+	PatientSystem string
+	OrderSystem   string
+}
+
+func NewConverter(patientSystem, orderSystem string) *Converter {
+	if patientSystem == "" {
+		patientSystem = DefaultPatientSystem
+	}
+	if orderSystem == "" {
+		orderSystem = DefaultOrderSystem
+	}
+	return &Converter{PatientSystem: patientSystem, OrderSystem: orderSystem}
+}
+
+// ToBundle converts an ORM^O01 (Patient, Encounter, ServiceRequest) or an
+// ORU^R01 (Patient, DiagnosticReport, Observation) message to a transaction
+// Bundle. Resources are created conditionally on their identifiers so that
+// resending a message does not create duplicates.
+func (c *Converter) ToBundle(raw []byte) (*Bundle, error) {
+	msg, err := hl7.ParseStructure(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &bundleBuilder{conv: c, msg: msg, bundle: &Bundle{
+		ResourceType: "Bundle",
+		Type:         BundleTransaction,
+	}}
+
+	switch msg.Type() {
+	case "ORM^O01":
+		err = b.order()
+	case "ORU^R01":
+		err = b.result()
+	default:
+		return nil, fmt.Errorf("FHIR dönüşümü desteklenmeyen mesaj tipi: %s", msg.Type())
+	}
+	if err != nil {
+		return nil, err
+	}
+	return b.bundle, nil
+}
+
+type bundleBuilder struct {
+	conv   *Converter
+	msg    *hl7.Message
+	bundle *Bundle
+
+	patient   *Reference
+	encounter *Reference
+}
+
+// add appends a resource and returns a reference to its temporary fullUrl
+func (b *bundleBuilder) add(resource any, resourceType string, identifier *Identifier, update bool) (*Reference, error) {
+	data, err := json.Marshal(resource)
+	if err != nil {
+		return nil, err
+	}
+
+	fullURL := "urn:uuid:" + uuid.New().String()
+	req := &BundleRequest{Method: "POST", URL: resourceType}
+	if identifier != nil && identifier.Value != "" {
+		query := "identifier=" + url.QueryEscape(identifierToken(identifier))
+		if update {
+			// Conditional update so corrected results replace earlier versions
+			req.Method = "PUT"
+			req.URL = resourceType + "?" + query
+		} else {
+			req.IfNoneExist = query
+		}
+	}
+
+	b.bundle.Entry = append(b.bundle.Entry, BundleEntry{
+		FullURL:  fullURL,
+		Resource: data,
+		Request:  req,
+	})
+	return &Reference{Reference: fullURL}, nil
+}
+
+func identifierToken(id *Identifier) string {
+	if id.System == "" {
+		return id.Value
+	}
+	return id.System + "|" + id.Value
+}
+
+func (b *bundleBuilder) order() error {
+	if err := b.addPatient(); err != nil {
+		return err
+	}
+	if err := b.addEncounter(); err != nil {
+		return err
+	}
+
+	var orc *hl7.Segment
+	created := 0
+	for _, seg := range b.msg.Segments {
+		switch seg.Name {
+		case "ORC":
+			orc = seg
+		case "OBR":
+			if err := b.addServiceRequest(orc, seg); err != nil {
+				return err
+			}
+			created++
+		}
+	}
+
+	// Cancellations may carry an ORC without an OBR
+	if created == 0 {
+		if orc == nil {
+			return fmt.Errorf("ORC/OBR segmenti bulunamadı")
+		}
+		return b.addServiceRequest(orc, nil)
+	}
+	return nil
+}
+
+func (b *bundleBuilder) result() error {
+	if err := b.addPatient(); err != nil {
+		return err
+	}
+
+	var orc *hl7.Segment
+	var obr *hl7.Segment
+	var obxs []*hl7.Segment
+	flush := func() error {
+		if obr == nil {
+			return nil
+		}
+		err := b.addDiagnosticReport(orc, obr, obxs)
+		obr, obxs = nil, nil
+		return err
+	}
+
+	for _, seg := range b.msg.Segments {
+		switch seg.Name {
+		case "ORC":
+			if err := flush(); err != nil {
+				return err
+			}
+			orc = seg
+		case "OBR":
+			if err := flush(); err != nil {
+				return err
+			}
+			obr = seg
+		case "OBX":
+			if obr != nil {
+				obxs = append(obxs, seg)
+			}
+		}
+	}
+	if len(b.msg.All("OBR")) == 0 {
+		return fmt.Errorf("OBR segmenti bulunamadı")
+	}
+	return flush()
+}
+
+func (b *bundleBuilder) addPatient() error {
+	pid := b.msg.Segment("PID")
+	if pid == nil {
+		return fmt.Errorf("PID segmenti bulunamadı")
+	}
+
+	patient := Patient{ResourceType: "Patient"}
+	for _, rep := range pid.Repetitions(3) {
+		comps := strings.Split(rep, string(b.msg.Delims.Component))
+		if comps[0] == "" {
+			continue
+		}
+		id := Identifier{
+			System: b.system(component(comps, 4), b.conv.PatientSystem),
+			Value:  comps[0],
+		}
+		if typ := component(comps, 5); typ != "" {
+			id.Type = &CodeableConcept{Coding: []Coding{{System: identifierTypeSystem, Code: typ}}}
+		}
+		patient.Identifier = append(patient.Identifier, id)
+	}
+	if len(patient.Identifier) == 0 {
+		return fmt.Errorf("PID-3 hasta kimliği boş")
+	}
+
+	for _, rep := range pid.Repetitions(5) {
+		comps := strings.Split(rep, string(b.msg.Delims.Component))
+		name := HumanName{Family: b.text(component(comps, 1))}
+		for _, given := range []string{component(comps, 2), component(comps, 3)} {
+			if given != "" {
+				name.Given = append(name.Given, b.text(given))
+			}
+		}
+		if prefix := component(comps, 5); prefix != "" {
+			name.Prefix = []string{b.text(prefix)}
+		}
+		if name.Family != "" || len(name.Given) > 0 {
+			patient.Name = append(patient.Name, name)
+		}
+	}
+
+	patient.BirthDate = date(pid.Field(7))
+	patient.Gender = gender(pid.Field(8))
+
+	for _, rep := range pid.Repetitions(11) {
+		comps := strings.Split(rep, string(b.msg.Delims.Component))
+		addr := Address{
+			City:       b.text(component(comps, 3)),
+			State:      b.text(component(comps, 4)),
+			PostalCode: component(comps, 5),
+			Country:    component(comps, 6),
+		}
+		for _, line := range []string{component(comps, 1), component(comps, 2)} {
+			if line != "" {
+				addr.Line = append(addr.Line, b.text(line))
+			}
+		}
+		if len(addr.Line) > 0 || addr.City != "" {
+			patient.Address = append(patient.Address, addr)
+		}
+	}
+
+	if phone := pid.Component(13, 1); phone != "" {
+		patient.Telecom = []ContactPoint{{System: "phone", Value: phone}}
+	}
+
+	ref, err := b.add(patient, "Patient", &patient.Identifier[0], false)
+	if err != nil {
+		return err
+	}
+	b.patient = ref
+	return nil
+}
+
+func (b *bundleBuilder) addEncounter() error {
+	pv1 := b.msg.Segment("PV1")
+	if pv1 == nil {
+		return nil
+	}
+
+	encounter := Encounter{
+		ResourceType: "Encounter",
+		Status:       "in-progress",
+		Class:        encounterClass(pv1.Field(2)),
+		Subject:      b.patient,
+	}
+	if pv1.Field(45) != "" {
+		encounter.Status = "finished"
+	}
+
+	var visit *Identifier
+	if number := pv1.Component(19, 1); number != "" {
+		encounter.Identifier = []Identifier{{
+			Type:   &CodeableConcept{Coding: []Coding{{System: identifierTypeSystem, Code: "VN"}}},
+			System: b.system(pv1.Component(19, 4), b.conv.PatientSystem+"/visit"),
+			Value:  number,
+		}}
+		visit = &encounter.Identifier[0]
+	}
+
+	ref, err := b.add(encounter, "Encounter", visit, false)
+	if err != nil {
+		return err
+	}
+	b.encounter = ref
+	return nil
+}
+
+func (b *bundleBuilder) addServiceRequest(orc, obr *hl7.Segment) error {
+	req := ServiceRequest{
+		ResourceType: "ServiceRequest",
+		Status:       "active",
+		Intent:       "order",
+		Subject:      b.patient,
+		Encounter:    b.encounter,
+	}
+
+	if orc != nil {
+		req.Status = orderStatus(orc.Field(1))
+		req.AuthoredOn = dateTime(orc.Field(9))
+		req.Requester = b.practitioner(orc.Components(12))
+		req.Priority = priority(orc.Component(7, 6))
+	}
+
+	placer := b.orderIdentifier(orc, obr, 2, "PLAC")
+	filler := b.orderIdentifier(orc, obr, 3, "FILL")
+	for _, id := range []*Identifier{placer, filler} {
+		if id != nil {
+			req.Identifier = append(req.Identifier, *id)
+		}
+	}
+
+	if obr != nil {
+		req.Code = b.codeableConcept(obr.Components(4))
+		if req.Requester == nil {
+			req.Requester = b.practitioner(obr.Components(16))
+		}
+		if p := priority(obr.Component(27, 6)); p != "" {
+			req.Priority = p
+		}
+		for _, rep := range obr.Repetitions(31) {
+			if reason := b.codeableConcept(strings.Split(rep, string(b.msg.Delims.Component))); reason != nil {
+				req.ReasonCode = append(req.ReasonCode, *reason)
+			}
+		}
+		if info := obr.Field(13); info != "" {
+			req.Note = []Annotation{{Text: b.text(info)}}
+		}
+	}
+
+	key := placer
+	if key == nil {
+		key = filler
+	}
+	_, err := b.add(req, "ServiceRequest", key, false)
+	return err
+}
+
+func (b *bundleBuilder) addDiagnosticReport(orc, obr *hl7.Segment, obxs []*hl7.Segment) error {
+	report := DiagnosticReport{
+		ResourceType:      "DiagnosticReport",
+		Status:            reportStatus(obr.Field(25)),
+		Subject:           b.patient,
+		EffectiveDateTime: dateTime(obr.Field(7)),
+		Issued:            dateTime(obr.Field(22)),
+	}
+	if code := b.codeableConcept(obr.Components(4)); code != nil {
+		report.Code = *code
+	}
+	if section := obr.Field(24); section != "" {
+		report.Category = []CodeableConcept{{Coding: []Coding{{System: serviceSectionSystem, Code: section}}}}
+	}
+	if placer := b.orderIdentifier(orc, obr, 2, "PLAC"); placer != nil {
+		report.BasedOn = []Reference{{Identifier: placer}}
+	}
+	filler := b.orderIdentifier(orc, obr, 3, "FILL")
+	if filler != nil {
+		report.Identifier = []Identifier{*filler}
+	}
+	if interpreter := obr.Component(32, 1); interpreter != "" {
+		subs := strings.Split(interpreter, string(b.msg.Delims.Subcomponent))
+		if display := personDisplay(component(subs, 2), component(subs, 3)); display != "" {
+			report.Performer = []Reference{{Display: b.text(display)}}
+		}
+	}
+
+	var conclusion []string
+	for i, obx := range obxs {
+		obs := b.observation(obx, obr)
+		if isText(obx.Field(2)) && obs.ValueString != "" {
+			conclusion = append(conclusion, obs.ValueString)
+		}
+
+		var key *Identifier
+		if filler != nil {
+			setID := obx.Field(1)
+			if setID == "" {
+				setID = strconv.Itoa(i + 1)
+			}
+			key = &Identifier{System: filler.System, Value: filler.Value + "." + setID}
+			obs.Identifier = []Identifier{*key}
+		}
+
+		ref, err := b.add(obs, "Observation", key, true)
+		if err != nil {
+			return err
+		}
+		report.Result = append(report.Result, *ref)
+	}
+	report.Conclusion = strings.Join(conclusion, "\n")
+
+	_, err := b.add(report, "DiagnosticReport", filler, true)
+	return err
+}
+
+func (b *bundleBuilder) observation(obx, obr *hl7.Segment) Observation {
+	obs := Observation{
+		ResourceType:      "Observation",
+		Status:            observationStatus(obx.Field(11)),
+		Subject:           b.patient,
+		EffectiveDateTime: dateTime(obx.Field(14)),
+	}
+	if obs.EffectiveDateTime == "" {
+		obs.EffectiveDateTime = dateTime(obr.Field(7))
+	}
+	if code := b.codeableConcept(obx.Components(3)); code != nil {
+		obs.Code = *code
+	}
+
+	switch valueType := obx.Field(2); valueType {
+	case "NM":
+		if v, err := strconv.ParseFloat(strings.TrimSpace(obx.Field(5)), 64); err == nil {
+			obs.ValueQuantity = &Quantity{Value: &v, Unit: obx.Component(6, 1)}
+		} else {
+			obs.ValueString = b.text(obx.Field(5))
+		}
+	case "CE", "CWE", "CNE":
+		obs.ValueCodeableConcept = b.codeableConcept(obx.Components(5))
+	case "DT", "TS", "DTM":
+		obs.ValueDateTime = dateTime(obx.Field(5))
+	case "ED", "RP":
+		// Attachments are not mapped to Observation values
+	default:
+		var lines []string
+		for _, rep := range obx.Repetitions(5) {
+			lines = append(lines, b.text(rep))
+		}
+		obs.ValueString = strings.Join(lines, "\n")
+	}
+
+	if rng := obx.Field(7); rng != "" {
+		obs.ReferenceRange = []ReferenceRange{{Text: b.text(rng)}}
+	}
+	if flag := obx.Field(8); flag != "" {
+		obs.Interpretation = []CodeableConcept{{Coding: []Coding{{System: interpretationSystem, Code: flag}}}}
+	}
+	return obs
+}
+
+// orderIdentifier returns the placer (field 2) or filler (field 3) order
+// number of the ORC, falling back to the OBR
+func (b *bundleBuilder) orderIdentifier(orc, obr *hl7.Segment, field int, typ string) *Identifier {
+	var comps []string
+	for _, seg := range []*hl7.Segment{orc, obr} {
+		if seg != nil && seg.Component(field, 1) != "" {
+			comps = seg.Components(field)
+			break
+		}
+	}
+	if len(comps) == 0 {
+		return nil
+	}
+	return &Identifier{
+		Type:   &CodeableConcept{Coding: []Coding{{System: identifierTypeSystem, Code: typ}}},
+		System: b.system(component(comps, 3), b.conv.OrderSystem),
+		Value:  comps[0],
+	}
+}
+
+// system maps an assigning authority to an identifier system: OIDs become
+// urn:oid: URIs, URIs are kept and anything else falls back to the default
+func (b *bundleBuilder) system(authority, fallback string) string {
+	switch {
+	case oidPattern.MatchString(authority):
+		return "urn:oid:" + authority
+	case strings.Contains(authority, ":"):
+		return authority
+	default:
+		return fallback
+	}
+}
+
+// codeableConcept maps a CE/CWE value (code^text^system^altCode^altText^altSystem)
+func (b *bundleBuilder) codeableConcept(comps []string) *CodeableConcept {
+	cc := &CodeableConcept{Text: b.text(component(comps, 2))}
+	for i := 0; i < 4; i += 3 {
+		code := component(comps, i+1)
+		if code == "" {
+			continue
+		}
+		cc.Coding = append(cc.Coding, Coding{
+			System:  codeSystemURI(component(comps, i+3)),
+			Code:    code,
+			Display: b.text(component(comps, i+2)),
+		})
+	}
+	if len(cc.Coding) == 0 && cc.Text == "" {
+		return nil
+	}
+	return cc
+}
+
+// practitioner maps an XCN value (id^family^given) to a display reference
+func (b *bundleBuilder) practitioner(comps []string) *Reference {
+	display := personDisplay(component(comps, 2), component(comps, 3))
+	if display == "" && component(comps, 1) == "" {
+		return nil
+	}
+	ref := &Reference{Display: b.text(display)}
+	if id := component(comps, 1); id != "" {
+		ref.Identifier = &Identifier{Value: id}
+	}
+	return ref
+}
+
+func (b *bundleBuilder) text(s string) string {
+	return b.msg.Delims.UnescapeText(s)
+}
+
+// codeSystemURI maps an HL7 v2 coding system name to its FHIR URI
+func codeSystemURI(name string) string {
+	if uri, ok := codeSystems[strings.ToUpper(name)]; ok {
+		return uri
+	}
+	if oidPattern.MatchString(name) {
+		return "urn:oid:" + name
+	}
+	if strings.Contains(name, ":") {
+		return name
+	}
+	return ""
+}
+
+func component(comps []string, n int) string {
+	if n <= 0 || n > len(comps) {
+		return ""
+	}
+	return comps[n-1]
+}
+
+func personDisplay(family, given string) string {
+	return strings.TrimSpace(given + " " + family)
+}
+
+func isText(valueType string) bool {
+	return valueType == "TX" || valueType == "FT" || valueType == "ST"
+}
+
+func gender(code string) string {
+	switch strings.ToUpper(code) {
+	case "M":
+		return "male"
+	case "F":
+		return "female"
+	case "O", "A":
+		return "other"
+	case "U", "N":
+		return "unknown"
+	}
+	return ""
+}
+
+func encounterClass(code string) Coding {
+	switch code {
+	case "I":
+		return Coding{System: actCodeSystem, Code: "IMP", Display: "inpatient encounter"}
+	case "O":
+		return Coding{System: actCodeSystem, Code: "AMB", Display: "ambulatory"}
+	case "E":
+		return Coding{System: actCodeSystem, Code: "EMER", Display: "emergency"}
+	case "P":
+		return Coding{System: actCodeSystem, Code: "PRENC", Display: "pre-admission"}
+	}
+	return Coding{System: "http://terminology.hl7.org/CodeSystem/v2-0004", Code: code}
+}
+
+// orderStatus maps the ORC-1 order control code
+func orderStatus(control string) string {
+	switch control {
+	case "CA", "OC", "CR", "DC", "OD":
+		return "revoked"
+	case "HD", "OH":
+		return "on-hold"
+	case "CM":
+		return "completed"
+	}
+	return "active"
+}
+
+func priority(code string) string {
+	switch code {
+	case "S":
+		return "stat"
+	case "A":
+		return "asap"
+	case "R":
+		return "routine"
+	}
+	return ""
+}
+
+// reportStatus maps the OBR-25 result status
+func reportStatus(code string) string {
+	switch code {
+	case "F":
+		return "final"
+	case "C":
+		return "corrected"
+	case "P":
+		return "preliminary"
+	case "X":
+		return "cancelled"
+	case "A", "R":
+		return "partial"
+	case "I", "O", "S":
+		return "registered"
+	}
+	return "unknown"
+}
+
+// observationStatus maps the OBX-11 result status
+func observationStatus(code string) string {
+	switch code {
+	case "F":
+		return "final"
+	case "C":
+		return "corrected"
+	case "P", "R":
+		return "preliminary"
+	case "X":
+		return "cancelled"
+	case "D", "W":
+		return "entered-in-error"
+	case "I":
+		return "registered"
+	}
+	return "unknown"
+}
+
+// date converts an HL7 DT/TS value to a FHIR date
+func date(ts string) string {
+	if len(ts) > 8 {
+		ts = ts[:8]
+	}
+	return dateTime(ts)
+}
+
+// dateTime converts an HL7 TS/DTM value (YYYY[MM[DD[HH[MM[SS[.S]]]]]][+ZZZZ])
+// to a FHIR dateTime; times without an offset are taken as local time
+func dateTime(ts string) string {
+	ts = strings.TrimSpace(ts)
+	if ts == "" {
+		return ""
+	}
+
+	loc := time.Local
+	if i := strings.IndexAny(ts, "+-"); i > 0 {
+		if offset, err := time.Parse("-0700", ts[i:]); err == nil {
+			loc = offset.Location()
+		}
+		ts = ts[:i]
+	}
+	if i := strings.Index(ts, "."); i > 0 {
+		ts = ts[:i]
+	}
+
+	switch len(ts) {
+	case 4:
+		return ts
+	case 6:
+		return ts[:4] + "-" + ts[4:6]
+	case 8:
+		return ts[:4] + "-" + ts[4:6] + "-" + ts[6:8]
+	case 10, 12, 14:
+		ts += strings.Repeat("0", 14-len(ts))
+	default:
+		return ""
+	}
+
+	t, err := time.ParseInLocation("20060102150405", ts, loc)
+	if err != nil {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
@@ -0,0 +1,122 @@
+package fhir
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/minasoft/hl7-replicator/internal/db"
+	"github.com/minasoft/hl7-replicator/internal/hl7"
+)
+
+const contentTypeFHIR = "application/fhir+json"
+
+// maxResponseSize limits the transaction response recorded as ACK
+const maxResponseSize = 1 << 20
+
+// Destination converts forwarded HL7 v2 messages to transaction Bundles and
+// POSTs them to the base URL of a FHIR R4 server
+type Destination struct {
+	baseURL   string
+	token     string
+	converter *Converter
+	client    *http.Client
+}
+
+func NewDestination(baseURL, token string, timeout time.Duration, converter *Converter) (*Destination, error) {
+	if baseURL == "" {
+		return nil, fmt.Errorf("fhir hedefi için base URL gerekli")
+	}
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	return &Destination{
+		baseURL:   strings.TrimSuffix(baseURL, "/"),
+		token:     token,
+		converter: converter,
+		client:    &http.Client{Timeout: timeout},
+	}, nil
+}
+
+func (d *Destination) String() string {
+	return d.baseURL
+}
+
+// Deliver posts the Bundle; the transaction-response Bundle is returned as ACK
+func (d *Destination) Deliver(ctx context.Context, msg *db.HL7Message) ([]byte, error) {
+	bundle, err := d.converter.ToBundle(msg.RawMessage)
+	if err != nil {
+		return nil, fmt.Errorf("FHIR dönüşüm hatası: %w", err)
+	}
+	body, err := json.Marshal(bundle)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.baseURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("FHIR isteği oluşturulamadı: %w", err)
+	}
+	req.Header.Set("Content-Type", contentTypeFHIR)
+	req.Header.Set("Accept", contentTypeFHIR)
+	if d.token != "" {
+		req.Header.Set("Authorization", "Bearer "+d.token)
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("FHIR isteği başarısız: %w", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		err := fmt.Errorf("FHIR sunucusu HTTP %d döndü%s", resp.StatusCode, outcomeDiagnostics(respBody))
+		if permanentStatus(resp.StatusCode) {
+			return respBody, &hl7.PermanentError{Err: err}
+		}
+		return respBody, err
+	}
+
+	slog.Debug("Mesaj FHIR sunucusuna gönderildi",
+		"url", d.baseURL,
+		"id", msg.ID,
+		"resources", len(bundle.Entry))
+	return respBody, nil
+}
+
+// permanentStatus reports whether the server rejected the Bundle itself;
+// timeouts and rate limiting are retried like server errors
+func permanentStatus(code int) bool {
+	return code >= 400 && code < 500 &&
+		code != http.StatusRequestTimeout && code != http.StatusTooManyRequests
+}
+
+// outcomeDiagnostics extracts the issues of an OperationOutcome response
+func outcomeDiagnostics(body []byte) string {
+	var outcome OperationOutcome
+	if json.Unmarshal(body, &outcome) != nil || outcome.ResourceType != "OperationOutcome" {
+		return ""
+	}
+	var issues []string
+	for _, issue := range outcome.Issue {
+		if issue.Diagnostics != "" {
+			issues = append(issues, issue.Diagnostics)
+		}
+	}
+	if len(issues) == 0 {
+		return ""
+	}
+	return ": " + strings.Join(issues, "; ")
+}
+
+func (d *Destination) Close() error {
+	d.client.CloseIdleConnections()
+	return nil
+}
@@ -0,0 +1,161 @@
+package fhir
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/minasoft/hl7-replicator/internal/db"
+	"github.com/minasoft/hl7-replicator/internal/hl7"
+)
+
+const testORM = "MSH|^~\\&|HIS|HOSPITAL|ZP|ZENPACS|20240101120000||ORM^O01|C1|P|2.5\r" +
+	"PID|1||12345^^^HOSP^MR||DOE^JOHN||19800101|M\r" +
+	"PV1|1|O|RAD\r" +
+	"ORC|NW|ORD1|ACC1\r" +
+	"OBR|1|ORD1|ACC1|CT001^CT HEAD^L\r"
+
+func newTestDestination(t *testing.T, url, token string) *Destination {
+	t.Helper()
+	d, err := NewDestination(url, token, 5*time.Second, NewConverter("", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.Close() })
+	return d
+}
+
+func testMessage() *db.HL7Message {
+	return &db.HL7Message{ID: "m1", RawMessage: []byte(testORM)}
+}
+
+func writeOutcome(w http.ResponseWriter, status int, diagnostics string) {
+	w.Header().Set("Content-Type", contentTypeFHIR)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(OperationOutcome{
+		ResourceType: "OperationOutcome",
+		Issue:        []OperationOutcomeIssue{{Severity: "error", Code: "invalid", Diagnostics: diagnostics}},
+	})
+}
+
+func TestDestinationPostsTransactionBundle(t *testing.T) {
+	var got Bundle
+	var header http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header.Clone()
+		if r.Method != http.MethodPost || r.URL.Path != "/fhir" {
+			t.Errorf("istek %s %s, beklenen POST /fhir", r.Method, r.URL.Path)
+		}
+		body, _ := io.ReadAll(r.Body)
+		if err := json.Unmarshal(body, &got); err != nil {
+			t.Errorf("gövde Bundle değil: %v", err)
+		}
+		w.Header().Set("Content-Type", contentTypeFHIR)
+		io.WriteString(w, `{"resourceType":"Bundle","type":"transaction-response"}`)
+	}))
+	defer srv.Close()
+
+	d := newTestDestination(t, srv.URL+"/fhir/", "secret-token")
+	ack, err := d.Deliver(context.Background(), testMessage())
+	if err != nil {
+		t.Fatalf("Deliver: %v", err)
+	}
+
+	if !strings.Contains(string(ack), BundleTransactionResponse) {
+		t.Errorf("ACK transaction-response değil: %s", ack)
+	}
+	if got.ResourceType != "Bundle" || got.Type != BundleTransaction {
+		t.Errorf("Bundle %s/%s, beklenen Bundle/transaction", got.ResourceType, got.Type)
+	}
+	types := map[string]bool{}
+	for _, e := range got.Entry {
+		if e.Request == nil || e.Request.Method == "" {
+			t.Errorf("%s girdisinde request yok", ResourceType(e.Resource))
+		}
+		types[ResourceType(e.Resource)] = true
+	}
+	for _, want := range []string{"Patient", "ServiceRequest"} {
+		if !types[want] {
+			t.Errorf("Bundle'da %s yok: %v", want, types)
+		}
+	}
+	if v := header.Get("Content-Type"); v != contentTypeFHIR {
+		t.Errorf("Content-Type %q", v)
+	}
+	if v := header.Get("Authorization"); v != "Bearer secret-token" {
+		t.Errorf("Authorization %q, beklenen bearer token", v)
+	}
+}
+
+func TestDestinationWithoutToken(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if v := r.Header.Get("Authorization"); v != "" {
+			t.Errorf("token yokken Authorization gönderildi: %q", v)
+		}
+		io.WriteString(w, `{"resourceType":"Bundle","type":"transaction-response"}`)
+	}))
+	defer srv.Close()
+
+	if _, err := newTestDestination(t, srv.URL, "").Deliver(context.Background(), testMessage()); err != nil {
+		t.Fatalf("Deliver: %v", err)
+	}
+}
+
+func TestDestinationRejectionIsPermanent(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeOutcome(w, http.StatusUnprocessableEntity, "Patient.birthDate geçersiz")
+	}))
+	defer srv.Close()
+
+	ack, err := newTestDestination(t, srv.URL, "").Deliver(context.Background(), testMessage())
+	var permanent *hl7.PermanentError
+	if !errors.As(err, &permanent) {
+		t.Fatalf("4xx kalıcı hata olmalı, alınan: %v", err)
+	}
+	if !strings.Contains(err.Error(), "HTTP 422") || !strings.Contains(err.Error(), "Patient.birthDate geçersiz") {
+		t.Errorf("hata OperationOutcome ayrıntısını içermiyor: %v", err)
+	}
+	if !strings.Contains(string(ack), "OperationOutcome") {
+		t.Errorf("OperationOutcome ACK olarak kaydedilmedi: %s", ack)
+	}
+}
+
+func TestDestinationRetriesServerErrors(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch calls.Add(1) {
+		case 1:
+			writeOutcome(w, http.StatusServiceUnavailable, "bakımda")
+		case 2:
+			writeOutcome(w, http.StatusTooManyRequests, "yavaşlayın")
+		default:
+			io.WriteString(w, `{"resourceType":"Bundle","type":"transaction-response"}`)
+		}
+	}))
+	defer srv.Close()
+
+	d := newTestDestination(t, srv.URL, "")
+	var permanent *hl7.PermanentError
+	for i := 0; i < 2; i++ {
+		_, err := d.Deliver(context.Background(), testMessage())
+		if err == nil {
+			t.Fatalf("deneme %d başarılı olmamalıydı", i+1)
+		}
+		if errors.As(err, &permanent) {
+			t.Fatalf("deneme %d tekrar denenebilir olmalı: %v", i+1, err)
+		}
+	}
+	if _, err := d.Deliver(context.Background(), testMessage()); err != nil {
+		t.Fatalf("üçüncü deneme: %v", err)
+	}
+	if n := calls.Load(); n != 3 {
+		t.Errorf("%d istek, beklenen 3", n)
+	}
+}
@@ -0,0 +1,182 @@
+package fhir
+
+import "encoding/json"
+
+// The types below cover the subset of FHIR R4 used by the HL7 v2 mappings;
+// unknown elements of incoming resources are ignored.
+
+// Bundle types
+const (
+	BundleTransaction         = "transaction"
+	BundleTransactionResponse = "transaction-response"
+)
+
+type Bundle struct {
+	ResourceType string        `json:"resourceType"`
+	Type         string        `json:"type"`
+	Entry        []BundleEntry `json:"entry,omitempty"`
+}
+
+type BundleEntry struct {
+	FullURL  string          `json:"fullUrl,omitempty"`
+	Resource json.RawMessage `json:"resource,omitempty"`
+	Request  *BundleRequest  `json:"request,omitempty"`
+}
+
+type BundleRequest struct {
+	Method      string `json:"method"`
+	URL         string `json:"url"`
+	IfNoneExist string `json:"ifNoneExist,omitempty"`
+}
+
+// ResourceType returns the resourceType of a raw resource
+func ResourceType(raw json.RawMessage) string {
+	var r struct {
+		ResourceType string `json:"resourceType"`
+	}
+	json.Unmarshal(raw, &r)
+	return r.ResourceType
+}
+
+type Reference struct {
+	Reference  string      `json:"reference,omitempty"`
+	Identifier *Identifier `json:"identifier,omitempty"`
+	Display    string      `json:"display,omitempty"`
+}
+
+type Identifier struct {
+	Type   *CodeableConcept `json:"type,omitempty"`
+	System string           `json:"system,omitempty"`
+	Value  string           `json:"value,omitempty"`
+}
+
+type Coding struct {
+	System  string `json:"system,omitempty"`
+	Code    string `json:"code,omitempty"`
+	Display string `json:"display,omitempty"`
+}
+
+type CodeableConcept struct {
+	Coding []Coding `json:"coding,omitempty"`
+	Text   string   `json:"text,omitempty"`
+}
+
+type HumanName struct {
+	Family string   `json:"family,omitempty"`
+	Given  []string `json:"given,omitempty"`
+	Prefix []string `json:"prefix,omitempty"`
+}
+
+type Address struct {
+	Line       []string `json:"line,omitempty"`
+	City       string   `json:"city,omitempty"`
+	State      string   `json:"state,omitempty"`
+	PostalCode string   `json:"postalCode,omitempty"`
+	Country    string   `json:"country,omitempty"`
+}
+
+type ContactPoint struct {
+	System string `json:"system,omitempty"`
+	Value  string `json:"value,omitempty"`
+}
+
+type Quantity struct {
+	Value *float64 `json:"value,omitempty"`
+	Unit  string   `json:"unit,omitempty"`
+}
+
+type Annotation struct {
+	Text string `json:"text"`
+}
+
+// Attachment data is base64 encoded in JSON, as []byte is by encoding/json
+type Attachment struct {
+	ContentType string `json:"contentType,omitempty"`
+	Data        []byte `json:"data,omitempty"`
+	Title       string `json:"title,omitempty"`
+}
+
+type ReferenceRange struct {
+	Text string `json:"text,omitempty"`
+}
+
+type Patient struct {
+	ResourceType string         `json:"resourceType"`
+	ID           string         `json:"id,omitempty"`
+	Identifier   []Identifier   `json:"identifier,omitempty"`
+	Name         []HumanName    `json:"name,omitempty"`
+	Gender       string         `json:"gender,omitempty"`
+	BirthDate    string         `json:"birthDate,omitempty"`
+	Address      []Address      `json:"address,omitempty"`
+	Telecom      []ContactPoint `json:"telecom,omitempty"`
+}
+
+type Encounter struct {
+	ResourceType string       `json:"resourceType"`
+	Identifier   []Identifier `json:"identifier,omitempty"`
+	Status       string       `json:"status"`
+	Class        Coding       `json:"class"`
+	Subject      *Reference   `json:"subject,omitempty"`
+}
+
+type ServiceRequest struct {
+	ResourceType string            `json:"resourceType"`
+	Identifier   []Identifier      `json:"identifier,omitempty"`
+	Status       string            `json:"status"`
+	Intent       string            `json:"intent"`
+	Priority     string            `json:"priority,omitempty"`
+	Code         *CodeableConcept  `json:"code,omitempty"`
+	Subject      *Reference        `json:"subject"`
+	Encounter    *Reference        `json:"encounter,omitempty"`
+	AuthoredOn   string            `json:"authoredOn,omitempty"`
+	Requester    *Reference        `json:"requester,omitempty"`
+	ReasonCode   []CodeableConcept `json:"reasonCode,omitempty"`
+	Note         []Annotation      `json:"note,omitempty"`
+}
+
+type DiagnosticReport struct {
+	ResourceType      string            `json:"resourceType"`
+	ID                string            `json:"id,omitempty"`
+	Identifier        []Identifier      `json:"identifier,omitempty"`
+	BasedOn           []Reference       `json:"basedOn,omitempty"`
+	Status            string            `json:"status"`
+	Category          []CodeableConcept `json:"category,omitempty"`
+	Code              CodeableConcept   `json:"code"`
+	Subject           *Reference        `json:"subject,omitempty"`
+	EffectiveDateTime string            `json:"effectiveDateTime,omitempty"`
+	Issued            string            `json:"issued,omitempty"`
+	Performer         []Reference       `json:"performer,omitempty"`
+	Result            []Reference       `json:"result,omitempty"`
+	Conclusion        string            `json:"conclusion,omitempty"`
+	PresentedForm     []Attachment      `json:"presentedForm,omitempty"`
+	Contained         []json.RawMessage `json:"contained,omitempty"`
+}
+
+type Observation struct {
+	ResourceType         string            `json:"resourceType"`
+	ID                   string            `json:"id,omitempty"`
+	Identifier           []Identifier      `json:"identifier,omitempty"`
+	Status               string            `json:"status"`
+	Code                 CodeableConcept   `json:"code"`
+	Subject              *Reference        `json:"subject,omitempty"`
+	EffectiveDateTime    string            `json:"effectiveDateTime,omitempty"`
+	ValueQuantity        *Quantity         `json:"valueQuantity,omitempty"`
+	ValueString          string            `json:"valueString,omitempty"`
+	ValueCodeableConcept *CodeableConcept  `json:"valueCodeableConcept,omitempty"`
+	ValueDateTime        string            `json:"valueDateTime,omitempty"`
+	Interpretation       []CodeableConcept `json:"interpretation,omitempty"`
+	ReferenceRange       []ReferenceRange  `json:"referenceRange,omitempty"`
+}
+
+// OperationOutcome reports processing errors back to FHIR clients
+type OperationOutcome struct {
+	ResourceType string                  `json:"resourceType"`
+	Issue        []OperationOutcomeIssue `json:"issue"`
+}
+
+type OperationOutcomeIssue struct {
+	Severity    string   `json:"severity"` // fatal, error, warning, information
+	Code        string   `json:"code"`     // invalid, required, not-supported, exception, ...
+	Diagnostics string   `json:"diagnostics,omitempty"`
+	Expression  []string `json:"expression,omitempty"`
+}
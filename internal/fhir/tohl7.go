@@ -0,0 +1,411 @@
+package fhir
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/minasoft/hl7-replicator/internal/hl7"
+)
+
+// ConversionError describes why a resource could not be converted; the
+// expression points at the offending element for the OperationOutcome
+type ConversionError struct {
+	Expression string
+	Message    string
+}
+
+func (e *ConversionError) Error() string {
+	return e.Expression + ": " + e.Message
+}
+
+// Outcome builds an OperationOutcome for an error
+func Outcome(severity, code string, err error) *OperationOutcome {
+	issue := OperationOutcomeIssue{
+		Severity:    severity,
+		Code:        code,
+		Diagnostics: err.Error(),
+	}
+	if convErr, ok := err.(*ConversionError); ok {
+		issue.Diagnostics = convErr.Message
+		issue.Expression = []string{convErr.Expression}
+	}
+	return &OperationOutcome{ResourceType: "OperationOutcome", Issue: []OperationOutcomeIssue{issue}}
+}
+
+// resolver finds referenced resources in a Bundle or in contained resources
+type resolver map[string]json.RawMessage
+
+func (r resolver) resolve(ref *Reference, v any) bool {
+	if ref == nil || ref.Reference == "" {
+		return false
+	}
+	raw, ok := r[ref.Reference]
+	if !ok {
+		return false
+	}
+	return json.Unmarshal(raw, v) == nil
+}
+
+// addContained registers the contained resources of a report as "#id"
+func (r resolver) addContained(contained []json.RawMessage) {
+	for _, raw := range contained {
+		var res struct {
+			ID string `json:"id"`
+		}
+		if json.Unmarshal(raw, &res) == nil && res.ID != "" {
+			r["#"+res.ID] = raw
+		}
+	}
+}
+
+// ReportToORU converts a DiagnosticReport to an ORU^R01 message. The patient
+// and observations must be contained in the report; a subject given only
+// by identifier is used as PID-3.
+func (c *Converter) ReportToORU(raw json.RawMessage) ([]byte, error) {
+	return c.reportToORU(raw, resolver{})
+}
+
+// BundleToORU converts every DiagnosticReport of a Bundle to an ORU^R01
+// message; references are resolved against the fullUrl and Type/id of the
+// Bundle entries
+func (c *Converter) BundleToORU(raw json.RawMessage) ([][]byte, error) {
+	var bundle Bundle
+	if err := json.Unmarshal(raw, &bundle); err != nil {
+		return nil, &ConversionError{Expression: "Bundle", Message: "geçersiz JSON: " + err.Error()}
+	}
+	if bundle.ResourceType != "Bundle" {
+		return nil, &ConversionError{Expression: "Bundle", Message: "resourceType Bundle olmalı"}
+	}
+
+	refs := resolver{}
+	for _, entry := range bundle.Entry {
+		if entry.FullURL != "" {
+			refs[entry.FullURL] = entry.Resource
+		}
+		var res struct {
+			ResourceType string `json:"resourceType"`
+			ID           string `json:"id"`
+		}
+		if json.Unmarshal(entry.Resource, &res) == nil && res.ID != "" {
+			refs[res.ResourceType+"/"+res.ID] = entry.Resource
+		}
+	}
+
+	var messages [][]byte
+	for i, entry := range bundle.Entry {
+		if ResourceType(entry.Resource) != "DiagnosticReport" {
+			continue
+		}
+		message, err := c.reportToORU(entry.Resource, refs)
+		if err != nil {
+			if convErr, ok := err.(*ConversionError); ok {
+				convErr.Expression = fmt.Sprintf("Bundle.entry[%d].resource.%s", i, convErr.Expression)
+			}
+			return nil, err
+		}
+		messages = append(messages, message)
+	}
+
+	if len(messages) == 0 {
+		return nil, &ConversionError{Expression: "Bundle.entry", Message: "DiagnosticReport bulunamadı"}
+	}
+	return messages, nil
+}
+
+func (c *Converter) reportToORU(raw json.RawMessage, refs resolver) ([]byte, error) {
+	var report DiagnosticReport
+	if err := json.Unmarshal(raw, &report); err != nil {
+		return nil, &ConversionError{Expression: "DiagnosticReport", Message: "geçersiz JSON: " + err.Error()}
+	}
+	if report.ResourceType != "DiagnosticReport" {
+		return nil, &ConversionError{Expression: "DiagnosticReport", Message: "resourceType DiagnosticReport olmalı"}
+	}
+	if report.Status == "" {
+		return nil, &ConversionError{Expression: "DiagnosticReport.status", Message: "status zorunlu"}
+	}
+	if len(report.Code.Coding) == 0 && report.Code.Text == "" {
+		return nil, &ConversionError{Expression: "DiagnosticReport.code", Message: "code zorunlu"}
+	}
+
+	local := resolver{}
+	for k, v := range refs {
+		local[k] = v
+	}
+	local.addContained(report.Contained)
+
+	d := hl7.DefaultDelimiters
+	w := &oruWriter{conv: c, delims: d}
+
+	// Patient: a resolvable resource or a logical reference by identifier
+	var patient Patient
+	if !local.resolve(report.Subject, &patient) {
+		if report.Subject == nil || report.Subject.Identifier == nil || report.Subject.Identifier.Value == "" {
+			return nil, &ConversionError{Expression: "DiagnosticReport.subject", Message: "hasta kaynağı veya kimliği bulunamadı"}
+		}
+		patient = Patient{Identifier: []Identifier{*report.Subject.Identifier}}
+		if report.Subject.Display != "" {
+			patient.Name = []HumanName{{Family: report.Subject.Display}}
+		}
+	}
+	if len(patient.Identifier) == 0 || patient.Identifier[0].Value == "" {
+		return nil, &ConversionError{Expression: "DiagnosticReport.subject", Message: "hasta kimliği (identifier) zorunlu"}
+	}
+
+	controlID := fmt.Sprintf("F%d", time.Now().UnixNano())
+	w.segment("MSH", "^~\\&", "HL7_REPLICATOR", "MINASOFT", "", "",
+		time.Now().Format("20060102150405"), "", "ORU^R01^ORU_R01", controlID, "P", "2.5")
+	w.pid(patient)
+
+	placer, filler := "", ""
+	for _, based := range report.BasedOn {
+		if based.Identifier != nil && based.Identifier.Value != "" {
+			placer = based.Identifier.Value
+			break
+		}
+	}
+	for _, id := range report.Identifier {
+		if filler == "" || hasTypeCode(id, "FILL") {
+			filler = id.Value
+		}
+	}
+	w.segment("ORC", "RE", w.text(placer), w.text(filler))
+
+	obr := make([]string, 32)
+	obr[0] = "1"
+	obr[1] = w.text(placer)
+	obr[2] = w.text(filler)
+	obr[3] = w.coded(&report.Code)
+	obr[6] = hl7DateTime(report.EffectiveDateTime)
+	obr[21] = hl7DateTime(report.Issued)
+	obr[24] = resultStatus(report.Status)
+	if len(report.Category) > 0 && len(report.Category[0].Coding) > 0 {
+		obr[23] = w.text(report.Category[0].Coding[0].Code)
+	}
+	if len(report.Performer) > 0 && report.Performer[0].Display != "" {
+		obr[31] = string(d.Subcomponent) + w.text(report.Performer[0].Display)
+	}
+	w.segment("OBR", obr...)
+
+	// Results: referenced observations, then the text of the report
+	for i, ref := range report.Result {
+		var obs Observation
+		if !local.resolve(&ref, &obs) {
+			return nil, &ConversionError{
+				Expression: fmt.Sprintf("DiagnosticReport.result[%d]", i),
+				Message:    "Observation bulunamadı: " + ref.Reference,
+			}
+		}
+		w.observation(obs, report.Status)
+	}
+	for _, form := range report.PresentedForm {
+		if form.ContentType != "" && !strings.HasPrefix(form.ContentType, "text/plain") {
+			continue
+		}
+		w.textOBX("REPORT", "Report", string(form.Data), report.Status)
+	}
+	if report.Conclusion != "" {
+		w.textOBX("IMP", "Impression", report.Conclusion, report.Status)
+	}
+
+	return w.bytes(), nil
+}
+
+func hasTypeCode(id Identifier, code string) bool {
+	if id.Type == nil {
+		return false
+	}
+	for _, coding := range id.Type.Coding {
+		if coding.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+// oruWriter accumulates the segments of the generated message
+type oruWriter struct {
+	conv     *Converter
+	delims   hl7.Delimiters
+	segments []string
+	obx      int
+}
+
+func (w *oruWriter) segment(name string, fields ...string) {
+	// Drop trailing empty fields
+	for len(fields) > 0 && fields[len(fields)-1] == "" {
+		fields = fields[:len(fields)-1]
+	}
+	w.segments = append(w.segments, name+string(w.delims.Field)+strings.Join(fields, string(w.delims.Field)))
+}
+
+func (w *oruWriter) bytes() []byte {
+	return []byte(strings.Join(w.segments, "\r"))
+}
+
+func (w *oruWriter) text(s string) string {
+	return w.delims.EscapeText(s)
+}
+
+func (w *oruWriter) components(values ...string) string {
+	for len(values) > 0 && values[len(values)-1] == "" {
+		values = values[:len(values)-1]
+	}
+	return strings.Join(values, string(w.delims.Component))
+}
+
+func (w *oruWriter) pid(p Patient) {
+	var ids []string
+	for _, id := range p.Identifier {
+		typ := "MR"
+		if id.Type != nil && len(id.Type.Coding) > 0 && id.Type.Coding[0].Code != "" {
+			typ = id.Type.Coding[0].Code
+		}
+		ids = append(ids, w.components(w.text(id.Value), "", "", w.authority(id.System), typ))
+	}
+
+	var name string
+	if len(p.Name) > 0 {
+		n := p.Name[0]
+		given := append(append([]string(nil), n.Given...), "", "")
+		name = w.components(w.text(n.Family), w.text(given[0]), w.text(given[1]))
+	}
+
+	w.segment("PID", "1", "", strings.Join(ids, string(w.delims.Repetition)), "", name, "",
+		strings.ReplaceAll(p.BirthDate, "-", ""), administrativeSex(p.Gender))
+}
+
+// authority maps an identifier system back to PID-3.4
+func (w *oruWriter) authority(system string) string {
+	switch {
+	case system == "" || system == w.conv.PatientSystem:
+		return ""
+	case strings.HasPrefix(system, "urn:oid:"):
+		return strings.TrimPrefix(system, "urn:oid:")
+	default:
+		return w.text(system)
+	}
+}
+
+func (w *oruWriter) coded(cc *CodeableConcept) string {
+	if cc == nil {
+		return ""
+	}
+	if len(cc.Coding) == 0 {
+		return w.components("", w.text(cc.Text))
+	}
+	coding := cc.Coding[0]
+	display := coding.Display
+	if display == "" {
+		display = cc.Text
+	}
+	return w.components(w.text(coding.Code), w.text(display), w.text(codeSystemName(coding.System)))
+}
+
+func (w *oruWriter) observation(obs Observation, reportStatus string) {
+	status := obs.Status
+	if status == "" {
+		status = reportStatus
+	}
+
+	var valueType, value, units string
+	switch {
+	case obs.ValueQuantity != nil && obs.ValueQuantity.Value != nil:
+		valueType = "NM"
+		value = strconv.FormatFloat(*obs.ValueQuantity.Value, 'f', -1, 64)
+		units = w.text(obs.ValueQuantity.Unit)
+	case obs.ValueCodeableConcept != nil:
+		valueType = "CWE"
+		value = w.coded(obs.ValueCodeableConcept)
+	case obs.ValueDateTime != "":
+		valueType = "DTM"
+		value = hl7DateTime(obs.ValueDateTime)
+	default:
+		valueType = "TX"
+		value = w.text(obs.ValueString)
+	}
+
+	var rng, flag string
+	if len(obs.ReferenceRange) > 0 {
+		rng = w.text(obs.ReferenceRange[0].Text)
+	}
+	if len(obs.Interpretation) > 0 && len(obs.Interpretation[0].Coding) > 0 {
+		flag = w.text(obs.Interpretation[0].Coding[0].Code)
+	}
+
+	w.obx++
+	w.segment("OBX", strconv.Itoa(w.obx), valueType, w.coded(&obs.Code), "", value, units, rng, flag,
+		"", "", resultStatus(status), "", "", hl7DateTime(obs.EffectiveDateTime))
+}
+
+// textOBX adds a TX observation holding free text
+func (w *oruWriter) textOBX(code, display, text, status string) {
+	w.obx++
+	w.segment("OBX", strconv.Itoa(w.obx), "TX", w.components(code, display), "", w.text(text), "", "", "",
+		"", "", resultStatus(status))
+}
+
+// codeSystemName maps a FHIR code system URI back to its HL7 v2 name
+func codeSystemName(uri string) string {
+	switch uri {
+	case "":
+		return ""
+	case "http://snomed.info/sct":
+		return "SCT"
+	}
+	for name, u := range codeSystems {
+		if u == uri {
+			return name
+		}
+	}
+	return strings.TrimPrefix(uri, "urn:oid:")
+}
+
+func administrativeSex(gender string) string {
+	switch gender {
+	case "male":
+		return "M"
+	case "female":
+		return "F"
+	case "other":
+		return "O"
+	case "unknown":
+		return "U"
+	}
+	return ""
+}
+
+// resultStatus maps a DiagnosticReport/Observation status to OBR-25/OBX-11
+func resultStatus(status string) string {
+	switch status {
+	case "final", "appended":
+		return "F"
+	case "corrected", "amended":
+		return "C"
+	case "preliminary", "partial":
+		return "P"
+	case "cancelled":
+		return "X"
+	case "entered-in-error":
+		return "W"
+	case "registered":
+		return "I"
+	}
+	return ""
+}
+
+// hl7DateTime converts a FHIR date, dateTime or instant to an HL7 DTM value
+func hl7DateTime(value string) string {
+	if value == "" {
+		return ""
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t.Format("20060102150405-0700")
+	}
+	if t, err := time.Parse("2006-01-02T15:04:05", value); err == nil {
+		return t.Format("20060102150405")
+	}
+	return strings.ReplaceAll(value, "-", "")
+}
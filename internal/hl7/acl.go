@@ -0,0 +1,159 @@
+package hl7
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// AccessPolicy restricts which peers may connect to a listener and which
+// sending application/facility each peer may claim in MSH-3/MSH-4
+type AccessPolicy struct {
+	allow   []*net.IPNet
+	deny    []*net.IPNet
+	senders []expectedSender
+}
+
+type expectedSender struct {
+	network     *net.IPNet
+	application string
+	facility    string // empty matches any facility
+}
+
+// ParseAccessPolicy builds a policy from comma separated CIDR lists and a
+// sender map in the form "10.0.0.0/24=HIS^HOSPITAL,10.0.1.5=RIS"
+func ParseAccessPolicy(allow, deny, senders string) (*AccessPolicy, error) {
+	p := &AccessPolicy{}
+
+	var err error
+	if p.allow, err = parseCIDRList(allow); err != nil {
+		return nil, fmt.Errorf("geçersiz izin listesi: %w", err)
+	}
+	if p.deny, err = parseCIDRList(deny); err != nil {
+		return nil, fmt.Errorf("geçersiz engel listesi: %w", err)
+	}
+
+	for _, entry := range splitList(senders) {
+		cidr, sender, ok := strings.Cut(entry, "=")
+		if !ok || sender == "" {
+			return nil, fmt.Errorf("geçersiz gönderici tanımı: %q", entry)
+		}
+		network, err := parseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("geçersiz gönderici tanımı %q: %w", entry, err)
+		}
+		app, facility, _ := strings.Cut(sender, "^")
+		p.senders = append(p.senders, expectedSender{
+			network:     network,
+			application: strings.TrimSpace(app),
+			facility:    strings.TrimSpace(facility),
+		})
+	}
+
+	return p, nil
+}
+
+// AllowIP reports whether a peer may connect; deny rules win over allow
+// rules and an empty allow list allows everyone not denied
+func (p *AccessPolicy) AllowIP(ip net.IP) bool {
+	if p == nil {
+		return true
+	}
+	for _, n := range p.deny {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	if len(p.allow) == 0 {
+		return true
+	}
+	for _, n := range p.allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckSender verifies that MSH-3/MSH-4 match the sender expected for the
+// peer; peers without a sender rule are not checked
+func (p *AccessPolicy) CheckSender(ip net.IP, application, facility string) error {
+	if p == nil || len(p.senders) == 0 {
+		return nil
+	}
+
+	matched := false
+	for _, s := range p.senders {
+		if !s.network.Contains(ip) {
+			continue
+		}
+		matched = true
+		if componentEqual(application, s.application) &&
+			(s.facility == "" || componentEqual(facility, s.facility)) {
+			return nil
+		}
+	}
+	if !matched {
+		return nil
+	}
+
+	return fmt.Errorf("gönderici %s^%s bu kaynak için yetkili değil (%s)", application, facility, ip)
+}
+
+// componentEqual compares the first component (namespace ID) of a HD field
+func componentEqual(field, expected string) bool {
+	first, _, _ := strings.Cut(field, "^")
+	return strings.EqualFold(strings.TrimSpace(first), expected)
+}
+
+func parseCIDRList(list string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, entry := range splitList(list) {
+		n, err := parseCIDR(entry)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// parseCIDR accepts both CIDR notation and single addresses
+func parseCIDR(s string) (*net.IPNet, error) {
+	s = strings.TrimSpace(s)
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("geçersiz IP adresi: %q", s)
+		}
+		bits := 32
+		if ip.To4() == nil {
+			bits = 128
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, n, err := net.ParseCIDR(s)
+	return n, err
+}
+
+func splitList(s string) []string {
+	var out []string
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
+}
+
+// peerIP extracts the IP address from a net.Addr
+func peerIP(addr net.Addr) net.IP {
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		return tcp.IP
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
@@ -0,0 +1,90 @@
+package hl7
+
+import (
+	"net"
+	"testing"
+)
+
+func TestAccessPolicyAllowIP(t *testing.T) {
+	tests := []struct {
+		name        string
+		allow, deny string
+		ip          string
+		want        bool
+	}{
+		{"no rules", "", "", "192.0.2.1", true},
+		{"allowed network", "10.0.0.0/24", "", "10.0.0.17", true},
+		{"outside allowed network", "10.0.0.0/24", "", "10.0.1.17", false},
+		{"single address", "10.0.0.5", "", "10.0.0.5", true},
+		{"other single address", "10.0.0.5", "", "10.0.0.6", false},
+		{"one of several", "10.0.0.0/24, 172.16.0.0/12", "", "172.20.1.1", true},
+		{"denied", "", "10.0.0.0/8", "10.1.2.3", false},
+		{"not denied", "", "10.0.0.0/8", "192.0.2.1", true},
+		{"deny wins over allow", "10.0.0.0/8", "10.0.0.66", "10.0.0.66", false},
+		{"allowed next to denied", "10.0.0.0/8", "10.0.0.66", "10.0.0.67", true},
+		{"IPv6 network", "2001:db8::/32", "", "2001:db8::1", true},
+		{"IPv6 outside", "2001:db8::/32", "", "2001:db9::1", false},
+		{"IPv4 mapped IPv6 peer", "10.0.0.0/24", "", "::ffff:10.0.0.9", true},
+		{"IPv4 rule, IPv6 peer", "10.0.0.0/24", "", "2001:db8::1", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := ParseAccessPolicy(tt.allow, tt.deny, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := p.AllowIP(net.ParseIP(tt.ip)); got != tt.want {
+				t.Errorf("AllowIP(%s) = %v, beklenen %v", tt.ip, got, tt.want)
+			}
+		})
+	}
+
+	var nilPolicy *AccessPolicy
+	if !nilPolicy.AllowIP(net.ParseIP("192.0.2.1")) {
+		t.Error("politikasız dinleyici bağlantıyı reddetti")
+	}
+}
+
+func TestAccessPolicyCheckSender(t *testing.T) {
+	p, err := ParseAccessPolicy("", "", "10.0.0.0/24=HIS^HOSPITAL, 10.0.0.9=RIS, 10.0.1.0/24=LIS")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name          string
+		ip            string
+		app, facility string
+		ok            bool
+	}{
+		{"expected sender", "10.0.0.1", "HIS", "HOSPITAL", true},
+		{"case and HD components", "10.0.0.1", "his^1.2.3^ISO", "Hospital^x", true},
+		{"wrong facility", "10.0.0.1", "HIS", "OTHER", false},
+		{"wrong application", "10.0.0.1", "RIS", "HOSPITAL", false},
+		{"any rule of the peer", "10.0.0.9", "RIS", "ANY", true},
+		{"any facility", "10.0.1.4", "LIS", "", true},
+		{"peer without rule", "192.0.2.1", "ANY", "ANY", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := p.CheckSender(net.ParseIP(tt.ip), tt.app, tt.facility)
+			if (err == nil) != tt.ok {
+				t.Errorf("CheckSender(%s, %s, %s) = %v, beklenen izin %v", tt.ip, tt.app, tt.facility, err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestParseAccessPolicyErrors(t *testing.T) {
+	for _, tt := range []struct{ allow, deny, senders string }{
+		{"10.0.0.0/33", "", ""},
+		{"", "not-an-ip", ""},
+		{"", "", "10.0.0.1"},
+		{"", "", "10.0.0.1="},
+		{"", "", "10.0.0/24=HIS"},
+	} {
+		if _, err := ParseAccessPolicy(tt.allow, tt.deny, tt.senders); err == nil {
+			t.Errorf("geçersiz politika kabul edildi: %+v", tt)
+		}
+	}
+}
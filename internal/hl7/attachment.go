@@ -0,0 +1,266 @@
+package hl7
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// TransformExtractAttachments moves ED attachments to the object store
+const TransformExtractAttachments = "extract_attachments"
+
+// AttachmentBucket is the JetStream object store holding extracted attachments
+const AttachmentBucket = "HL7_ATTACHMENTS"
+
+// Attachment is an encapsulated (ED) or referenced (RP) document found in
+// OBX-5, e.g. a base64 encoded PDF report
+type Attachment struct {
+	Index     int    `json:"index"`  // 1-based position among the attachments of the message
+	SetID     string `json:"set_id"` // OBX-1
+	Type      string `json:"type"`   // "ED" or "RP"
+	MediaType string `json:"media_type"`
+	Encoding  string `json:"encoding,omitempty"`  // ED only: Base64, Hex or A
+	Size      int    `json:"size,omitempty"`      // decoded size of ED data
+	Reference string `json:"reference,omitempty"` // RP only: pointer to the document
+
+	data   string
+	delims Delimiters
+}
+
+// Attachments returns the ED and RP values of the message's OBX segments in
+// order; every repetition of OBX-5 is a separate attachment
+func (m *Message) Attachments() []Attachment {
+	var out []Attachment
+	for _, obx := range m.All("OBX") {
+		valueType := strings.ToUpper(obx.Field(2))
+		if valueType != "ED" && valueType != "RP" {
+			continue
+		}
+
+		for _, rep := range obx.Repetitions(5) {
+			if rep == "" {
+				continue
+			}
+			comps := strings.Split(rep, string(m.Delims.Component))
+			for len(comps) < 5 {
+				comps = append(comps, "")
+			}
+
+			a := Attachment{
+				Index:  len(out) + 1,
+				SetID:  obx.Field(1),
+				Type:   valueType,
+				delims: m.Delims,
+			}
+			if valueType == "ED" {
+				// Source application ^ type of data ^ subtype ^ encoding ^ data
+				a.MediaType = mediaType(comps[1], comps[2])
+				a.Encoding = comps[3]
+				a.data = comps[4]
+				if data, err := a.Data(); err == nil {
+					a.Size = len(data)
+				}
+			} else {
+				// Pointer ^ application ID ^ type of data ^ subtype
+				a.MediaType = mediaType(comps[2], comps[3])
+				a.Reference = m.Delims.UnescapeText(comps[0])
+			}
+			out = append(out, a)
+		}
+	}
+	return out
+}
+
+// Data decodes the content of an ED attachment
+func (a Attachment) Data() ([]byte, error) {
+	if a.Type != "ED" {
+		return nil, fmt.Errorf("%s eki veri içermiyor", a.Type)
+	}
+
+	switch strings.ToUpper(a.Encoding) {
+	case "BASE64":
+		cleaned := strings.Map(func(r rune) rune {
+			if r == ' ' || r == '\n' || r == '\r' || r == '\t' {
+				return -1
+			}
+			return r
+		}, a.delims.UnescapeText(a.data))
+		if data, err := base64.StdEncoding.DecodeString(cleaned); err == nil {
+			return data, nil
+		}
+		// Some senders drop the padding
+		data, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(cleaned, "="))
+		if err != nil {
+			return nil, fmt.Errorf("geçersiz base64 verisi: %w", err)
+		}
+		return data, nil
+	case "HEX":
+		data, err := hex.DecodeString(a.delims.UnescapeText(a.data))
+		if err != nil {
+			return nil, fmt.Errorf("geçersiz hex verisi: %w", err)
+		}
+		return data, nil
+	case "A", "":
+		return []byte(a.delims.UnescapeText(a.data)), nil
+	default:
+		return nil, fmt.Errorf("desteklenmeyen ED kodlaması: %s", a.Encoding)
+	}
+}
+
+// Extension returns the file extension matching the media type
+func (a Attachment) Extension() string {
+	switch a.MediaType {
+	case "application/pdf":
+		return ".pdf"
+	case "image/jpeg":
+		return ".jpg"
+	case "image/png":
+		return ".png"
+	case "image/tiff":
+		return ".tiff"
+	case "text/plain":
+		return ".txt"
+	case "text/html":
+		return ".html"
+	case "text/rtf", "application/rtf":
+		return ".rtf"
+	case "application/xml", "text/xml":
+		return ".xml"
+	}
+	return ".bin"
+}
+
+// mediaType builds a MIME type from the HL7 type of data (table 0191, e.g.
+// AP, IM, TEXT) and subtype (table 0291, e.g. PDF, JPEG)
+func mediaType(typeOfData, subtype string) string {
+	typ := strings.ToLower(strings.TrimSpace(typeOfData))
+	sub := strings.ToLower(strings.TrimSpace(subtype))
+
+	switch typ {
+	case "ap", "application":
+		typ = "application"
+	case "im", "image":
+		typ = "image"
+	case "tx", "text":
+		typ = "text"
+	case "au", "audio":
+		typ = "audio"
+	case "video", "multipart":
+	default:
+		typ = ""
+	}
+	if sub == "x-hl7-cda-level-one" {
+		return "application/xml"
+	}
+
+	switch {
+	case typ == "" && sub == "pdf":
+		return "application/pdf"
+	case typ == "" || sub == "":
+		return "application/octet-stream"
+	}
+	return typ + "/" + sub
+}
+
+// AttachmentExtractor is the transform storing ED attachments in the object
+// store; the OBX is rewritten as RP pointing to the download URL so that
+// destinations receive a link instead of the document
+type AttachmentExtractor struct {
+	store   jetstream.ObjectStore
+	baseURL string
+}
+
+func NewAttachmentExtractor(store jetstream.ObjectStore, baseURL string) *AttachmentExtractor {
+	return &AttachmentExtractor{
+		store:   store,
+		baseURL: strings.TrimRight(baseURL, "/"),
+	}
+}
+
+func (e *AttachmentExtractor) Name() string {
+	return TransformExtractAttachments
+}
+
+func (e *AttachmentExtractor) Apply(raw []byte) ([][]byte, error) {
+	msg, err := ParseStructure(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	attachments := msg.Attachments()
+	changed := false
+	i := 0
+	for _, obx := range msg.All("OBX") {
+		if !strings.EqualFold(obx.Field(2), "ED") {
+			// RP values are counted to keep the attachment indexes aligned
+			if strings.EqualFold(obx.Field(2), "RP") {
+				i += countValues(obx.Repetitions(5))
+			}
+			continue
+		}
+
+		var reps []string
+		for _, rep := range obx.Repetitions(5) {
+			if rep == "" {
+				continue
+			}
+			a := attachments[i]
+			i++
+
+			url, err := e.storeAttachment(a)
+			if err != nil {
+				return nil, err
+			}
+			comps := strings.Split(rep, string(msg.Delims.Component))
+			for len(comps) < 3 {
+				comps = append(comps, "")
+			}
+			reps = append(reps, strings.Join([]string{
+				msg.Delims.EscapeText(url), "HL7_REPLICATOR", comps[1], comps[2],
+			}, string(msg.Delims.Component)))
+		}
+
+		obx.SetField(2, "RP")
+		obx.SetField(5, strings.Join(reps, string(msg.Delims.Repetition)))
+		changed = true
+	}
+
+	if !changed {
+		return [][]byte{raw}, nil
+	}
+	return [][]byte{msg.Encode()}, nil
+}
+
+// storeAttachment saves the attachment and returns its download URL
+func (e *AttachmentExtractor) storeAttachment(a Attachment) (string, error) {
+	data, err := a.Data()
+	if err != nil {
+		return "", fmt.Errorf("OBX %s eki çözülemedi: %w", a.SetID, err)
+	}
+
+	name := uuid.New().String() + a.Extension()
+	_, err = e.store.Put(context.Background(), jetstream.ObjectMeta{
+		Name:     name,
+		Metadata: map[string]string{"content-type": a.MediaType},
+	}, bytes.NewReader(data))
+	if err != nil {
+		return "", fmt.Errorf("ek object store'a yazılamadı: %w", err)
+	}
+	return e.baseURL + "/api/attachments/" + name, nil
+}
+
+func countValues(reps []string) int {
+	n := 0
+	for _, rep := range reps {
+		if rep != "" {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,155 @@
+package hl7
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Batch is an HL7 v2 batch (BHS/BTS), optionally wrapped in a file envelope (FHS/FTS)
+type Batch struct {
+	FileHeader  []byte   // FHS segment, nil when the batch has no file envelope
+	BatchHeader []byte   // BHS segment, nil for a file with a single implicit batch
+	Messages    [][]byte // individual messages, each starting with MSH
+	Declared    int      // message count declared in BTS-1, -1 when absent
+}
+
+// IsBatch reports whether data starts with a file or batch header segment
+func IsBatch(data []byte) bool {
+	data = bytes.TrimLeft(UnwrapMLLP(data), "\r\n")
+	return bytes.HasPrefix(data, []byte("FHS")) || bytes.HasPrefix(data, []byte("BHS"))
+}
+
+// ParseBatch splits a batch into its messages; nested batches inside one
+// file are flattened
+func ParseBatch(data []byte) (*Batch, error) {
+	b := &Batch{Declared: -1}
+
+	var current [][]byte
+	flush := func() {
+		if len(current) > 0 {
+			b.Messages = append(b.Messages, bytes.Join(current, []byte{CarriageReturn}))
+			current = nil
+		}
+	}
+
+	for _, line := range splitSegments(UnwrapMLLP(data)) {
+		switch {
+		case bytes.HasPrefix(line, []byte("FHS")):
+			b.FileHeader = line
+		case bytes.HasPrefix(line, []byte("BHS")):
+			flush()
+			if b.BatchHeader == nil {
+				b.BatchHeader = line
+			}
+		case bytes.HasPrefix(line, []byte("BTS")):
+			flush()
+			fields := strings.Split(string(line), "|")
+			if len(fields) > 1 && fields[1] != "" {
+				if n, err := strconv.Atoi(fields[1]); err == nil {
+					if b.Declared < 0 {
+						b.Declared = 0
+					}
+					b.Declared += n
+				}
+			}
+		case bytes.HasPrefix(line, []byte("FTS")):
+			flush()
+		case bytes.HasPrefix(line, []byte("MSH")):
+			flush()
+			current = append(current, line)
+		default:
+			if len(current) == 0 {
+				return nil, fmt.Errorf("batch hatası: MSH'den önce segment bulundu: %.3s", line)
+			}
+			current = append(current, line)
+		}
+	}
+	flush()
+
+	if b.FileHeader == nil && b.BatchHeader == nil {
+		return nil, fmt.Errorf("batch hatası: FHS/BHS segmenti bulunamadı")
+	}
+	if b.Declared >= 0 && b.Declared != len(b.Messages) {
+		return nil, fmt.Errorf("batch hatası: BTS %d mesaj bildiriyor, %d bulundu", b.Declared, len(b.Messages))
+	}
+
+	return b, nil
+}
+
+// headerField returns field n (1-based, as for MSH) of a FHS/BHS segment
+func headerField(segment []byte, n int) string {
+	fields := strings.Split(string(segment), "|")
+	if n-1 < len(fields) && n > 1 {
+		return fields[n-1]
+	}
+	return ""
+}
+
+// BuildBatch wraps messages in a BHS/BTS batch, optionally within FHS/FTS
+func BuildBatch(messages [][]byte, sendingApp, receivingApp string, withFile bool) []byte {
+	timestamp := time.Now().Format("20060102150405")
+	controlID := fmt.Sprintf("B%d", time.Now().UnixNano())
+
+	var segs [][]byte
+	if withFile {
+		segs = append(segs, []byte(fmt.Sprintf("FHS|^~\\&|%s||%s||%s||||F%s", sendingApp, receivingApp, timestamp, controlID)))
+	}
+	segs = append(segs, []byte(fmt.Sprintf("BHS|^~\\&|%s||%s||%s||||%s", sendingApp, receivingApp, timestamp, controlID)))
+	for _, m := range messages {
+		segs = append(segs, bytes.TrimRight(UnwrapMLLP(m), "\r\n"))
+	}
+	segs = append(segs, []byte(fmt.Sprintf("BTS|%d", len(messages))))
+	if withFile {
+		segs = append(segs, []byte("FTS|1"))
+	}
+
+	return append(bytes.Join(segs, []byte{CarriageReturn}), CarriageReturn)
+}
+
+// CreateBatchACK builds the acknowledgement batch for a received batch:
+// one ACK per message in the original order, echoing the batch control ID
+// in BHS-12 and mirroring the file envelope when present
+func CreateBatchACK(b *Batch, acks [][]byte) []byte {
+	timestamp := time.Now().Format("20060102150405")
+
+	var segs [][]byte
+	if b.FileHeader != nil {
+		segs = append(segs, []byte(fmt.Sprintf("FHS|^~\\&|HL7_REPLICATOR|MINASOFT|%s|%s|%s||||ACK%s|%s",
+			headerField(b.FileHeader, 3), headerField(b.FileHeader, 4), timestamp,
+			headerField(b.FileHeader, 11), headerField(b.FileHeader, 11))))
+	}
+
+	batchControlID := headerField(b.BatchHeader, 11)
+	segs = append(segs, []byte(fmt.Sprintf("BHS|^~\\&|HL7_REPLICATOR|MINASOFT|%s|%s|%s||||ACK%s|%s",
+		headerField(b.BatchHeader, 3), headerField(b.BatchHeader, 4), timestamp,
+		batchControlID, batchControlID)))
+
+	for _, ack := range acks {
+		segs = append(segs, bytes.TrimRight(UnwrapMLLP(ack), "\r"))
+	}
+
+	segs = append(segs, []byte(fmt.Sprintf("BTS|%d", len(acks))))
+	if b.FileHeader != nil {
+		segs = append(segs, []byte("FTS|1"))
+	}
+
+	return WrapMLLP(append(bytes.Join(segs, []byte{CarriageReturn}), CarriageReturn))
+}
+
+// ACKCodes returns the MSA-1 code of every acknowledgement in data, which
+// may be a single ACK or an acknowledgement batch
+func ACKCodes(data []byte) []string {
+	var codes []string
+	for _, line := range splitSegments(UnwrapMLLP(data)) {
+		if bytes.HasPrefix(line, []byte("MSA")) {
+			fields := bytes.Split(line, []byte("|"))
+			if len(fields) > 1 {
+				codes = append(codes, string(fields[1]))
+			}
+		}
+	}
+	return codes
+}
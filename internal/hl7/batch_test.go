@@ -0,0 +1,133 @@
+package hl7
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+const (
+	batchMsg1 = "MSH|^~\\&|HIS|H|||20240101||ORM^O01|1|P|2.5\rPID|1||12345"
+	batchMsg2 = "MSH|^~\\&|HIS|H|||20240101||ORM^O01|2|P|2.5\rPID|1||67890\rOBR|1|A"
+)
+
+func TestBuildBatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		messages []string
+		withFile bool
+	}{
+		{"single message", []string{batchMsg1}, false},
+		{"several messages", []string{batchMsg1, batchMsg2}, false},
+		{"file envelope", []string{batchMsg1, batchMsg2}, true},
+		{"terminated and MLLP wrapped input", []string{batchMsg1 + "\r", string(WrapMLLP([]byte(batchMsg2 + "\r\n")))}, false},
+		{"empty", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var messages [][]byte
+			for _, m := range tt.messages {
+				messages = append(messages, []byte(m))
+			}
+			data := BuildBatch(messages, "APP", "PACS", tt.withFile)
+
+			if !IsBatch(data) {
+				t.Fatalf("batch olarak tanınmadı: %q", data)
+			}
+			if !strings.Contains(string(data), fmt.Sprintf("\rBTS|%d\r", len(messages))) {
+				t.Errorf("BTS segmenti hatalı: %q", data)
+			}
+
+			b, err := ParseBatch(data)
+			if err != nil {
+				t.Fatalf("ParseBatch: %v", err)
+			}
+			if (b.FileHeader != nil) != tt.withFile {
+				t.Errorf("FHS %q, beklenen dosya zarfı %v", b.FileHeader, tt.withFile)
+			}
+			if got := headerField(b.BatchHeader, 3); got != "APP" {
+				t.Errorf("BHS-3 %q", got)
+			}
+			if b.Declared != len(messages) || len(b.Messages) != len(messages) {
+				t.Fatalf("BTS %d, %d mesaj; beklenen %d", b.Declared, len(b.Messages), len(messages))
+			}
+			for i, m := range b.Messages {
+				want := []string{batchMsg1, batchMsg2}[i]
+				if string(m) != want {
+					t.Errorf("mesaj %d\nalınan   %q\nbeklenen %q", i+1, m, want)
+				}
+			}
+		})
+	}
+}
+
+func TestParseBatchErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"no header", batchMsg1 + "\r"},
+		{"segment before MSH", "BHS|^~\\&|HIS\rPID|1\r" + batchMsg1 + "\rBTS|1\r"},
+		{"count mismatch", "BHS|^~\\&|HIS\r" + batchMsg1 + "\rBTS|2\r"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ParseBatch([]byte(tt.data)); err == nil {
+				t.Errorf("geçersiz batch kabul edildi: %q", tt.data)
+			}
+		})
+	}
+}
+
+func TestSplitMessages(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want []string
+	}{
+		{"single", batchMsg1 + "\r", []string{batchMsg1}},
+		{"consecutive", batchMsg1 + "\r" + batchMsg2 + "\r", []string{batchMsg1, batchMsg2}},
+		{"blank lines between", batchMsg1 + "\r\r\n\r" + batchMsg2, []string{batchMsg1, batchMsg2}},
+		{"MLLP wrapped", string(WrapMLLP([]byte(batchMsg1 + "\r" + batchMsg2 + "\r"))), []string{batchMsg1, batchMsg2}},
+		{"empty", "\r\n", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := SplitMessages([]byte(tt.data))
+			if len(got) != len(tt.want) {
+				t.Fatalf("%d mesaj bulundu, beklenen %d: %q", len(got), len(tt.want), got)
+			}
+			for i := range got {
+				if string(got[i]) != tt.want[i] {
+					t.Errorf("mesaj %d\nalınan   %q\nbeklenen %q", i+1, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestCreateBatchACK(t *testing.T) {
+	b, err := ParseBatch([]byte("FHS|^~\\&|HIS|H|||||||F7\rBHS|^~\\&|HIS|H|||||||B7\r" + batchMsg1 + "\r" + batchMsg2 + "\rBTS|2\rFTS|1\r"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	acks := [][]byte{
+		CreateACK(b.Messages[0], "AA"),
+		CreateACK(b.Messages[1], "AE"),
+	}
+	data := CreateBatchACK(b, acks)
+
+	if got := ACKCodes(data); fmt.Sprint(got) != "[AA AE]" {
+		t.Errorf("ACK kodları %v", got)
+	}
+	reply, err := ParseBatch(data)
+	if err != nil {
+		t.Fatalf("ACK batch'i ayrıştırılamadı: %v", err)
+	}
+	if reply.FileHeader == nil {
+		t.Error("dosya zarfı yansıtılmadı")
+	}
+	if got := headerField(reply.BatchHeader, 12); got != "B7" {
+		t.Errorf("BHS-12 %q, beklenen B7", got)
+	}
+}
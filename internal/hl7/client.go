@@ -1,145 +1,320 @@
 package hl7
 
 import (
-	"bufio"
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
+	"syscall"
 	"time"
 )
 
-type MLLPClient struct {
-	host    string
-	port    int
-	timeout time.Duration
-	pool    *ConnectionPool
+// maxAckSize bounds the replies read by the client
+const maxAckSize = 10 * 1024 * 1024
+
+// Connection modes of an MLLP client
+const (
+	ModePersistent = "persistent"  // keep pooled connections open between messages
+	ModePerMessage = "per_message" // open a new connection for every message
+)
+
+// Framing describes non-standard MLLP framing used by some devices
+type Framing struct {
+	CRLF         bool // terminate segments with CR LF instead of CR
+	NoTrailingCR bool // end frames with <FS> only; replies are accepted either way
 }
 
-func NewMLLPClient(host string, port int) *MLLPClient {
-	return &MLLPClient{
-		host:    host,
-		port:    port,
-		timeout: 30 * time.Second,
-		pool:    NewConnectionPool(host, port, 5),
+// ClientOptions holds the settings of an MLLP client
+type ClientOptions struct {
+	ConnectTimeout time.Duration // default 10s
+	WriteTimeout   time.Duration // default 10s
+	AckTimeout     time.Duration // default 30s
+	Mode           string        // ModePersistent (default) or ModePerMessage
+	Framing        Framing
+	Pool           PoolOptions
+}
+
+// AckResult is the acknowledgement received for a message or batch
+type AckResult struct {
+	Code      string        // MSA-1 of the (first) acknowledgement
+	ControlID string        // MSA-2, the acknowledged message control ID
+	Text      string        // MSA-3 text message
+	Codes     []string      // MSA-1 of every acknowledgement in a batch reply
+	Message   []byte        // the unwrapped reply
+	Duration  time.Duration // time from sending to receiving the reply
+}
+
+// Accepted reports whether every acknowledgement is positive
+func (r *AckResult) Accepted() bool {
+	if len(r.Codes) == 0 {
+		return false
 	}
+	for _, code := range r.Codes {
+		if code != "AA" && code != "CA" {
+			return false
+		}
+	}
+	return true
 }
 
-func (c *MLLPClient) SendMessage(message []byte) error {
-	addr := fmt.Sprintf("%s:%d", c.host, c.port)
+type MLLPClient struct {
+	host string
+	port int
+	opts ClientOptions
+	pool *ConnectionPool
+}
 
-	// Get connection from pool
-	conn, err := c.pool.Get()
-	if err != nil {
-		return fmt.Errorf("bağlantı hatası %s: %w", addr, err)
+func NewMLLPClient(host string, port int, opts ClientOptions) *MLLPClient {
+	if opts.ConnectTimeout <= 0 {
+		opts.ConnectTimeout = 10 * time.Second
 	}
-	defer conn.Close()
+	if opts.WriteTimeout <= 0 {
+		opts.WriteTimeout = 10 * time.Second
+	}
+	if opts.AckTimeout <= 0 {
+		opts.AckTimeout = 30 * time.Second
+	}
+	if opts.Mode == "" {
+		opts.Mode = ModePersistent
+	}
+	opts.Pool.DialTimeout = opts.ConnectTimeout
 
-	slog.Debug("HL7 sunucusuna bağlandı", "address", addr)
+	return &MLLPClient{
+		host: host,
+		port: port,
+		opts: opts,
+		pool: NewConnectionPool(host, port, opts.Pool),
+	}
+}
 
-	// Wrap message with MLLP if not already wrapped
-	wrappedMessage := WrapMLLP(message)
+// Send delivers a message and waits for its acknowledgement. A result is
+// returned whenever a reply was received, also with the error of a negative
+// acknowledgement.
+func (c *MLLPClient) Send(ctx context.Context, message []byte) (*AckResult, error) {
+	addr := fmt.Sprintf("%s:%d", c.host, c.port)
+	message = UnwrapMLLP(message)
 
-	// Set write deadline
-	conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	controlID := ""
+	if parsed, err := ParseMessage(message); err == nil {
+		controlID = parsed["message_control_id"]
+	}
 
-	// Send message
-	_, err = conn.Write(wrappedMessage)
+	result, err := c.exchange(ctx, message, controlID)
 	if err != nil {
-		return fmt.Errorf("mesaj gönderme hatası: %w", err)
+		return nil, err
 	}
 
-	slog.Debug("HL7 mesaj gönderildi", "size", len(wrappedMessage))
+	if !result.Accepted() {
+		return result, fmt.Errorf("negatif ACK alındı: %s %s", result.Code, result.Text)
+	}
 
-	// Set read deadline for ACK
-	conn.SetReadDeadline(time.Now().Add(c.timeout))
+	slog.Info("HL7 mesaj başarıyla gönderildi",
+		"address", addr,
+		"messageControlID", result.ControlID,
+		"ackCode", result.Code,
+		"duration", result.Duration)
 
-	// Read ACK
-	reader := bufio.NewReader(conn)
-	ack, err := c.readMLLPMessage(reader)
-	if err != nil {
-		return fmt.Errorf("ACK okuma hatası: %w", err)
-	}
+	return result, nil
+}
+
+// SendBatch sends messages as a single BHS/BTS batch. The batch is accepted
+// only when every acknowledgement in the reply is positive; an empty
+// acknowledgement batch means the receiver only acknowledges errors.
+func (c *MLLPClient) SendBatch(ctx context.Context, messages [][]byte) (*AckResult, error) {
+	addr := fmt.Sprintf("%s:%d", c.host, c.port)
 
-	// Parse ACK
-	ackParsed, err := ParseMessage(ack)
+	result, err := c.exchange(ctx, BuildBatch(messages, "HL7_REPLICATOR", "", false), "")
 	if err != nil {
-		return fmt.Errorf("ACK parse hatası: %w", err)
+		return nil, err
 	}
 
-	// Check ACK code
-	ackCode := c.extractACKCode(ack)
-	if ackCode != "AA" && ackCode != "CA" {
-		return fmt.Errorf("negatif ACK alındı: %s", ackCode)
+	for _, code := range result.Codes {
+		if code != "AA" && code != "CA" {
+			return result, fmt.Errorf("batch içinde negatif ACK alındı: %s", code)
+		}
+	}
+	if len(result.Codes) == 0 && !IsBatch(result.Message) {
+		return result, fmt.Errorf("batch ACK alınamadı")
 	}
 
-	slog.Info("HL7 mesaj başarıyla gönderildi",
+	slog.Info("HL7 batch başarıyla gönderildi",
 		"address", addr,
-		"messageControlID", ackParsed["message_control_id"],
-		"ackCode", ackCode)
+		"messages", len(messages),
+		"acks", len(result.Codes))
 
-	return nil
+	return result, nil
 }
 
-func (c *MLLPClient) readMLLPMessage(reader *bufio.Reader) ([]byte, error) {
-	// Wait for start block
+// exchange sends one MLLP frame and returns the reply. A reused connection
+// closed by the peer while idle fails on write or before any reply byte;
+// only then is the frame sent again on another connection. The peer may
+// still have processed the first copy, so delivery is at least once and
+// receivers are expected to drop repeats by the unchanged MSH-10 control ID.
+func (c *MLLPClient) exchange(ctx context.Context, message []byte, controlID string) (*AckResult, error) {
 	for {
-		b, err := reader.ReadByte()
+		dialCtx, cancel := context.WithTimeout(ctx, c.opts.ConnectTimeout)
+		conn, err := c.pool.Get(dialCtx)
+		cancel()
 		if err != nil {
 			return nil, err
 		}
-		if b == StartBlock {
-			break
+
+		result, replied, err := c.exchangeOn(ctx, conn, message, controlID)
+		if err != nil || c.opts.Mode == ModePerMessage {
+			conn.MarkBroken()
 		}
+		conn.Close()
+
+		if err != nil && !replied && conn.Reused() && isStaleConnError(err) {
+			slog.Debug("Kapanmış bağlantı, yeni bağlantıyla tekrar deneniyor", "address", conn.RemoteAddr())
+			continue
+		}
+		return result, err
 	}
+}
+
+// exchangeOn sends the frame on conn; replied reports whether any reply
+// byte was received
+func (c *MLLPClient) exchangeOn(ctx context.Context, conn *PoolConn, message []byte, controlID string) (result *AckResult, replied bool, err error) {
+	// Abort blocking reads and writes when the context ends
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+	defer stop()
 
-	// Read until end block
-	var buffer bytes.Buffer
+	frame := c.frame(message)
+
+	conn.SetWriteDeadline(time.Now().Add(c.opts.WriteTimeout))
+	start := time.Now()
+	if _, err := conn.Write(frame); err != nil {
+		return nil, false, fmt.Errorf("mesaj gönderme hatası: %w", contextError(ctx, err))
+	}
+
+	slog.Debug("HL7 mesaj gönderildi", "size", len(frame))
+
+	conn.SetReadDeadline(time.Now().Add(c.opts.AckTimeout))
+	if _, err := conn.Reader().Peek(1); err != nil {
+		return nil, false, fmt.Errorf("ACK okuma hatası: %w", contextError(ctx, err))
+	}
 	for {
-		b, err := reader.ReadByte()
+		reply, err := ReadFrame(conn.Reader(), maxAckSize, nil)
 		if err != nil {
-			return nil, err
+			return nil, true, fmt.Errorf("ACK okuma hatası: %w", contextError(ctx, err))
 		}
+		reply = NormalizeSegments(reply)
 
-		if b == EndBlock {
-			// Read carriage return
-			cr, err := reader.ReadByte()
-			if err != nil {
-				return nil, err
-			}
-			if cr != CarriageReturn {
-				return nil, fmt.Errorf("MLLP formatı hatası: CR beklendi, %02X alındı", cr)
-			}
-			break
+		result = &AckResult{
+			Message:  reply,
+			Codes:    ACKCodes(reply),
+			Duration: time.Since(start),
 		}
+		if msa := msaFields(reply); msa != nil {
+			result.Code = msaField(msa, 1)
+			result.ControlID = msaField(msa, 2)
+			result.Text = msaField(msa, 3)
+		}
+
+		// A late reply to an earlier, timed out message is skipped
+		if controlID != "" && result.ControlID != "" && result.ControlID != controlID {
+			slog.Warn("Beklenmeyen ACK atlandı",
+				"expected", controlID,
+				"received", result.ControlID,
+				"address", conn.RemoteAddr())
+			continue
+		}
+		return result, true, nil
+	}
+}
 
-		buffer.WriteByte(b)
+// frame wraps a message in MLLP using the configured framing; apart from
+// CRLF framing the message is sent as is
+func (c *MLLPClient) frame(message []byte) []byte {
+	body := message
+	if c.opts.Framing.CRLF {
+		body = bytes.ReplaceAll(body, []byte("\r\n"), []byte{CarriageReturn})
+		body = bytes.ReplaceAll(body, []byte{CarriageReturn}, []byte("\r\n"))
 	}
 
-	return buffer.Bytes(), nil
+	frame := make([]byte, 0, len(body)+3)
+	frame = append(frame, StartBlock)
+	frame = append(frame, body...)
+	frame = append(frame, EndBlock)
+	if !c.opts.Framing.NoTrailingCR {
+		frame = append(frame, CarriageReturn)
+	}
+	return frame
 }
 
-func (c *MLLPClient) extractACKCode(ack []byte) string {
-	// Simple MSA segment parser for ACK code
-	lines := bytes.Split(ack, []byte("\r"))
-	for _, line := range lines {
+// msaFields returns the fields of the first MSA segment
+func msaFields(ack []byte) [][]byte {
+	for _, line := range bytes.Split(ack, []byte("\r")) {
 		if bytes.HasPrefix(line, []byte("MSA")) {
-			fields := bytes.Split(line, []byte("|"))
-			if len(fields) > 1 {
-				return string(fields[1])
-			}
+			return bytes.Split(line, []byte("|"))
 		}
 	}
+	return nil
+}
+
+func msaField(fields [][]byte, n int) string {
+	if n < len(fields) {
+		return string(fields[n])
+	}
 	return ""
 }
 
-// TestConnection tests if the HL7 server is reachable
-func (c *MLLPClient) TestConnection() error {
-	conn, err := c.pool.Get()
+// contextError reports the context error for I/O aborted by context.AfterFunc
+func contextError(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	return err
+}
+
+// isStaleConnError reports errors of a connection the peer already closed
+func isStaleConnError(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE)
+}
+
+// TestConnection tests if the HL7 server is reachable. With a message, the
+// message is sent as well and its acknowledgement returned; a negative
+// acknowledgement is returned together with an error.
+func (c *MLLPClient) TestConnection(ctx context.Context, message []byte) (*AckResult, error) {
+	if len(message) == 0 {
+		ctx, cancel := context.WithTimeout(ctx, c.opts.ConnectTimeout)
+		defer cancel()
+
+		conn, err := c.pool.Get(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("bağlantı testi başarısız: %w", err)
+		}
+		if c.opts.Mode == ModePerMessage {
+			conn.MarkBroken()
+		}
+		conn.Close()
+		return nil, nil
+	}
+
+	message = UnwrapMLLP(message)
+	controlID := ""
+	if parsed, err := ParseMessage(message); err == nil {
+		controlID = parsed["message_control_id"]
+	}
+
+	result, err := c.exchange(ctx, message, controlID)
 	if err != nil {
-		return fmt.Errorf("bağlantı testi başarısız: %w", err)
+		return nil, fmt.Errorf("bağlantı testi başarısız: %w", err)
 	}
-	conn.Close()
-	return nil
+	if !result.Accepted() {
+		return result, fmt.Errorf("test mesajı için negatif ACK alındı: %s %s", result.Code, result.Text)
+	}
+	return result, nil
+}
+
+// PoolStats returns the connection pool counters
+func (c *MLLPClient) PoolStats() PoolStats {
+	return c.pool.Stats()
 }
 
 // Close closes the connection pool
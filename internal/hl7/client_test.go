@@ -0,0 +1,167 @@
+package hl7
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stubServer is an MLLP server whose n-th accepted connection (0-based) is
+// served by serve; received frames are recorded per connection
+type stubServer struct {
+	mu       sync.Mutex
+	received map[int][]string
+	accepted int
+}
+
+func (s *stubServer) frames() (map[int][]string, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	received := make(map[int][]string, len(s.received))
+	for n, frames := range s.received {
+		received[n] = append([]string(nil), frames...)
+	}
+	return received, s.accepted
+}
+
+// read reads one frame on connection n and records it
+func (s *stubServer) read(n int, r *bufio.Reader) ([]byte, error) {
+	frame, err := ReadFrame(r, 0, nil)
+	if err == nil {
+		s.mu.Lock()
+		s.received[n] = append(s.received[n], string(frame))
+		s.mu.Unlock()
+	}
+	return frame, err
+}
+
+func newTestClient(t *testing.T, serve func(s *stubServer, n int, conn net.Conn, r *bufio.Reader)) (*MLLPClient, *stubServer) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	s := &stubServer{received: make(map[int][]string)}
+	go func() {
+		for n := 0; ; n++ {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.accepted++
+			s.mu.Unlock()
+			go func(n int) {
+				defer conn.Close()
+				conn.SetDeadline(time.Now().Add(5 * time.Second))
+				serve(s, n, conn, bufio.NewReader(conn))
+			}(n)
+		}
+	}()
+
+	host, port, _ := net.SplitHostPort(ln.Addr().String())
+	p, _ := strconv.Atoi(port)
+	c := NewMLLPClient(host, p, ClientOptions{AckTimeout: 5 * time.Second})
+	t.Cleanup(func() { c.pool.Close() })
+	return c, s
+}
+
+func testMessage(controlID string) []byte {
+	return []byte("MSH|^~\\&|HIS|H|PACS|R|20240101||ORM^O01|" + controlID + "|P|2.5\rPID|1||12345\r")
+}
+
+// send sends a message with the given control ID
+func send(t *testing.T, c *MLLPClient, controlID string) error {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := c.Send(ctx, testMessage(controlID))
+	return err
+}
+
+func TestClientResendsOnStaleConnection(t *testing.T) {
+	closed := make(chan struct{})
+	c, s := newTestClient(t, func(s *stubServer, n int, conn net.Conn, r *bufio.Reader) {
+		for {
+			frame, err := s.read(n, r)
+			if err != nil {
+				return
+			}
+			conn.Write(CreateACK(frame, "AA"))
+			if n == 0 {
+				// The first connection is closed while idle
+				close(closed)
+				return
+			}
+		}
+	})
+
+	if err := send(t, c, "1"); err != nil {
+		t.Fatalf("ilk mesaj: %v", err)
+	}
+	<-closed
+	time.Sleep(50 * time.Millisecond)
+
+	if err := send(t, c, "2"); err != nil {
+		t.Fatalf("kapanmış bağlantıdan sonra mesaj gönderilemedi: %v", err)
+	}
+	received, accepted := s.frames()
+	if accepted != 2 || len(received[0]) != 1 || len(received[1]) != 1 {
+		t.Errorf("%d bağlantı, alınan mesajlar %v", accepted, received)
+	}
+}
+
+func TestClientDoesNotResendAfterReply(t *testing.T) {
+	c, s := newTestClient(t, func(s *stubServer, n int, conn net.Conn, r *bufio.Reader) {
+		frame, err := s.read(n, r)
+		if err != nil {
+			return
+		}
+		conn.Write(CreateACK(frame, "AA"))
+
+		// The second message is answered with a late ACK of an earlier
+		// message only, then the connection is closed
+		if _, err := s.read(n, r); err != nil {
+			return
+		}
+		conn.Write(CreateACK(testMessage("0"), "AA"))
+	})
+
+	if err := send(t, c, "1"); err != nil {
+		t.Fatalf("ilk mesaj: %v", err)
+	}
+	if err := send(t, c, "2"); err == nil {
+		t.Fatal("ACK alınmadan mesaj kabul edildi")
+	}
+	received, accepted := s.frames()
+	if accepted != 1 || len(received[0]) != 2 {
+		t.Errorf("yanıt alınmış mesaj tekrar gönderildi: %d bağlantı, alınan mesajlar %v", accepted, received)
+	}
+}
+
+func TestClientFrame(t *testing.T) {
+	message := "MSH|^~\\&|HIS\rOBX|1|FT|||line 1\nline 2\r"
+	tests := []struct {
+		name    string
+		framing Framing
+		want    string
+	}{
+		{"as is", Framing{}, "\x0b" + message + "\x1c\r"},
+		{"CRLF", Framing{CRLF: true}, "\x0bMSH|^~\\&|HIS\r\nOBX|1|FT|||line 1\nline 2\r\n\x1c\r"},
+		{"no trailing CR", Framing{NoTrailingCR: true}, "\x0b" + message + "\x1c"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &MLLPClient{opts: ClientOptions{Framing: tt.framing}}
+			if got := string(c.frame([]byte(message))); got != tt.want {
+				t.Errorf("\nalınan   %q\nbeklenen %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,364 @@
+package hl7
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// XMLNamespace is the namespace of the HL7 v2 XML encoding
+const XMLNamespace = "urn:hl7-org:v2xml"
+
+// fieldTypes holds the data types of common composite fields; the XML
+// encoding names their components after the type (PID.3 -> CX.1, CX.4 ...).
+// Components of other fields are named after the field (PID.13.1).
+var fieldTypes = map[string]string{
+	"MSH.3": "HD", "MSH.4": "HD", "MSH.5": "HD", "MSH.6": "HD", "MSH.7": "TS",
+	"MSH.9": "MSG", "MSH.11": "PT", "MSH.12": "VID",
+	"ERR.3": "CWE",
+	"PID.3": "CX", "PID.5": "XPN", "PID.7": "TS", "PID.11": "XAD", "PID.13": "XTN",
+	"PV1.3": "PL", "PV1.7": "XCN", "PV1.8": "XCN", "PV1.19": "CX",
+	"ORC.2": "EI", "ORC.3": "EI", "ORC.4": "EI", "ORC.9": "TS", "ORC.12": "XCN",
+	"OBR.2": "EI", "OBR.3": "EI", "OBR.4": "CE", "OBR.7": "TS", "OBR.16": "XCN",
+	"OBR.22": "TS", "OBR.32": "NDL",
+	"OBX.3": "CE", "OBX.6": "CE", "OBX.14": "TS",
+}
+
+var segmentName = regexp.MustCompile(`^[A-Z][A-Z0-9]{2}$`)
+
+// FieldCount returns the number of the last field present in the segment
+func (s *Segment) FieldCount() int {
+	if s.Name == "MSH" {
+		return len(s.Fields)
+	}
+	return len(s.Fields) - 1
+}
+
+// Structure returns the message structure used as XML root element, e.g.
+// ORU_R01, taken from MSH-9.3 or built from the type and trigger event
+func (m *Message) Structure() string {
+	msh := m.Segment("MSH")
+	if msh == nil {
+		return "HL7"
+	}
+	// Acknowledgements always use the ACK structure
+	if msh.Component(9, 1) == "ACK" {
+		return "ACK"
+	}
+	if s := msh.Component(9, 3); s != "" {
+		return s
+	}
+	if trigger := msh.Component(9, 2); trigger != "" {
+		return msh.Component(9, 1) + "_" + trigger
+	}
+	if typ := msh.Component(9, 1); typ != "" {
+		return typ
+	}
+	return "HL7"
+}
+
+// EncodeXML encodes the message with the HL7 v2 XML encoding rules. Segment
+// groups are not emitted: segments are direct children of the root element.
+func (m *Message) EncodeXML() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+
+	enc := xml.NewEncoder(&buf)
+	enc.Indent("", "  ")
+
+	root := xml.StartElement{
+		Name: xml.Name{Local: m.Structure()},
+		Attr: []xml.Attr{{Name: xml.Name{Local: "xmlns"}, Value: XMLNamespace}},
+	}
+	enc.EncodeToken(root)
+
+	for _, seg := range m.Segments {
+		segStart := xml.StartElement{Name: xml.Name{Local: seg.Name}}
+		enc.EncodeToken(segStart)
+
+		for n := 1; n <= seg.FieldCount(); n++ {
+			fieldName := fmt.Sprintf("%s.%d", seg.Name, n)
+			value := seg.Field(n)
+			if value == "" {
+				continue
+			}
+
+			// MSH-1 and MSH-2 hold the delimiters themselves
+			if seg.Name == "MSH" && n <= 2 {
+				writeElement(enc, fieldName, value)
+				continue
+			}
+
+			for _, rep := range seg.Repetitions(n) {
+				if rep == "" {
+					continue
+				}
+				m.encodeField(enc, fieldName, rep)
+			}
+		}
+
+		enc.EncodeToken(segStart.End())
+	}
+
+	enc.EncodeToken(root.End())
+	if err := enc.Flush(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (m *Message) encodeField(enc *xml.Encoder, fieldName, value string) {
+	comps := strings.Split(value, string(m.Delims.Component))
+	if len(comps) == 1 && !strings.ContainsRune(value, rune(m.Delims.Subcomponent)) {
+		writeElement(enc, fieldName, m.Delims.UnescapeText(value))
+		return
+	}
+
+	prefix := fieldName
+	if typ, ok := fieldTypes[fieldName]; ok {
+		prefix = typ
+	}
+
+	start := xml.StartElement{Name: xml.Name{Local: fieldName}}
+	enc.EncodeToken(start)
+	for c, comp := range comps {
+		if comp == "" {
+			continue
+		}
+		compName := fmt.Sprintf("%s.%d", prefix, c+1)
+		subs := strings.Split(comp, string(m.Delims.Subcomponent))
+		if len(subs) == 1 {
+			writeElement(enc, compName, m.Delims.UnescapeText(comp))
+			continue
+		}
+
+		compStart := xml.StartElement{Name: xml.Name{Local: compName}}
+		enc.EncodeToken(compStart)
+		for s, sub := range subs {
+			if sub != "" {
+				writeElement(enc, fmt.Sprintf("%s.%d", compName, s+1), m.Delims.UnescapeText(sub))
+			}
+		}
+		enc.EncodeToken(compStart.End())
+	}
+	enc.EncodeToken(start.End())
+}
+
+func writeElement(enc *xml.Encoder, name, text string) {
+	start := xml.StartElement{Name: xml.Name{Local: name}}
+	enc.EncodeToken(start)
+	enc.EncodeToken(xml.CharData(text))
+	enc.EncodeToken(start.End())
+}
+
+// xmlNode is a generic element tree used while decoding
+type xmlNode struct {
+	name     string
+	text     string
+	children []*xmlNode
+}
+
+// DecodeXML converts an HL7 v2 XML encoded message to ER7. Segment group
+// elements (e.g. ORU_R01.PATIENT_RESULT) are descended into; components are
+// matched by the number after the last dot of their element names.
+func DecodeXML(data []byte) ([]byte, error) {
+	root, err := parseXMLTree(data)
+	if err != nil {
+		return nil, fmt.Errorf("geçersiz XML: %w", err)
+	}
+
+	var segments []*xmlNode
+	collectSegments(root, &segments)
+	if len(segments) == 0 || segments[0].name != "MSH" {
+		return nil, fmt.Errorf("geçersiz HL7 XML: MSH segmenti bulunamadı")
+	}
+
+	delims := DefaultDelimiters
+	for _, f := range segments[0].children {
+		switch f.name {
+		case "MSH.1":
+			if len(f.text) == 1 {
+				delims.Field = f.text[0]
+			}
+		case "MSH.2":
+			if len(f.text) >= 4 {
+				delims.Component = f.text[0]
+				delims.Repetition = f.text[1]
+				delims.Escape = f.text[2]
+				delims.Subcomponent = f.text[3]
+			}
+		}
+	}
+
+	var lines []string
+	for _, seg := range segments {
+		lines = append(lines, encodeSegment(seg, delims))
+	}
+	return []byte(strings.Join(lines, "\r")), nil
+}
+
+func parseXMLTree(data []byte) (*xmlNode, error) {
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	var stack []*xmlNode
+	var root *xmlNode
+
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			node := &xmlNode{name: t.Name.Local}
+			if len(stack) > 0 {
+				parent := stack[len(stack)-1]
+				parent.children = append(parent.children, node)
+			} else if root == nil {
+				root = node
+			}
+			stack = append(stack, node)
+		case xml.EndElement:
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+		case xml.CharData:
+			if len(stack) > 0 {
+				stack[len(stack)-1].text += string(t)
+			}
+		}
+	}
+
+	if root == nil {
+		return nil, fmt.Errorf("boş belge")
+	}
+	return root, nil
+}
+
+func collectSegments(node *xmlNode, out *[]*xmlNode) {
+	for _, child := range node.children {
+		if segmentName.MatchString(child.name) {
+			*out = append(*out, child)
+		} else if len(child.children) > 0 {
+			collectSegments(child, out)
+		}
+	}
+}
+
+// elementIndex returns the number after the last dot of an element name
+func elementIndex(name string) int {
+	i := strings.LastIndex(name, ".")
+	if i < 0 {
+		return 0
+	}
+	n, _ := strconv.Atoi(name[i+1:])
+	return n
+}
+
+func encodeSegment(seg *xmlNode, d Delimiters) string {
+	fields := map[int][]string{}
+	maxField := 0
+	for _, f := range seg.children {
+		n := elementIndex(f.name)
+		if n <= 0 {
+			continue
+		}
+		fields[n] = append(fields[n], encodeComposite(f, d, d.Component, d.Subcomponent))
+		if n > maxField {
+			maxField = n
+		}
+	}
+
+	parts := []string{seg.name}
+	start := 1
+	if seg.name == "MSH" {
+		parts = append(parts, string([]byte{d.Component, d.Repetition, d.Escape, d.Subcomponent}))
+		start = 3
+	}
+	for n := start; n <= maxField; n++ {
+		parts = append(parts, strings.Join(fields[n], string(d.Repetition)))
+	}
+	return strings.Join(parts, string(d.Field))
+}
+
+// encodeComposite builds a field (or component) value from its children
+func encodeComposite(node *xmlNode, d Delimiters, sep, subSep byte) string {
+	if len(node.children) == 0 {
+		return d.EscapeText(strings.TrimSpace(node.text))
+	}
+
+	values := map[int]string{}
+	maxIndex := 0
+	for _, child := range node.children {
+		n := elementIndex(child.name)
+		if n <= 0 {
+			continue
+		}
+		values[n] = encodeComposite(child, d, subSep, subSep)
+		if n > maxIndex {
+			maxIndex = n
+		}
+	}
+
+	parts := make([]string, maxIndex)
+	for i := range parts {
+		parts[i] = values[i+1]
+	}
+	return strings.Join(parts, string(sep))
+}
+
+// JSONMessage is the structured JSON representation of a message
+type JSONMessage struct {
+	Type     string        `json:"type"`
+	Segments []JSONSegment `json:"segments"`
+}
+
+type JSONSegment struct {
+	Name   string      `json:"name"`
+	Fields []JSONField `json:"fields"`
+}
+
+// JSONField holds a non-empty field; Repetitions lists the (unescaped)
+// components of each repetition when the field is composite or repeated.
+// Subcomponents stay joined with the subcomponent separator.
+type JSONField struct {
+	Position    int        `json:"position"`
+	Value       string     `json:"value"`
+	Repetitions [][]string `json:"repetitions,omitempty"`
+}
+
+// JSON returns the structured representation of the message
+func (m *Message) JSON() *JSONMessage {
+	out := &JSONMessage{Type: m.Type(), Segments: []JSONSegment{}}
+	for _, seg := range m.Segments {
+		js := JSONSegment{Name: seg.Name, Fields: []JSONField{}}
+		for n := 1; n <= seg.FieldCount(); n++ {
+			value := seg.Field(n)
+			if value == "" {
+				continue
+			}
+			field := JSONField{Position: n, Value: value}
+
+			composite := strings.ContainsAny(value, string([]byte{m.Delims.Component, m.Delims.Repetition}))
+			if composite && !(seg.Name == "MSH" && n <= 2) {
+				for _, rep := range seg.Repetitions(n) {
+					comps := strings.Split(rep, string(m.Delims.Component))
+					for i := range comps {
+						comps[i] = m.Delims.UnescapeText(comps[i])
+					}
+					field.Repetitions = append(field.Repetitions, comps)
+				}
+			}
+			js.Fields = append(js.Fields, field)
+		}
+		out.Segments = append(out.Segments, js)
+	}
+	return out
+}
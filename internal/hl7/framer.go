@@ -0,0 +1,74 @@
+package hl7
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+)
+
+// ErrFrameTooLarge is returned by ReadFrame when a frame exceeds the size
+// limit; the rest of the frame has been discarded
+var ErrFrameTooLarge = errors.New("MLLP çerçevesi boyut sınırını aşıyor")
+
+// ReadFrame reads one MLLP frame and returns its content. Bytes before the
+// start block are skipped and the CR after the end block is optional, as
+// some devices omit it. With maxSize > 0 at most maxSize bytes are kept: a
+// larger frame is read up to its end block without being buffered and its
+// first maxSize bytes are returned with ErrFrameTooLarge.
+//
+// onStart, when not nil, is called once the start block has been read so
+// that callers can switch from an idle to a read timeout.
+func ReadFrame(reader *bufio.Reader, maxSize int, onStart func()) ([]byte, error) {
+	// Wait for start block
+	for {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if b == StartBlock {
+			break
+		}
+	}
+	if onStart != nil {
+		onStart()
+	}
+
+	// Read until end block; EOF inside the frame is not a clean close
+	var frame bytes.Buffer
+	tooLarge := false
+	for {
+		chunk, err := reader.ReadSlice(EndBlock)
+		if err != nil && err != bufio.ErrBufferFull {
+			if err == io.EOF {
+				return nil, io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		if err == nil {
+			chunk = chunk[:len(chunk)-1]
+		}
+
+		if maxSize > 0 && frame.Len()+len(chunk) > maxSize {
+			chunk = chunk[:maxSize-frame.Len()]
+			tooLarge = true
+		}
+		frame.Write(chunk)
+
+		if err == nil {
+			break
+		}
+	}
+
+	// Consume the trailing CR when it has already arrived
+	if reader.Buffered() > 0 {
+		if next, _ := reader.Peek(1); next[0] == CarriageReturn {
+			reader.ReadByte()
+		}
+	}
+
+	if tooLarge {
+		return frame.Bytes(), ErrFrameTooLarge
+	}
+	return frame.Bytes(), nil
+}
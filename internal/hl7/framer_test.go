@@ -0,0 +1,95 @@
+package hl7
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+// frame wraps payload in MLLP blocks followed by trailer
+func frame(payload []byte, trailer string) []byte {
+	b := append([]byte{StartBlock}, payload...)
+	b = append(b, EndBlock)
+	return append(b, trailer...)
+}
+
+// readAll reads frames until the reader fails
+func readAll(data []byte, maxSize int) (frames [][]byte, errs []error) {
+	// A small buffer makes frames span several ReadSlice calls
+	reader := bufio.NewReaderSize(bytes.NewReader(data), 16)
+	for {
+		f, err := ReadFrame(reader, maxSize, nil)
+		if err != nil && !errors.Is(err, ErrFrameTooLarge) {
+			return frames, errs
+		}
+		frames = append(frames, f)
+		errs = append(errs, err)
+	}
+}
+
+func FuzzReadFrame(f *testing.F) {
+	f.Add([]byte("MSH|^~\\&|HIS|H|ZP|Z|20240101||ORM^O01|C1|P|2.5\rPID|1||123\r"), uint16(0))
+	f.Add([]byte("MSH|^~\\&|HIS|H\nPID|1\r\n"), uint16(8))
+	f.Add([]byte{}, uint16(1))
+	f.Add([]byte{StartBlock, EndBlock, CarriageReturn, StartBlock}, uint16(3))
+	f.Add(bytes.Repeat([]byte("x"), 100), uint16(17))
+
+	f.Fuzz(func(t *testing.T, data []byte, limit uint16) {
+		maxSize := int(limit)
+
+		// Arbitrary input: no panic and no frame beyond the limit
+		frames, errs := readAll(data, maxSize)
+		for i, fr := range frames {
+			if maxSize > 0 && len(fr) > maxSize {
+				t.Fatalf("çerçeve %d bayt, sınır %d", len(fr), maxSize)
+			}
+			if errors.Is(errs[i], ErrFrameTooLarge) && len(fr) != maxSize {
+				t.Fatalf("büyük çerçevenin %d baytı döndü, beklenen %d", len(fr), maxSize)
+			}
+		}
+
+		// A payload without block characters is returned as is, whatever
+		// follows the end block, and the next frame is read correctly
+		payload := bytes.Map(func(r rune) rune {
+			if r == StartBlock || r == EndBlock {
+				return -1
+			}
+			return r
+		}, data)
+		next := []byte("MSH|^~\\&|NEXT\r")
+		for _, trailer := range []string{"", "\r", "\r\n", "\n"} {
+			input := append(frame(payload, trailer), frame(next, "\r")...)
+			frames, errs := readAll(input, 0)
+			if len(frames) != 2 || errs[0] != nil || errs[1] != nil {
+				t.Fatalf("trailer %q: %d çerçeve, hatalar %v", trailer, len(frames), errs)
+			}
+			if !bytes.Equal(frames[0], payload) || !bytes.Equal(frames[1], next) {
+				t.Fatalf("trailer %q: içerik değişti: %q, %q", trailer, frames[0], frames[1])
+			}
+		}
+
+		// After a frame beyond the limit the next frame is read correctly
+		if maxSize == 0 || len(payload) <= maxSize || len(next) > maxSize {
+			return
+		}
+		frames, errs = readAll(append(frame(payload, "\r"), frame(next, "\r")...), maxSize)
+		if len(frames) != 2 || !errors.Is(errs[0], ErrFrameTooLarge) || errs[1] != nil {
+			t.Fatalf("%d çerçeve, hatalar %v", len(frames), errs)
+		}
+		if !bytes.Equal(frames[0], payload[:maxSize]) || !bytes.Equal(frames[1], next) {
+			t.Fatalf("içerik değişti: %q, %q", frames[0], frames[1])
+		}
+	})
+}
+
+func TestReadFrameUnexpectedEOF(t *testing.T) {
+	reader := bufio.NewReader(bytes.NewReader([]byte{StartBlock, 'M', 'S', 'H'}))
+	if _, err := ReadFrame(reader, 0, nil); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("yarım çerçeve %v döndü, beklenen ErrUnexpectedEOF", err)
+	}
+	if _, err := ReadFrame(reader, 0, nil); !errors.Is(err, io.EOF) {
+		t.Fatalf("boş bağlantı %v döndü, beklenen EOF", err)
+	}
+}
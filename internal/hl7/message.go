@@ -0,0 +1,275 @@
+package hl7
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// Delimiters holds the encoding characters declared in MSH-1/MSH-2
+type Delimiters struct {
+	Field        byte
+	Component    byte
+	Repetition   byte
+	Escape       byte
+	Subcomponent byte
+}
+
+// DefaultDelimiters are the standard HL7 v2 encoding characters
+var DefaultDelimiters = Delimiters{
+	Field:        '|',
+	Component:    '^',
+	Repetition:   '~',
+	Escape:       '\\',
+	Subcomponent: '&',
+}
+
+// Message is a parsed HL7 v2 message
+type Message struct {
+	Delims   Delimiters
+	Segments []*Segment
+}
+
+// Segment is a single segment; Fields[0] holds the segment name so that
+// Fields[n] is field n for every segment except MSH (see Field)
+type Segment struct {
+	Name   string
+	Fields []string
+	delims *Delimiters
+}
+
+// ParseStructure parses an ER7 encoded message into segments and fields
+func ParseStructure(data []byte) (*Message, error) {
+	data = UnwrapMLLP(data)
+
+	lines := splitSegments(data)
+	if len(lines) == 0 {
+		return nil, fmt.Errorf("boş mesaj")
+	}
+	if !bytes.HasPrefix(lines[0], []byte("MSH")) || len(lines[0]) < 8 {
+		return nil, fmt.Errorf("geçersiz HL7 mesajı: MSH segmenti bulunamadı")
+	}
+
+	header := lines[0]
+	msg := &Message{Delims: Delimiters{
+		Field:        header[3],
+		Component:    header[4],
+		Repetition:   header[5],
+		Escape:       header[6],
+		Subcomponent: header[7],
+	}}
+
+	for _, line := range lines {
+		fields := strings.Split(string(line), string(msg.Delims.Field))
+		msg.Segments = append(msg.Segments, &Segment{
+			Name:   fields[0],
+			Fields: fields,
+			delims: &msg.Delims,
+		})
+	}
+
+	return msg, nil
+}
+
+// splitSegments splits on CR and drops empty lines; stray LFs are trimmed
+func splitSegments(data []byte) [][]byte {
+	var lines [][]byte
+	for _, line := range bytes.Split(data, []byte{CarriageReturn}) {
+		line = bytes.Trim(line, "\n")
+		if len(line) > 0 {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// Segment returns the first segment with the given name
+func (m *Message) Segment(name string) *Segment {
+	for _, seg := range m.Segments {
+		if seg.Name == name {
+			return seg
+		}
+	}
+	return nil
+}
+
+// All returns every segment with the given name
+func (m *Message) All(name string) []*Segment {
+	var out []*Segment
+	for _, seg := range m.Segments {
+		if seg.Name == name {
+			out = append(out, seg)
+		}
+	}
+	return out
+}
+
+// Type returns MSH-9 as "ORM^O01"
+func (m *Message) Type() string {
+	msh := m.Segment("MSH")
+	if msh == nil {
+		return ""
+	}
+	comps := msh.Components(9)
+	if len(comps) > 2 {
+		comps = comps[:2]
+	}
+	return strings.Join(comps, string(m.Delims.Component))
+}
+
+// Encode serializes the message back to ER7 with CR segment terminators
+func (m *Message) Encode() []byte {
+	var buf bytes.Buffer
+	for i, seg := range m.Segments {
+		if i > 0 {
+			buf.WriteByte(CarriageReturn)
+		}
+		buf.WriteString(strings.Join(seg.Fields, string(m.Delims.Field)))
+	}
+	return buf.Bytes()
+}
+
+// NewSegment creates a segment using the message delimiters
+func (m *Message) NewSegment(name string, fields ...string) *Segment {
+	return &Segment{
+		Name:   name,
+		Fields: append([]string{name}, fields...),
+		delims: &m.Delims,
+	}
+}
+
+// index maps an HL7 field number to the Fields index; MSH-1 is the field
+// separator itself so MSH fields are shifted by one
+func (s *Segment) index(n int) int {
+	if s.Name == "MSH" {
+		return n - 1
+	}
+	return n
+}
+
+// Field returns field n (1-based, as numbered in the HL7 standard)
+func (s *Segment) Field(n int) string {
+	if s.Name == "MSH" && n == 1 {
+		return string(s.delims.Field)
+	}
+	i := s.index(n)
+	if i <= 0 || i >= len(s.Fields) {
+		return ""
+	}
+	return s.Fields[i]
+}
+
+// SetField sets field n, growing the segment when needed
+func (s *Segment) SetField(n int, value string) {
+	i := s.index(n)
+	if i <= 0 {
+		return
+	}
+	for len(s.Fields) <= i {
+		s.Fields = append(s.Fields, "")
+	}
+	s.Fields[i] = value
+}
+
+// Repetitions returns the repetitions of field n
+func (s *Segment) Repetitions(n int) []string {
+	value := s.Field(n)
+	if value == "" {
+		return nil
+	}
+	if s.Name == "MSH" && n == 2 {
+		return []string{value}
+	}
+	return strings.Split(value, string(s.delims.Repetition))
+}
+
+// Components returns the components of the first repetition of field n
+func (s *Segment) Components(n int) []string {
+	reps := s.Repetitions(n)
+	if len(reps) == 0 {
+		return []string{""}
+	}
+	return strings.Split(reps[0], string(s.delims.Component))
+}
+
+// Component returns component c (1-based) of the first repetition of field n
+func (s *Segment) Component(n, c int) string {
+	comps := s.Components(n)
+	if c <= 0 || c > len(comps) {
+		return ""
+	}
+	return comps[c-1]
+}
+
+// Clone returns a deep copy of the segment
+func (s *Segment) Clone() *Segment {
+	return &Segment{
+		Name:   s.Name,
+		Fields: append([]string(nil), s.Fields...),
+		delims: s.delims,
+	}
+}
+
+// NormalizeSegments converts CRLF segment terminators to CR, as written by
+// tools that save HL7 as ordinary text files. LF is a terminator only in
+// data without any CR; otherwise it belongs to the text (e.g. OBX-5 FT).
+func NormalizeSegments(data []byte) []byte {
+	data = bytes.ReplaceAll(data, []byte("\r\n"), []byte{CarriageReturn})
+	if bytes.IndexByte(data, CarriageReturn) >= 0 {
+		return data
+	}
+	return bytes.ReplaceAll(data, []byte("\n"), []byte{CarriageReturn})
+}
+
+// SplitMessages splits data holding one or more consecutive messages (not a
+// FHS/BHS batch) at every MSH segment
+func SplitMessages(data []byte) [][]byte {
+	var messages [][]byte
+	var current [][]byte
+	for _, line := range splitSegments(UnwrapMLLP(data)) {
+		if bytes.HasPrefix(line, []byte("MSH")) && len(current) > 0 {
+			messages = append(messages, bytes.Join(current, []byte{CarriageReturn}))
+			current = nil
+		}
+		current = append(current, line)
+	}
+	if len(current) > 0 {
+		messages = append(messages, bytes.Join(current, []byte{CarriageReturn}))
+	}
+	return messages
+}
+
+// UnescapeText resolves the HL7 escape sequences (\F\, \S\, \T\, \R\, \E\ and
+// \.br\) of a text value
+func (d Delimiters) UnescapeText(s string) string {
+	esc := string(d.Escape)
+	if !strings.Contains(s, esc) {
+		return s
+	}
+	r := strings.NewReplacer(
+		esc+"F"+esc, string(d.Field),
+		esc+"S"+esc, string(d.Component),
+		esc+"T"+esc, string(d.Subcomponent),
+		esc+"R"+esc, string(d.Repetition),
+		esc+"E"+esc, esc,
+		esc+".br"+esc, "\n",
+	)
+	return r.Replace(s)
+}
+
+// EscapeText replaces delimiter characters in a text value with HL7 escape
+// sequences; line breaks become \.br\
+func (d Delimiters) EscapeText(s string) string {
+	esc := string(d.Escape)
+	r := strings.NewReplacer(
+		esc, esc+"E"+esc,
+		string(d.Field), esc+"F"+esc,
+		string(d.Component), esc+"S"+esc,
+		string(d.Subcomponent), esc+"T"+esc,
+		string(d.Repetition), esc+"R"+esc,
+		"\r\n", esc+".br"+esc,
+		"\n", esc+".br"+esc,
+		"\r", esc+".br"+esc,
+	)
+	return r.Replace(s)
+}
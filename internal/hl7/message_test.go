@@ -0,0 +1,37 @@
+package hl7
+
+import "testing"
+
+func TestNormalizeSegments(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want string
+	}{
+		{"CR", "MSH|^~\\&|HIS\rPID|1\r", "MSH|^~\\&|HIS\rPID|1\r"},
+		{"CRLF", "MSH|^~\\&|HIS\r\nPID|1\r\n", "MSH|^~\\&|HIS\rPID|1\r"},
+		{"LF", "MSH|^~\\&|HIS\nPID|1\n", "MSH|^~\\&|HIS\rPID|1\r"},
+		{"LF inside CR terminated text", "MSH|^~\\&|HIS\rOBX|1|FT|||line 1\nPID|line 2\r", "MSH|^~\\&|HIS\rOBX|1|FT|||line 1\nPID|line 2\r"},
+		{"LF inside CRLF terminated text", "MSH|^~\\&|HIS\r\nOBX|1|TX|||a\nb\r\n", "MSH|^~\\&|HIS\rOBX|1|TX|||a\nb\r"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(NormalizeSegments([]byte(tt.data))); got != tt.want {
+				t.Errorf("\nalınan   %q\nbeklenen %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseStructureKeepsLFInText(t *testing.T) {
+	msg, err := ParseStructure(NormalizeSegments([]byte("MSH|^~\\&|HIS\rOBX|1|FT|||line 1\nPID|line 2\r")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msg.Segments) != 2 || msg.Segment("PID") != nil {
+		t.Fatalf("metindeki LF segment sonu sayıldı: %d segment", len(msg.Segments))
+	}
+	if got := msg.Segment("OBX").Field(5); got != "line 1\nPID" {
+		t.Errorf("OBX-5 %q", got)
+	}
+}
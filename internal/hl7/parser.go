@@ -40,7 +40,9 @@ func ParseMessage(data []byte) (map[string]string, error) {
 	result["message_type"] = mshFields[8]
 	result["message_control_id"] = mshFields[9]
 	result["sending_application"] = mshFields[2]
+	result["sending_facility"] = mshFields[3]
 	result["receiving_application"] = mshFields[4]
+	result["receiving_facility"] = mshFields[5]
 
 	// Parse PID segment if exists
 	for _, line := range lines {
@@ -86,6 +88,128 @@ func CreateACK(originalMessage []byte, ackCode string) []byte {
 	return append([]byte{StartBlock}, append([]byte(ack+"\r"), EndBlock, CarriageReturn)...)
 }
 
+// CreateTestMessage creates a QRY^A19 query with processing ID T (training)
+// used to test a destination end to end; receivers treat it as test traffic
+func CreateTestMessage() []byte {
+	now := time.Now()
+	controlID := fmt.Sprintf("TEST%d", now.UnixNano())
+
+	msg := fmt.Sprintf("MSH|^~\\&|HL7_REPLICATOR|MINASOFT|||%s||QRY^A19|%s|T|2.5\rQRD|%s|R|I|%s|||1^RD|TEST|DEM",
+		now.Format("20060102150405"),
+		controlID,
+		now.Format("20060102150405"),
+		controlID)
+
+	return []byte(msg + "\r")
+}
+
+// CreateNACK creates a negative HL7 ACK (AE/AR) with an ERR segment
+// describing why the message was not accepted
+func CreateNACK(originalMessage []byte, ackCode, errorCode, errorText string) []byte {
+	text := escapeText(errorText)
+	return createErrorACK(originalMessage, ackCode, text, []string{
+		fmt.Sprintf("ERR|||%s^%s^HL70357|E||||%s", errorCode, errorDescription(errorCode), text),
+	})
+}
+
+// CreateValidationNACK creates a negative ACK with one ERR segment per violation
+func CreateValidationNACK(originalMessage []byte, ackCode string, violations []Violation) []byte {
+	errs := make([]string, len(violations))
+	for i, v := range violations {
+		location := v.Segment
+		if v.Sequence > 0 {
+			location += fmt.Sprintf("^%d", v.Sequence)
+			if v.Field > 0 {
+				location += fmt.Sprintf("^%d", v.Field)
+			}
+		}
+		errs[i] = fmt.Sprintf("ERR||%s|%s^%s^HL70357|E||||%s",
+			location, v.Code, errorDescription(v.Code), escapeText(v.String()))
+	}
+	return createErrorACK(originalMessage, ackCode, escapeText((&ValidationError{Violations: violations}).Error()), errs)
+}
+
+// createErrorACK appends the MSA-3 text and ERR segments to a regular ACK
+func createErrorACK(originalMessage []byte, ackCode, text string, errSegments []string) []byte {
+	ack := UnwrapMLLP(CreateACK(originalMessage, ackCode))
+	ack = bytes.TrimSuffix(ack, []byte{CarriageReturn})
+
+	// MSA-3 text message, ERR-3 error code (HL7 table 0357), ERR-4 severity, ERR-8 user message
+	ack = append(ack, []byte("|"+text)...)
+	for _, seg := range errSegments {
+		ack = append(ack, CarriageReturn)
+		ack = append(ack, []byte(seg)...)
+	}
+
+	return WrapMLLP(append(ack, CarriageReturn))
+}
+
+// HL7 table 0357 message error condition codes
+const (
+	ErrSegmentSequence    = "100"
+	ErrRequiredField      = "101"
+	ErrDataType           = "102"
+	ErrTableValue         = "103"
+	ErrUnsupportedMessage = "200"
+	ErrApplicationError   = "207"
+)
+
+func errorDescription(code string) string {
+	switch code {
+	case ErrSegmentSequence:
+		return "Segment sequence error"
+	case ErrRequiredField:
+		return "Required field missing"
+	case ErrDataType:
+		return "Data type error"
+	case ErrTableValue:
+		return "Table value not found"
+	case ErrUnsupportedMessage:
+		return "Unsupported message type"
+	default:
+		return "Application internal error"
+	}
+}
+
+// escapeText escapes HL7 delimiters in free text
+func escapeText(s string) string {
+	r := strings.NewReplacer(
+		"\\", "\\E\\",
+		"|", "\\F\\",
+		"^", "\\S\\",
+		"~", "\\R\\",
+		"&", "\\T\\",
+		"\r", " ",
+		"\n", " ",
+	)
+	return r.Replace(s)
+}
+
+// RejectError marks a message that was refused by policy and must be
+// answered with an AR ACK
+type RejectError struct {
+	Code   string // HL7 table 0357 error code
+	Reason string
+}
+
+func (e *RejectError) Error() string {
+	return e.Reason
+}
+
+// PermanentError marks a delivery the destination refused in a way a retry
+// cannot fix; the message is dead-lettered without further attempts
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PermanentError) Unwrap() error {
+	return e.Err
+}
+
 // WrapMLLP adds MLLP wrapper to message
 func WrapMLLP(message []byte) []byte {
 	if len(message) == 0 {
@@ -1,240 +1,377 @@
 package hl7
 
 import (
+	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net"
+	"strconv"
 	"sync"
 	"time"
 )
 
-// ConnectionPool manages a pool of reusable MLLP connections with automatic recovery
+// ErrPoolClosed is returned by Get after the pool has been closed
+var ErrPoolClosed = errors.New("bağlantı havuzu kapalı")
+
+// PoolOptions holds the limits of a connection pool
+type PoolOptions struct {
+	MaxConns    int           // upper bound of open connections, default 5
+	MaxIdle     int           // idle connections kept for reuse, default MaxConns
+	IdleTimeout time.Duration // idle connections unused this long are closed, default 5m
+	MaxLifetime time.Duration // connections older than this are closed, 0 keeps them
+	DialTimeout time.Duration // default 30s
+}
+
+// PoolStats is a snapshot of the pool counters
+type PoolStats struct {
+	Address      string        `json:"address"`
+	MaxConns     int           `json:"max_conns"`
+	Open         int           `json:"open"`
+	Idle         int           `json:"idle"`
+	InUse        int           `json:"in_use"`
+	Waiting      int           `json:"waiting"`
+	Waits        uint64        `json:"waits"`
+	WaitDuration time.Duration `json:"wait_duration"`
+	Dials        uint64        `json:"dials"`
+	DialErrors   uint64        `json:"dial_errors"`
+	Expired      uint64        `json:"expired"`
+}
+
+// ConnectionPool keeps reusable MLLP connections to one destination. At most
+// MaxConns connections are open; callers beyond the limit wait in FIFO order
+// until a connection is returned or their context ends.
 type ConnectionPool struct {
-	host        string
-	port        int
-	maxConns    int
-	timeout     time.Duration
-	connections chan *poolConn
-	mu          sync.Mutex
-	closed      bool
+	addr string
+	opts PoolOptions
+
+	mu      sync.Mutex
+	idle    []*PoolConn
+	open    int
+	waiters []chan *PoolConn // a nil connection hands over a dial slot
+	closed  bool
+	stats   PoolStats
+
+	stop chan struct{}
+	done chan struct{}
 }
 
-type poolConn struct {
-	conn     net.Conn
-	lastUsed time.Time
+// PoolConn is a connection taken from the pool. Close returns it to the
+// pool; connections that failed must be marked with MarkBroken first.
+type PoolConn struct {
+	net.Conn
 	pool     *ConnectionPool
-	inUse    bool
+	reader   *bufio.Reader // kept with the connection so buffered bytes are not lost
+	created  time.Time
+	lastUsed time.Time
+	reused   bool
+	broken   bool
+	released bool
 }
 
-// NewConnectionPool creates a new connection pool
-func NewConnectionPool(host string, port int, maxConns int) *ConnectionPool {
-	if maxConns <= 0 {
-		maxConns = 5
+// NewConnectionPool creates a pool for host:port
+func NewConnectionPool(host string, port int, opts PoolOptions) *ConnectionPool {
+	if opts.MaxConns <= 0 {
+		opts.MaxConns = 5
+	}
+	if opts.MaxIdle <= 0 || opts.MaxIdle > opts.MaxConns {
+		opts.MaxIdle = opts.MaxConns
+	}
+	if opts.IdleTimeout <= 0 {
+		opts.IdleTimeout = 5 * time.Minute
+	}
+	if opts.DialTimeout <= 0 {
+		opts.DialTimeout = 30 * time.Second
 	}
 
-	pool := &ConnectionPool{
-		host:        host,
-		port:        port,
-		maxConns:    maxConns,
-		timeout:     30 * time.Second,
-		connections: make(chan *poolConn, maxConns),
-		closed:      false,
+	p := &ConnectionPool{
+		addr: net.JoinHostPort(host, strconv.Itoa(port)),
+		opts: opts,
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
 	}
 
-	// Start health check routine
-	go pool.healthCheck()
+	// Start idle connection cleaner
+	go p.cleaner()
 
-	return pool
+	return p
 }
 
-// Get retrieves a connection from the pool or creates a new one
-func (p *ConnectionPool) Get() (net.Conn, error) {
+// Get returns an idle connection, dials a new one while below MaxConns, or
+// waits for a connection to be returned
+func (p *ConnectionPool) Get(ctx context.Context) (*PoolConn, error) {
 	p.mu.Lock()
 	if p.closed {
 		p.mu.Unlock()
-		return nil, fmt.Errorf("connection pool is closed")
+		return nil, ErrPoolClosed
 	}
-	p.mu.Unlock()
 
-	// Try to get an existing connection
-	select {
-	case pc := <-p.connections:
-		// Test if connection is still alive
-		if p.isConnectionAlive(pc.conn) {
-			pc.inUse = true
-			pc.lastUsed = time.Now()
-			return &wrappedConn{Conn: pc.conn, pc: pc}, nil
+	// Reuse the most recently returned connection
+	for len(p.idle) > 0 {
+		pc := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		if p.expired(pc) {
+			p.stats.Expired++
+			p.closeConnLocked(pc)
+			continue
 		}
-		// Connection is dead, close it
-		pc.conn.Close()
-	default:
-		// No connections available
+		pc.released = false
+		pc.reused = true
+		p.mu.Unlock()
+		return pc, nil
 	}
 
-	// Create new connection
-	addr := fmt.Sprintf("%s:%d", p.host, p.port)
-	conn, err := net.DialTimeout("tcp", addr, p.timeout)
-	if err != nil {
-		return nil, fmt.Errorf("bağlantı hatası %s: %w", addr, err)
+	if p.open < p.opts.MaxConns {
+		p.open++
+		p.mu.Unlock()
+		return p.dial(ctx)
 	}
 
-	// Set keep-alive
-	if tcpConn, ok := conn.(*net.TCPConn); ok {
-		tcpConn.SetKeepAlive(true)
-		tcpConn.SetKeepAlivePeriod(30 * time.Second)
-	}
+	// Wait for a returned connection or a free slot
+	req := make(chan *PoolConn, 1)
+	p.waiters = append(p.waiters, req)
+	p.stats.Waits++
+	p.mu.Unlock()
 
-	pc := &poolConn{
-		conn:     conn,
-		lastUsed: time.Now(),
-		pool:     p,
-		inUse:    true,
-	}
+	start := time.Now()
+	select {
+	case <-ctx.Done():
+		p.mu.Lock()
+		for i, w := range p.waiters {
+			if w == req {
+				p.waiters = append(p.waiters[:i], p.waiters[i+1:]...)
+				break
+			}
+		}
+		p.stats.WaitDuration += time.Since(start)
+		p.mu.Unlock()
 
-	slog.Debug("Yeni bağlantı oluşturuldu", "address", addr)
+		// A connection may have been handed over in the meantime
+		select {
+		case pc, ok := <-req:
+			switch {
+			case !ok:
+			case pc != nil:
+				p.release(pc)
+			default:
+				// Pass the handed over slot on
+				p.mu.Lock()
+				p.freeSlotLocked()
+				p.mu.Unlock()
+			}
+		default:
+		}
+		return nil, fmt.Errorf("bağlantı beklenirken %s: %w", p.addr, ctx.Err())
+
+	case pc, ok := <-req:
+		p.mu.Lock()
+		p.stats.WaitDuration += time.Since(start)
+		p.mu.Unlock()
 
-	return &wrappedConn{Conn: conn, pc: pc}, nil
+		if !ok {
+			return nil, ErrPoolClosed
+		}
+		if pc == nil {
+			return p.dial(ctx)
+		}
+		return pc, nil
+	}
 }
 
-// Put returns a connection to the pool
-func (p *ConnectionPool) Put(pc *poolConn) {
+// dial opens a connection for a slot already counted in p.open
+func (p *ConnectionPool) dial(ctx context.Context) (*PoolConn, error) {
+	dialer := net.Dialer{
+		Timeout:   p.opts.DialTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", p.addr)
+
 	p.mu.Lock()
 	defer p.mu.Unlock()
+	p.stats.Dials++
 
+	if err != nil {
+		p.stats.DialErrors++
+		p.freeSlotLocked()
+		return nil, fmt.Errorf("bağlantı hatası %s: %w", p.addr, err)
+	}
 	if p.closed {
-		pc.conn.Close()
-		return
+		conn.Close()
+		p.freeSlotLocked()
+		return nil, ErrPoolClosed
 	}
 
-	pc.inUse = false
-	pc.lastUsed = time.Now()
+	slog.Debug("Yeni bağlantı oluşturuldu", "address", p.addr)
 
-	// Try to return to pool
-	select {
-	case p.connections <- pc:
-		// Successfully returned to pool
-	default:
-		// Pool is full, close the connection
-		pc.conn.Close()
-	}
+	now := time.Now()
+	return &PoolConn{Conn: conn, pool: p, created: now, lastUsed: now}, nil
 }
 
-// Close closes all connections in the pool
-func (p *ConnectionPool) Close() error {
+// release returns a connection: it goes to the first waiter, to the idle
+// list, or is closed when broken, expired or beyond MaxIdle
+func (p *ConnectionPool) release(pc *PoolConn) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
-	if p.closed {
-		return nil
+	if pc.released {
+		return
 	}
+	pc.released = true
+	pc.lastUsed = time.Now()
 
-	p.closed = true
-	close(p.connections)
+	if p.closed || pc.broken {
+		p.closeConnLocked(pc)
+		return
+	}
+	if p.expired(pc) {
+		p.stats.Expired++
+		p.closeConnLocked(pc)
+		return
+	}
 
-	// Close all connections
-	for pc := range p.connections {
-		pc.conn.Close()
+	if len(p.waiters) > 0 {
+		req := p.waiters[0]
+		p.waiters = p.waiters[1:]
+		pc.released = false
+		pc.reused = true
+		req <- pc
+		return
 	}
 
-	return nil
+	if len(p.idle) >= p.opts.MaxIdle {
+		p.closeConnLocked(pc)
+		return
+	}
+	p.idle = append(p.idle, pc)
 }
 
-// isConnectionAlive checks if a connection is still usable
-func (p *ConnectionPool) isConnectionAlive(conn net.Conn) bool {
-	// Set a very short deadline
-	conn.SetReadDeadline(time.Now().Add(1 * time.Millisecond))
-
-	// Try to read one byte
-	one := make([]byte, 1)
-	_, err := conn.Read(one)
+// closeConnLocked closes the underlying connection and frees its slot
+func (p *ConnectionPool) closeConnLocked(pc *PoolConn) {
+	pc.Conn.Close()
+	p.freeSlotLocked()
+}
 
-	// Reset the deadline
-	conn.SetReadDeadline(time.Time{})
+// freeSlotLocked hands a free slot to the first waiter, who then dials
+func (p *ConnectionPool) freeSlotLocked() {
+	if len(p.waiters) > 0 && !p.closed {
+		req := p.waiters[0]
+		p.waiters = p.waiters[1:]
+		req <- nil
+		return
+	}
+	p.open--
+}
 
-	// If we got a timeout, the connection is probably still alive
-	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+func (p *ConnectionPool) expired(pc *PoolConn) bool {
+	now := time.Now()
+	if p.opts.MaxLifetime > 0 && now.Sub(pc.created) > p.opts.MaxLifetime {
 		return true
 	}
-
-	// Any other error means the connection is dead
-	return err == nil
+	return now.Sub(pc.lastUsed) > p.opts.IdleTimeout
 }
 
-// healthCheck periodically checks and removes stale connections
-func (p *ConnectionPool) healthCheck() {
-	ticker := time.NewTicker(30 * time.Second)
+// cleaner periodically closes idle connections past their idle timeout or
+// lifetime until the pool is closed
+func (p *ConnectionPool) cleaner() {
+	defer close(p.done)
+
+	interval := p.opts.IdleTimeout / 2
+	if p.opts.MaxLifetime > 0 && p.opts.MaxLifetime/2 < interval {
+		interval = p.opts.MaxLifetime / 2
+	}
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
-	for range ticker.C {
-		p.mu.Lock()
-		if p.closed {
-			p.mu.Unlock()
+	for {
+		select {
+		case <-p.stop:
 			return
-		}
-		p.mu.Unlock()
-
-		// Check connections
-		var healthy []*poolConn
-
-		for {
-			select {
-			case pc := <-p.connections:
-				if pc.inUse {
-					healthy = append(healthy, pc)
-					continue
-				}
-
-				// Check if connection is stale (unused for > 5 minutes)
-				if time.Since(pc.lastUsed) > 5*time.Minute {
-					pc.conn.Close()
-					slog.Debug("Eski bağlantı kapatıldı", "age", time.Since(pc.lastUsed))
-					continue
-				}
-
-				// Check if connection is alive
-				if p.isConnectionAlive(pc.conn) {
-					healthy = append(healthy, pc)
-				} else {
-					pc.conn.Close()
-					slog.Debug("Ölü bağlantı kapatıldı")
-				}
-			default:
-				// No more connections to check
-				goto done
-			}
+		case <-ticker.C:
 		}
 
-	done:
-		// Return healthy connections to pool
-		for _, pc := range healthy {
-			select {
-			case p.connections <- pc:
-			default:
-				pc.conn.Close()
+		p.mu.Lock()
+		kept := p.idle[:0]
+		for _, pc := range p.idle {
+			if p.expired(pc) {
+				p.stats.Expired++
+				p.closeConnLocked(pc)
+				slog.Debug("Eski bağlantı kapatıldı", "address", p.addr, "age", time.Since(pc.created))
+				continue
 			}
+			kept = append(kept, pc)
 		}
+		p.idle = kept
+		p.mu.Unlock()
 	}
 }
 
-// wrappedConn wraps a connection to return it to the pool when closed
-type wrappedConn struct {
-	net.Conn
-	pc     *poolConn
-	closed bool
-	mu     sync.Mutex
-}
+// Stats returns a snapshot of the pool counters
+func (p *ConnectionPool) Stats() PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 
-func (w *wrappedConn) Close() error {
-	w.mu.Lock()
-	defer w.mu.Unlock()
+	s := p.stats
+	s.Address = p.addr
+	s.MaxConns = p.opts.MaxConns
+	s.Open = p.open
+	s.Idle = len(p.idle)
+	s.InUse = p.open - len(p.idle)
+	s.Waiting = len(p.waiters)
+	return s
+}
 
-	if w.closed {
+// Close closes the idle connections, fails waiting callers and stops the
+// cleaner. Connections in use are closed when they are returned.
+func (p *ConnectionPool) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
 		return nil
 	}
+	p.closed = true
+
+	for _, pc := range p.idle {
+		pc.Conn.Close()
+		p.open--
+	}
+	p.idle = nil
 
-	w.closed = true
+	for _, req := range p.waiters {
+		close(req)
+	}
+	p.waiters = nil
+	p.mu.Unlock()
+
+	close(p.stop)
+	<-p.done
+	return nil
+}
+
+// Reused reports whether the connection was used before, i.e. the peer may
+// have closed it while it was idle
+func (pc *PoolConn) Reused() bool {
+	return pc.reused
+}
+
+// Reader returns the buffered reader of the connection
+func (pc *PoolConn) Reader() *bufio.Reader {
+	if pc.reader == nil {
+		pc.reader = bufio.NewReader(pc.Conn)
+	}
+	return pc.reader
+}
+
+// MarkBroken keeps the connection from being reused; it is closed on Close
+func (pc *PoolConn) MarkBroken() {
+	pc.broken = true
+}
 
-	// Return to pool instead of closing
-	w.pc.pool.Put(w.pc)
+// Close returns the connection to the pool
+func (pc *PoolConn) Close() error {
+	pc.pool.release(pc)
 	return nil
 }
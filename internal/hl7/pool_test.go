@@ -0,0 +1,236 @@
+package hl7
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestPool starts a TCP server that keeps accepted connections open and
+// returns a pool for it
+func newTestPool(t *testing.T, opts PoolOptions) *ConnectionPool {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	var conns []net.Conn
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+		}
+	}()
+	t.Cleanup(func() {
+		ln.Close()
+		mu.Lock()
+		defer mu.Unlock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+	})
+
+	host, port, _ := net.SplitHostPort(ln.Addr().String())
+	n, _ := strconv.Atoi(port)
+	p := NewConnectionPool(host, n, opts)
+	t.Cleanup(func() { p.Close() })
+	return p
+}
+
+func mustGet(t *testing.T, p *ConnectionPool) *PoolConn {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	pc, err := p.Get(ctx)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	return pc
+}
+
+// waitFor polls the pool stats until cond holds
+func waitFor(t *testing.T, p *ConnectionPool, cond func(PoolStats) bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond(p.Stats()) {
+		if time.Now().After(deadline) {
+			t.Fatalf("havuz beklenen duruma gelmedi: %+v", p.Stats())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestPoolReusesReturnedConnection(t *testing.T) {
+	p := newTestPool(t, PoolOptions{MaxConns: 2})
+
+	first := mustGet(t, p)
+	if first.Reused() {
+		t.Error("yeni bağlantı yeniden kullanılmış görünüyor")
+	}
+	first.Close()
+
+	second := mustGet(t, p)
+	if second != first || !second.Reused() {
+		t.Error("boştaki bağlantı yeniden kullanılmadı")
+	}
+	second.Close()
+	second.Close() // a second Close must not return it twice
+
+	st := p.Stats()
+	if st.Dials != 1 || st.Open != 1 || st.Idle != 1 || st.InUse != 0 {
+		t.Errorf("istatistikler hatalı: %+v", st)
+	}
+}
+
+func TestPoolBoundsOpenConnections(t *testing.T) {
+	p := newTestPool(t, PoolOptions{MaxConns: 2})
+	a, b := mustGet(t, p), mustGet(t, p)
+	defer a.Close()
+	defer b.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := p.Get(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("sınırdaki Get %v döndü, beklenen DeadlineExceeded", err)
+	}
+
+	st := p.Stats()
+	if st.Open != 2 || st.Waits != 1 || st.Waiting != 0 || st.WaitDuration <= 0 {
+		t.Errorf("istatistikler hatalı: %+v", st)
+	}
+}
+
+func TestPoolHandsReturnedConnectionsInOrder(t *testing.T) {
+	p := newTestPool(t, PoolOptions{MaxConns: 1})
+	held := mustGet(t, p)
+
+	results := make([]chan *PoolConn, 2)
+	for i := range results {
+		results[i] = make(chan *PoolConn, 1)
+		go func(ch chan *PoolConn) {
+			pc, err := p.Get(context.Background())
+			if err != nil {
+				t.Error(err)
+			}
+			ch <- pc
+		}(results[i])
+		waitFor(t, p, func(st PoolStats) bool { return st.Waiting == i+1 })
+	}
+
+	held.Close()
+	first := <-results[0]
+	if first != held {
+		t.Error("ilk bekleyen iade edilen bağlantıyı almadı")
+	}
+	select {
+	case <-results[1]:
+		t.Fatal("ikinci bekleyen sırasını beklemedi")
+	default:
+	}
+
+	// A broken connection frees its slot; the waiter dials a new one
+	first.MarkBroken()
+	first.Close()
+	second := <-results[1]
+	if second == first || second.Reused() {
+		t.Error("bozuk bağlantı yeniden verildi")
+	}
+	second.Close()
+
+	if st := p.Stats(); st.Dials != 2 || st.Open != 1 {
+		t.Errorf("istatistikler hatalı: %+v", st)
+	}
+}
+
+// Callers giving up while a connection or a dial slot is handed to them
+// must pass it on instead of leaking or dereferencing it
+func TestPoolCancelDuringHandOver(t *testing.T) {
+	const maxConns = 3
+	p := newTestPool(t, PoolOptions{MaxConns: maxConns})
+
+	var wg sync.WaitGroup
+	for g := 0; g < 16; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				timeout := time.Duration((g+i)%4) * 100 * time.Microsecond
+				ctx, cancel := context.WithTimeout(context.Background(), timeout)
+				pc, err := p.Get(ctx)
+				cancel()
+				if err != nil {
+					continue
+				}
+				if i%3 == 0 {
+					pc.MarkBroken()
+				}
+				pc.Close()
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	st := p.Stats()
+	if st.InUse != 0 || st.Waiting != 0 || st.Open > maxConns {
+		t.Fatalf("havuz tutarsız kaldı: %+v", st)
+	}
+
+	// No slot leaked: every connection can still be taken
+	conns := make([]*PoolConn, maxConns)
+	for i := range conns {
+		conns[i] = mustGet(t, p)
+	}
+	for _, pc := range conns {
+		pc.Close()
+	}
+}
+
+func TestPoolClose(t *testing.T) {
+	p := newTestPool(t, PoolOptions{MaxConns: 2})
+	idle := mustGet(t, p)
+	held := mustGet(t, p)
+	idle.Close()
+
+	waiter := make(chan error, 1)
+	go func() {
+		// Takes the idle connection, then waits
+		pc, err := p.Get(context.Background())
+		if err != nil {
+			waiter <- err
+			return
+		}
+		defer pc.Close()
+		_, err = p.Get(context.Background())
+		waiter <- err
+	}()
+	waitFor(t, p, func(st PoolStats) bool { return st.Waiting == 1 })
+
+	p.Close()
+	if err := <-waiter; !errors.Is(err, ErrPoolClosed) {
+		t.Errorf("bekleyen Get %v döndü, beklenen ErrPoolClosed", err)
+	}
+	if _, err := p.Get(context.Background()); !errors.Is(err, ErrPoolClosed) {
+		t.Errorf("kapalı havuzda Get %v döndü", err)
+	}
+
+	// Connections in use are closed when they are returned
+	held.Close()
+	waitFor(t, p, func(st PoolStats) bool { return st.Open == 0 })
+	if _, err := held.Write([]byte("x")); err == nil {
+		t.Error("kapalı havuza iade edilen bağlantı açık kaldı")
+	}
+	if err := p.Close(); err != nil {
+		t.Errorf("ikinci Close: %v", err)
+	}
+}
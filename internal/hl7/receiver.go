@@ -0,0 +1,397 @@
+package hl7
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/minasoft/hl7-replicator/internal/db"
+	"github.com/minasoft/hl7-replicator/internal/phi"
+	"github.com/minasoft/hl7-replicator/internal/stats"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// ReceiverOptions holds the optional settings of a route's inbound path
+type ReceiverOptions struct {
+	Destination    string        // destination label recorded on every message
+	AccessPolicy   *AccessPolicy // sender rules checked against MSH-3/MSH-4
+	Validator      *Validator    // nil disables conformance validation
+	ValidationMode string        // ValidationOff, ValidationWarn or ValidationReject
+	Transforms     []Transform   // applied in order after validation
+	Expectations   []TrafficExpectation
+}
+
+// Source identifies where an inbound message came from
+type Source struct {
+	Addr    string // remote address, file path or URL
+	IP      net.IP // peer IP for network inputs, nil otherwise
+	BatchID string // set for messages received in the same batch
+	MsgID   string // JetStream message ID; a retry with the same ID is dropped within the stream's duplicate window
+}
+
+// EnqueueError reports that a valid message could not be published to the
+// route's stream; the sender may retry later
+type EnqueueError struct {
+	Err error
+}
+
+func (e *EnqueueError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *EnqueueError) Unwrap() error {
+	return e.Err
+}
+
+// Receiver validates, tracks and enqueues inbound messages of a route. It is
+// shared by every input of the route (MLLP listener, file drop, ...).
+type Receiver struct {
+	direction string // "order" or "report"
+	js        jetstream.JetStream
+	opts      atomic.Pointer[ReceiverOptions]
+	traffic   *trafficLog
+	stats     *stats.Store
+
+	rejectedMsgs atomic.Uint64
+}
+
+// NewReceiver creates the inbound path of a route; enqueued messages are
+// counted in st
+func NewReceiver(direction string, js jetstream.JetStream, st *stats.Store, opts ReceiverOptions) *Receiver {
+	r := &Receiver{
+		direction: direction,
+		js:        js,
+		traffic:   newTrafficLog(),
+		stats:     st,
+	}
+	r.opts.Store(&opts)
+	return r
+}
+
+// SetOptions replaces the options; messages being processed keep the
+// options they started with
+func (r *Receiver) SetOptions(opts ReceiverOptions) {
+	r.opts.Store(&opts)
+}
+
+func (r *Receiver) options() *ReceiverOptions {
+	return r.opts.Load()
+}
+
+// Direction returns the route served by the receiver
+func (r *Receiver) Direction() string {
+	return r.direction
+}
+
+// RejectedMessages returns the number of messages refused by policy or validation
+func (r *Receiver) RejectedMessages() uint64 {
+	return r.rejectedMsgs.Load()
+}
+
+// Senders returns the activity of every sender seen since the start
+func (r *Receiver) Senders() []SenderActivity {
+	return r.traffic.activity()
+}
+
+// Traffic evaluates the traffic expectations of the route
+func (r *Receiver) Traffic() []TrafficStatus {
+	now := time.Now()
+	expectations := r.options().Expectations
+	statuses := make([]TrafficStatus, 0, len(expectations))
+	for _, e := range expectations {
+		statuses = append(statuses, r.traffic.status(r.direction, e, now))
+	}
+	return statuses
+}
+
+// Handle processes a single message or a batch and returns the ACK to send back
+func (r *Receiver) Handle(data []byte, src Source) []byte {
+	if IsBatch(data) {
+		return r.handleBatch(data, src)
+	}
+	_, err := r.Receive(data, src)
+	return r.Acknowledge(data, err, src)
+}
+
+// Acknowledge builds the ACK for a processed message: AA on success, AE with
+// the violations for validation errors, AR for policy rejections
+func (r *Receiver) Acknowledge(message []byte, err error, src Source) []byte {
+	if err == nil {
+		return CreateACK(message, "AA")
+	}
+
+	var rejectErr *RejectError
+	var validationErr *ValidationError
+	if errors.As(err, &validationErr) {
+		slog.Warn("Mesaj doğrulamadan geçemedi", "error", err, "source", src.Addr)
+		return CreateValidationNACK(message, "AE", validationErr.Violations)
+	}
+	if errors.As(err, &rejectErr) {
+		slog.Warn("Mesaj reddedildi", "reason", rejectErr.Reason, "source", src.Addr)
+		return CreateNACK(message, "AR", rejectErr.Code, rejectErr.Reason)
+	}
+
+	slog.Error("Mesaj işleme hatası", "error", err)
+	return CreateNACK(message, "AE", ErrApplicationError, err.Error())
+}
+
+// handleBatch splits a FHS/BHS batch, enqueues every message on its own and
+// replies with an acknowledgement batch holding one ACK per message
+func (r *Receiver) handleBatch(data []byte, src Source) []byte {
+	batch, err := ParseBatch(data)
+	if err != nil {
+		r.rejectedMsgs.Add(1)
+		slog.Warn("Batch reddedildi", "error", err, "source", src.Addr)
+		return CreateNACK(data, "AR", ErrSegmentSequence, err.Error())
+	}
+
+	src.BatchID = uuid.New().String()
+	acks := make([][]byte, 0, len(batch.Messages))
+	for _, message := range batch.Messages {
+		_, err := r.Receive(message, src)
+		acks = append(acks, r.Acknowledge(message, err, src))
+	}
+
+	slog.Info("HL7 batch alındı",
+		"batchID", src.BatchID,
+		"direction", r.direction,
+		"messages", len(batch.Messages),
+		"source", src.Addr)
+
+	return CreateBatchACK(batch, acks)
+}
+
+// Receive checks, tracks and publishes a single message to the route's stream
+func (r *Receiver) Receive(rawMessage []byte, src Source) (*db.HL7Message, error) {
+	msg, err := r.receive(rawMessage, src)
+	if err != nil {
+		var rejectErr *RejectError
+		var validationErr *ValidationError
+		if errors.As(err, &rejectErr) || errors.As(err, &validationErr) {
+			r.rejectedMsgs.Add(1)
+		}
+	}
+	return msg, err
+}
+
+func (r *Receiver) receive(rawMessage []byte, src Source) (*db.HL7Message, error) {
+	// Parse HL7 message
+	parsed, err := ParseMessage(rawMessage)
+	if err != nil {
+		return nil, fmt.Errorf("mesaj parse hatası: %w", err)
+	}
+
+	opts := r.options()
+
+	// Verify that the peer is allowed to send as MSH-3/MSH-4
+	if src.IP != nil {
+		if err := opts.AccessPolicy.CheckSender(src.IP, parsed["sending_application"], parsed["sending_facility"]); err != nil {
+			return nil, &RejectError{Code: ErrApplicationError, Reason: err.Error()}
+		}
+	}
+
+	// A sender is alive even if its message fails validation below
+	r.traffic.record(r.direction, parsed["sending_application"], parsed["sending_facility"], src.Addr, time.Now())
+
+	// Validate against the conformance profiles of the route
+	violations, err := r.validate(opts, rawMessage)
+	if err != nil {
+		return nil, err
+	}
+
+	// Create message object
+	msg := &db.HL7Message{
+		ID:               uuid.New().String(),
+		Timestamp:        time.Now(),
+		Direction:        r.direction,
+		SourceAddr:       src.Addr,
+		DestinationAddr:  opts.Destination,
+		MessageType:      parsed["message_type"],
+		MessageControlID: parsed["message_control_id"],
+		PatientID:        parsed["patient_id"],
+		PatientName:      parsed["patient_name"],
+		RawMessage:       rawMessage,
+		Status:           "pending",
+		BatchID:          src.BatchID,
+		CreatedAt:        time.Now(),
+	}
+	for _, v := range violations {
+		msg.ValidationWarnings = append(msg.ValidationWarnings, v.String())
+	}
+
+	// Run the route's transforms; a message turned into several messages is
+	// enqueued as children and the original is only kept in history
+	outputs, err := r.transform(rawMessage)
+	if err != nil {
+		return nil, err
+	}
+	if len(outputs) > 1 {
+		// A resent parent must not enqueue its children twice; they are
+		// identified by the sender and control ID of the parent
+		splitID := src.MsgID
+		if splitID == "" && msg.MessageControlID != "" {
+			splitID = fmt.Sprintf("%s-%s^%s-%s", r.direction,
+				parsed["sending_application"], parsed["sending_facility"], msg.MessageControlID)
+		}
+		return r.enqueueChildren(msg, outputs, src, splitID)
+	}
+	msg.RawMessage = outputs[0]
+
+	if err := r.publish(msg, src.MsgID); err != nil {
+		return nil, err
+	}
+
+	slog.Info("HL7 mesaj alındı ve kuyruğa eklendi",
+		"id", msg.ID,
+		"direction", r.direction,
+		"messageType", msg.MessageType,
+		"patientID", phi.Mask(msg.PatientID),
+		"source", src.Addr)
+
+	return msg, nil
+}
+
+// publish sends a message to the route's stream; with a msgID a message
+// already published by an earlier attempt is not enqueued again
+func (r *Receiver) publish(msg *db.HL7Message, msgID string) error {
+	subject := fmt.Sprintf("hl7.%ss.%s", r.direction, msg.ID)
+
+	msgData, err := json.Marshal(msg)
+	if err != nil {
+		return &EnqueueError{Err: fmt.Errorf("mesaj serialize hatası: %w", err)}
+	}
+
+	var opts []jetstream.PublishOpt
+	if msgID != "" {
+		opts = append(opts, jetstream.WithMsgID(msgID))
+	}
+	ack, err := r.js.Publish(context.Background(), subject, msgData, opts...)
+	if err != nil {
+		return &EnqueueError{Err: fmt.Errorf("NATS publish hatası: %w", err)}
+	}
+	if ack.Duplicate {
+		slog.Info("Mesaj daha önce kuyruğa eklenmiş, tekrar eklenmedi", "msgID", msgID, "direction", r.direction)
+		return nil
+	}
+	r.stats.Record(stats.Received, stats.Labels{Route: r.direction, MessageType: msg.MessageType})
+	return nil
+}
+
+func (r *Receiver) transform(rawMessage []byte) ([][]byte, error) {
+	outputs := [][]byte{rawMessage}
+	for _, t := range r.options().Transforms {
+		var next [][]byte
+		for _, message := range outputs {
+			result, err := t.Apply(message)
+			if err != nil {
+				return nil, fmt.Errorf("dönüşüm hatası (%s): %w", t.Name(), err)
+			}
+			next = append(next, result...)
+		}
+		outputs = next
+	}
+	if len(outputs) == 0 {
+		return nil, fmt.Errorf("dönüşüm sonucu boş mesaj")
+	}
+	return outputs, nil
+}
+
+// enqueueChildren publishes the messages produced from parent, each linked
+// to it by ParentID, and records the parent in history with status "split".
+// With a splitID the children are published with the message IDs
+// "<splitID>-<n>" and the parent and child IDs are derived from it, so a
+// retry after a partial failure only enqueues the missing children and
+// links them to the same parent.
+func (r *Receiver) enqueueChildren(parent *db.HL7Message, outputs [][]byte, src Source, splitID string) (*db.HL7Message, error) {
+	if splitID != "" {
+		parent.ID = uuid.NewSHA1(uuid.NameSpaceOID, []byte(splitID)).String()
+	}
+	for i, output := range outputs {
+		parsed, err := ParseMessage(output)
+		if err != nil {
+			return nil, fmt.Errorf("dönüşüm sonucu parse edilemedi: %w", err)
+		}
+
+		child := *parent
+		child.ID = uuid.New().String()
+		var msgID string
+		if splitID != "" {
+			msgID = fmt.Sprintf("%s-%d", splitID, i+1)
+			child.ID = uuid.NewSHA1(uuid.NameSpaceOID, []byte(msgID)).String()
+		}
+		child.ParentID = parent.ID
+		child.ChildIDs = nil
+		child.MessageType = parsed["message_type"]
+		child.MessageControlID = parsed["message_control_id"]
+		child.PatientID = parsed["patient_id"]
+		child.PatientName = parsed["patient_name"]
+		child.RawMessage = output
+
+		if err := r.publish(&child, msgID); err != nil {
+			return nil, err
+		}
+		parent.ChildIDs = append(parent.ChildIDs, child.ID)
+	}
+
+	parent.Status = "split"
+	now := time.Now()
+	parent.ProcessedAt = &now
+	r.saveToHistory(parent)
+
+	slog.Info("HL7 mesaj bölünerek kuyruğa eklendi",
+		"id", parent.ID,
+		"direction", r.direction,
+		"messageType", parent.MessageType,
+		"children", len(parent.ChildIDs),
+		"patientID", phi.Mask(parent.PatientID),
+		"source", src.Addr)
+
+	return parent, nil
+}
+
+// saveToHistory records a message that is not delivered itself; keys match
+// the ones written by the forwarder
+func (r *Receiver) saveToHistory(msg *db.HL7Message) {
+	ctx := context.Background()
+	kv, err := r.js.KeyValue(ctx, "HL7_HISTORY")
+	if err != nil {
+		slog.Error("History bucket açılamadı", "error", err)
+		return
+	}
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		slog.Error("Mesaj history'ye kaydedilemedi", "error", err, "id", msg.ID)
+		return
+	}
+
+	key := fmt.Sprintf("%s_%s_%d", msg.Direction, msg.ID, time.Now().UnixNano())
+	if _, err := kv.Put(ctx, key, data); err != nil {
+		slog.Error("History KV put hatası", "error", err, "key", key)
+	}
+}
+
+// validate runs the conformance profiles; in reject mode violations are
+// returned as a ValidationError, in warn mode they are returned for tagging
+func (r *Receiver) validate(opts *ReceiverOptions, rawMessage []byte) ([]Violation, error) {
+	if opts.Validator == nil || opts.ValidationMode == "" || opts.ValidationMode == ValidationOff {
+		return nil, nil
+	}
+
+	structured, err := ParseStructure(rawMessage)
+	if err != nil {
+		return nil, fmt.Errorf("mesaj parse hatası: %w", err)
+	}
+
+	violations := opts.Validator.Validate(r.direction, structured)
+	if len(violations) > 0 && opts.ValidationMode == ValidationReject {
+		return nil, &ValidationError{Violations: violations}
+	}
+	return violations, nil
+}
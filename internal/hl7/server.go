@@ -2,50 +2,139 @@ package hl7
 
 import (
 	"bufio"
-	"bytes"
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
-
-	"github.com/google/uuid"
-	"github.com/minasoft/hl7-replicator/internal/db"
-	"github.com/nats-io/nats.go/jetstream"
 )
 
+// ServerOptions holds the optional settings of a listener
+type ServerOptions struct {
+	AccessPolicy   *AccessPolicy // nil accepts every peer
+	MaxMessageSize int           // larger frames are rejected with AR, default 10MB
+	MaxConnections int           // concurrent connections of the listener, 0 = unlimited
+	MaxConnsPerIP  int           // concurrent connections of one peer IP, 0 = unlimited
+	IdleTimeout    time.Duration // connections without a new frame are closed, default 5m
+	ReadTimeout    time.Duration // a started frame must be complete within, default 30s
+}
+
+// ServerStats holds the counters of a listener
+type ServerStats struct {
+	Direction           string `json:"direction"`
+	Port                int    `json:"port"`
+	ActiveConnections   int64  `json:"active_connections"`
+	RejectedConnections uint64 `json:"rejected_connections"`
+	RejectedMessages    uint64 `json:"rejected_messages"`
+	OversizedMessages   uint64 `json:"oversized_messages"`
+	IdleDisconnects     uint64 `json:"idle_disconnects"`
+}
+
 type MLLPServer struct {
 	port      int
 	direction string // "order" or "report"
-	js        jetstream.JetStream
+	receiver  *Receiver
 	listener  net.Listener
+	opts      atomic.Pointer[ServerOptions]
+
+	mu      sync.Mutex
+	perIP   map[string]int
+	active  atomic.Int64
+	conns   map[net.Conn]bool // open connections; true while a frame is being handled
+	closing bool
+	wg      sync.WaitGroup
+
+	rejectedConns atomic.Uint64
+	oversized     atomic.Uint64
+	idleClosed    atomic.Uint64
 }
 
-func NewMLLPServer(port int, direction string, js jetstream.JetStream) *MLLPServer {
-	return &MLLPServer{
+func NewMLLPServer(port int, receiver *Receiver, opts ServerOptions) *MLLPServer {
+	s := &MLLPServer{
 		port:      port,
-		direction: direction,
-		js:        js,
+		direction: receiver.Direction(),
+		receiver:  receiver,
+		perIP:     make(map[string]int),
+		conns:     make(map[net.Conn]bool),
+	}
+	s.SetOptions(opts)
+	return s
+}
+
+// SetOptions replaces the limits and access policy of a running listener;
+// open connections pick them up with their next frame
+func (s *MLLPServer) SetOptions(opts ServerOptions) {
+	if opts.MaxMessageSize <= 0 {
+		opts.MaxMessageSize = 10 * 1024 * 1024
+	}
+	if opts.IdleTimeout <= 0 {
+		opts.IdleTimeout = 5 * time.Minute
+	}
+	if opts.ReadTimeout <= 0 {
+		opts.ReadTimeout = 30 * time.Second
+	}
+	s.opts.Store(&opts)
+}
+
+func (s *MLLPServer) options() *ServerOptions {
+	return s.opts.Load()
+}
+
+// Port returns the listening port
+func (s *MLLPServer) Port() int {
+	return s.port
+}
+
+// Direction returns the route served by the listener
+func (s *MLLPServer) Direction() string {
+	return s.direction
+}
+
+// Stats returns the listener counters
+func (s *MLLPServer) Stats() ServerStats {
+	return ServerStats{
+		Direction:           s.direction,
+		Port:                s.port,
+		ActiveConnections:   s.active.Load(),
+		RejectedConnections: s.rejectedConns.Load(),
+		RejectedMessages:    s.receiver.RejectedMessages(),
+		OversizedMessages:   s.oversized.Load(),
+		IdleDisconnects:     s.idleClosed.Load(),
 	}
 }
 
 func (s *MLLPServer) Start(ctx context.Context) error {
+	if err := s.Listen(); err != nil {
+		return err
+	}
+	s.Serve(ctx)
+	return nil
+}
+
+// Listen binds the port without accepting connections yet, so that a new
+// listener can be checked before it replaces a running one
+func (s *MLLPServer) Listen() error {
 	addr := fmt.Sprintf(":%d", s.port)
 	listener, err := net.Listen("tcp", addr)
 	if err != nil {
 		return fmt.Errorf("port dinlenemedi %s: %w", addr, err)
 	}
 	s.listener = listener
+	return nil
+}
 
+// Serve starts accepting connections on the bound port
+func (s *MLLPServer) Serve(ctx context.Context) {
 	slog.Info("HL7 MLLP sunucu başlatıldı",
 		"port", s.port,
 		"direction", s.direction,
-		"address", addr)
+		"address", s.listener.Addr().String())
 
 	go s.acceptConnections(ctx)
-	return nil
 }
 
 func (s *MLLPServer) acceptConnections(ctx context.Context) {
@@ -56,18 +145,78 @@ func (s *MLLPServer) acceptConnections(ctx context.Context) {
 		default:
 			conn, err := s.listener.Accept()
 			if err != nil {
-				if ctx.Err() != nil {
+				if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
 					return
 				}
 				slog.Error("Bağlantı kabul hatası", "error", err)
 				continue
 			}
 
-			go s.handleConnection(ctx, conn)
+			ip := peerIP(conn.RemoteAddr())
+			if !s.options().AccessPolicy.AllowIP(ip) {
+				s.rejectedConns.Add(1)
+				slog.Warn("Bağlantı reddedildi: kaynak izinli değil",
+					"remoteAddr", conn.RemoteAddr().String(),
+					"direction", s.direction)
+				conn.Close()
+				continue
+			}
+
+			if reason := s.acquire(ip, conn); reason != "" {
+				s.rejectedConns.Add(1)
+				slog.Warn("Bağlantı reddedildi: "+reason,
+					"remoteAddr", conn.RemoteAddr().String(),
+					"direction", s.direction)
+				conn.Close()
+				continue
+			}
+
+			go func() {
+				defer s.release(ip, conn)
+				s.handleConnection(ctx, conn)
+			}()
 		}
 	}
 }
 
+// acquire reserves a connection slot for ip and returns the reason when a
+// limit is reached or the listener is shutting down
+func (s *MLLPServer) acquire(ip net.IP, conn net.Conn) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closing {
+		return "sunucu kapanıyor"
+	}
+	opts := s.options()
+	if opts.MaxConnections > 0 && s.active.Load() >= int64(opts.MaxConnections) {
+		return "bağlantı sınırı aşıldı"
+	}
+	key := ip.String()
+	if opts.MaxConnsPerIP > 0 && s.perIP[key] >= opts.MaxConnsPerIP {
+		return "kaynak başına bağlantı sınırı aşıldı"
+	}
+
+	s.active.Add(1)
+	s.perIP[key]++
+	s.conns[conn] = false
+	s.wg.Add(1)
+	return ""
+}
+
+func (s *MLLPServer) release(ip net.IP, conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer s.wg.Done()
+
+	delete(s.conns, conn)
+	s.active.Add(-1)
+	key := ip.String()
+	if s.perIP[key]--; s.perIP[key] <= 0 {
+		delete(s.perIP, key)
+	}
+}
+
 func (s *MLLPServer) handleConnection(ctx context.Context, conn net.Conn) {
 	defer conn.Close()
 
@@ -75,136 +224,146 @@ func (s *MLLPServer) handleConnection(ctx context.Context, conn net.Conn) {
 	slog.Info("Yeni HL7 bağlantısı", "remoteAddr", remoteAddr, "direction", s.direction)
 
 	reader := bufio.NewReader(conn)
+	src := Source{
+		Addr: remoteAddr,
+		IP:   peerIP(conn.RemoteAddr()),
+	}
 
-	for {
-		select {
-		case <-ctx.Done():
+	for ctx.Err() == nil {
+		// Wait up to the idle timeout for the next frame; once it has
+		// started it must be complete within the read timeout
+		if !s.waitForFrame(conn) {
+			slog.Info("Sunucu kapanıyor, bağlantı kapatıldı", "remoteAddr", remoteAddr)
 			return
-		default:
-			// Set read timeout
-			conn.SetReadDeadline(time.Now().Add(30 * time.Second))
-
-			// Read MLLP message
-			message, err := s.readMLLPMessage(reader)
-			if err != nil {
-				if err == io.EOF {
-					slog.Info("Bağlantı kapatıldı", "remoteAddr", remoteAddr)
-					return
-				}
-				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-					continue
-				}
-				slog.Error("Mesaj okuma hatası", "error", err, "remoteAddr", remoteAddr)
-				return
-			}
-
-			// Process message
-			if err := s.processMessage(message, remoteAddr); err != nil {
-				slog.Error("Mesaj işleme hatası", "error", err)
-				// Send NACK
-				conn.Write(CreateACK(message, "AE"))
-			} else {
-				// Send ACK
-				conn.Write(CreateACK(message, "AA"))
-			}
 		}
-	}
-}
+		opts := s.options()
+		inFrame := false
+		message, err := ReadFrame(reader, opts.MaxMessageSize, func() {
+			inFrame = true
+			s.startFrame(conn)
+		})
 
-func (s *MLLPServer) readMLLPMessage(reader *bufio.Reader) ([]byte, error) {
-	// Wait for start block
-	for {
-		b, err := reader.ReadByte()
-		if err != nil {
-			return nil, err
+		var reply []byte
+		switch {
+		case err == nil:
+			// Process message (or every message of a batch)
+			reply = s.receiver.Handle(NormalizeSegments(message), src)
+		case errors.Is(err, ErrFrameTooLarge):
+			s.oversized.Add(1)
+			slog.Warn("Mesaj boyut sınırını aşıyor",
+				"remoteAddr", remoteAddr,
+				"maxSize", opts.MaxMessageSize)
+			reply = CreateNACK(NormalizeSegments(message), "AR", ErrApplicationError,
+				fmt.Sprintf("mesaj boyutu sınırı aşıldı (%d bayt)", opts.MaxMessageSize))
+		case err == io.EOF:
+			slog.Info("Bağlantı kapatıldı", "remoteAddr", remoteAddr)
+			return
+		case isTimeout(err) && !inFrame && s.isClosing():
+			slog.Info("Sunucu kapanıyor, bağlantı kapatıldı", "remoteAddr", remoteAddr)
+			return
+		case isTimeout(err) && !inFrame:
+			s.idleClosed.Add(1)
+			slog.Info("Boşta kalan bağlantı kapatıldı", "remoteAddr", remoteAddr, "idleTimeout", opts.IdleTimeout)
+			return
+		case isTimeout(err):
+			slog.Warn("Mesaj zamanında tamamlanmadı, bağlantı kapatıldı",
+				"remoteAddr", remoteAddr,
+				"readTimeout", opts.ReadTimeout)
+			return
+		default:
+			slog.Error("Mesaj okuma hatası", "error", err, "remoteAddr", remoteAddr)
+			return
 		}
-		if b == StartBlock {
-			break
+
+		conn.SetWriteDeadline(time.Now().Add(opts.ReadTimeout))
+		if _, err := conn.Write(reply); err != nil {
+			slog.Error("ACK gönderilemedi", "error", err, "remoteAddr", remoteAddr)
+			return
 		}
 	}
+}
 
-	// Read until end block
-	var buffer bytes.Buffer
-	for {
-		b, err := reader.ReadByte()
-		if err != nil {
-			return nil, err
-		}
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
 
-		if b == EndBlock {
-			// Read carriage return
-			cr, err := reader.ReadByte()
-			if err != nil {
-				return nil, err
-			}
-			if cr != CarriageReturn {
-				return nil, fmt.Errorf("MLLP formatı hatası: CR beklendi, %02X alındı", cr)
-			}
-			break
-		}
+// waitForFrame marks the connection idle and sets the idle deadline; it
+// returns false once the listener is shutting down
+func (s *MLLPServer) waitForFrame(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-		buffer.WriteByte(b)
+	if s.closing {
+		return false
 	}
+	s.conns[conn] = false
+	conn.SetReadDeadline(time.Now().Add(s.options().IdleTimeout))
+	return true
+}
 
-	return buffer.Bytes(), nil
+// startFrame marks the connection busy; a started frame is read, handled
+// and acknowledged even during shutdown
+func (s *MLLPServer) startFrame(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.conns[conn] = true
+	conn.SetReadDeadline(time.Now().Add(s.options().ReadTimeout))
 }
 
-func (s *MLLPServer) processMessage(rawMessage []byte, sourceAddr string) error {
-	// Parse HL7 message
-	parsed, err := ParseMessage(rawMessage)
-	if err != nil {
-		return fmt.Errorf("mesaj parse hatası: %w", err)
-	}
+func (s *MLLPServer) isClosing() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closing
+}
 
-	// Create message object
-	msg := &db.HL7Message{
-		ID:               uuid.New().String(),
-		Timestamp:        time.Now(),
-		Direction:        s.direction,
-		SourceAddr:       sourceAddr,
-		MessageType:      parsed["message_type"],
-		MessageControlID: parsed["message_control_id"],
-		PatientID:        parsed["patient_id"],
-		PatientName:      parsed["patient_name"],
-		RawMessage:       rawMessage,
-		Status:           "pending",
-		CreatedAt:        time.Now(),
+// Shutdown stops accepting connections, closes idle connections and waits
+// for connections handling a frame to send their ACK. Connections still
+// open when ctx ends are closed; the context error is returned then.
+func (s *MLLPServer) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closing = true
+	if s.listener != nil {
+		s.listener.Close()
 	}
-
-	// Set destination based on direction
-	if s.direction == "order" {
-		msg.DestinationAddr = "194.187.253.34:2575" // ZenPACS
-	} else {
-		// This will be configured from environment
-		msg.DestinationAddr = "hospital_his"
+	busy := 0
+	for conn, inFrame := range s.conns {
+		if inFrame {
+			busy++
+			continue
+		}
+		// Unblock the read waiting for the next frame
+		conn.SetReadDeadline(time.Now())
 	}
+	s.mu.Unlock()
 
-	// Publish to NATS JetStream
-	subject := fmt.Sprintf("hl7.%ss.%s", s.direction, msg.ID)
+	slog.Info("HL7 MLLP sunucu kapatılıyor", "direction", s.direction, "port", s.port, "inFlight", busy)
 
-	msgData, err := json.Marshal(msg)
-	if err != nil {
-		return fmt.Errorf("mesaj serialize hatası: %w", err)
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		slog.Info("HL7 MLLP sunucu kapatıldı", "direction", s.direction, "port", s.port)
+		return nil
+	case <-ctx.Done():
 	}
 
-	_, err = s.js.Publish(context.Background(), subject, msgData)
-	if err != nil {
-		return fmt.Errorf("NATS publish hatası: %w", err)
+	s.mu.Lock()
+	remaining := len(s.conns)
+	for conn := range s.conns {
+		conn.Close()
 	}
+	s.mu.Unlock()
+	<-done
 
-	slog.Info("HL7 mesaj alındı ve kuyruğa eklendi",
-		"id", msg.ID,
+	slog.Warn("HL7 MLLP sunucu kapatma süresi aşıldı, bağlantılar kesildi",
 		"direction", s.direction,
-		"messageType", msg.MessageType,
-		"patientID", msg.PatientID,
-		"source", sourceAddr)
-
-	return nil
-}
-
-func (s *MLLPServer) Stop() error {
-	if s.listener != nil {
-		return s.listener.Close()
-	}
-	return nil
+		"port", s.port,
+		"closedConnections", remaining)
+	return ctx.Err()
 }
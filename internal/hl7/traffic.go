@@ -0,0 +1,216 @@
+package hl7
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/minasoft/hl7-replicator/internal/schedule"
+)
+
+// Traffic states of an expected sender
+const (
+	TrafficOK          = "ok"
+	TrafficSilent      = "silent"       // nothing received for longer than the expected interval
+	TrafficOffSchedule = "off_schedule" // no traffic is expected at the moment
+)
+
+// AnySender matches every sender of a route in a traffic expectation
+const AnySender = "*"
+
+// maxTrackedSenders bounds the sender activity kept per route
+const maxTrackedSenders = 1000
+
+// TrafficExpectation is the traffic a route expects from a sender
+type TrafficExpectation struct {
+	Sender   string             // "APP^FACILITY", "APP" (any facility) or AnySender
+	Interval time.Duration      // longest silence accepted
+	Schedule *schedule.Schedule // nil expects traffic at any time
+}
+
+// ParseTrafficExpectations parses comma separated "SENDER=INTERVAL" entries,
+// optionally followed by "@DAYS HOURS", e.g.
+// "HIS^HOSPITAL=15m@mon-fri 08:00-20:00,*=2h"
+func ParseTrafficExpectations(value string) ([]TrafficExpectation, error) {
+	var expectations []TrafficExpectation
+	for _, entry := range splitList(value) {
+		sender, rest, ok := strings.Cut(entry, "=")
+		sender = strings.TrimSpace(sender)
+		if !ok || sender == "" {
+			return nil, fmt.Errorf("geçersiz trafik beklentisi: %q", entry)
+		}
+		interval, when, scheduled := strings.Cut(rest, "@")
+
+		e := TrafficExpectation{Sender: sender}
+		d, err := time.ParseDuration(strings.TrimSpace(interval))
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("geçersiz trafik beklentisi %q: süre hatalı", entry)
+		}
+		e.Interval = d
+
+		if scheduled {
+			s := &schedule.Schedule{}
+			for _, field := range strings.Fields(when) {
+				if strings.Contains(field, ":") {
+					s.Hours = field
+				} else {
+					s.Days = append(s.Days, field)
+				}
+			}
+			if err := s.Parse(); err != nil {
+				return nil, fmt.Errorf("geçersiz trafik beklentisi %q: %w", entry, err)
+			}
+			e.Schedule = s
+		}
+		expectations = append(expectations, e)
+	}
+	return expectations, nil
+}
+
+// matches reports whether MSH-3/MSH-4 belong to the expected sender
+func (e *TrafficExpectation) matches(application, facility string) bool {
+	if e.Sender == AnySender {
+		return true
+	}
+	app, fac, _ := strings.Cut(e.Sender, "^")
+	return componentEqual(application, strings.TrimSpace(app)) &&
+		(fac == "" || componentEqual(facility, strings.TrimSpace(fac)))
+}
+
+// SenderActivity is the traffic received from one sender of a route
+type SenderActivity struct {
+	Direction   string    `json:"direction"`
+	Application string    `json:"application"`
+	Facility    string    `json:"facility"`
+	FirstSeen   time.Time `json:"first_seen"`
+	LastSeen    time.Time `json:"last_seen"`
+	LastSource  string    `json:"last_source"`
+	Messages    uint64    `json:"messages"`
+}
+
+// TrafficStatus reports whether an expected sender keeps sending
+type TrafficStatus struct {
+	Name        string     `json:"name"` // "<direction>:<sender>"
+	Direction   string     `json:"direction"`
+	Sender      string     `json:"sender"`
+	Interval    string     `json:"interval"`
+	Schedule    string     `json:"schedule,omitempty"`
+	State       string     `json:"state"`
+	LastSeen    *time.Time `json:"last_seen,omitempty"`
+	SilentSince *time.Time `json:"silent_since,omitempty"` // when the silence exceeded the interval
+	Silence     float64    `json:"silence_seconds"`        // time since the last message, the window start or the service start
+}
+
+// trafficLog keeps the sender activity of a route
+type trafficLog struct {
+	started time.Time
+
+	mu      sync.Mutex
+	senders map[string]*SenderActivity // by upper-case APP^FACILITY
+}
+
+func newTrafficLog() *trafficLog {
+	return &trafficLog{
+		started: time.Now(),
+		senders: make(map[string]*SenderActivity),
+	}
+}
+
+// record notes a message from MSH-3/MSH-4; only the namespace IDs are kept
+func (t *trafficLog) record(direction, application, facility, source string, at time.Time) {
+	application, _, _ = strings.Cut(application, "^")
+	facility, _, _ = strings.Cut(facility, "^")
+	key := strings.ToUpper(application + "^" + facility)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	a, ok := t.senders[key]
+	if !ok {
+		if len(t.senders) >= maxTrackedSenders {
+			return
+		}
+		a = &SenderActivity{
+			Direction:   direction,
+			Application: application,
+			Facility:    facility,
+			FirstSeen:   at,
+		}
+		t.senders[key] = a
+	}
+	a.LastSeen = at
+	a.LastSource = source
+	a.Messages++
+}
+
+func (t *trafficLog) activity() []SenderActivity {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	senders := make([]SenderActivity, 0, len(t.senders))
+	for _, a := range t.senders {
+		senders = append(senders, *a)
+	}
+	sort.Slice(senders, func(i, j int) bool {
+		if senders[i].Application != senders[j].Application {
+			return senders[i].Application < senders[j].Application
+		}
+		return senders[i].Facility < senders[j].Facility
+	})
+	return senders
+}
+
+// status evaluates an expectation. Silence counts from the last message,
+// the start of the scheduled window or the start of the service, whichever
+// is last, so a restart or a new window does not report a sender silent
+// right away.
+func (t *trafficLog) status(direction string, e TrafficExpectation, now time.Time) TrafficStatus {
+	st := TrafficStatus{
+		Name:      direction + ":" + e.Sender,
+		Direction: direction,
+		Sender:    e.Sender,
+		Interval:  e.Interval.String(),
+		State:     TrafficOK,
+	}
+	if e.Schedule != nil {
+		st.Schedule = e.Schedule.String()
+	}
+
+	var last time.Time
+	t.mu.Lock()
+	for _, a := range t.senders {
+		if e.matches(a.Application, a.Facility) && a.LastSeen.After(last) {
+			last = a.LastSeen
+		}
+	}
+	t.mu.Unlock()
+	if !last.IsZero() {
+		st.LastSeen = &last
+	}
+
+	since := last
+	if t.started.After(since) {
+		since = t.started
+	}
+	if e.Schedule != nil {
+		start, ok := e.Schedule.Start(now)
+		if !ok {
+			st.State = TrafficOffSchedule
+			return st
+		}
+		if start.After(since) {
+			since = start
+		}
+	}
+
+	silence := now.Sub(since)
+	st.Silence = silence.Round(time.Second).Seconds()
+	if silence >= e.Interval {
+		silentSince := since.Add(e.Interval)
+		st.State = TrafficSilent
+		st.SilentSince = &silentSince
+	}
+	return st
+}
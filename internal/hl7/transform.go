@@ -0,0 +1,178 @@
+package hl7
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Transform rewrites an inbound message before it is enqueued. A transform
+// may return several messages, which are then tracked as children of the
+// original message.
+type Transform interface {
+	Name() string
+	Apply(raw []byte) ([][]byte, error)
+}
+
+// Built-in transform names
+const (
+	TransformSplitOBR = "split_obr"
+)
+
+// SplitOBR is the transform emitting one message per OBR group
+type SplitOBR struct{}
+
+func (SplitOBR) Name() string {
+	return TransformSplitOBR
+}
+
+func (SplitOBR) Apply(raw []byte) ([][]byte, error) {
+	return SplitByOBR(raw)
+}
+
+// ParseTransforms builds the transform chain of a route from a comma
+// separated list of names. Transforms needing runtime dependencies are
+// created by the caller and passed as available.
+func ParseTransforms(names string, available ...Transform) ([]Transform, error) {
+	var chain []Transform
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(strings.ToLower(name))
+		if name == "" {
+			continue
+		}
+
+		var t Transform
+		if name == TransformSplitOBR {
+			t = SplitOBR{}
+		}
+		for _, a := range available {
+			if a.Name() == name {
+				t = a
+			}
+		}
+		if t == nil {
+			return nil, fmt.Errorf("bilinmeyen dönüşüm: %s", name)
+		}
+		chain = append(chain, t)
+	}
+	return chain, nil
+}
+
+// orderGroups splits the segments into the header (everything before the
+// first ORC/OBR) and one group per OBR; an ORC belongs to the OBR after it
+func orderGroups(m *Message) (header []*Segment, groups [][]*Segment) {
+	var current []*Segment
+	hasOBR := false
+
+	for _, seg := range m.Segments {
+		switch {
+		case seg.Name == "ORC" || seg.Name == "OBR":
+			if hasOBR {
+				groups = append(groups, current)
+				current, hasOBR = nil, false
+			}
+			current = append(current, seg)
+			hasOBR = hasOBR || seg.Name == "OBR"
+		case current == nil:
+			header = append(header, seg)
+		default:
+			current = append(current, seg)
+		}
+	}
+	if current != nil {
+		groups = append(groups, current)
+	}
+	return header, groups
+}
+
+// SplitByOBR splits a message holding several OBR groups (e.g. an ORU with
+// results for multiple accessions) into one message per group. The header
+// segments (MSH, PID, PV1, ...) are copied into every message and MSH-10
+// gets a "-<n>" suffix. Messages with a single group are returned unchanged.
+func SplitByOBR(raw []byte) ([][]byte, error) {
+	msg, err := ParseStructure(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	header, groups := orderGroups(msg)
+	if len(groups) <= 1 {
+		return [][]byte{raw}, nil
+	}
+
+	controlID := msg.Segment("MSH").Field(10)
+	out := make([][]byte, 0, len(groups))
+	for i, group := range groups {
+		child := &Message{Delims: msg.Delims}
+		for _, seg := range header {
+			child.Segments = append(child.Segments, seg.Clone())
+		}
+		for _, seg := range group {
+			child.Segments = append(child.Segments, seg.Clone())
+		}
+
+		child.Segment("MSH").SetField(10, fmt.Sprintf("%s-%d", controlID, i+1))
+		if obr := child.Segment("OBR"); obr != nil {
+			obr.SetField(1, "1")
+		}
+		out = append(out, child.Encode())
+	}
+	return out, nil
+}
+
+// MergeResults combines messages of the same patient into one message: the
+// header of the first message followed by the OBR groups of all messages,
+// with OBR-1 renumbered
+func MergeResults(messages [][]byte) ([]byte, error) {
+	if len(messages) == 0 {
+		return nil, fmt.Errorf("birleştirilecek mesaj yok")
+	}
+	if len(messages) == 1 {
+		return messages[0], nil
+	}
+
+	first, err := ParseStructure(messages[0])
+	if err != nil {
+		return nil, err
+	}
+	patientID := patientKey(first)
+
+	header, groups := orderGroups(first)
+	merged := &Message{Delims: first.Delims}
+	for _, seg := range header {
+		merged.Segments = append(merged.Segments, seg.Clone())
+	}
+
+	for i, raw := range messages {
+		msg := first
+		if i > 0 {
+			if msg, err = ParseStructure(raw); err != nil {
+				return nil, fmt.Errorf("mesaj %d: %w", i+1, err)
+			}
+			if patientKey(msg) != patientID {
+				return nil, fmt.Errorf("mesaj %d farklı hastaya ait", i+1)
+			}
+			_, groups = orderGroups(msg)
+		}
+		for _, group := range groups {
+			for _, seg := range group {
+				merged.Segments = append(merged.Segments, seg.Clone())
+			}
+		}
+	}
+
+	setID := 0
+	for _, obr := range merged.All("OBR") {
+		setID++
+		obr.SetField(1, strconv.Itoa(setID))
+	}
+
+	return merged.Encode(), nil
+}
+
+func patientKey(m *Message) string {
+	if pid := m.Segment("PID"); pid != nil {
+		return strings.TrimSpace(pid.Component(3, 1))
+	}
+	return ""
+}
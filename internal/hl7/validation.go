@@ -0,0 +1,229 @@
+package hl7
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Validation modes per route
+const (
+	ValidationOff    = "off"    // messages are not validated
+	ValidationWarn   = "warn"   // violations are recorded but the message is forwarded
+	ValidationReject = "reject" // messages with violations are refused with an AE ACK
+)
+
+// Profile is a conformance profile for one or more message types
+type Profile struct {
+	Name         string           `json:"name"`
+	Routes       []string         `json:"routes,omitempty"`        // empty matches every route
+	MessageTypes []string         `json:"message_types,omitempty"` // e.g. "ORM^O01", empty matches every type
+	Segments     []SegmentProfile `json:"segments"`
+}
+
+// SegmentProfile defines the cardinality and fields of a segment
+type SegmentProfile struct {
+	Name   string         `json:"name"`
+	Min    int            `json:"min"`
+	Max    int            `json:"max"` // 0 means unbounded
+	Fields []FieldProfile `json:"fields,omitempty"`
+}
+
+// FieldProfile defines the constraints of a single field
+type FieldProfile struct {
+	Position  int      `json:"position"`
+	Required  bool     `json:"required,omitempty"`
+	Type      string   `json:"type,omitempty"` // ST, NM, ID, IS, TS, DTM, DT, CX, XPN
+	MaxLength int      `json:"max_length,omitempty"`
+	Table     []string `json:"table,omitempty"` // allowed values for the first component
+}
+
+// Violation is a single conformance error
+type Violation struct {
+	Segment  string `json:"segment"`
+	Sequence int    `json:"sequence,omitempty"` // segment occurrence, 1-based
+	Field    int    `json:"field,omitempty"`
+	Code     string `json:"code"` // HL7 table 0357 error code
+	Message  string `json:"message"`
+}
+
+func (v Violation) String() string {
+	if v.Field > 0 {
+		return fmt.Sprintf("%s-%d: %s", v.Segment, v.Field, v.Message)
+	}
+	return fmt.Sprintf("%s: %s", v.Segment, v.Message)
+}
+
+// ValidationError is returned when a message fails validation in reject mode
+type ValidationError struct {
+	Violations []Violation
+}
+
+func (e *ValidationError) Error() string {
+	parts := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		parts[i] = v.String()
+	}
+	return "doğrulama hatası: " + strings.Join(parts, "; ")
+}
+
+// Validator validates messages against a set of profiles
+type Validator struct {
+	profiles []Profile
+}
+
+// LoadValidator reads profiles from a JSON file holding a list of profiles
+func LoadValidator(path string) (*Validator, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("profil dosyası okunamadı %s: %w", path, err)
+	}
+
+	var profiles []Profile
+	if err := json.Unmarshal(data, &profiles); err != nil {
+		return nil, fmt.Errorf("profil dosyası geçersiz %s: %w", path, err)
+	}
+
+	return NewValidator(profiles), nil
+}
+
+// NewValidator creates a validator for the given profiles
+func NewValidator(profiles []Profile) *Validator {
+	return &Validator{profiles: profiles}
+}
+
+// Validate checks msg against every profile matching the route and message type
+func (v *Validator) Validate(route string, msg *Message) []Violation {
+	if v == nil {
+		return nil
+	}
+
+	var violations []Violation
+	msgType := msg.Type()
+	for _, p := range v.profiles {
+		if !p.matches(route, msgType) {
+			continue
+		}
+		violations = append(violations, p.validate(msg)...)
+	}
+	return violations
+}
+
+func (p *Profile) matches(route, msgType string) bool {
+	if len(p.Routes) > 0 && !containsFold(p.Routes, route) {
+		return false
+	}
+	if len(p.MessageTypes) > 0 && !containsFold(p.MessageTypes, msgType) {
+		return false
+	}
+	return true
+}
+
+func (p *Profile) validate(msg *Message) []Violation {
+	var violations []Violation
+
+	for _, sp := range p.Segments {
+		segments := msg.All(sp.Name)
+
+		if len(segments) < sp.Min {
+			violations = append(violations, Violation{
+				Segment: sp.Name,
+				Code:    ErrSegmentSequence,
+				Message: fmt.Sprintf("en az %d segment gerekli, %d bulundu", sp.Min, len(segments)),
+			})
+		}
+		if sp.Max > 0 && len(segments) > sp.Max {
+			violations = append(violations, Violation{
+				Segment: sp.Name,
+				Code:    ErrSegmentSequence,
+				Message: fmt.Sprintf("en fazla %d segment izinli, %d bulundu", sp.Max, len(segments)),
+			})
+		}
+
+		for i, seg := range segments {
+			for _, fp := range sp.Fields {
+				if violation, ok := fp.check(seg); !ok {
+					violation.Segment = sp.Name
+					violation.Sequence = i + 1
+					violation.Field = fp.Position
+					violations = append(violations, violation)
+				}
+			}
+		}
+	}
+
+	return violations
+}
+
+func (fp *FieldProfile) check(seg *Segment) (Violation, bool) {
+	value := seg.Field(fp.Position)
+	if value == "" {
+		if fp.Required {
+			return Violation{Code: ErrRequiredField, Message: "zorunlu alan eksik"}, false
+		}
+		return Violation{}, true
+	}
+
+	for _, rep := range seg.Repetitions(fp.Position) {
+		// The length limit applies to each repetition, not the whole field
+		if fp.MaxLength > 0 && len(rep) > fp.MaxLength {
+			return Violation{
+				Code:    ErrDataType,
+				Message: fmt.Sprintf("alan uzunluğu %d, en fazla %d", len(rep), fp.MaxLength),
+			}, false
+		}
+		comps := strings.Split(rep, string(seg.delims.Component))
+		if !validType(fp.Type, comps) {
+			return Violation{
+				Code:    ErrDataType,
+				Message: fmt.Sprintf("%s veri tipine uygun değil: %q", fp.Type, rep),
+			}, false
+		}
+		if len(fp.Table) > 0 && !containsFold(fp.Table, comps[0]) {
+			return Violation{
+				Code:    ErrTableValue,
+				Message: fmt.Sprintf("izin verilmeyen değer: %q", comps[0]),
+			}, false
+		}
+	}
+
+	return Violation{}, true
+}
+
+var (
+	tsPattern = regexp.MustCompile(`^\d{4}(\d{2}(\d{2}(\d{2}(\d{2}(\d{2}(\.\d{1,4})?)?)?)?)?)?([+-]\d{4})?$`)
+	dtPattern = regexp.MustCompile(`^\d{4}(\d{2}(\d{2})?)?$`)
+)
+
+// validType checks the components of a single repetition against a data type
+func validType(dataType string, comps []string) bool {
+	switch strings.ToUpper(dataType) {
+	case "TS", "DTM":
+		return tsPattern.MatchString(comps[0])
+	case "DT":
+		return dtPattern.MatchString(comps[0])
+	case "NM":
+		_, err := strconv.ParseFloat(comps[0], 64)
+		return err == nil
+	case "CX":
+		// CX.1 ID number is mandatory
+		return comps[0] != ""
+	case "XPN":
+		// Family name or given name must be present
+		return comps[0] != "" || (len(comps) > 1 && comps[1] != "")
+	default:
+		return true
+	}
+}
+
+func containsFold(list []string, value string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, value) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,79 @@
+package hl7
+
+import "testing"
+
+func TestFieldProfileCheck(t *testing.T) {
+	tests := []struct {
+		name    string
+		profile FieldProfile
+		field   string
+		code    string // empty when the field conforms
+	}{
+		{"optional empty", FieldProfile{Position: 3, Type: "NM"}, "", ""},
+		{"required empty", FieldProfile{Position: 3, Required: true}, "", ErrRequiredField},
+		{"required present", FieldProfile{Position: 3, Required: true}, "X", ""},
+		{"within length", FieldProfile{Position: 3, MaxLength: 5}, "12345", ""},
+		{"too long", FieldProfile{Position: 3, MaxLength: 5}, "123456", ErrDataType},
+		{"length per repetition", FieldProfile{Position: 3, MaxLength: 5}, "12345~67890~1", ""},
+		{"one repetition too long", FieldProfile{Position: 3, MaxLength: 5}, "12345~678901", ErrDataType},
+		{"TS", FieldProfile{Position: 3, Type: "TS"}, "20240101083000+0300", ""},
+		{"TS date only", FieldProfile{Position: 3, Type: "DTM"}, "2024", ""},
+		{"bad TS", FieldProfile{Position: 3, Type: "TS"}, "01.01.2024", ErrDataType},
+		{"DT", FieldProfile{Position: 3, Type: "DT"}, "20240101", ""},
+		{"DT with time", FieldProfile{Position: 3, Type: "DT"}, "202401010830", ErrDataType},
+		{"NM", FieldProfile{Position: 3, Type: "NM"}, "-12.5", ""},
+		{"bad NM", FieldProfile{Position: 3, Type: "NM"}, "12a", ErrDataType},
+		{"CX", FieldProfile{Position: 3, Type: "CX"}, "12345^^^HOSP^MR", ""},
+		{"CX without ID", FieldProfile{Position: 3, Type: "CX"}, "^^^HOSP^MR", ErrDataType},
+		{"bad CX repetition", FieldProfile{Position: 3, Type: "CX"}, "12345^^^HOSP~^^^TC", ErrDataType},
+		{"XPN given name only", FieldProfile{Position: 3, Type: "XPN"}, "^JOHN", ""},
+		{"XPN without name", FieldProfile{Position: 3, Type: "XPN"}, "^^^DR", ErrDataType},
+		{"unknown type", FieldProfile{Position: 3, Type: "ZZ"}, "anything", ""},
+		{"table value", FieldProfile{Position: 3, Table: []string{"M", "F"}}, "f", ""},
+		{"table first component", FieldProfile{Position: 3, Table: []string{"NW"}}, "NW^new", ""},
+		{"not in table", FieldProfile{Position: 3, Table: []string{"M", "F"}}, "X", ErrTableValue},
+		{"repetition not in table", FieldProfile{Position: 3, Table: []string{"M", "F"}}, "M~X", ErrTableValue},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, err := ParseStructure([]byte("MSH|^~\\&|HIS|H\rPID|1||" + tt.field + "\r"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			v, ok := tt.profile.check(msg.Segment("PID"))
+			if ok != (tt.code == "") || v.Code != tt.code {
+				t.Errorf("check(%q) = %+v %v, beklenen kod %q", tt.field, v, ok, tt.code)
+			}
+		})
+	}
+}
+
+func TestValidatorCardinality(t *testing.T) {
+	v := NewValidator([]Profile{{
+		Name:         "orm",
+		Routes:       []string{"order"},
+		MessageTypes: []string{"ORM^O01"},
+		Segments: []SegmentProfile{
+			{Name: "PID", Min: 1, Max: 1},
+			{Name: "OBR", Min: 1, Fields: []FieldProfile{{Position: 2, Required: true}}},
+		},
+	}})
+	msg, err := ParseStructure([]byte("MSH|^~\\&|HIS|H|||||ORM^O01|1|P|2.5\rPID|1\rPID|2\rOBR|1|A\rOBR|2\r"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := v.Validate("result", msg); len(got) != 0 {
+		t.Errorf("başka rotada doğrulandı: %v", got)
+	}
+	got := v.Validate("ORDER", msg)
+	if len(got) != 2 {
+		t.Fatalf("ihlaller %v", got)
+	}
+	if got[0].Segment != "PID" || got[0].Code != ErrSegmentSequence {
+		t.Errorf("segment sayısı ihlali hatalı: %+v", got[0])
+	}
+	if got[1].Segment != "OBR" || got[1].Sequence != 2 || got[1].Field != 2 || got[1].Code != ErrRequiredField {
+		t.Errorf("alan ihlali hatalı: %+v", got[1])
+	}
+}
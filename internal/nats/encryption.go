@@ -0,0 +1,139 @@
+package nats
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+)
+
+// KeyProvider supplies a JetStream encryption key
+type KeyProvider interface {
+	Key(ctx context.Context) (string, error)
+}
+
+// StaticKey provides a key given directly, e.g. from an env var
+type StaticKey string
+
+func (k StaticKey) Key(ctx context.Context) (string, error) {
+	return string(k), nil
+}
+
+// FileKey reads the key from a file such as a mounted secret
+type FileKey string
+
+func (k FileKey) Key(ctx context.Context) (string, error) {
+	data, err := os.ReadFile(string(k))
+	if err != nil {
+		return "", fmt.Errorf("anahtar dosyası okunamadı %s: %w", string(k), err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// CommandKey runs an external command (KMS plugin) that prints the key to stdout
+type CommandKey string
+
+func (k CommandKey) Key(ctx context.Context) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", string(k))
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("anahtar komutu başarısız: %w", err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// EncryptionOptions configures at-rest encryption of the JetStream store
+type EncryptionOptions struct {
+	Key      KeyProvider // current key, nil disables encryption
+	OldKey   KeyProvider // previous key, only set while rotating
+	Cipher   string      // "aes" or "chacha"
+	Required bool        // refuse to start without encryption
+	Migrate  bool        // allow encrypting an existing plaintext store
+}
+
+// apply resolves the keys and sets the JetStream encryption options
+func (e *EncryptionOptions) apply(opts *server.Options) error {
+	var key, oldKey string
+	var err error
+
+	if e.Key != nil {
+		if key, err = e.Key.Key(context.Background()); err != nil {
+			return err
+		}
+	}
+	if e.OldKey != nil {
+		if oldKey, err = e.OldKey.Key(context.Background()); err != nil {
+			return err
+		}
+	}
+
+	state, err := storeEncryptionState(opts.StoreDir)
+	if err != nil {
+		return err
+	}
+
+	if key == "" {
+		if e.Required {
+			return fmt.Errorf("şifreleme zorunlu fakat anahtar tanımlanmamış")
+		}
+		if state == storeEncrypted {
+			return fmt.Errorf("store şifreli fakat anahtar tanımlanmamış: %s", opts.StoreDir)
+		}
+		return nil
+	}
+
+	if state == storePlaintext && !e.Migrate {
+		return fmt.Errorf("store şifrelenmemiş veri içeriyor, dönüştürmek için STORE_ENCRYPTION_MIGRATE=true ayarlayın: %s", opts.StoreDir)
+	}
+
+	switch strings.ToLower(e.Cipher) {
+	case "", "chacha", "chachapoly":
+		opts.JetStreamCipher = server.ChaCha
+	case "aes":
+		opts.JetStreamCipher = server.AES
+	default:
+		return fmt.Errorf("bilinmeyen şifreleme algoritması: %s", e.Cipher)
+	}
+
+	opts.JetStreamKey = key
+	opts.JetStreamOldKey = oldKey
+	return nil
+}
+
+type storeState int
+
+const (
+	storeEmpty storeState = iota
+	storePlaintext
+	storeEncrypted
+)
+
+// storeEncryptionState inspects existing stream directories to find out
+// whether the store was written with or without encryption
+func storeEncryptionState(storeDir string) (storeState, error) {
+	metas, err := filepath.Glob(filepath.Join(storeDir, "jetstream", "*", "streams", "*", server.JetStreamMetaFile))
+	if err != nil {
+		return storeEmpty, err
+	}
+
+	state := storeEmpty
+	for _, meta := range metas {
+		keyFile := filepath.Join(filepath.Dir(meta), server.JetStreamMetaFileKey)
+		if _, err := os.Stat(keyFile); err == nil {
+			state = storeEncrypted
+		} else {
+			// A single plaintext stream makes the whole store plaintext
+			return storePlaintext, nil
+		}
+	}
+	return state, nil
+}
@@ -8,6 +8,7 @@ import (
 	"path/filepath"
 	"time"
 
+	"github.com/minasoft/hl7-replicator/internal/hl7"
 	"github.com/nats-io/nats-server/v2/server"
 	"github.com/nats-io/nats.go"
 	"github.com/nats-io/nats.go/jetstream"
@@ -19,13 +20,14 @@ type EmbeddedServer struct {
 	js     jetstream.JetStream
 }
 
-func NewEmbeddedServer(dataDir string) (*EmbeddedServer, error) {
+func NewEmbeddedServer(dataDir string, enc EncryptionOptions) (*EmbeddedServer, error) {
 	// NATS sunucu ayarları
 	opts := &server.Options{
 		JetStream: true,
 		StoreDir:  filepath.Join(dataDir, "nats-store"),
-		Port:      -1, // Random port, sadece internal kullanım
-		HTTPPort:  -1, // HTTP monitoring kapalı
+		Port:      -1,   // Random port, sadece internal kullanım
+		HTTPPort:  -1,   // HTTP monitoring kapalı
+		NoSigs:    true, // Sinyalleri uygulama yönetir
 	}
 
 	// Store dizinini oluştur
@@ -33,6 +35,11 @@ func NewEmbeddedServer(dataDir string) (*EmbeddedServer, error) {
 		return nil, fmt.Errorf("store dizini oluşturulamadı: %w", err)
 	}
 
+	// At-rest şifreleme
+	if err := enc.apply(opts); err != nil {
+		return nil, fmt.Errorf("store şifreleme hatası: %w", err)
+	}
+
 	// NATS sunucusunu başlat
 	ns, err := server.NewServer(opts)
 	if err != nil {
@@ -47,7 +54,10 @@ func NewEmbeddedServer(dataDir string) (*EmbeddedServer, error) {
 		return nil, fmt.Errorf("NATS sunucu başlatılamadı")
 	}
 
-	slog.Info("Gömülü NATS sunucu başlatıldı", "clientURL", ns.ClientURL())
+	slog.Info("Gömülü NATS sunucu başlatıldı",
+		"clientURL", ns.ClientURL(),
+		"encrypted", opts.JetStreamKey != "",
+		"keyRotation", opts.JetStreamOldKey != "")
 
 	// Client bağlantısı oluştur
 	nc, err := nats.Connect(ns.ClientURL())
@@ -130,8 +140,8 @@ func (es *EmbeddedServer) createStreams() error {
 func (es *EmbeddedServer) createKVStore() error {
 	ctx := context.Background()
 
-	// Create KV store for statistics
-	statsKV, err := es.js.CreateKeyValue(ctx, jetstream.KeyValueConfig{
+	// Create KV store for statistics: all-time counts and last delivery times
+	_, err := es.js.CreateKeyValue(ctx, jetstream.KeyValueConfig{
 		Bucket:      "HL7_STATS",
 		Description: "HL7 mesaj istatistikleri",
 		History:     10,
@@ -143,23 +153,33 @@ func (es *EmbeddedServer) createKVStore() error {
 		return fmt.Errorf("stats KV store oluşturulamadı: %w", err)
 	}
 
-	// Initialize statistics
-	keys := []string{
-		"total_orders", "successful_orders", "failed_orders",
-		"total_reports", "successful_reports", "failed_reports",
-		"last_order_time", "last_report_time",
-	}
+	slog.Info("HL7_STATS KV store oluşturuldu")
 
-	for _, key := range keys {
-		if _, err := statsKV.Get(ctx, key); err != nil {
-			// Key doesn't exist, initialize with 0
-			if err.Error() == "nats: key not found" {
-				statsKV.Put(ctx, key, []byte("0"))
-			}
+	// Time-series buckets of the statistics, one key per minute, hour or day
+	series := []struct {
+		bucket      string
+		description string
+		ttl         time.Duration
+	}{
+		{"HL7_STATS_MINUTE", "Dakikalık HL7 mesaj istatistikleri", 48 * time.Hour},
+		{"HL7_STATS_HOUR", "Saatlik HL7 mesaj istatistikleri", 90 * 24 * time.Hour},
+		{"HL7_STATS_DAY", "Günlük HL7 mesaj istatistikleri", 5 * 365 * 24 * time.Hour},
+	}
+	for _, sr := range series {
+		_, err = es.js.CreateKeyValue(ctx, jetstream.KeyValueConfig{
+			Bucket:      sr.bucket,
+			Description: sr.description,
+			History:     1,
+			TTL:         sr.ttl,
+			MaxBytes:    64 * 1024 * 1024, // 64MB
+			Storage:     jetstream.FileStorage,
+		})
+		if err != nil {
+			return fmt.Errorf("%s KV store oluşturulamadı: %w", sr.bucket, err)
 		}
 	}
 
-	slog.Info("HL7_STATS KV store oluşturuldu")
+	slog.Info("İstatistik zaman serisi KV store'ları oluşturuldu")
 
 	// Create KV store for dead letter queue (failed messages)
 	_, err = es.js.CreateKeyValue(ctx, jetstream.KeyValueConfig{
@@ -190,6 +210,50 @@ func (es *EmbeddedServer) createKVStore() error {
 	}
 
 	slog.Info("HL7_HISTORY KV store oluşturuldu")
+
+	// Web API üzerinden yönetilen hedefler
+	_, err = es.js.CreateKeyValue(ctx, jetstream.KeyValueConfig{
+		Bucket:      "HL7_DESTINATIONS",
+		Description: "Web API üzerinden yönetilen giden hedefler",
+		History:     5,
+		TTL:         0, // Süresiz
+		MaxBytes:    1024 * 1024,
+		Storage:     jetstream.FileStorage,
+	})
+	if err != nil {
+		return fmt.Errorf("Destinations KV store oluşturulamadı: %w", err)
+	}
+
+	slog.Info("HL7_DESTINATIONS KV store oluşturuldu")
+
+	// Web API üzerinden eklenen alarm kuralları
+	_, err = es.js.CreateKeyValue(ctx, jetstream.KeyValueConfig{
+		Bucket:      "HL7_ALERT_RULES",
+		Description: "Web API üzerinden eklenen alarm kuralları",
+		History:     5,
+		TTL:         0, // Süresiz
+		MaxBytes:    1024 * 1024,
+		Storage:     jetstream.FileStorage,
+	})
+	if err != nil {
+		return fmt.Errorf("Alert rules KV store oluşturulamadı: %w", err)
+	}
+
+	slog.Info("HL7_ALERT_RULES KV store oluşturuldu")
+
+	// Create object store for documents extracted from OBX segments
+	_, err = es.js.CreateOrUpdateObjectStore(ctx, jetstream.ObjectStoreConfig{
+		Bucket:      hl7.AttachmentBucket,
+		Description: "HL7 mesajlarından çıkarılan ekler (PDF raporlar)",
+		TTL:         30 * 24 * time.Hour,    // 30 days
+		MaxBytes:    5 * 1024 * 1024 * 1024, // 5GB
+		Storage:     jetstream.FileStorage,
+	})
+	if err != nil {
+		return fmt.Errorf("Attachment object store oluşturulamadı: %w", err)
+	}
+
+	slog.Info("HL7_ATTACHMENTS object store oluşturuldu")
 	return nil
 }
 
@@ -203,6 +267,10 @@ func (es *EmbeddedServer) Connection() *nats.Conn {
 
 func (es *EmbeddedServer) Shutdown() {
 	if es.nc != nil {
+		// Bekleyen ACK ve yazımları sunucuya ilet
+		if err := es.nc.FlushTimeout(5 * time.Second); err != nil {
+			slog.Warn("NATS bağlantısı boşaltılamadı", "error", err)
+		}
 		es.nc.Close()
 	}
 	if es.server != nil {
@@ -0,0 +1,182 @@
+package phi
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"sync/atomic"
+
+	"github.com/minasoft/hl7-replicator/internal/db"
+)
+
+// Mode controls how identifying values are masked
+type Mode string
+
+const (
+	ModeOff    Mode = "off"    // values are shown as-is
+	ModeRedact Mode = "redact" // values are replaced with a fixed placeholder
+	ModeHash   Mode = "hash"   // values are replaced with a keyed, stable hash
+)
+
+// Redacted is the placeholder used in redact mode
+const Redacted = "***"
+
+// identifyingFields lists the fields (by HL7 field number) that carry PHI per segment
+var identifyingFields = map[string][]int{
+	"PID": {2, 3, 4, 5, 6, 7, 9, 11, 13, 14, 18, 19, 20},
+	"NK1": {2, 4, 5, 6, 30, 31, 32},
+	"MRG": {1, 2, 3, 4, 7},
+	"GT1": {3, 5, 6, 7, 8, 12},
+	"IN1": {16, 18, 19, 36, 49},
+	"IN2": {1, 2, 6, 8},
+	"PV1": {19, 50},
+}
+
+// Masker masks patient identifying information in values and HL7 messages
+type Masker struct {
+	mode Mode
+	salt string
+}
+
+// NewMasker creates a masker; unknown modes fall back to ModeOff
+func NewMasker(mode, salt string) *Masker {
+	m := Mode(strings.ToLower(mode))
+	switch m {
+	case ModeRedact, ModeHash:
+	default:
+		m = ModeOff
+	}
+	return &Masker{mode: m, salt: salt}
+}
+
+// Mode returns the active masking mode
+func (m *Masker) Mode() Mode {
+	return m.mode
+}
+
+// Enabled reports whether masking is active
+func (m *Masker) Enabled() bool {
+	return m.mode != ModeOff
+}
+
+// Value masks a single identifying value
+func (m *Masker) Value(v string) string {
+	if v == "" {
+		return v
+	}
+	switch m.mode {
+	case ModeRedact:
+		return Redacted
+	case ModeHash:
+		// Keyed with the salt, so values cannot be brute-forced without it
+		mac := hmac.New(sha256.New, []byte(m.salt))
+		mac.Write([]byte(v))
+		return "h:" + hex.EncodeToString(mac.Sum(nil)[:8])
+	default:
+		return v
+	}
+}
+
+// Message masks identifying fields of a raw ER7 encoded HL7 message. The
+// delimiters are read from MSH; segments may end with CR, CRLF or LF.
+func (m *Masker) Message(raw []byte) []byte {
+	if m.mode == ModeOff || len(raw) == 0 {
+		return raw
+	}
+
+	d := delimitersOf(raw)
+	terminator := []byte("\r")
+	if !bytes.Contains(raw, terminator) {
+		terminator = []byte("\n")
+	}
+
+	segments := bytes.Split(raw, terminator)
+	for i, seg := range segments {
+		// CRLF leaves the LF in front of the next segment
+		body := bytes.TrimLeft(seg, "\n")
+		if len(body) < 3 {
+			continue
+		}
+		positions, ok := identifyingFields[string(body[:3])]
+		if !ok {
+			continue
+		}
+
+		fields := strings.Split(string(body), d.field)
+		for _, pos := range positions {
+			if pos < len(fields) {
+				fields[pos] = m.field(fields[pos], d)
+			}
+		}
+		masked := append([]byte{}, seg[:len(seg)-len(body)]...)
+		segments[i] = append(masked, strings.Join(fields, d.field)...)
+	}
+
+	return bytes.Join(segments, terminator)
+}
+
+// delimiters are the field, component and repetition separators of a message
+type delimiters struct {
+	field, component, repetition string
+}
+
+// delimitersOf reads MSH-1 and MSH-2, falling back to |^~
+func delimitersOf(raw []byte) delimiters {
+	d := delimiters{field: "|", component: "^", repetition: "~"}
+	if len(raw) >= 6 && bytes.HasPrefix(raw, []byte("MSH")) {
+		d.field = string(raw[3])
+		d.component = string(raw[4])
+		d.repetition = string(raw[5])
+	}
+	return d
+}
+
+// field masks every component of a field while keeping the delimiters intact
+func (m *Masker) field(value string, d delimiters) string {
+	if value == "" {
+		return value
+	}
+	reps := strings.Split(value, d.repetition)
+	for i, rep := range reps {
+		comps := strings.Split(rep, d.component)
+		for j, comp := range comps {
+			comps[j] = m.Value(comp)
+		}
+		reps[i] = strings.Join(comps, d.component)
+	}
+	return strings.Join(reps, d.repetition)
+}
+
+// HL7Message returns a copy of msg with identifying fields masked
+func (m *Masker) HL7Message(msg db.HL7Message) db.HL7Message {
+	if m.mode == ModeOff {
+		return msg
+	}
+	msg.PatientID = m.Value(msg.PatientID)
+	msg.PatientName = m.Value(msg.PatientName)
+	msg.RawMessage = m.Message(msg.RawMessage)
+	return msg
+}
+
+var defaultMasker atomic.Pointer[Masker]
+
+func init() {
+	defaultMasker.Store(NewMasker(string(ModeOff), ""))
+}
+
+// SetDefault makes m the masker used by Mask
+func SetDefault(m *Masker) {
+	defaultMasker.Store(m)
+}
+
+// Default returns the process wide masker
+func Default() *Masker {
+	return defaultMasker.Load()
+}
+
+// Mask masks a value for logging with the default masker
+func Mask(v string) string {
+	return Default().Value(v)
+}
@@ -0,0 +1,115 @@
+package phi
+
+import (
+	"strings"
+	"testing"
+)
+
+const testSalt = "0123456789abcdef"
+
+func TestValue(t *testing.T) {
+	redact := NewMasker("redact", "")
+	hash := NewMasker("HASH", testSalt)
+
+	if got := NewMasker("off", "").Value("12345"); got != "12345" {
+		t.Errorf("off modunda değer değişti: %q", got)
+	}
+	if got := NewMasker("bilinmeyen", "").Value("12345"); got != "12345" {
+		t.Errorf("bilinmeyen mod off olmalı: %q", got)
+	}
+	if got := redact.Value("12345"); got != Redacted {
+		t.Errorf("redact %q döndü", got)
+	}
+	if got := redact.Value(""); got != "" {
+		t.Errorf("boş değer maskelendi: %q", got)
+	}
+
+	h := hash.Value("12345")
+	if !strings.HasPrefix(h, "h:") || len(h) != 2+16 {
+		t.Errorf("özet biçimi hatalı: %q", h)
+	}
+	if hash.Value("12345") != h {
+		t.Error("aynı değer için özet değişti")
+	}
+	if hash.Value("12346") == h {
+		t.Error("farklı değerler aynı özeti verdi")
+	}
+	if NewMasker("hash", testSalt+"x").Value("12345") == h {
+		t.Error("farklı anahtar aynı özeti verdi")
+	}
+}
+
+func TestMessage(t *testing.T) {
+	redact := NewMasker("redact", "")
+	hash := NewMasker("hash", testSalt)
+	id, name := hash.Value("12345"), hash.Value("DOE")
+
+	tests := []struct {
+		name   string
+		masker *Masker
+		raw    string
+		want   string
+	}{
+		{
+			name:   "redact PID",
+			masker: redact,
+			raw:    "MSH|^~\\&|HIS|H\rPID|1||12345^^^HOSP^MR~999^^^TC||DOE^JOHN||19800101|M\rOBR|1|ORD1\r",
+			want:   "MSH|^~\\&|HIS|H\rPID|1||***^^^***^***~***^^^***||***^***||***|M\rOBR|1|ORD1\r",
+		},
+		{
+			name:   "hash PID",
+			masker: hash,
+			raw:    "MSH|^~\\&|HIS|H\rPID|1||12345||DOE\r",
+			want:   "MSH|^~\\&|HIS|H\rPID|1||" + id + "||" + name + "\r",
+		},
+		{
+			name:   "redact NK1",
+			masker: redact,
+			raw:    "MSH|^~\\&|HIS|H\rNK1|1|DOE^JANE|SPO|STREET 1^^CITY|5551234\r",
+			want:   "MSH|^~\\&|HIS|H\rNK1|1|***^***|SPO|***^^***|***\r",
+		},
+		{
+			name:   "custom delimiters",
+			masker: redact,
+			raw:    "MSH#$@\\&#HIS#H\rPID#1##12345$HOSP@999##DOE$JOHN\rNK1#1#DOE$JANE\r",
+			want:   "MSH#$@\\&#HIS#H\rPID#1##***$***@***##***$***\rNK1#1#***$***\r",
+		},
+		{
+			name:   "hash with custom delimiters",
+			masker: hash,
+			raw:    "MSH#*~\\&#HIS\rPID#1##12345##DOE*X",
+			want:   "MSH#*~\\&#HIS\rPID#1##" + id + "##" + name + "*" + hash.Value("X"),
+		},
+		{
+			name:   "LF terminators",
+			masker: redact,
+			raw:    "MSH|^~\\&|HIS|H\nPID|1||12345||DOE\nNK1|1|DOE\n",
+			want:   "MSH|^~\\&|HIS|H\nPID|1||***||***\nNK1|1|***\n",
+		},
+		{
+			name:   "CRLF terminators",
+			masker: redact,
+			raw:    "MSH|^~\\&|HIS|H\r\nPID|1||12345||DOE\r\nOBX|1|TX|||text\r\n",
+			want:   "MSH|^~\\&|HIS|H\r\nPID|1||***||***\r\nOBX|1|TX|||text\r\n",
+		},
+		{
+			name:   "LF inside CR terminated text",
+			masker: redact,
+			raw:    "MSH|^~\\&|HIS|H\rPID|1||12345\rOBX|1|TX|||line 1\nPID is not a segment here\r",
+			want:   "MSH|^~\\&|HIS|H\rPID|1||***\rOBX|1|TX|||line 1\nPID is not a segment here\r",
+		},
+		{
+			name:   "off",
+			masker: NewMasker("off", ""),
+			raw:    "MSH|^~\\&|HIS|H\rPID|1||12345\r",
+			want:   "MSH|^~\\&|HIS|H\rPID|1||12345\r",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(tt.masker.Message([]byte(tt.raw))); got != tt.want {
+				t.Errorf("\nalınan   %q\nbeklenen %q", got, tt.want)
+			}
+		})
+	}
+}
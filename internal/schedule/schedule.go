@@ -0,0 +1,126 @@
+package schedule
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Schedule limits something to some days and hours, in local time. Hours
+// may cross midnight ("22:00-07:00"); a window belongs to the day it starts on.
+type Schedule struct {
+	Days  []string `json:"days,omitempty" yaml:"days"`   // mon, tue, ... or ranges such as mon-fri; empty means every day
+	Hours string   `json:"hours,omitempty" yaml:"hours"` // "08:00-20:00"; empty means all day
+
+	days     map[time.Weekday]bool
+	from, to time.Duration // offsets from midnight
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// Parse checks the days and hours; it must be called before the schedule
+// is used
+func (s *Schedule) Parse() error {
+	s.days = nil
+	if len(s.Days) > 0 {
+		s.days = make(map[time.Weekday]bool)
+		for _, day := range s.Days {
+			if err := s.addDays(day); err != nil {
+				return err
+			}
+		}
+	}
+
+	s.from, s.to = 0, 24*time.Hour
+	if s.Hours == "" {
+		return nil
+	}
+	from, to, ok := strings.Cut(s.Hours, "-")
+	if !ok {
+		return fmt.Errorf("saat aralığı SS:DD-SS:DD olmalı: %q", s.Hours)
+	}
+	var err error
+	if s.from, err = clock(from); err != nil {
+		return err
+	}
+	if s.to, err = clock(to); err != nil {
+		return err
+	}
+	if s.from == s.to {
+		return fmt.Errorf("saat aralığı boş: %q", s.Hours)
+	}
+	return nil
+}
+
+// addDays adds a day or a range of days such as "mon-fri" or "fri-mon"
+func (s *Schedule) addDays(value string) error {
+	first, last, isRange := strings.Cut(strings.ToLower(strings.TrimSpace(value)), "-")
+	from, ok := weekdays[first]
+	if !ok {
+		return fmt.Errorf("bilinmeyen gün: %q", value)
+	}
+	to := from
+	if isRange {
+		if to, ok = weekdays[last]; !ok {
+			return fmt.Errorf("bilinmeyen gün: %q", value)
+		}
+	}
+	for day := from; ; day = (day + 1) % 7 {
+		s.days[day] = true
+		if day == to {
+			return nil
+		}
+	}
+}
+
+func clock(value string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(value))
+	if err != nil {
+		return 0, fmt.Errorf("geçersiz saat: %q", value)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// Start returns the start of the window containing t; ok is false when t is
+// outside the schedule
+func (s *Schedule) Start(t time.Time) (start time.Time, ok bool) {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	offset := t.Sub(midnight)
+
+	switch {
+	case s.from < s.to:
+		if offset < s.from || offset >= s.to {
+			return time.Time{}, false
+		}
+		start = midnight.Add(s.from)
+	case offset >= s.from:
+		start = midnight.Add(s.from)
+	case offset < s.to:
+		start = midnight.AddDate(0, 0, -1).Add(s.from)
+	default:
+		return time.Time{}, false
+	}
+
+	if s.days != nil && !s.days[start.Weekday()] {
+		return time.Time{}, false
+	}
+	return start, true
+}
+
+// Contains reports whether t is within the schedule
+func (s *Schedule) Contains(t time.Time) bool {
+	_, ok := s.Start(t)
+	return ok
+}
+
+// String returns the schedule in the "mon-fri 08:00-20:00" form
+func (s *Schedule) String() string {
+	parts := append([]string{}, s.Days...)
+	if s.Hours != "" {
+		parts = append(parts, s.Hours)
+	}
+	return strings.Join(parts, " ")
+}
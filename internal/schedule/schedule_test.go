@@ -0,0 +1,82 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+// at returns the given day of January 2024 (the 1st is a Monday) at hh:mm
+func at(day, hh, mm int) time.Time {
+	return time.Date(2024, time.January, day, hh, mm, 0, 0, time.UTC)
+}
+
+func TestScheduleStart(t *testing.T) {
+	tests := []struct {
+		name      string
+		days      []string
+		hours     string
+		t         time.Time
+		wantStart time.Time // zero when t is outside the schedule
+	}{
+		{"always", nil, "", at(3, 15, 0), at(3, 0, 0)},
+		{"within hours", nil, "08:00-20:00", at(3, 8, 0), at(3, 8, 0)},
+		{"before hours", nil, "08:00-20:00", at(3, 7, 59), time.Time{}},
+		{"end is exclusive", nil, "08:00-20:00", at(3, 20, 0), time.Time{}},
+		{"weekday", []string{"mon-fri"}, "", at(5, 12, 0), at(5, 0, 0)},
+		{"weekend", []string{"mon-fri"}, "", at(6, 12, 0), time.Time{}},
+		{"single days", []string{"tue", "THU"}, "", at(4, 12, 0), at(4, 0, 0)},
+		{"day not listed", []string{"tue", "thu"}, "", at(3, 12, 0), time.Time{}},
+		{"range across the week end", []string{"fri-mon"}, "", at(7, 12, 0), at(7, 0, 0)},
+		{"outside range across the week end", []string{"fri-mon"}, "", at(3, 12, 0), time.Time{}},
+		{"night before midnight", nil, "22:00-07:00", at(3, 23, 0), at(3, 22, 0)},
+		{"night after midnight", nil, "22:00-07:00", at(4, 6, 59), at(3, 22, 0)},
+		{"night ended", nil, "22:00-07:00", at(4, 7, 0), time.Time{}},
+		{"night window belongs to its start day", []string{"fri"}, "22:00-07:00", at(6, 3, 0), at(5, 22, 0)},
+		{"night window started on an excluded day", []string{"mon-fri"}, "22:00-07:00", at(1, 3, 0), time.Time{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Schedule{Days: tt.days, Hours: tt.hours}
+			if err := s.Parse(); err != nil {
+				t.Fatal(err)
+			}
+			start, ok := s.Start(tt.t)
+			if ok != !tt.wantStart.IsZero() || !start.Equal(tt.wantStart) {
+				t.Errorf("Start(%s) = %s %v, beklenen %s", tt.t.Format("Mon 15:04"), start, ok, tt.wantStart)
+			}
+			if s.Contains(tt.t) != ok {
+				t.Error("Contains ile Start uyuşmuyor")
+			}
+		})
+	}
+}
+
+func TestScheduleParseErrors(t *testing.T) {
+	tests := []Schedule{
+		{Days: []string{"monday"}},
+		{Days: []string{"mon-xyz"}},
+		{Hours: "08:00"},
+		{Hours: "8-20"},
+		{Hours: "08:00-24:30"},
+		{Hours: "08:00-08:00"},
+	}
+	for _, s := range tests {
+		if err := s.Parse(); err == nil {
+			t.Errorf("geçersiz zaman aralığı kabul edildi: %q", s.String())
+		}
+	}
+}
+
+func TestScheduleReparse(t *testing.T) {
+	s := &Schedule{Days: []string{"mon"}, Hours: "08:00-09:00"}
+	if err := s.Parse(); err != nil {
+		t.Fatal(err)
+	}
+	s.Days, s.Hours = nil, ""
+	if err := s.Parse(); err != nil {
+		t.Fatal(err)
+	}
+	if !s.Contains(at(6, 23, 0)) {
+		t.Error("önceki gün ve saatler temizlenmedi")
+	}
+}
@@ -0,0 +1,206 @@
+package stats
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Resolutions of the time buckets
+const (
+	Minute = "minute"
+	Hour   = "hour"
+	Day    = "day"
+)
+
+// MaxPoints bounds the buckets read by one query
+const MaxPoints = 1500
+
+// ErrInvalidQuery reports a query that cannot be answered
+var ErrInvalidQuery = errors.New("geçersiz istatistik sorgusu")
+
+// resolution describes the buckets of one resolution; buckets start on
+// local minute, hour and day boundaries and are kept for the TTL of their
+// KV bucket
+type resolution struct {
+	name   string
+	bucket string
+	start  func(t time.Time) time.Time
+	next   func(t time.Time) time.Time
+}
+
+var resolutions = []resolution{
+	{
+		name:   Minute,
+		bucket: MinuteBucket,
+		start: func(t time.Time) time.Time {
+			return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, t.Location())
+		},
+		next: func(t time.Time) time.Time { return t.Add(time.Minute) },
+	},
+	{
+		name:   Hour,
+		bucket: HourBucket,
+		start: func(t time.Time) time.Time {
+			return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, t.Location())
+		},
+		next: func(t time.Time) time.Time { return t.Add(time.Hour) },
+	},
+	{
+		name:   Day,
+		bucket: DayBucket,
+		start: func(t time.Time) time.Time {
+			return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+		},
+		next: func(t time.Time) time.Time { return t.AddDate(0, 0, 1) },
+	},
+}
+
+func resolutionByName(name string) (resolution, bool) {
+	for _, r := range resolutions {
+		if r.name == name {
+			return r, true
+		}
+	}
+	return resolution{}, false
+}
+
+// Query selects the buckets of a time range
+type Query struct {
+	From       time.Time
+	To         time.Time
+	Resolution string   // minute, hour or day; chosen from the range when empty
+	GroupBy    string   // route (default), destination or message_type
+	Keys       []string // only these routes, destinations or message types; empty means all
+}
+
+// Point is the counts of one bucket
+type Point struct {
+	Time time.Time `json:"time"`
+	Counts
+}
+
+// Line is the points of one route, destination or message type
+type Line struct {
+	Key    string  `json:"key"`
+	Total  Counts  `json:"total"`
+	Points []Point `json:"points"`
+}
+
+// Series is the result of a query; every line has a point for every bucket
+// of the range, empty buckets included
+type Series struct {
+	Resolution string    `json:"resolution"`
+	GroupBy    string    `json:"group_by"`
+	From       time.Time `json:"from"`
+	To         time.Time `json:"to"`
+	Lines      []Line    `json:"series"`
+}
+
+// AutoResolution picks the finest resolution that keeps a range readable
+func AutoResolution(from, to time.Time) string {
+	switch span := to.Sub(from); {
+	case span <= 6*time.Hour:
+		return Minute
+	case span <= 31*24*time.Hour:
+		return Hour
+	default:
+		return Day
+	}
+}
+
+// Series reads the buckets of a query
+func (s *Store) Series(ctx context.Context, q Query) (*Series, error) {
+	if q.GroupBy == "" {
+		q.GroupBy = ByRoute
+	}
+	if !contains(Dimensions, q.GroupBy) {
+		return nil, fmt.Errorf("%w: group_by %q (route, destination veya message_type)", ErrInvalidQuery, q.GroupBy)
+	}
+	if !q.From.Before(q.To) {
+		return nil, fmt.Errorf("%w: from, to'dan önce olmalı", ErrInvalidQuery)
+	}
+	if q.Resolution == "" {
+		q.Resolution = AutoResolution(q.From, q.To)
+	}
+	res, ok := resolutionByName(q.Resolution)
+	if !ok {
+		return nil, fmt.Errorf("%w: resolution %q (minute, hour veya day)", ErrInvalidQuery, q.Resolution)
+	}
+
+	// Buckets are keyed by their local start, whatever zone the range is in
+	q.From, q.To = q.From.In(time.Local), q.To.In(time.Local)
+
+	var starts []time.Time
+	for t := res.start(q.From); t.Before(q.To); t = res.next(t) {
+		if len(starts) == MaxPoints {
+			return nil, fmt.Errorf("%w: aralık %d noktadan fazla, daha kaba bir resolution seçin", ErrInvalidQuery, MaxPoints)
+		}
+		starts = append(starts, t)
+	}
+
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+
+	kv := s.series[res.name]
+	buckets := make([]Bucket, len(starts))
+	seen := make(map[string]bool)
+	for i, start := range starts {
+		b, _, err := load(ctx, kv, strconv.FormatInt(start.Unix(), 10))
+		if err != nil {
+			return nil, err
+		}
+		b.merge(s.unwritten(res.name, start.Unix()))
+		buckets[i] = b
+		for key := range b[q.GroupBy] {
+			seen[key] = true
+		}
+	}
+
+	keys := q.Keys
+	if len(keys) == 0 {
+		for key := range seen {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+	}
+
+	series := &Series{
+		Resolution: res.name,
+		GroupBy:    q.GroupBy,
+		From:       q.From,
+		To:         q.To,
+		Lines:      make([]Line, 0, len(keys)),
+	}
+	for _, key := range keys {
+		line := Line{Key: key, Points: make([]Point, len(starts))}
+		for i, start := range starts {
+			c := buckets[i].Get(q.GroupBy, key)
+			line.Points[i] = Point{Time: start, Counts: c}
+			line.Total.Merge(c)
+		}
+		series.Lines = append(series.Lines, line)
+	}
+	return series, nil
+}
+
+// Sum returns the counts of one key over a range
+func (s *Store) Sum(ctx context.Context, dimension, key string, from, to time.Time) (Counts, error) {
+	series, err := s.Series(ctx, Query{From: from, To: to, GroupBy: dimension, Keys: []string{key}})
+	if err != nil {
+		return Counts{}, err
+	}
+	return series.Lines[0].Total, nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
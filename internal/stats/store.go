@@ -0,0 +1,459 @@
+package stats
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// Metrics
+const (
+	Received     = "received"      // messages enqueued on a route
+	Delivered    = "delivered"     // messages delivered to a destination
+	Failed       = "failed"        // failed delivery attempts
+	DeadLettered = "dead_lettered" // messages moved to the DLQ after the last attempt
+)
+
+// Dimensions the counts are kept by
+const (
+	ByRoute       = "route"
+	ByDestination = "destination"
+	ByMessageType = "message_type"
+)
+
+// Dimensions lists the dimensions the counts are kept by
+var Dimensions = []string{ByRoute, ByDestination, ByMessageType}
+
+// Buckets
+const (
+	TotalsBucket = "HL7_STATS"
+	MinuteBucket = "HL7_STATS_MINUTE"
+	HourBucket   = "HL7_STATS_HOUR"
+	DayBucket    = "HL7_STATS_DAY"
+)
+
+// totalsKey holds the all-time counts in TotalsBucket
+const totalsKey = "totals"
+
+// FlushInterval is the time between writes of the recorded counts
+const FlushInterval = 5 * time.Second
+
+// OtherKey collects the keys of a dimension beyond maxKeys, so that a
+// sender inventing message types cannot grow a bucket without bound
+const OtherKey = "other"
+
+const maxKeys = 100
+
+// maxConflicts bounds the retries of a compare-and-set write
+const maxConflicts = 20
+
+// Counts are the counters of one route, destination or message type
+type Counts struct {
+	Received     int64 `json:"received"`
+	Delivered    int64 `json:"delivered"`
+	Failed       int64 `json:"failed"`
+	DeadLettered int64 `json:"dead_lettered"`
+}
+
+func (c *Counts) add(metric string, n int64) {
+	switch metric {
+	case Received:
+		c.Received += n
+	case Delivered:
+		c.Delivered += n
+	case Failed:
+		c.Failed += n
+	case DeadLettered:
+		c.DeadLettered += n
+	}
+}
+
+// Merge adds the counts of o
+func (c *Counts) Merge(o Counts) {
+	c.Received += o.Received
+	c.Delivered += o.Delivered
+	c.Failed += o.Failed
+	c.DeadLettered += o.DeadLettered
+}
+
+// Bucket holds counts by dimension and key, for one time bucket or for all time
+type Bucket map[string]map[string]*Counts
+
+func (b Bucket) counts(dimension, key string) *Counts {
+	keys := b[dimension]
+	if keys == nil {
+		keys = make(map[string]*Counts)
+		b[dimension] = keys
+	}
+	c, ok := keys[key]
+	if !ok {
+		if len(keys) >= maxKeys && key != OtherKey {
+			return b.counts(dimension, OtherKey)
+		}
+		c = &Counts{}
+		keys[key] = c
+	}
+	return c
+}
+
+func (b Bucket) merge(o Bucket) {
+	for dimension, keys := range o {
+		for key, c := range keys {
+			b.counts(dimension, key).Merge(*c)
+		}
+	}
+}
+
+// Get returns the counts of a key; missing keys count zero
+func (b Bucket) Get(dimension, key string) Counts {
+	if c, ok := b[dimension][key]; ok {
+		return *c
+	}
+	return Counts{}
+}
+
+// Labels tell what a recorded event belongs to; empty labels are not counted
+type Labels struct {
+	Route       string
+	Destination string
+	MessageType string
+}
+
+// deltas are the counts recorded since the last write
+type deltas struct {
+	totals Bucket
+	series map[string]map[int64]Bucket // by resolution and bucket start
+	last   map[string]time.Time        // last delivery by route
+}
+
+func newDeltas() *deltas {
+	return &deltas{
+		totals: Bucket{},
+		series: make(map[string]map[int64]Bucket),
+		last:   make(map[string]time.Time),
+	}
+}
+
+func (d *deltas) empty() bool {
+	return len(d.totals) == 0 && len(d.last) == 0
+}
+
+func (d *deltas) bucket(resolution string, start int64) Bucket {
+	buckets := d.series[resolution]
+	if buckets == nil {
+		buckets = make(map[int64]Bucket)
+		d.series[resolution] = buckets
+	}
+	b := buckets[start]
+	if b == nil {
+		b = Bucket{}
+		buckets[start] = b
+	}
+	return b
+}
+
+// merge adds the counts of o, used to requeue deltas that could not be written
+func (d *deltas) merge(o *deltas) {
+	d.totals.merge(o.totals)
+	for resolution, buckets := range o.series {
+		for start, b := range buckets {
+			d.bucket(resolution, start).merge(b)
+		}
+	}
+	for route, t := range o.last {
+		if t.After(d.last[route]) {
+			d.last[route] = t
+		}
+	}
+}
+
+// Store counts messages by route, destination and message type, in total and
+// in per-minute, per-hour and per-day buckets. Events are added up in memory
+// and written every FlushInterval; every write is a compare-and-set on the
+// KV revision, so counts are never lost to concurrent writers. Counts not
+// yet written are lost if the process dies without the final flush.
+type Store struct {
+	totals jetstream.KeyValue
+	series map[string]jetstream.KeyValue // by resolution
+
+	// flushMu is held by writes and by reads, which add the unwritten counts
+	// to what they read from KV; a flush in between would count them twice
+	// or not at all
+	flushMu sync.Mutex
+	mu      sync.Mutex
+	pending *deltas
+}
+
+// Open opens the stats buckets; counters of earlier versions are carried over
+func Open(ctx context.Context, js jetstream.JetStream) (*Store, error) {
+	s := &Store{
+		series:  make(map[string]jetstream.KeyValue),
+		pending: newDeltas(),
+	}
+
+	var err error
+	if s.totals, err = js.KeyValue(ctx, TotalsBucket); err != nil {
+		return nil, fmt.Errorf("stats KV store erişilemedi: %w", err)
+	}
+	for _, r := range resolutions {
+		kv, err := js.KeyValue(ctx, r.bucket)
+		if err != nil {
+			return nil, fmt.Errorf("%s KV store erişilemedi: %w", r.bucket, err)
+		}
+		s.series[r.name] = kv
+	}
+
+	if err := s.migrate(ctx); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// migrate moves the counters of the key-per-counter layout into the totals;
+// failures were counted per message on the first attempt there, which does
+// not match any current metric, so only deliveries are carried over
+func (s *Store) migrate(ctx context.Context) error {
+	_, err := s.totals.Get(ctx, totalsKey)
+	if err == nil || !errors.Is(err, jetstream.ErrKeyNotFound) {
+		return err
+	}
+
+	// Only keys that exist are deleted; a delete leaves a marker behind
+	var legacy []string
+	totals := Bucket{}
+	for _, route := range []string{"order", "report"} {
+		for _, prefix := range []string{"total_", "successful_", "failed_"} {
+			key := prefix + route + "s"
+			entry, err := s.totals.Get(ctx, key)
+			if errors.Is(err, jetstream.ErrKeyNotFound) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			legacy = append(legacy, key)
+			if n, _ := strconv.ParseInt(string(entry.Value()), 10, 64); prefix == "successful_" && n > 0 {
+				totals.counts(ByRoute, route).Delivered = n
+				totals.counts(ByDestination, route).Delivered = n
+			}
+		}
+	}
+
+	data, _ := json.Marshal(totals)
+	if _, err := s.totals.Create(ctx, totalsKey, data); err != nil && !errors.Is(err, jetstream.ErrKeyExists) {
+		return fmt.Errorf("istatistikler taşınamadı: %w", err)
+	}
+	for _, key := range legacy {
+		if err := s.totals.Delete(ctx, key); err != nil {
+			slog.Warn("Eski istatistik sayacı silinemedi", "key", key, "error", err)
+		}
+	}
+	if len(totals) > 0 {
+		slog.Info("Eski istatistik sayaçları taşındı",
+			"deliveredOrders", totals.Get(ByRoute, "order").Delivered,
+			"deliveredReports", totals.Get(ByRoute, "report").Delivered)
+	}
+	return nil
+}
+
+// Record counts one event now
+func (s *Store) Record(metric string, labels Labels) {
+	s.RecordAt(metric, labels, time.Now())
+}
+
+// RecordAt counts one event at the given time
+func (s *Store) RecordAt(metric string, labels Labels, at time.Time) {
+	if s == nil {
+		return
+	}
+	at = at.In(time.Local)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	add := func(b Bucket) {
+		if labels.Route != "" {
+			b.counts(ByRoute, labels.Route).add(metric, 1)
+		}
+		if labels.Destination != "" {
+			b.counts(ByDestination, labels.Destination).add(metric, 1)
+		}
+		if labels.MessageType != "" {
+			b.counts(ByMessageType, labels.MessageType).add(metric, 1)
+		}
+	}
+	add(s.pending.totals)
+	for _, r := range resolutions {
+		add(s.pending.bucket(r.name, r.start(at).Unix()))
+	}
+	if metric == Delivered && labels.Route != "" && at.After(s.pending.last[labels.Route]) {
+		s.pending.last[labels.Route] = at
+	}
+}
+
+// Run writes the recorded counts every FlushInterval until ctx is done; the
+// caller flushes once more after the last event
+func (s *Store) Run(ctx context.Context) {
+	ticker := time.NewTicker(FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.Flush(ctx); err != nil {
+				slog.Error("İstatistikler kaydedilemedi, sonraki denemede tekrar yazılacak", "error", err)
+			}
+		}
+	}
+}
+
+// Flush writes the counts recorded so far. Counts that could not be written
+// are kept and retried with the next flush.
+func (s *Store) Flush(ctx context.Context) error {
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+
+	s.mu.Lock()
+	d := s.pending
+	s.pending = newDeltas()
+	s.mu.Unlock()
+
+	if d.empty() {
+		return nil
+	}
+
+	var errs []error
+	failed := newDeltas()
+	if err := s.add(ctx, s.totals, totalsKey, d.totals); err != nil {
+		errs = append(errs, err)
+		failed.totals = d.totals
+	}
+	for resolution, buckets := range d.series {
+		kv := s.series[resolution]
+		for start, b := range buckets {
+			if err := s.add(ctx, kv, strconv.FormatInt(start, 10), b); err != nil {
+				errs = append(errs, err)
+				failed.bucket(resolution, start).merge(b)
+			}
+		}
+	}
+	for route, t := range d.last {
+		if _, err := s.totals.Put(ctx, "last_"+route+"_time", []byte(t.Format(time.RFC3339))); err != nil {
+			errs = append(errs, err)
+			failed.last[route] = t
+		}
+	}
+
+	s.mu.Lock()
+	s.pending.merge(failed)
+	s.mu.Unlock()
+	return errors.Join(errs...)
+}
+
+// add merges delta into the bucket stored under key. The write only
+// succeeds if the key is unchanged since it was read; it is retried on
+// conflict.
+func (s *Store) add(ctx context.Context, kv jetstream.KeyValue, key string, delta Bucket) error {
+	for i := 0; i < maxConflicts; i++ {
+		b, revision, err := load(ctx, kv, key)
+		if err != nil {
+			return fmt.Errorf("%s okunamadı: %w", key, err)
+		}
+		b.merge(delta)
+		data, err := json.Marshal(b)
+		if err != nil {
+			return err
+		}
+		if revision == 0 {
+			_, err = kv.Create(ctx, key, data)
+		} else {
+			_, err = kv.Update(ctx, key, data, revision)
+		}
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, jetstream.ErrKeyExists) {
+			return fmt.Errorf("%s yazılamadı: %w", key, err)
+		}
+	}
+	return fmt.Errorf("%s yazılamadı: eşzamanlı güncelleme çakışması", key)
+}
+
+// load reads a stored bucket; revision is 0 when the key does not exist
+func load(ctx context.Context, kv jetstream.KeyValue, key string) (Bucket, uint64, error) {
+	entry, err := kv.Get(ctx, key)
+	if errors.Is(err, jetstream.ErrKeyNotFound) {
+		return Bucket{}, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	b := Bucket{}
+	if err := json.Unmarshal(entry.Value(), &b); err != nil {
+		return nil, 0, fmt.Errorf("geçersiz istatistik kaydı: %w", err)
+	}
+	return b, entry.Revision(), nil
+}
+
+// unwritten returns the counts recorded but not yet written for a bucket;
+// totals are returned for an empty resolution. The caller holds flushMu.
+func (s *Store) unwritten(resolution string, start int64) Bucket {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b := Bucket{}
+	if resolution == "" {
+		b.merge(s.pending.totals)
+	} else if pending, ok := s.pending.series[resolution][start]; ok {
+		b.merge(pending)
+	}
+	return b
+}
+
+// Totals returns the all-time counts, including counts not yet written
+func (s *Store) Totals(ctx context.Context) (Bucket, error) {
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+
+	b, _, err := load(ctx, s.totals, totalsKey)
+	if err != nil {
+		return nil, err
+	}
+	b.merge(s.unwritten("", 0))
+	return b, nil
+}
+
+// LastDelivered returns the time of the last delivery by route
+func (s *Store) LastDelivered(ctx context.Context) map[string]time.Time {
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+
+	last := make(map[string]time.Time)
+	for _, route := range []string{"order", "report"} {
+		entry, err := s.totals.Get(ctx, "last_"+route+"_time")
+		if err != nil {
+			continue
+		}
+		if t, err := time.Parse(time.RFC3339, string(entry.Value())); err == nil {
+			last[route] = t
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for route, t := range s.pending.last {
+		if t.After(last[route]) {
+			last[route] = t
+		}
+	}
+	return last
+}
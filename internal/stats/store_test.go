@@ -0,0 +1,235 @@
+package stats_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	natsrv "github.com/minasoft/hl7-replicator/internal/nats"
+	"github.com/minasoft/hl7-replicator/internal/stats"
+)
+
+func openStore(t *testing.T) *stats.Store {
+	t.Helper()
+	es, err := natsrv.NewEmbeddedServer(t.TempDir(), natsrv.EncryptionOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(es.Shutdown)
+
+	s, err := stats.Open(context.Background(), es.JetStream())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// TestMain runs the tests in a local zone that is not a whole number of
+// hours from UTC, so local and UTC hour and day buckets differ
+func TestMain(m *testing.M) {
+	time.Local = time.FixedZone("IST", 5*3600+1800)
+	os.Exit(m.Run())
+}
+
+var order = stats.Labels{Route: "order", Destination: "zenpacs", MessageType: "ORM^O01"}
+
+func TestSeries(t *testing.T) {
+	loc := time.Local
+	s := openStore(t)
+	ctx := context.Background()
+
+	at := time.Date(2024, 1, 1, 10, 0, 0, 0, loc)
+	s.RecordAt(stats.Received, order, at.Add(5*time.Minute))
+	s.RecordAt(stats.Received, order, at.Add(65*time.Minute))
+	s.RecordAt(stats.Delivered, order, at.Add(66*time.Minute))
+	s.RecordAt(stats.Received, stats.Labels{Route: "report", MessageType: "ORU^R01"}, at.Add(70*time.Minute))
+
+	check := func(when string, q stats.Query) {
+		t.Helper()
+		series, err := s.Series(ctx, q)
+		if err != nil {
+			t.Fatalf("%s: %v", when, err)
+		}
+		if len(series.Lines) != 2 || series.Lines[0].Key != "order" || series.Lines[1].Key != "report" {
+			t.Fatalf("%s: seriler %+v", when, series.Lines)
+		}
+		line := series.Lines[0]
+		if len(line.Points) != 3 {
+			t.Fatalf("%s: %d nokta, beklenen 3", when, len(line.Points))
+		}
+		for i, want := range []stats.Counts{{Received: 1}, {Received: 1, Delivered: 1}, {}} {
+			p := line.Points[i]
+			if !p.Time.Equal(at.Add(time.Duration(i)*time.Hour)) || p.Counts != want {
+				t.Errorf("%s: nokta %d %s %+v, beklenen %s %+v", when, i, p.Time, p.Counts, at.Add(time.Duration(i)*time.Hour), want)
+			}
+		}
+		if line.Total != (stats.Counts{Received: 2, Delivered: 1}) {
+			t.Errorf("%s: toplam %+v", when, line.Total)
+		}
+	}
+
+	local := stats.Query{From: at, To: at.Add(3 * time.Hour), Resolution: stats.Hour}
+	check("yazılmadan önce", local)
+	if err := s.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	check("yazıldıktan sonra", local)
+
+	// A range given in UTC reads the same local buckets
+	check("UTC aralık", stats.Query{From: at.UTC(), To: at.Add(3 * time.Hour).UTC(), Resolution: stats.Hour})
+}
+
+func TestSeriesUTCRangeByDay(t *testing.T) {
+	loc := time.Local
+	s := openStore(t)
+	ctx := context.Background()
+
+	// 02:00 local is still the previous day in UTC
+	at := time.Date(2024, 1, 2, 2, 0, 0, 0, loc)
+	s.RecordAt(stats.Received, order, at)
+	if err := s.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	series, err := s.Series(ctx, stats.Query{From: at.UTC(), To: at.Add(time.Hour).UTC(), Resolution: stats.Day})
+	if err != nil {
+		t.Fatal(err)
+	}
+	points := series.Lines[0].Points
+	if len(points) != 1 || points[0].Received != 1 || !points[0].Time.Equal(time.Date(2024, 1, 2, 0, 0, 0, 0, loc)) {
+		t.Errorf("günlük dilim %+v", points)
+	}
+}
+
+func TestSeriesKeysAndGroups(t *testing.T) {
+	s := openStore(t)
+	ctx := context.Background()
+	now := time.Now()
+	s.RecordAt(stats.Failed, order, now)
+
+	series, err := s.Series(ctx, stats.Query{From: now.Add(-time.Minute), To: now.Add(time.Minute), GroupBy: stats.ByDestination, Keys: []string{"zenpacs", "his"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(series.Lines) != 2 || series.Lines[0].Total.Failed != 1 || series.Lines[1].Total != (stats.Counts{}) {
+		t.Errorf("hedef serileri %+v", series.Lines)
+	}
+
+	sum, err := s.Sum(ctx, stats.ByMessageType, "ORM^O01", now.Add(-time.Hour), now.Add(time.Minute))
+	if err != nil || sum.Failed != 1 {
+		t.Errorf("Sum %+v %v", sum, err)
+	}
+}
+
+func TestSeriesInvalidQuery(t *testing.T) {
+	s := openStore(t)
+	now := time.Now()
+
+	tests := []struct {
+		name string
+		q    stats.Query
+	}{
+		{"unknown group", stats.Query{From: now.Add(-time.Hour), To: now, GroupBy: "sender"}},
+		{"unknown resolution", stats.Query{From: now.Add(-time.Hour), To: now, Resolution: "second"}},
+		{"empty range", stats.Query{From: now, To: now}},
+		{"reversed range", stats.Query{From: now, To: now.Add(-time.Hour)}},
+		{"too many points", stats.Query{From: now.Add(-time.Duration(stats.MaxPoints+1) * time.Minute), To: now, Resolution: stats.Minute}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := s.Series(context.Background(), tt.q); !errors.Is(err, stats.ErrInvalidQuery) {
+				t.Errorf("hata %v, beklenen ErrInvalidQuery", err)
+			}
+		})
+	}
+
+	// Exactly MaxPoints buckets are allowed
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.Local)
+	series, err := s.Series(context.Background(), stats.Query{From: from, To: from.Add(stats.MaxPoints * time.Minute), Resolution: stats.Minute, Keys: []string{"order"}})
+	if err != nil || len(series.Lines[0].Points) != stats.MaxPoints {
+		t.Errorf("%d noktalık sorgu reddedildi: %v", stats.MaxPoints, err)
+	}
+}
+
+func TestAutoResolution(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		span time.Duration
+		want string
+	}{
+		{time.Hour, stats.Minute},
+		{6 * time.Hour, stats.Minute},
+		{6*time.Hour + time.Minute, stats.Hour},
+		{7 * 24 * time.Hour, stats.Hour},
+		{31 * 24 * time.Hour, stats.Hour},
+		{32 * 24 * time.Hour, stats.Day},
+	}
+	for _, tt := range tests {
+		if got := stats.AutoResolution(now.Add(-tt.span), now); got != tt.want {
+			t.Errorf("AutoResolution(%s) = %s, beklenen %s", tt.span, got, tt.want)
+		}
+	}
+}
+
+func TestTotalsAndLastDelivered(t *testing.T) {
+	s := openStore(t)
+	ctx := context.Background()
+	at := time.Now().Add(-time.Minute).Truncate(time.Second)
+
+	s.RecordAt(stats.Delivered, order, at)
+	s.Record(stats.DeadLettered, order)
+	s.Record(stats.Received, stats.Labels{}) // counted nowhere
+
+	for _, when := range []string{"yazılmadan önce", "yazıldıktan sonra"} {
+		totals, err := s.Totals(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := totals.Get(stats.ByRoute, "order"); got != (stats.Counts{Delivered: 1, DeadLettered: 1}) {
+			t.Errorf("%s: toplam %+v", when, got)
+		}
+		if last := s.LastDelivered(ctx)["order"]; !last.Equal(at) {
+			t.Errorf("%s: son teslim %s, beklenen %s", when, last, at)
+		}
+		if err := s.Flush(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestTotalsDuringFlush(t *testing.T) {
+	s := openStore(t)
+	ctx := context.Background()
+
+	// Every read must see each event exactly once, whether it is still in
+	// memory, being written or already in KV
+	const events = 50
+	var wg sync.WaitGroup
+	for round := 1; round <= 5; round++ {
+		for i := 0; i < events; i++ {
+			s.Record(stats.Received, order)
+		}
+		want := int64(round * events)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.Flush(ctx); err != nil {
+				t.Error(err)
+			}
+		}()
+		for i := 0; i < 20; i++ {
+			totals, err := s.Totals(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := totals.Get(stats.ByRoute, "order").Received; got != want {
+				t.Fatalf("okunan toplam %d, beklenen %d", got, want)
+			}
+		}
+		wg.Wait()
+	}
+}
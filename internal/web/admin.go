@@ -0,0 +1,46 @@
+package web
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/minasoft/hl7-replicator/internal/config"
+)
+
+// handleReload reloads the configuration. Requires one of ADMIN_API_KEYS;
+// the endpoint is closed when none is configured.
+func (s *Server) handleReload(c echo.Context) error {
+	if !apiKeyAuthorized(c, s.currentConfig().AdminAPIKeys) {
+		return echo.NewHTTPError(http.StatusUnauthorized, "geçersiz API anahtarı")
+	}
+	if s.reload == nil {
+		return echo.NewHTTPError(http.StatusServiceUnavailable, "Yeniden yükleme desteklenmiyor")
+	}
+
+	changes, err := s.reload("api")
+	if err != nil {
+		return c.JSON(http.StatusUnprocessableEntity, map[string]interface{}{
+			"status": "rejected",
+			"error":  err.Error(),
+		})
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"status":  "reloaded",
+		"changes": changes,
+	})
+}
+
+// handleGetConfig returns the effective configuration: every setting with
+// its value and source (env, env_file, config_file or default). Secrets are
+// redacted. Requires one of ADMIN_API_KEYS.
+func (s *Server) handleGetConfig(c echo.Context) error {
+	cfg := s.currentConfig()
+	if !apiKeyAuthorized(c, cfg.AdminAPIKeys) {
+		return echo.NewHTTPError(http.StatusUnauthorized, "geçersiz API anahtarı")
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"env_file":    config.EnvFile(),
+		"config_file": config.ConfigFile(),
+		"settings":    cfg.Settings(),
+	})
+}
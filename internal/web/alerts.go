@@ -0,0 +1,153 @@
+package web
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/minasoft/hl7-replicator/internal/alerts"
+)
+
+// SetAlerts registers the engine behind /api/alerts
+func (s *Server) SetAlerts(e *alerts.Engine) {
+	s.alerts = e
+}
+
+// alertsAuthorized checks the admin API key and that alerting runs
+func (s *Server) alertsAuthorized(c echo.Context) error {
+	if !apiKeyAuthorized(c, s.currentConfig().AdminAPIKeys) {
+		return echo.NewHTTPError(http.StatusUnauthorized, "geçersiz API anahtarı")
+	}
+	if s.alerts == nil {
+		return echo.NewHTTPError(http.StatusServiceUnavailable, "Alarm motoru kullanılamıyor")
+	}
+	return nil
+}
+
+// handleListAlerts returns the pending, firing and resolving alerts
+func (s *Server) handleListAlerts(c echo.Context) error {
+	if err := s.alertsAuthorized(c); err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"alerts":   s.alerts.Alerts(),
+		"channels": s.alerts.ConfiguredChannels(),
+	})
+}
+
+func (s *Server) handleListAlertRules(c echo.Context) error {
+	if err := s.alertsAuthorized(c); err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, s.alerts.Rules())
+}
+
+func (s *Server) handleGetAlertRule(c echo.Context) error {
+	if err := s.alertsAuthorized(c); err != nil {
+		return err
+	}
+	r, err := s.alerts.Rule(c.Param("name"))
+	if err != nil {
+		return alertError(err)
+	}
+	return c.JSON(http.StatusOK, r)
+}
+
+// handleCreateAlertRule adds a rule; the name must not exist yet
+func (s *Server) handleCreateAlertRule(c echo.Context) error {
+	if err := s.alertsAuthorized(c); err != nil {
+		return err
+	}
+	var r alerts.Rule
+	if err := c.Bind(&r); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Geçersiz JSON")
+	}
+	if _, err := s.alerts.Rule(r.Name); err == nil {
+		return echo.NewHTTPError(http.StatusConflict, "Kural zaten var: "+r.Name)
+	}
+	if err := s.alerts.SaveRule(c.Request().Context(), &r); err != nil {
+		return alertError(err)
+	}
+	return c.JSON(http.StatusCreated, &r)
+}
+
+// handleUpdateAlertRule creates or replaces the rule named in the path
+func (s *Server) handleUpdateAlertRule(c echo.Context) error {
+	if err := s.alertsAuthorized(c); err != nil {
+		return err
+	}
+	var r alerts.Rule
+	if err := c.Bind(&r); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Geçersiz JSON")
+	}
+	r.Name = c.Param("name")
+
+	if err := s.alerts.SaveRule(c.Request().Context(), &r); err != nil {
+		return alertError(err)
+	}
+	return c.JSON(http.StatusOK, &r)
+}
+
+func (s *Server) handleDeleteAlertRule(c echo.Context) error {
+	if err := s.alertsAuthorized(c); err != nil {
+		return err
+	}
+	if err := s.alerts.DeleteRule(c.Request().Context(), c.Param("name")); err != nil {
+		return alertError(err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// handleTestAlertRule evaluates the rule named in the path, or the unsaved
+// rule in the body, and returns its findings without raising alerts
+func (s *Server) handleTestAlertRule(c echo.Context) error {
+	if err := s.alertsAuthorized(c); err != nil {
+		return err
+	}
+
+	var r alerts.Rule
+	if name := c.Param("name"); name != "" {
+		stored, err := s.alerts.Rule(name)
+		if err != nil {
+			return alertError(err)
+		}
+		r = *stored
+	} else if err := c.Bind(&r); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Geçersiz JSON")
+	}
+
+	findings, err := s.alerts.TestRule(c.Request().Context(), &r)
+	if err != nil {
+		return alertError(err)
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"rule":     r.Name,
+		"findings": findings,
+	})
+}
+
+// handleTestAlertChannels sends a test notification to the channel given
+// with ?channel=, or to every configured channel
+func (s *Server) handleTestAlertChannels(c echo.Context) error {
+	if err := s.alertsAuthorized(c); err != nil {
+		return err
+	}
+	results, err := s.alerts.TestChannels(c.Request().Context(), c.QueryParam("channel"))
+	if err != nil {
+		return alertError(err)
+	}
+	return c.JSON(http.StatusOK, results)
+}
+
+func alertError(err error) error {
+	switch {
+	case errors.Is(err, alerts.ErrRuleNotFound):
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	case errors.Is(err, alerts.ErrInvalidRule), errors.Is(err, alerts.ErrNoChannel):
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	case errors.Is(err, alerts.ErrRuleReadOnly):
+		return echo.NewHTTPError(http.StatusConflict, err.Error())
+	default:
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+}
@@ -0,0 +1,125 @@
+package web
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/minasoft/hl7-replicator/internal/hl7"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// attachmentPath is the path of documents kept in the attachment object store
+const attachmentPath = "/api/attachments/"
+
+// handleGetAttachment downloads the n-th ED/RP attachment of a message. ED
+// data is decoded; RP references to the attachment store are served from
+// it. Other http(s) references come from the sender, so they are only
+// redirected to on ATTACHMENT_REDIRECT_HOSTS and returned as JSON otherwise.
+func (s *Server) handleGetAttachment(c echo.Context) error {
+	// Attachments are documents about the patient and cannot be masked
+	if s.maskerFor(c).Enabled() {
+		return echo.NewHTTPError(http.StatusForbidden, "PHI maskeleme aktif, ekler maskesiz erişim gerektirir")
+	}
+
+	n, err := strconv.Atoi(c.Param("n"))
+	if err != nil || n < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, "Geçersiz ek numarası")
+	}
+
+	msg, err := s.findMessage(c.Request().Context(), c.Param("id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Mesajlar okunamadı")
+	}
+	if msg == nil {
+		return echo.NewHTTPError(http.StatusNotFound, "Mesaj bulunamadı")
+	}
+
+	parsed, err := hl7.ParseStructure(hl7.UnwrapMLLP(msg.RawMessage))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusUnprocessableEntity, "Mesaj parse edilemedi: "+err.Error())
+	}
+	attachments := parsed.Attachments()
+	if n > len(attachments) {
+		return echo.NewHTTPError(http.StatusNotFound, "Ek bulunamadı")
+	}
+	a := attachments[n-1]
+
+	if a.Type == "RP" {
+		if i := strings.Index(a.Reference, attachmentPath); i >= 0 {
+			return s.streamAttachment(c, a.Reference[i+len(attachmentPath):])
+		}
+		if u, err := url.Parse(a.Reference); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+			if redirectAllowed(u, s.currentConfig().AttachmentRedirectHosts) {
+				return c.Redirect(http.StatusFound, u.String())
+			}
+			return c.JSON(http.StatusOK, map[string]string{
+				"type":      a.Type,
+				"reference": a.Reference,
+			})
+		}
+		return echo.NewHTTPError(http.StatusNotFound, "Ek referansı indirilemiyor: "+a.Reference)
+	}
+
+	data, err := a.Data()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusUnprocessableEntity, "Ek çözülemedi: "+err.Error())
+	}
+	filename := fmt.Sprintf("%s-%d%s", msg.ID, n, a.Extension())
+	c.Response().Header().Set("Content-Disposition", `inline; filename="`+filename+`"`)
+	return c.Blob(http.StatusOK, a.MediaType, data)
+}
+
+// redirectAllowed reports whether u points to one of the comma separated
+// hosts; an entry without a port matches any port
+func redirectAllowed(u *url.URL, hosts string) bool {
+	for _, host := range strings.Split(hosts, ",") {
+		host = strings.ToLower(strings.TrimSpace(host))
+		if host != "" && (host == strings.ToLower(u.Host) || host == strings.ToLower(u.Hostname())) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleGetStoredAttachment serves a document written to the attachment
+// store by the extract_attachments transform
+func (s *Server) handleGetStoredAttachment(c echo.Context) error {
+	if s.maskerFor(c).Enabled() {
+		return echo.NewHTTPError(http.StatusForbidden, "PHI maskeleme aktif, ekler maskesiz erişim gerektirir")
+	}
+	return s.streamAttachment(c, c.Param("name"))
+}
+
+func (s *Server) streamAttachment(c echo.Context, name string) error {
+	ctx := c.Request().Context()
+	store, err := s.js.ObjectStore(ctx, hl7.AttachmentBucket)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusServiceUnavailable, "Ek deposu açılamadı")
+	}
+
+	result, err := store.Get(ctx, name)
+	if errors.Is(err, jetstream.ErrObjectNotFound) {
+		return echo.NewHTTPError(http.StatusNotFound, "Ek bulunamadı")
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Ek okunamadı")
+	}
+	defer result.Close()
+
+	info, err := result.Info()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Ek okunamadı")
+	}
+	contentType := info.Metadata["content-type"]
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	c.Response().Header().Set("Content-Disposition", `inline; filename="`+name+`"`)
+	return c.Stream(http.StatusOK, contentType, result)
+}
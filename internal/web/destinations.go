@@ -0,0 +1,151 @@
+package web
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/minasoft/hl7-replicator/internal/consumers"
+)
+
+// testRequest is the body of a destination test: the message to send,
+// a QRY^A19 test message when empty, and for an unsaved destination its
+// settings
+type testRequest struct {
+	Message     string                        `json:"message"`
+	Destination *consumers.ManagedDestination `json:"destination"`
+}
+
+// SetDestinations registers the manager behind /api/destinations
+func (s *Server) SetDestinations(m *consumers.DestinationManager) {
+	s.destinations = m
+}
+
+// destinationsAuthorized checks the admin API key and that destinations
+// are managed at all
+func (s *Server) destinationsAuthorized(c echo.Context) error {
+	if !apiKeyAuthorized(c, s.currentConfig().AdminAPIKeys) {
+		return echo.NewHTTPError(http.StatusUnauthorized, "geçersiz API anahtarı")
+	}
+	if s.destinations == nil {
+		return echo.NewHTTPError(http.StatusServiceUnavailable, "Hedef yönetimi kullanılamıyor")
+	}
+	return nil
+}
+
+func (s *Server) handleListDestinations(c echo.Context) error {
+	if err := s.destinationsAuthorized(c); err != nil {
+		return err
+	}
+	list, err := s.destinations.List(c.Request().Context())
+	if err != nil {
+		return destinationError(err)
+	}
+	for i, d := range list {
+		list[i] = d.Redacted()
+	}
+	return c.JSON(http.StatusOK, list)
+}
+
+func (s *Server) handleGetDestination(c echo.Context) error {
+	if err := s.destinationsAuthorized(c); err != nil {
+		return err
+	}
+	d, err := s.destinations.Get(c.Request().Context(), c.Param("name"))
+	if err != nil {
+		return destinationError(err)
+	}
+	return c.JSON(http.StatusOK, d.Redacted())
+}
+
+// handleCreateDestination adds a destination; the name must not exist yet
+func (s *Server) handleCreateDestination(c echo.Context) error {
+	if err := s.destinationsAuthorized(c); err != nil {
+		return err
+	}
+	var d consumers.ManagedDestination
+	if err := c.Bind(&d); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Geçersiz JSON")
+	}
+
+	ctx := c.Request().Context()
+	if _, err := s.destinations.Get(ctx, d.Name); err == nil {
+		return echo.NewHTTPError(http.StatusConflict, "Hedef zaten var: "+d.Name)
+	}
+	if err := s.destinations.Save(ctx, &d); err != nil {
+		return destinationError(err)
+	}
+	return c.JSON(http.StatusCreated, d.Redacted())
+}
+
+// handleUpdateDestination creates or replaces the destination named in the
+// path; redacted secrets ("***") keep their stored values
+func (s *Server) handleUpdateDestination(c echo.Context) error {
+	if err := s.destinationsAuthorized(c); err != nil {
+		return err
+	}
+	var d consumers.ManagedDestination
+	if err := c.Bind(&d); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Geçersiz JSON")
+	}
+	d.Name = c.Param("name")
+
+	if err := s.destinations.Save(c.Request().Context(), &d); err != nil {
+		return destinationError(err)
+	}
+	return c.JSON(http.StatusOK, d.Redacted())
+}
+
+func (s *Server) handleDeleteDestination(c echo.Context) error {
+	if err := s.destinationsAuthorized(c); err != nil {
+		return err
+	}
+	if err := s.destinations.Delete(c.Request().Context(), c.Param("name")); err != nil {
+		return destinationError(err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// handleTestDestination sends a test message to a stored destination, or to
+// the unsaved destination in the body, and reports the acknowledgement
+func (s *Server) handleTestDestination(c echo.Context) error {
+	if err := s.destinationsAuthorized(c); err != nil {
+		return err
+	}
+	var req testRequest
+	if c.Request().ContentLength != 0 {
+		if err := c.Bind(&req); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Geçersiz JSON")
+		}
+	}
+
+	ctx := c.Request().Context()
+	d := req.Destination
+	if name := c.Param("name"); name != "" {
+		stored, err := s.destinations.Get(ctx, name)
+		if err != nil {
+			return destinationError(err)
+		}
+		d = stored
+	}
+	if d == nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Test edilecek hedef gerekli")
+	}
+
+	result, err := s.destinations.Test(ctx, d, []byte(req.Message))
+	if err != nil {
+		return destinationError(err)
+	}
+	return c.JSON(http.StatusOK, result)
+}
+
+func destinationError(err error) error {
+	switch {
+	case errors.Is(err, consumers.ErrDestinationNotFound):
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	case errors.Is(err, consumers.ErrInvalidDestination):
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	default:
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+}
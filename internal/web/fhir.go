@@ -0,0 +1,90 @@
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/minasoft/hl7-replicator/internal/fhir"
+	"github.com/minasoft/hl7-replicator/internal/hl7"
+)
+
+// handleFHIRDiagnosticReport converts a posted DiagnosticReport to ORU^R01
+// and enqueues it on the report route
+func (s *Server) handleFHIRDiagnosticReport(c echo.Context) error {
+	return s.handleFHIR(c, func(conv *fhir.Converter, body []byte) ([][]byte, error) {
+		message, err := conv.ReportToORU(body)
+		if err != nil {
+			return nil, err
+		}
+		return [][]byte{message}, nil
+	})
+}
+
+// handleFHIRBundle converts every DiagnosticReport of a posted Bundle
+func (s *Server) handleFHIRBundle(c echo.Context) error {
+	return s.handleFHIR(c, func(conv *fhir.Converter, body []byte) ([][]byte, error) {
+		return conv.BundleToORU(body)
+	})
+}
+
+// handleFHIR runs a conversion and enqueues the resulting messages. Every
+// resource is converted before anything is enqueued so that a Bundle with
+// an invalid report is rejected as a whole; errors are returned as
+// OperationOutcome.
+func (s *Server) handleFHIR(c echo.Context, convert func(*fhir.Converter, []byte) ([][]byte, error)) error {
+	if !s.inboundAuthorized(c) {
+		slog.Warn("FHIR giriş yetkisiz istek", "path", c.Request().URL.Path, "remoteAddr", c.RealIP())
+		return fhirError(c, http.StatusUnauthorized, "security", errors.New("geçersiz API anahtarı"))
+	}
+
+	receiver, ok := s.receivers["report"]
+	if !ok {
+		return fhirError(c, http.StatusServiceUnavailable, "exception", errors.New("report route'u tanımlı değil"))
+	}
+
+	body, err := io.ReadAll(io.LimitReader(c.Request().Body, maxInboundSize+1))
+	if err != nil || len(body) > maxInboundSize {
+		return fhirError(c, http.StatusRequestEntityTooLarge, "too-costly", errors.New("istek gövdesi okunamadı veya çok büyük"))
+	}
+
+	cfg := s.currentConfig()
+	converter := fhir.NewConverter(cfg.FHIRPatientSystem, cfg.FHIROrderSystem)
+	messages, err := convert(converter, body)
+	if err != nil {
+		slog.Warn("FHIR dönüşüm hatası", "error", err, "remoteAddr", c.RealIP())
+		return fhirError(c, http.StatusBadRequest, "invalid", err)
+	}
+
+	src := hl7.Source{Addr: "fhir://" + c.RealIP()}
+	outcome := &fhir.OperationOutcome{ResourceType: "OperationOutcome"}
+	for _, message := range messages {
+		msg, err := receiver.Receive(message, src)
+		if err != nil {
+			return fhirError(c, inboundStatus(err), "processing", err)
+		}
+		outcome.Issue = append(outcome.Issue, fhir.OperationOutcomeIssue{
+			Severity:    "information",
+			Code:        "informational",
+			Diagnostics: fmt.Sprintf("ORU^R01 kuyruğa eklendi: id=%s controlId=%s", msg.ID, msg.MessageControlID),
+		})
+	}
+
+	return fhirJSON(c, http.StatusAccepted, outcome)
+}
+
+func fhirError(c echo.Context, status int, code string, err error) error {
+	return fhirJSON(c, status, fhir.Outcome("error", code, err))
+}
+
+func fhirJSON(c echo.Context, status int, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.Blob(status, "application/fhir+json", data)
+}
@@ -0,0 +1,158 @@
+package web
+
+import (
+	"crypto/subtle"
+	"errors"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/minasoft/hl7-replicator/internal/hl7"
+)
+
+// maxInboundSize limits the body of a posted message or batch
+const maxInboundSize = 10 << 20
+
+// inboundContentTypes lists the accepted request content types
+var inboundContentTypes = map[string]bool{
+	"text/plain":               true,
+	"application/hl7-v2":       true,
+	"x-application/hl7-v2+er7": true,
+}
+
+// inboundXMLTypes lists the content types of the HL7 v2 XML encoding
+var inboundXMLTypes = map[string]bool{
+	contentTypeXML:    true,
+	"application/xml": true,
+	"text/xml":        true,
+}
+
+// AddReceiver registers the receiver of a route for POST /api/inbound/:route
+func (s *Server) AddReceiver(r *hl7.Receiver) {
+	if s.receivers == nil {
+		s.receivers = make(map[string]*hl7.Receiver)
+	}
+	s.receivers[r.Direction()] = r
+}
+
+// handleInbound accepts a raw HL7 message (or FHS/BHS batch) over HTTP, runs
+// it through the same path as the MLLP listeners and returns the ACK
+func (s *Server) handleInbound(c echo.Context) error {
+	if !s.inboundAuthorized(c) {
+		slog.Warn("HTTP giriş yetkisiz istek",
+			"route", c.Param("route"),
+			"remoteAddr", c.RealIP())
+		return echo.NewHTTPError(http.StatusUnauthorized, "geçersiz API anahtarı")
+	}
+
+	receiver, ok := s.receivers[c.Param("route")]
+	if !ok {
+		return echo.NewHTTPError(http.StatusNotFound, "bilinmeyen route: "+c.Param("route"))
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(c.Request().Header.Get(echo.HeaderContentType))
+	isXML := inboundXMLTypes[mediaType]
+	if !inboundContentTypes[mediaType] && !isXML {
+		return echo.NewHTTPError(http.StatusUnsupportedMediaType,
+			"desteklenmeyen içerik tipi, text/plain, application/hl7-v2 veya application/hl7-v2+xml kullanın")
+	}
+
+	body, err := io.ReadAll(io.LimitReader(c.Request().Body, maxInboundSize+1))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "istek gövdesi okunamadı")
+	}
+	if len(body) > maxInboundSize {
+		return echo.NewHTTPError(http.StatusRequestEntityTooLarge, "mesaj çok büyük")
+	}
+
+	if isXML {
+		if body, err = hl7.DecodeXML(body); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+	}
+
+	message := hl7.NormalizeSegments(hl7.UnwrapMLLP(body))
+	if len(strings.TrimSpace(string(message))) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "boş mesaj")
+	}
+
+	src := hl7.Source{Addr: "http://" + c.RealIP()}
+	if hl7.IsBatch(message) {
+		ack := hl7.UnwrapMLLP(receiver.Handle(message, src))
+		return c.Blob(batchStatus(ack), contentTypeER7, ack)
+	}
+
+	_, err = receiver.Receive(message, src)
+	ack := hl7.UnwrapMLLP(receiver.Acknowledge(message, err, src))
+	return writeACK(c, inboundStatus(err), ack, isXML)
+}
+
+// writeACK returns the ACK in the encoding of the request
+func writeACK(c echo.Context, status int, ack []byte, asXML bool) error {
+	if asXML {
+		if parsed, err := hl7.ParseStructure(ack); err == nil {
+			if data, err := parsed.EncodeXML(); err == nil {
+				return c.Blob(status, contentTypeXML, data)
+			}
+		}
+	}
+	return c.Blob(status, contentTypeER7, ack)
+}
+
+// inboundAuthorized checks the X-API-Key header (or a bearer token) against
+// the configured keys; the endpoint is closed when no key is configured
+func (s *Server) inboundAuthorized(c echo.Context) bool {
+	return apiKeyAuthorized(c, s.currentConfig().InboundAPIKeys)
+}
+
+// apiKeyAuthorized checks the X-API-Key header (or a bearer token) against a
+// comma separated key list; an empty list authorizes nobody
+func apiKeyAuthorized(c echo.Context, keys string) bool {
+	key := c.Request().Header.Get("X-API-Key")
+	if key == "" {
+		key = strings.TrimPrefix(c.Request().Header.Get(echo.HeaderAuthorization), "Bearer ")
+	}
+	if key == "" {
+		return false
+	}
+
+	for _, allowed := range strings.Split(keys, ",") {
+		allowed = strings.TrimSpace(allowed)
+		if allowed != "" && subtle.ConstantTimeCompare([]byte(key), []byte(allowed)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// inboundStatus maps the processing result to an HTTP status: 503 when a
+// valid message could not be enqueued (the sender should retry), 422 when it
+// was rejected for policy or validation and 400 when it could not be parsed
+func inboundStatus(err error) int {
+	var enqueueErr *hl7.EnqueueError
+	var rejectErr *hl7.RejectError
+	var validationErr *hl7.ValidationError
+	switch {
+	case err == nil:
+		return http.StatusOK
+	case errors.As(err, &enqueueErr):
+		return http.StatusServiceUnavailable
+	case errors.As(err, &rejectErr), errors.As(err, &validationErr):
+		return http.StatusUnprocessableEntity
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+// batchStatus returns 200 only when every message of a batch was accepted
+func batchStatus(ack []byte) int {
+	for _, code := range hl7.ACKCodes(ack) {
+		if code != "AA" && code != "CA" {
+			return http.StatusUnprocessableEntity
+		}
+	}
+	return http.StatusOK
+}
@@ -0,0 +1,149 @@
+package web
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/minasoft/hl7-replicator/internal/db"
+	"github.com/minasoft/hl7-replicator/internal/hl7"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// Message representations offered by the message endpoints
+const (
+	formatER7  = "er7"
+	formatXML  = "xml"
+	formatJSON = "json"
+)
+
+const (
+	contentTypeER7 = "application/hl7-v2"
+	contentTypeXML = "application/hl7-v2+xml"
+)
+
+// apiMessage is the JSON view of a message: the raw message is returned as
+// ER7 text instead of base64, optionally with its segment/field tree. ED/RP
+// attachments found in OBX-5 are listed for /messages/:id/attachments/:n.
+type apiMessage struct {
+	db.HL7Message
+	RawMessage  string           `json:"raw_message"`
+	Structure   *hl7.JSONMessage `json:"structure,omitempty"`
+	Attachments []hl7.Attachment `json:"attachments,omitempty"`
+}
+
+func newAPIMessage(msg db.HL7Message, withStructure bool) apiMessage {
+	raw := hl7.UnwrapMLLP(msg.RawMessage)
+	out := apiMessage{HL7Message: msg, RawMessage: string(raw)}
+
+	// Only messages that may hold attachments are parsed for the list
+	hasAttachments := bytes.Contains(raw, []byte("|ED|")) || bytes.Contains(raw, []byte("|RP|"))
+	if !withStructure && !hasAttachments {
+		return out
+	}
+	if parsed, err := hl7.ParseStructure(raw); err == nil {
+		if withStructure {
+			out.Structure = parsed.JSON()
+		}
+		out.Attachments = parsed.Attachments()
+	}
+	return out
+}
+
+// negotiateFormat picks the representation from ?format= or the Accept header
+func negotiateFormat(c echo.Context) string {
+	switch format := strings.ToLower(c.QueryParam("format")); format {
+	case formatER7, formatXML, formatJSON:
+		return format
+	}
+
+	accept := c.Request().Header.Get(echo.HeaderAccept)
+	for _, part := range strings.Split(accept, ",") {
+		mediaType := strings.TrimSpace(strings.SplitN(part, ";", 2)[0])
+		switch mediaType {
+		case contentTypeER7, "x-application/hl7-v2+er7", "text/plain":
+			return formatER7
+		case contentTypeXML, "application/xml", "text/xml":
+			return formatXML
+		case "application/json":
+			return formatJSON
+		}
+	}
+	return formatJSON
+}
+
+// handleGetMessage returns a single message as ER7 text, HL7 v2 XML or JSON
+// (metadata plus the segment/field tree)
+func (s *Server) handleGetMessage(c echo.Context) error {
+	msg, err := s.findMessage(c.Request().Context(), c.Param("id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Mesajlar okunamadı")
+	}
+	if msg == nil {
+		return echo.NewHTTPError(http.StatusNotFound, "Mesaj bulunamadı")
+	}
+
+	masked := s.maskerFor(c).HL7Message(*msg)
+	raw := hl7.UnwrapMLLP(masked.RawMessage)
+
+	switch negotiateFormat(c) {
+	case formatER7:
+		return c.Blob(http.StatusOK, contentTypeER7, raw)
+	case formatXML:
+		parsed, err := hl7.ParseStructure(raw)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusUnprocessableEntity, "Mesaj parse edilemedi: "+err.Error())
+		}
+		data, err := parsed.EncodeXML()
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "XML oluşturulamadı")
+		}
+		return c.Blob(http.StatusOK, contentTypeXML, data)
+	default:
+		return c.JSON(http.StatusOK, newAPIMessage(masked, true))
+	}
+}
+
+// findMessage returns the latest history or DLQ entry of a message; keys
+// are "<direction>_<id>_<time>" so only matching keys are read
+func (s *Server) findMessage(ctx context.Context, id string) (*db.HL7Message, error) {
+	var found *db.HL7Message
+	var foundAt time.Time
+
+	for _, bucket := range []string{"HL7_HISTORY", "HL7_DLQ"} {
+		kv, err := s.js.KeyValue(ctx, bucket)
+		if err != nil {
+			continue
+		}
+		keys, err := kv.Keys(ctx)
+		if err == jetstream.ErrNoKeysFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		for _, key := range keys {
+			if !strings.Contains(key, "_"+id+"_") {
+				continue
+			}
+			entry, err := kv.Get(ctx, key)
+			if err != nil {
+				continue
+			}
+			var msg db.HL7Message
+			if json.Unmarshal(entry.Value(), &msg) != nil || msg.ID != id {
+				continue
+			}
+			if found == nil || entry.Created().After(foundAt) {
+				found = &msg
+				foundAt = entry.Created()
+			}
+		}
+	}
+	return found, nil
+}
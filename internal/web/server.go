@@ -3,20 +3,30 @@ package web
 import (
 	"bytes"
 	"context"
+	"crypto/subtle"
 	"embed"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
 	"log/slog"
 	"net/http"
 	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
+	"github.com/minasoft/hl7-replicator/internal/alerts"
 	"github.com/minasoft/hl7-replicator/internal/config"
+	"github.com/minasoft/hl7-replicator/internal/consumers"
 	"github.com/minasoft/hl7-replicator/internal/db"
+	"github.com/minasoft/hl7-replicator/internal/hl7"
+	"github.com/minasoft/hl7-replicator/internal/phi"
+	"github.com/minasoft/hl7-replicator/internal/stats"
 	"github.com/nats-io/nats.go/jetstream"
 )
 
@@ -24,11 +34,26 @@ import (
 var webFiles embed.FS
 
 type Server struct {
-	echo   *echo.Echo
-	js     jetstream.JetStream
-	config *config.Config
+	echo       *echo.Echo
+	js         jetstream.JetStream
+	receivers  map[string]*hl7.Receiver
+	poolStats  func() map[string]hl7.PoolStats
+	heartbeats func() []consumers.HeartbeatStatus
+	backlogs   func(ctx context.Context) ([]consumers.Backlog, error)
+	stats      *stats.Store
+	reload     ReloadFunc
+
+	destinations *consumers.DestinationManager
+	alerts       *alerts.Engine
+
+	mu        sync.RWMutex
+	config    *config.Config
+	listeners []*hl7.MLLPServer
 }
 
+// ReloadFunc reloads the configuration and returns the changed components
+type ReloadFunc func(source string) ([]string, error)
+
 func NewServer(js jetstream.JetStream, cfg *config.Config) *Server {
 	e := echo.New()
 	e.HideBanner = true
@@ -45,13 +70,69 @@ func NewServer(js jetstream.JetStream, cfg *config.Config) *Server {
 	}
 }
 
+// AddListener registers an MLLP listener whose counters are reported in the stats
+func (s *Server) AddListener(l *hl7.MLLPServer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.listeners = append(s.listeners, l)
+}
+
+// ReplaceListener swaps a listener rebound by a configuration reload
+func (s *Server) ReplaceListener(old, l *hl7.MLLPServer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, current := range s.listeners {
+		if current == old {
+			s.listeners[i] = l
+			return
+		}
+	}
+	s.listeners = append(s.listeners, l)
+}
+
+// SetConfig swaps in a reloaded configuration; the web port is kept
+func (s *Server) SetConfig(cfg *config.Config) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.config = cfg
+}
+
+func (s *Server) currentConfig() *config.Config {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.config
+}
+
+// SetReloader registers the function behind POST /api/admin/reload
+func (s *Server) SetReloader(f ReloadFunc) {
+	s.reload = f
+}
+
+// SetPoolStats registers the source of the outbound connection pool counters
+func (s *Server) SetPoolStats(f func() map[string]hl7.PoolStats) {
+	s.poolStats = f
+}
+
+// SetHeartbeats registers the source of the destination probe results
+func (s *Server) SetHeartbeats(f func() []consumers.HeartbeatStatus) {
+	s.heartbeats = f
+}
+
+// SetStats registers the message counts and the source of the consumer
+// backlog reported by /api/stats
+func (s *Server) SetStats(st *stats.Store, backlogs func(ctx context.Context) ([]consumers.Backlog, error)) {
+	s.stats = st
+	s.backlogs = backlogs
+}
+
 func (s *Server) Start(ctx context.Context) error {
 	// Setup routes
 	s.setupRoutes()
 
 	// Start server
-	addr := fmt.Sprintf(":%d", s.config.WebPort)
-	slog.Info("Web sunucu başlatılıyor", "port", s.config.WebPort)
+	port := s.currentConfig().WebPort
+	addr := fmt.Sprintf(":%d", port)
+	slog.Info("Web sunucu başlatılıyor", "port", port)
 
 	go func() {
 		if err := s.echo.Start(addr); err != nil && err != http.ErrServerClosed {
@@ -74,10 +155,43 @@ func (s *Server) setupRoutes() {
 	api := s.echo.Group("/api")
 	api.GET("/health", s.handleHealth)
 	api.GET("/stats", s.handleStats)
+	api.GET("/stats/series", s.handleStatsSeries)
 	api.GET("/messages", s.handleGetMessages)
+	api.GET("/messages/export", s.handleExportMessages)
+	api.GET("/messages/:id", s.handleGetMessage)
+	api.GET("/messages/:id/attachments/:n", s.handleGetAttachment)
+	api.GET("/attachments/:name", s.handleGetStoredAttachment)
 	api.POST("/messages/:id/retry", s.handleRetryMessage)
 	api.GET("/streams", s.handleGetStreams)
 	api.GET("/consumers", s.handleGetConsumers)
+	api.POST("/inbound/:route", s.handleInbound)
+	api.POST("/admin/reload", s.handleReload)
+	api.GET("/config", s.handleGetConfig)
+
+	// Outbound destinations managed at runtime
+	api.GET("/destinations", s.handleListDestinations)
+	api.POST("/destinations", s.handleCreateDestination)
+	api.POST("/destinations/test", s.handleTestDestination)
+	api.GET("/destinations/:name", s.handleGetDestination)
+	api.PUT("/destinations/:name", s.handleUpdateDestination)
+	api.DELETE("/destinations/:name", s.handleDeleteDestination)
+	api.POST("/destinations/:name/test", s.handleTestDestination)
+
+	// Alerting
+	api.GET("/alerts", s.handleListAlerts)
+	api.POST("/alerts/test", s.handleTestAlertChannels)
+	api.GET("/alerts/rules", s.handleListAlertRules)
+	api.POST("/alerts/rules", s.handleCreateAlertRule)
+	api.POST("/alerts/rules/test", s.handleTestAlertRule)
+	api.GET("/alerts/rules/:name", s.handleGetAlertRule)
+	api.PUT("/alerts/rules/:name", s.handleUpdateAlertRule)
+	api.DELETE("/alerts/rules/:name", s.handleDeleteAlertRule)
+	api.POST("/alerts/rules/:name/test", s.handleTestAlertRule)
+
+	// FHIR to HL7 v2 bridge
+	s.echo.POST("/fhir", s.handleFHIRBundle)
+	s.echo.POST("/fhir/Bundle", s.handleFHIRBundle)
+	s.echo.POST("/fhir/DiagnosticReport", s.handleFHIRDiagnosticReport)
 
 	// Static files
 	// Serve static files from embedded filesystem
@@ -190,12 +304,55 @@ func (s *Server) handleHealth(c echo.Context) error {
 		}
 	}
 
+	// Check the destinations with heartbeats
+	var heartbeats []consumers.HeartbeatStatus
+	if s.heartbeats != nil {
+		heartbeats = s.heartbeats()
+	}
+	for _, hb := range heartbeats {
+		key := "destination_" + hb.Name
+		switch hb.State {
+		case consumers.HeartbeatUp:
+			components[key] = fmt.Sprintf("healthy (rtt: %.1fms)", hb.RTTMs)
+		case consumers.HeartbeatDown:
+			components[key] = "unhealthy: " + hb.LastError
+			if overallStatus == "healthy" {
+				overallStatus = "degraded"
+			}
+		default:
+			components[key] = "unknown"
+		}
+	}
+
+	// Check the senders expected to keep sending
+	traffic := s.traffic()
+	for _, t := range traffic {
+		key := "sender_" + t.Name
+		switch t.State {
+		case hl7.TrafficSilent:
+			components[key] = fmt.Sprintf("silent (%s)", time.Duration(t.Silence)*time.Second)
+			if overallStatus == "healthy" {
+				overallStatus = "degraded"
+			}
+		case hl7.TrafficOffSchedule:
+			components[key] = "off_schedule"
+		default:
+			components[key] = "healthy"
+		}
+	}
+
 	health := map[string]interface{}{
 		"status":     overallStatus,
 		"timestamp":  time.Now(),
 		"components": components,
 		"version":    "1.0.0",
 	}
+	if heartbeats != nil {
+		health["heartbeats"] = heartbeats
+	}
+	if len(traffic) > 0 {
+		health["traffic"] = traffic
+	}
 
 	statusCode := http.StatusOK
 	if overallStatus == "unhealthy" {
@@ -205,73 +362,293 @@ func (s *Server) handleHealth(c echo.Context) error {
 	return c.JSON(statusCode, health)
 }
 
+// traffic returns the traffic expectation states of every route
+func (s *Server) traffic() []hl7.TrafficStatus {
+	var statuses []hl7.TrafficStatus
+	for _, direction := range []string{"order", "report"} {
+		if r, ok := s.receivers[direction]; ok {
+			statuses = append(statuses, r.Traffic()...)
+		}
+	}
+	return statuses
+}
+
 func (s *Server) handleStats(c echo.Context) error {
 	ctx := c.Request().Context()
 
-	// Get stats from KV store
-	statsKV, err := s.js.KeyValue(ctx, "HL7_STATS")
+	if s.stats == nil {
+		return echo.NewHTTPError(http.StatusServiceUnavailable, "İstatistikler kullanılamıyor")
+	}
+	totals, err := s.stats.Totals(ctx)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "Stats KV erişilemedi")
+		return echo.NewHTTPError(http.StatusInternalServerError, "İstatistikler okunamadı: "+err.Error())
+	}
+	var backlogs []consumers.Backlog
+	if s.backlogs != nil {
+		if backlogs, err = s.backlogs(ctx); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "Consumer bilgisi okunamadı: "+err.Error())
+		}
+	}
+
+	// A message is counted in total once it is delivered or moved to the
+	// DLQ; failed_attempts counts every failed delivery attempt and pending
+	// the messages the consumers have not finished
+	summary := func(counts stats.Counts, pending uint64) map[string]interface{} {
+		return map[string]interface{}{
+			"total":           counts.Delivered + counts.DeadLettered,
+			"successful":      counts.Delivered,
+			"failed":          counts.DeadLettered,
+			"failed_attempts": counts.Failed,
+			"received":        counts.Received,
+			"pending":         pending,
+		}
+	}
+	var pending uint64
+	pendingByRoute := make(map[string]uint64)
+	pendingByDestination := make(map[string]uint64)
+	for _, b := range backlogs {
+		pending += b.Total()
+		pendingByRoute[b.Direction] += b.Total()
+		pendingByDestination[b.Name] += b.Total()
+	}
+
+	orders := totals.Get(stats.ByRoute, "order")
+	reports := totals.Get(stats.ByRoute, "report")
+	all := orders
+	all.Merge(reports)
+
+	result := summary(all, pending)
+	result["orders"] = summary(orders, pendingByRoute["order"])
+	result["reports"] = summary(reports, pendingByRoute["report"])
+
+	destinations := make(map[string]interface{})
+	for name, counts := range totals[stats.ByDestination] {
+		destinations[name] = summary(*counts, pendingByDestination[name])
+	}
+	for name, n := range pendingByDestination {
+		if _, ok := destinations[name]; !ok {
+			destinations[name] = summary(stats.Counts{}, n)
+		}
+	}
+	result["destinations"] = destinations
+	result["message_types"] = totals[stats.ByMessageType]
+	result["consumers"] = backlogs
+
+	// Add listener counters (rejected connections and messages)
+	listeners := []hl7.ServerStats{}
+	s.mu.RLock()
+	for _, l := range s.listeners {
+		listeners = append(listeners, l.Stats())
+	}
+	s.mu.RUnlock()
+	result["listeners"] = listeners
+
+	// Add outbound connection pool counters
+	if s.poolStats != nil {
+		result["pools"] = s.poolStats()
+	}
+
+	// Add destination probe results
+	if s.heartbeats != nil {
+		result["heartbeats"] = s.heartbeats()
+	}
+
+	// Add inbound sender activity and traffic expectations
+	var senders []hl7.SenderActivity
+	for _, direction := range []string{"order", "report"} {
+		if r, ok := s.receivers[direction]; ok {
+			senders = append(senders, r.Senders()...)
+		}
+	}
+	result["senders"] = senders
+	result["traffic"] = s.traffic()
+
+	// Add last delivery times
+	last := s.stats.LastDelivered(ctx)
+	if t, ok := last["order"]; ok {
+		result["last_order_time"] = t.Format(time.RFC3339)
+	}
+	if t, ok := last["report"]; ok {
+		result["last_report_time"] = t.Format(time.RFC3339)
 	}
 
-	// Helper function to get KV value as int
-	getKVInt := func(key string) int {
-		entry, err := statsKV.Get(ctx, key)
+	return c.JSON(http.StatusOK, result)
+}
+
+// handleStatsSeries returns the message counts of a time range in minute,
+// hour or day buckets for charts
+func (s *Server) handleStatsSeries(c echo.Context) error {
+	if s.stats == nil {
+		return echo.NewHTTPError(http.StatusServiceUnavailable, "İstatistikler kullanılamıyor")
+	}
+
+	q := stats.Query{
+		To:         time.Now(),
+		Resolution: c.QueryParam("resolution"),
+		GroupBy:    c.QueryParam("group_by"),
+	}
+	if v := c.QueryParam("to"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Geçersiz to (RFC3339 olmalı)")
+		}
+		q.To = t
+	}
+	switch v := c.QueryParam("from"); {
+	case v != "":
+		t, err := time.Parse(time.RFC3339, v)
 		if err != nil {
-			return 0
+			return echo.NewHTTPError(http.StatusBadRequest, "Geçersiz from (RFC3339 olmalı)")
 		}
-		var val int
-		fmt.Sscanf(string(entry.Value()), "%d", &val)
-		return val
-	}
-
-	// Get all statistics
-	totalOrders := getKVInt("total_orders")
-	successfulOrders := getKVInt("successful_orders")
-	failedOrders := getKVInt("failed_orders")
-
-	totalReports := getKVInt("total_reports")
-	successfulReports := getKVInt("successful_reports")
-	failedReports := getKVInt("failed_reports")
-
-	stats := map[string]interface{}{
-		"total":      totalOrders + totalReports,
-		"successful": successfulOrders + successfulReports,
-		"failed":     failedOrders + failedReports,
-		"pending":    0, // We don't track pending anymore
-		"orders": map[string]int{
-			"total":      totalOrders,
-			"successful": successfulOrders,
-			"failed":     failedOrders,
-		},
-		"reports": map[string]int{
-			"total":      totalReports,
-			"successful": successfulReports,
-			"failed":     failedReports,
-		},
-	}
-
-	// Add last message times
-	if lastOrderTime, err := statsKV.Get(ctx, "last_order_time"); err == nil {
-		stats["last_order_time"] = string(lastOrderTime.Value())
-	}
-	if lastReportTime, err := statsKV.Get(ctx, "last_report_time"); err == nil {
-		stats["last_report_time"] = string(lastReportTime.Value())
-	}
-
-	return c.JSON(http.StatusOK, stats)
+		q.From = t
+	case c.QueryParam("range") != "":
+		d, err := parseRange(c.QueryParam("range"))
+		if err != nil || d <= 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "Geçersiz range (ör. 24h, 7d)")
+		}
+		q.From = q.To.Add(-d)
+	default:
+		q.From = q.To.Add(-24 * time.Hour)
+	}
+	for _, key := range strings.Split(c.QueryParam("keys"), ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			q.Keys = append(q.Keys, key)
+		}
+	}
+
+	series, err := s.stats.Series(c.Request().Context(), q)
+	if errors.Is(err, stats.ErrInvalidQuery) {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "İstatistikler okunamadı: "+err.Error())
+	}
+	return c.JSON(http.StatusOK, series)
+}
+
+// parseRange parses a duration that may also be given in days ("7d")
+func parseRange(value string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		return time.Duration(n) * 24 * time.Hour, err
+	}
+	return time.ParseDuration(value)
+}
+
+// messageFilter holds the query filters shared by the message endpoints
+type messageFilter struct {
+	status      string
+	direction   string
+	patientID   string
+	messageType string
+	parentID    string
+	limit       int
+
+	// masker is the masking applied to the caller; the hashed patient IDs
+	// it shows are matched too
+	masker *phi.Masker
+}
+
+func newMessageFilter(c echo.Context, masker *phi.Masker) messageFilter {
+	return messageFilter{
+		status:      c.QueryParam("status"),
+		direction:   c.QueryParam("direction"),
+		patientID:   c.QueryParam("patientId"),
+		messageType: c.QueryParam("messageType"),
+		parentID:    c.QueryParam("parentId"),
+		limit:       100, // Default limit
+		masker:      masker,
+	}
+}
+
+func (f messageFilter) match(msg *db.HL7Message) bool {
+	if f.direction != "" && msg.Direction != f.direction {
+		return false
+	}
+	if f.patientID != "" && !f.matchPatient(msg.PatientID) {
+		return false
+	}
+	if f.messageType != "" && (msg.MessageType == "" || !contains(msg.MessageType, f.messageType)) {
+		return false
+	}
+	if f.parentID != "" && msg.ParentID != f.parentID {
+		return false
+	}
+	return true
+}
+
+// matchPatient compares the filter with the unmasked patient ID, before any
+// masking; in hash mode the full hash shown to masked callers matches as well
+func (f messageFilter) matchPatient(id string) bool {
+	if id == "" {
+		return false
+	}
+	if f.masker.Mode() == phi.ModeHash && f.masker.Value(id) == f.patientID {
+		return true
+	}
+	return contains(id, f.patientID)
 }
 
 func (s *Server) handleGetMessages(c echo.Context) error {
-	ctx := c.Request().Context()
+	// Mask PHI unless the caller is allowed to see it
+	masker := s.maskerFor(c)
+	messages := s.collectMessages(c.Request().Context(), newMessageFilter(c, masker))
+
+	withStructure := c.QueryParam("format") == formatJSON
+	result := make([]apiMessage, len(messages))
+	for i := range messages {
+		result[i] = newAPIMessage(masker.HL7Message(messages[i]), withStructure)
+	}
+
+	return c.JSON(http.StatusOK, result)
+}
 
-	// Query parameters for filtering
-	status := c.QueryParam("status")
-	direction := c.QueryParam("direction")
-	patientID := c.QueryParam("patientId")
-	messageType := c.QueryParam("messageType")
-	limit := 100 // Default limit
+// handleExportMessages exports messages as ER7 text; with deidentify=true
+// identifying fields are always redacted so samples can be shared with vendors
+func (s *Server) handleExportMessages(c echo.Context) error {
+	masker := s.maskerFor(c)
+	filter := newMessageFilter(c, masker)
+	if limit, err := strconv.Atoi(c.QueryParam("limit")); err == nil && limit > 0 {
+		filter.limit = limit
+	}
+	messages := s.collectMessages(c.Request().Context(), filter)
+
+	if c.QueryParam("deidentify") == "true" {
+		masker = phi.NewMasker(string(phi.ModeRedact), "")
+	}
+
+	var buf bytes.Buffer
+	for _, msg := range messages {
+		buf.Write(masker.Message(msg.RawMessage))
+		buf.WriteString("\r\n")
+	}
+
+	c.Response().Header().Set(echo.HeaderContentDisposition,
+		fmt.Sprintf("attachment; filename=hl7-export-%s.hl7", time.Now().Format("20060102150405")))
+	return c.Blob(http.StatusOK, "application/hl7-v2", buf.Bytes())
+}
 
+// maskerFor returns the masker to apply for the request; callers presenting
+// the configured unmask token see unmasked data and the access is logged
+func (s *Server) maskerFor(c echo.Context) *phi.Masker {
+	masker := phi.Default()
+	unmaskToken := s.currentConfig().PHIUnmaskToken
+	if !masker.Enabled() || unmaskToken == "" {
+		return masker
+	}
+
+	token := c.Request().Header.Get("X-PHI-Unmask-Token")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(unmaskToken)) != 1 {
+		return masker
+	}
+
+	slog.Warn("PHI maskesiz erişim",
+		"path", c.Request().URL.Path,
+		"remoteAddr", c.RealIP())
+	return phi.NewMasker(string(phi.ModeOff), "")
+}
+
+func (s *Server) collectMessages(ctx context.Context, filter messageFilter) []db.HL7Message {
 	messages := []db.HL7Message{}
 
 	// Get messages from history (all messages)
@@ -288,16 +665,10 @@ func (s *Server) handleGetMessages(c echo.Context) error {
 				var msg db.HL7Message
 				if err := json.Unmarshal(entry.Value(), &msg); err == nil {
 					// Apply filters
-					if status != "" && msg.Status != status {
-						continue
-					}
-					if direction != "" && msg.Direction != direction {
-						continue
-					}
-					if patientID != "" && (msg.PatientID == "" || !contains(msg.PatientID, patientID)) {
+					if filter.status != "" && msg.Status != filter.status {
 						continue
 					}
-					if messageType != "" && (msg.MessageType == "" || !contains(msg.MessageType, messageType)) {
+					if !filter.match(&msg) {
 						continue
 					}
 
@@ -308,7 +679,7 @@ func (s *Server) handleGetMessages(c echo.Context) error {
 	}
 
 	// Also get failed messages from DLQ if showing all or failed status
-	if status == "" || status == "failed" {
+	if filter.status == "" || filter.status == "failed" {
 		dlqKV, err := s.js.KeyValue(ctx, "HL7_DLQ")
 		if err == nil {
 			keys, err := dlqKV.Keys(ctx)
@@ -322,13 +693,7 @@ func (s *Server) handleGetMessages(c echo.Context) error {
 					var msg db.HL7Message
 					if err := json.Unmarshal(entry.Value(), &msg); err == nil {
 						// Apply filters
-						if direction != "" && msg.Direction != direction {
-							continue
-						}
-						if patientID != "" && (msg.PatientID == "" || !contains(msg.PatientID, patientID)) {
-							continue
-						}
-						if messageType != "" && (msg.MessageType == "" || !contains(msg.MessageType, messageType)) {
+						if !filter.match(&msg) {
 							continue
 						}
 
@@ -355,11 +720,11 @@ func (s *Server) handleGetMessages(c echo.Context) error {
 	})
 
 	// Apply limit
-	if len(messages) > limit {
-		messages = messages[:limit]
+	if len(messages) > filter.limit {
+		messages = messages[:filter.limit]
 	}
 
-	return c.JSON(http.StatusOK, messages)
+	return messages
 }
 
 // Helper function to check if a string contains a substring (case-insensitive)